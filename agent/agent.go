@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,22 +40,57 @@ type Agent struct {
 	// config
 	conf *config.AgentConfig
 
-	// Used to synchronize on a clean exit
+	// Used to synchronize on a clean exit: the agent stops when either ctx
+	// is cancelled or exit is closed
+	ctx  context.Context
 	exit chan struct{}
 
+	// flushRequests asks the agent to flush, it replies with the number of traces flushed
+	flushRequests chan chan int
+	// samplerConfigRequests asks the agent to update its sampler configuration
+	samplerConfigRequests chan samplerConfigRequest
+	// samplerConfig is the sampler configuration in effect
+	samplerConfig samplerConfig
+
+	// flushWatchdog reports the agent unhealthy when its flushes stall
+	flushWatchdog *flushWatchdog
+	// flushInterval gives the time until the next flush
+	flushInterval *jitteredInterval
+	// hostTags are attached to the flushed payloads, nil if disabled
+	hostTags *hostTagsCollector
+	// excluder tells the traces neither sampled nor aggregated, nil if disabled
+	excluder *rootExcluder
+	// deduper tells the traces received again, nil if disabled
+	deduper *traceDeduper
+	// checkpointer saves the stats being aggregated, nil if disabled
+	checkpointer *statsCheckpointer
+
 	die func(format string, args ...interface{})
 }
 
-// NewAgent returns a new Agent object, ready to be started
-func NewAgent(conf *config.AgentConfig) *Agent {
+// NewAgent returns a new Agent object, ready to be started. It stops
+// running once ctx is cancelled.
+func NewAgent(ctx context.Context, conf *config.AgentConfig) *Agent {
 	exit := make(chan struct{})
 
 	r := NewHTTPReceiver(conf)
 	c := NewConcentrator(
 		conf.ExtraAggregators,
 		conf.BucketInterval.Nanoseconds(),
+		conf.MaxResources,
 	)
-	s := NewSampler(conf)
+	s, err := NewSampler(conf)
+	if err != nil {
+		die("cannot create the sampler: %v", err)
+	}
+
+	checkpointer := newStatsCheckpointer(conf)
+	if buckets, err := checkpointer.Restore(); err != nil {
+		log.Warnf("stats checkpoint ignored: %v", err)
+	} else if len(buckets) > 0 {
+		log.Infof("restored %d stats buckets from the checkpoint", len(buckets))
+		c.Restore(buckets)
+	}
 
 	w := NewWriter(conf)
 	w.inServices = r.services
@@ -64,15 +101,37 @@ func NewAgent(conf *config.AgentConfig) *Agent {
 		Sampler:      s,
 		Writer:       w,
 		conf:         conf,
+		ctx:          ctx,
 		exit:         exit,
 		die:          die,
+
+		flushRequests: make(chan chan int),
+		flushWatchdog: newFlushWatchdog(conf.BucketInterval),
+		flushInterval: newJitteredInterval(conf.BucketInterval, conf.FlushJitter, conf.HostName),
+		hostTags:      newHostTagsCollectorFromConfig(conf),
+		excluder:      newRootExcluder(conf.ExcludeRoots),
+		deduper:       newTraceDeduperFromConfig(conf),
+		checkpointer:  checkpointer,
+
+		samplerConfigRequests: make(chan samplerConfigRequest),
+		samplerConfig:         newSamplerConfig(conf),
 	}
 }
 
+// registerHandlers registers the debug endpoints of the agent on mux, which
+// the receiver serves along with the other debug endpoints (http.DefaultServeMux
+// in main). It must be called once: mux panics on a second registration.
+func (a *Agent) registerHandlers(mux *http.ServeMux) {
+	mux.Handle("/flush", newFlushHandler(a))
+	mux.Handle("/health", a.flushWatchdog)
+	mux.Handle("/sampler/config", &samplerConfigHandler{agent: a})
+	mux.Handle("/config", configHandler(a.conf))
+}
+
 // Run starts routers routines and individual pieces then stop them when the exit order is received
 func (a *Agent) Run() {
-	flushTicker := time.NewTicker(a.conf.BucketInterval)
-	defer flushTicker.Stop()
+	flushTimer := time.NewTimer(a.flushInterval.next())
+	defer flushTimer.Stop()
 
 	// it's really important to use a ticker for this, and with a not too short
 	// interval, for this is our garantee that the process won't start and kill
@@ -80,60 +139,133 @@ func (a *Agent) Run() {
 	watchdogTicker := time.NewTicker(a.conf.WatchdogInterval)
 	defer watchdogTicker.Stop()
 
+	var checkpointC <-chan time.Time
+	if a.checkpointer != nil {
+		checkpointTicker := time.NewTicker(a.conf.StatsCheckpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointC = checkpointTicker.C
+	}
+
 	a.Receiver.Run()
 	a.Writer.Run()
 	a.Sampler.Run()
+	watchdog.Go(a.flushWatchdog.Run)
 
 	for {
 		select {
 		case t := <-a.Receiver.traces:
 			a.Process(t)
-		case <-flushTicker.C:
-			p := model.AgentPayload{
-				HostName: a.conf.HostName,
-				Env:      a.conf.DefaultEnv,
-			}
-			var wg sync.WaitGroup
-			wg.Add(2)
-			go func() {
-				defer watchdog.LogOnPanic()
-				p.Stats = a.Concentrator.Flush()
-				wg.Done()
-			}()
-			go func() {
-				defer watchdog.LogOnPanic()
-				p.Traces = a.Sampler.Flush()
-				wg.Done()
-			}()
-
-			wg.Wait()
-
-			a.Writer.inPayloads <- p
+		case <-flushTimer.C:
+			a.flush()
+			flushTimer.Reset(a.flushInterval.next())
+		case reply := <-a.flushRequests:
+			reply <- a.flush()
+		case req := <-a.samplerConfigRequests:
+			req.reply <- a.updateSamplerConfig(req.update)
 		case <-watchdogTicker.C:
 			a.watchdog()
+		case <-checkpointC:
+			a.checkpoint()
+		case <-a.ctx.Done():
+			a.stop()
+			return
 		case <-a.exit:
-			log.Info("exiting")
-			close(a.Receiver.exit)
-			a.Writer.Stop()
-			a.Sampler.Stop()
+			a.stop()
 			return
 		}
 	}
 }
 
+// flush sends the stats and the sampled traces to the writer, it returns
+// the number of traces flushed
+func (a *Agent) flush() int {
+	p := model.AgentPayload{
+		HostName: a.conf.HostName,
+		Env:      a.conf.DefaultEnv,
+		Tags:     a.hostTags.Tags(),
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer watchdog.LogOnPanic()
+		p.Stats = a.Concentrator.Flush()
+		wg.Done()
+	}()
+	go func() {
+		defer watchdog.LogOnPanic()
+		p.Traces = a.Sampler.Flush()
+		wg.Done()
+	}()
+
+	wg.Wait()
+
+	if a.checkpointer.Flushed(p.Stats) {
+		// not to restore them after a crash, sending them twice
+		a.checkpoint()
+	}
+
+	reportLag(p.Traces, model.Now())
+	a.Writer.Enqueue(p)
+	a.flushWatchdog.flushed()
+
+	return len(p.Traces)
+}
+
+// stop stops all the sub-components of the agent, after a last flush
+func (a *Agent) stop() {
+	log.Info("exiting")
+	close(a.Receiver.exit)
+	a.flush()
+	// the stats of the buckets still open are restored at the next start
+	a.checkpoint()
+	a.Writer.Stop()
+	a.Sampler.Stop()
+	a.flushWatchdog.Stop()
+}
+
+// checkpoint writes the stats being aggregated to the checkpoint, if enabled
+func (a *Agent) checkpoint() {
+	if a.checkpointer == nil {
+		return
+	}
+	if err := a.checkpointer.Write(a.Concentrator.Checkpoint()); err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
 // Process is the default work unit that receives a trace, transforms it and
 // passes it downstream
 func (a *Agent) Process(t model.Trace) {
 	if len(t) == 0 {
 		// XXX Should never happen since we reject empty traces during
 		// normalization.
-		log.Debugf("skipping received empty trace")
+		traceLog.Debugf("skipping received empty trace")
 		return
 	}
 
+	// spans without a service or a name would all get the same signature,
+	// fix them before the concentrator and the sampler get the trace
+	for i := range t {
+		if t[i].FillDefaults() {
+			atomic.AddInt64(&a.Receiver.stats.SpansFixed, 1)
+		}
+	}
+
 	root := t.GetRoot()
+	if a.excluder.Excluded(root) {
+		atomic.AddInt64(&a.Receiver.stats.TracesExcluded, 1)
+		return
+	}
+
+	// clients retrying their requests can send us the same trace twice, only
+	// account for it once, in the stats as well as in the sampling
+	if a.deduper.Seen(root, time.Now()) {
+		atomic.AddInt64(&a.Receiver.stats.TracesDuplicate, 1)
+		return
+	}
+
 	if root.End() < model.Now()-2*a.conf.BucketInterval.Nanoseconds() {
-		log.Debugf("skipping trace with root too far in past, root:%v", *root)
+		traceLog.Debugf("skipping trace with root too far in past, root:%v", *root)
 		atomic.AddInt64(&a.Receiver.stats.TracesDropped, 1)
 		atomic.AddInt64(&a.Receiver.stats.SpansDropped, int64(len(t)))
 		return
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
 )
 
 func TestWatchdog(t *testing.T) {
@@ -26,7 +32,7 @@ func TestWatchdog(t *testing.T) {
 	defaultMux := http.DefaultServeMux
 	http.DefaultServeMux = http.NewServeMux()
 
-	agent := NewAgent(conf)
+	agent := NewAgent(context.Background(), conf)
 
 	defer func() {
 		close(agent.exit)
@@ -71,13 +77,96 @@ func TestWatchdog(t *testing.T) {
 	buf[len(buf)-1] = 2
 }
 
+func TestAgentContextCancel(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+
+	// grab a free port for the receiver
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "apikey_2")
+	conf.ReceiverHost = "localhost"
+	conf.ReceiverPort = port
+
+	// save the global mux aside, we don't want to break other tests
+	defaultMux := http.DefaultServeMux
+	http.DefaultServeMux = http.NewServeMux()
+	defer func() { http.DefaultServeMux = defaultMux }()
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	agent := NewAgent(ctx, conf)
+
+	done := make(chan struct{})
+	go func() {
+		agent.Run()
+		close(done)
+	}()
+
+	// let every component start its routines
+	time.Sleep(100 * time.Millisecond)
+	if runtime.NumGoroutine() <= before {
+		t.Fatalf("expected the agent to start routines")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop after its context was cancelled")
+	}
+
+	// the listeners take up to a second to acknowledge the exit
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d routines still running after cancel, %d before start:\n%s",
+				runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestProcessFillDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "apikey_2")
+	agent := NewAgent(context.Background(), conf)
+
+	// fixed before the concentrator and the sampler see them
+	span := fixtures.RandomSpan()
+	span.Name = ""
+	span.Type = "WEB"
+	child := fixtures.RandomSpan()
+	child.TraceID, child.ParentID = span.TraceID, span.SpanID
+	child.Service, child.Name, child.Type = "pg-master", "sql.query", "sql"
+	span.Service = "web-billing"
+	trace := model.Trace{span, child}
+	agent.Process(trace)
+
+	assert.Equal(model.DefaultSpanName, trace[0].Name)
+	assert.Equal("web", trace[0].Type)
+	assert.Equal(int64(1), atomic.LoadInt64(&agent.Receiver.stats.SpansFixed))
+}
+
 func BenchmarkAgentTraceProcessing(b *testing.B) {
 	// Disable debug logs in these tests
 	config.NewLoggerLevelCustom("INFO", "/var/log/datadog/trace-agent.log")
 
 	conf := config.NewDefaultAgentConfig()
 	conf.APIKeys = append(conf.APIKeys, "")
-	agent := NewAgent(conf)
+	agent := NewAgent(context.Background(), conf)
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
@@ -88,7 +177,7 @@ func BenchmarkAgentTraceProcessing(b *testing.B) {
 func BenchmarkWatchdog(b *testing.B) {
 	conf := config.NewDefaultAgentConfig()
 	conf.APIKeys = append(conf.APIKeys, "apikey_2")
-	agent := NewAgent(conf)
+	agent := NewAgent(context.Background(), conf)
 
 	b.ResetTimer()
 	b.ReportAllocs()
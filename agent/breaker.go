@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// breakerState is the state of a circuitBreaker, its value reported as gauge
+type breakerState int
+
+const (
+	// breakerClosed lets the requests through
+	breakerClosed breakerState = iota
+	// breakerHalfOpen lets a single request through, to test the recovery
+	breakerHalfOpen
+	// breakerOpen fails the requests fast, until the cooldown elapses
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// circuitBreaker stops sending to the intake after threshold failures in a
+// row, for cooldown, instead of piling up retries against it. Once the
+// cooldown elapses a single request is let through: on success, the circuit
+// closes again, on failure it opens for another cooldown. A nil
+// circuitBreaker always lets the requests through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the circuit last opened
+	trial    bool      // whether the half-open request is in flight
+
+	now func() time.Time
+}
+
+// newCircuitBreaker returns a circuitBreaker, nil if threshold <= 0
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow tells if a request can be sent. Once the cooldown elapses, it allows
+// a single request until its outcome is reported with Success or Failure.
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.setState(breakerHalfOpen)
+	}
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Success reports a request which went through, it returns true if it closed
+// the circuit
+func (b *circuitBreaker) Success() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state == breakerClosed {
+		return false
+	}
+	b.setState(breakerClosed)
+	return true
+}
+
+// Failure reports a request which failed, opening the circuit if it was the
+// half-open one or the threshold-th in a row
+func (b *circuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// State returns the state of the circuit
+func (b *circuitBreaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	switch s {
+	case breakerOpen:
+		log.Warnf("%d failed writes to the API, not sending anything for %s", b.failures, b.cooldown)
+	case breakerClosed:
+		log.Info("the API is reachable again, resuming the writes")
+	}
+	b.state = s
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// errorEndpoint fails every write with err
+type errorEndpoint struct {
+	NullEndpoint
+	err error
+}
+
+func (e errorEndpoint) Write(p model.AgentPayload) (int, error) {
+	return 0, e.err
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// closed until 3 failures in a row
+	b.Failure()
+	b.Failure()
+	b.Success()
+	b.Failure()
+	b.Failure()
+	assert.Equal(breakerClosed, b.State())
+	assert.True(b.Allow())
+	b.Failure()
+	assert.Equal(breakerOpen, b.State())
+	assert.False(b.Allow())
+
+	// half-open after the cooldown, for a single request
+	now = now.Add(time.Minute)
+	assert.True(b.Allow())
+	assert.Equal(breakerHalfOpen, b.State())
+	assert.False(b.Allow(), "only one request is let through to test the recovery")
+
+	// which failing opens the circuit for another cooldown
+	b.Failure()
+	assert.Equal(breakerOpen, b.State())
+	now = now.Add(30 * time.Second)
+	assert.False(b.Allow())
+	now = now.Add(30 * time.Second)
+	assert.True(b.Allow())
+
+	// and succeeding closes it
+	assert.True(b.Success())
+	assert.Equal(breakerClosed, b.State())
+	assert.True(b.Allow())
+	assert.True(b.Allow())
+	assert.False(b.Success())
+
+	// a nil breaker, disabled, always lets the requests through
+	b = newCircuitBreaker(0, time.Minute)
+	assert.Nil(b)
+	b.Failure()
+	assert.True(b.Allow())
+	assert.Equal(breakerClosed, b.State())
+}
+
+func TestWriterCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 3)
+	server := newFlakyTestServer(t, data, 2, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "trace-agent-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APISpoolDir = dir
+	conf.APIBreakerThreshold = 2
+	conf.APIBreakerCooldown = time.Minute
+	w := NewWriter(conf)
+	defer w.endpoint.(*APIEndpoint).Stop()
+	w.backoff = backoff{}
+	now := time.Now()
+	w.breaker.now = func() time.Time { return now }
+
+	w.bufferPayload(newTestPayload("first"))
+	w.Flush()
+	w.Flush()
+	assert.Equal(breakerOpen, w.breaker.State())
+	assert.Len(w.payloadBuffer, 1)
+
+	// the payloads are spooled without even trying while the circuit is open
+	w.bufferPayload(newTestPayload("second"))
+	w.Flush()
+	assert.Empty(w.payloadBuffer)
+	assert.Len(w.spool.files(), 2)
+
+	// until the recovery, which sends the spooled payloads back
+	now = now.Add(time.Minute)
+	w.bufferPayload(newTestPayload("third"))
+	w.Flush()
+	assert.Equal(breakerClosed, w.breaker.State())
+	assert.Len(w.payloadBuffer, 2)
+	w.Flush()
+	assert.Empty(w.payloadBuffer)
+	assert.Len(data, 3)
+}
+
+func TestWriterCircuitBreakerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	conf.APIBreakerThreshold = 2
+	conf.APIBreakerCooldown = time.Minute
+	w := NewWriter(conf)
+	w.endpoint.(*APIEndpoint).Stop()
+
+	// any failed write counts, not only the retryable ones
+	w.endpoint = errorEndpoint{err: errors.New("rejected")}
+	w.bufferPayload(newTestPayload("first"))
+	w.bufferPayload(newTestPayload("second"))
+	w.Flush()
+	assert.Equal(breakerOpen, w.breaker.State())
+}
+
+func TestWriterCircuitBreakerRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	// e.g. a revoked API key
+	server := newFailingTestServer(t, http.StatusForbidden)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"revoked"}
+	conf.APIBreakerThreshold = 2
+	conf.APIBreakerCooldown = time.Minute
+	w := NewWriter(conf)
+	defer w.endpoint.(*APIEndpoint).Stop()
+
+	// a rejected payload is a failure, but it is not retried
+	w.bufferPayload(newTestPayload("first"))
+	w.Flush()
+	assert.Equal(breakerClosed, w.breaker.State())
+	assert.Empty(w.payloadBuffer)
+
+	w.bufferPayload(newTestPayload("second"))
+	w.Flush()
+	assert.Equal(breakerOpen, w.breaker.State())
+	assert.Empty(w.payloadBuffer)
+}
+
+func TestWriterCircuitBreakerSpoolRemainingURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	accepted := make(chan dataFromAPI, 1)
+	acceptedServer := newTestServer(t, accepted)
+	defer acceptedServer.Close()
+	failingServer := newFailingTestServer(t, http.StatusServiceUnavailable)
+	defer failingServer.Close()
+
+	dir, err := ioutil.TempDir("", "trace-agent-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{acceptedServer.URL, failingServer.URL}
+	conf.APIKeys = []string{"key1", "key2"}
+	conf.APISpoolDir = dir
+	conf.APIBreakerThreshold = 1
+	conf.APIBreakerCooldown = time.Minute
+	w := NewWriter(conf)
+	defer w.endpoint.(*APIEndpoint).Stop()
+	w.backoff = backoff{}
+
+	// the first write opens the circuit, the retry is short-circuited
+	w.bufferPayload(newTestPayload("narrowed"))
+	w.Flush()
+	assert.Equal(breakerOpen, w.breaker.State())
+	assert.Len(accepted, 1)
+	w.Flush()
+	assert.Empty(w.payloadBuffer)
+
+	// and spooled for the failing endpoint only
+	payloads := w.spool.Replay()
+	assert.Len(payloads, 1)
+	assert.Equal([]string{failingServer.URL}, payloads[0].urls)
+}
+
+func TestWriterCircuitBreakerPerEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 2)
+	server := newTestServer(t, data)
+	defer server.Close()
+	failingServer := newFailingTestServer(t, http.StatusServiceUnavailable)
+	defer failingServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIEnvEndpoints = map[string]config.APIEndpointSettings{
+		"prod": {URL: failingServer.URL, APIKey: "prod_key"},
+	}
+	conf.APIBreakerThreshold = 1
+	conf.APIBreakerCooldown = time.Minute
+	w := NewWriter(conf)
+	defer w.endpoint.(*APIEndpoint).Stop()
+	defer w.envEndpoints["prod"].(*APIEndpoint).Stop()
+	w.backoff = backoff{}
+
+	write := func(env string) {
+		p := newWriterPayload(newTestPayload(env), w.endpointFor(env))
+		w.payloadBuffer = append(w.payloadBuffer, p)
+		w.Flush()
+	}
+
+	// the failing endpoint opens its own circuit only
+	write("prod")
+	assert.Equal(breakerOpen, w.breakerFor("prod").State())
+	assert.Equal(breakerClosed, w.breakerFor("none").State())
+
+	write("none")
+	assert.Equal(breakerClosed, w.breakerFor("none").State())
+	assert.Len(data, 1)
+}
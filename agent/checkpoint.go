@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+const (
+	// statsCheckpointFile is the name of the checkpoint in its directory
+	statsCheckpointFile = "stats.checkpoint.gob"
+	// statsCheckpointMaxAge is the age above which a checkpoint is not
+	// restored, its buckets would be too late for the API anyway
+	statsCheckpointMaxAge = 10 * time.Minute
+)
+
+// statsCheckpointer writes the stats being aggregated by the Concentrator to
+// disk, with encoding/gob, so that they survive a crash: the agent restores
+// them at the next start. The agent writes it every StatsCheckpointInterval,
+// and after the flushes of the buckets it holds. A nil statsCheckpointer is
+// disabled.
+type statsCheckpointer struct {
+	path    string
+	maxSize int
+
+	buckets map[int64]struct{} // the buckets the checkpoint on disk holds
+
+	now func() time.Time
+}
+
+// newStatsCheckpointer returns the statsCheckpointer configured by conf, nil
+// if disabled
+func newStatsCheckpointer(conf *config.AgentConfig) *statsCheckpointer {
+	if conf.StatsCheckpointDir == "" {
+		return nil
+	}
+	return &statsCheckpointer{
+		path:    filepath.Join(conf.StatsCheckpointDir, statsCheckpointFile),
+		maxSize: conf.StatsCheckpointMaxSize,
+		buckets: make(map[int64]struct{}),
+		now:     time.Now,
+	}
+}
+
+// Flushed tells if the checkpoint holds any of the flushed buckets, in which
+// case it has to be written again not to restore stats already flushed
+func (c *statsCheckpointer) Flushed(buckets []model.StatsBucket) bool {
+	if c == nil {
+		return false
+	}
+	for _, b := range buckets {
+		if _, ok := c.buckets[b.Start]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Write replaces the checkpoint with buckets. If they do not fit in maxSize,
+// the checkpoint is removed rather than left holding stale stats.
+func (c *statsCheckpointer) Write(buckets []model.StatsBucket) error {
+	if c == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(buckets); err != nil {
+		c.remove()
+		return fmt.Errorf("cannot encode stats checkpoint: %v", err)
+	}
+	if buf.Len() > c.maxSize {
+		c.remove()
+		return fmt.Errorf("stats checkpoint of %d bytes larger than the max size %d, not written", buf.Len(), c.maxSize)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		c.remove()
+		return fmt.Errorf("cannot create stats checkpoint directory: %v", err)
+	}
+	// written aside then renamed, not to leave a truncated checkpoint if
+	// the agent dies meanwhile
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		c.remove()
+		return fmt.Errorf("cannot write stats checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		c.remove()
+		return fmt.Errorf("cannot write stats checkpoint: %v", err)
+	}
+
+	c.buckets = make(map[int64]struct{}, len(buckets))
+	for _, b := range buckets {
+		c.buckets[b.Start] = struct{}{}
+	}
+	return nil
+}
+
+// Restore returns the buckets of the checkpoint left by the previous run, if
+// any and recent enough. The checkpoint is kept until written again, in case
+// the agent dies before, unless it cannot be restored.
+func (c *statsCheckpointer) Restore() ([]model.StatsBucket, error) {
+	if c == nil {
+		return nil, nil
+	}
+	fi, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read stats checkpoint: %v", err)
+	}
+	if age := c.now().Sub(fi.ModTime()); age > statsCheckpointMaxAge {
+		c.remove()
+		return nil, fmt.Errorf("stats checkpoint %s old, not restored", age)
+	}
+
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read stats checkpoint: %v", err)
+	}
+	var buckets []model.StatsBucket
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&buckets); err != nil {
+		c.remove()
+		return nil, fmt.Errorf("cannot decode stats checkpoint: %v", err)
+	}
+
+	for _, b := range buckets {
+		c.buckets[b.Start] = struct{}{}
+	}
+	return buckets, nil
+}
+
+func (c *statsCheckpointer) remove() {
+	os.Remove(c.path)
+	c.buckets = make(map[int64]struct{})
+}
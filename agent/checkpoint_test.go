@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestStatsCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := config.NewDefaultAgentConfig()
+	conf.StatsCheckpointDir = dir
+
+	// c aggregates half the spans before dying, all of them go to ref
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	ref := NewConcentrator([]string{}, testBucketInterval, 0)
+	var before, after model.Trace
+	for i := 0; i < 40; i++ {
+		// a bucket to flush and an open one
+		offset := int64(1 + 2*(i%2))
+		s := testSpan(c, uint64(i), int64(1000+i*100), offset, "A1", "resource1", int32(i%3/2))
+		if i < 20 {
+			before = append(before, s)
+		} else {
+			after = append(after, s)
+		}
+	}
+	c.Add(processedTrace{Env: "none", Trace: before}, 1)
+	ref.Add(processedTrace{Env: "none", Trace: before}, 1)
+	ref.Add(processedTrace{Env: "none", Trace: after}, 1)
+
+	checkpointer := newStatsCheckpointer(conf)
+	assert.NoError(checkpointer.Write(c.Checkpoint()))
+
+	// restarted, the restored stats are aggregated with the new ones
+	checkpointer = newStatsCheckpointer(conf)
+	buckets, err := checkpointer.Restore()
+	assert.NoError(err)
+	assert.Len(buckets, 2)
+	c = NewConcentrator([]string{}, testBucketInterval, 0)
+	c.Restore(buckets)
+	c.Add(processedTrace{Env: "none", Trace: after}, 1)
+
+	stats, expected := c.Flush(), ref.Flush()
+	if !assert.Len(stats, 1) || !assert.Len(expected, 1) {
+		t.FailNow()
+	}
+	assert.Equal(expected[0].Start, stats[0].Start)
+	assert.Equal(expected[0].Counts, stats[0].Counts)
+	assert.Len(stats[0].Distributions, len(expected[0].Distributions))
+	for k, d := range expected[0].Distributions {
+		restored := stats[0].Distributions[k]
+		if !assert.NotNil(restored.Summary, k) {
+			continue
+		}
+		assert.Equal(d.Summary.N, restored.Summary.N, k)
+		for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+			assert.Equal(d.Summary.Quantile(q), restored.Summary.Quantile(q), "%s quantile %v", k, q)
+		}
+	}
+
+	// the flushed bucket is in the checkpoint, which must be written again
+	assert.True(checkpointer.Flushed(stats))
+	assert.NoError(checkpointer.Write(c.Checkpoint()))
+	assert.False(checkpointer.Flushed(stats))
+	buckets, err = newStatsCheckpointer(conf).Restore()
+	assert.NoError(err)
+	assert.Len(buckets, 1, "only the open bucket is left")
+
+	// the checkpoints too large are not written, nor the old ones restored
+	checkpointer.maxSize = 10
+	assert.Error(checkpointer.Write(c.Checkpoint()))
+	_, err = os.Stat(filepath.Join(dir, statsCheckpointFile))
+	assert.True(os.IsNotExist(err))
+
+	checkpointer.maxSize = conf.StatsCheckpointMaxSize
+	assert.NoError(checkpointer.Write(c.Checkpoint()))
+	checkpointer = newStatsCheckpointer(conf)
+	checkpointer.now = func() time.Time { return time.Now().Add(statsCheckpointMaxAge + time.Minute) }
+	buckets, err = checkpointer.Restore()
+	assert.Error(err)
+	assert.Empty(buckets)
+
+	// disabled, nothing is written
+	var disabled *statsCheckpointer
+	assert.NoError(disabled.Write(c.Checkpoint()))
+	assert.False(disabled.Flushed(stats))
+}
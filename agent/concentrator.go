@@ -7,6 +7,7 @@ import (
 	log "github.com/cihub/seelog"
 
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
 	"github.com/DataDog/datadog-trace-agent/statsd"
 )
 
@@ -15,19 +16,24 @@ import (
 // Gets an imperial shitton of traces, and outputs pre-computed data structures
 // allowing to find the gold (stats) amongst the traces.
 type Concentrator struct {
-	aggregators []string
-	bsize       int64
+	aggregators  []string
+	bsize        int64
+	maxResources int // distinct (service, resource) per bucket, see StatsRawBucket.SetMaxResources
 
-	buckets map[int64]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
-	mu      sync.Mutex
+	buckets  map[int64]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
+	restored map[int64]model.StatsBucket     // stats restored from a checkpoint, merged into the buckets at flush
+	mu       sync.Mutex
 }
 
-// NewConcentrator initializes a new concentrator ready to be started
-func NewConcentrator(aggregators []string, bsize int64) *Concentrator {
+// NewConcentrator initializes a new concentrator ready to be started,
+// maxResources <= 0 means no limit on the resources per bucket
+func NewConcentrator(aggregators []string, bsize int64, maxResources int) *Concentrator {
 	c := Concentrator{
-		aggregators: aggregators,
-		bsize:       bsize,
-		buckets:     make(map[int64]*model.StatsRawBucket),
+		aggregators:  aggregators,
+		bsize:        bsize,
+		maxResources: maxResources,
+		buckets:      make(map[int64]*model.StatsRawBucket),
+		restored:     make(map[int64]model.StatsBucket),
 	}
 	sort.Strings(c.aggregators)
 	return &c
@@ -38,10 +44,15 @@ func (c *Concentrator) Add(t processedTrace, weight float64) {
 	c.mu.Lock()
 
 	for _, s := range t.Trace {
+		if s.IsTruncatedMarker() {
+			// it stands for spans the stats never got, it is no operation
+			continue
+		}
 		btime := s.End() - s.End()%c.bsize
 		b, ok := c.buckets[btime]
 		if !ok {
 			b = model.NewStatsRawBucket(btime, c.bsize)
+			b.SetMaxResources(c.maxResources)
 			c.buckets[btime] = b
 		}
 
@@ -61,6 +72,9 @@ func (c *Concentrator) Flush() []model.StatsBucket {
 	var sb []model.StatsBucket
 	now := model.Now()
 
+	// keep track of the largest summary, to catch them growing out of hand
+	var largest quantile.SummaryStats
+
 	c.mu.Lock()
 	for ts, srb := range c.buckets {
 		bucket := srb.Export()
@@ -73,13 +87,82 @@ func (c *Concentrator) Flush() []model.StatsBucket {
 		}
 
 		log.Debugf("flushing bucket %d", ts)
+		if restored, ok := c.restored[ts]; ok {
+			bucket.Merge(restored)
+			delete(c.restored, ts)
+		}
+		if n := srb.Overflowed(); n > 0 {
+			log.Debugf("bucket %d reached the resources cap, %d spans aggregated as %q", ts, n, model.OverflowResource)
+			statsd.Client.Count("datadog.trace_agent.concentrator.resources_overflow", int64(n), nil, 1)
+		}
 		for _, d := range bucket.Distributions {
 			statsd.Client.Histogram("datadog.trace_agent.distribution.len", float64(d.Summary.N), nil, 1)
+			if st := d.Summary.Stats(); st.Bytes > largest.Bytes {
+				largest = st
+			}
 		}
 		sb = append(sb, bucket)
 		delete(c.buckets, ts)
 	}
+	for ts, bucket := range c.restored {
+		// nothing aggregated in these buckets since the restart
+		if ts > now-2*c.bsize {
+			continue
+		}
+		log.Debugf("flushing restored bucket %d", ts)
+		sb = append(sb, bucket)
+		delete(c.restored, ts)
+	}
 	c.mu.Unlock()
 
+	if largest.Bytes > 0 {
+		statsd.Client.Gauge("datadog.trace_agent.distribution.max_entries", float64(largest.Entries), nil, 1)
+		statsd.Client.Gauge("datadog.trace_agent.distribution.max_bytes", float64(largest.Bytes), nil, 1)
+	}
+
+	return sb
+}
+
+// Checkpoint returns a copy of the stats being aggregated, the restored ones
+// included, see Restore
+func (c *Concentrator) Checkpoint() []model.StatsBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buckets := make(map[int64]model.StatsBucket, len(c.buckets)+len(c.restored))
+	for ts, srb := range c.buckets {
+		bucket := model.NewStatsBucket(ts, c.bsize)
+		bucket.Merge(srb.Export())
+		buckets[ts] = bucket
+	}
+	for ts, restored := range c.restored {
+		bucket, ok := buckets[ts]
+		if !ok {
+			bucket = model.NewStatsBucket(ts, c.bsize)
+			buckets[ts] = bucket
+		}
+		bucket.Merge(restored)
+	}
+
+	sb := make([]model.StatsBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		sb = append(sb, bucket)
+	}
 	return sb
 }
+
+// Restore adds the stats of a checkpoint to the aggregation, they are flushed
+// along with the stats aggregated since in the same buckets
+func (c *Concentrator) Restore(buckets []model.StatsBucket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, b := range buckets {
+		restored, ok := c.restored[b.Start]
+		if !ok {
+			restored = model.NewStatsBucket(b.Start, b.Duration)
+			c.restored[b.Start] = restored
+		}
+		restored.Merge(b)
+	}
+}
@@ -12,7 +12,7 @@ import (
 var testBucketInterval = time.Duration(2 * time.Second).Nanoseconds()
 
 func NewTestConcentrator() *Concentrator {
-	return NewConcentrator([]string{}, time.Second.Nanoseconds())
+	return NewConcentrator([]string{}, time.Second.Nanoseconds(), 0)
 }
 
 // getTsInBucket gives a timestamp in ns which is `offset` buckets late
@@ -39,7 +39,7 @@ func testSpan(c *Concentrator, spanID uint64, duration, offset int64, service, r
 
 func TestConcentratorStatsCounts(t *testing.T) {
 	assert := assert.New(t)
-	c := NewConcentrator([]string{}, testBucketInterval)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
 
 	now := model.Now()
 	alignedNow := now - now%c.bsize
@@ -138,3 +138,30 @@ func TestConcentratorStatsCounts(t *testing.T) {
 		assert.Equal(val, int64(count.Value), "Wrong value for count %s", key)
 	}
 }
+
+func TestConcentratorSkipsTruncatedMarker(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+
+	root := testSpan(c, 1, 24, 2, "A1", "resource1", 0)
+	deep := model.Trace{root}
+	for i := 2; i < 10; i++ {
+		s := testSpan(c, uint64(i), 12, 2, "A1", "resource1", 0)
+		s.ParentID = uint64(i - 1)
+		deep = append(deep, s)
+	}
+	truncated, removed := deep.TruncateDepth(2)
+	assert.Equal(6, removed)
+
+	pt := processedTrace{Env: "none", Trace: truncated, Root: truncated.GetRoot()}
+	c.Add(pt, pt.weight())
+	stats := c.Flush()
+
+	if !assert.Len(stats, 1) {
+		return
+	}
+	for _, count := range stats[0].Counts {
+		assert.NotEqual(model.TruncatedSpanName, count.Name)
+	}
+	assert.Equal(3.0, stats[0].Counts["query|hits|env:none,resource:resource1,service:A1"].Value)
+}
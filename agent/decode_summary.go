@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/DataDog/datadog-trace-agent/quantile"
+)
+
+// decodeSummaryCommand is the subcommand printing a serialized summary
+const decodeSummaryCommand = "decode-summary"
+
+// decodedSummary is what both summary implementations offer to describe them
+type decodedSummary interface {
+	Quantile(q float64) float64
+	BySlices() []quantile.SummarySlice
+}
+
+// readSummary decodes a summary serialized either as JSON, from a Summary or
+// a SliceSummary, or with gob, from a Summary. It returns the summary and
+// the number of values it holds.
+func readSummary(data []byte) (decodedSummary, int64, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &fields); err != nil {
+			return nil, 0, fmt.Errorf("cannot decode JSON summary: %v", err)
+		}
+		if _, ok := fields["Entries"]; ok {
+			var s quantile.SliceSummary
+			if err := json.Unmarshal(trimmed, &s); err != nil {
+				return nil, 0, fmt.Errorf("cannot decode JSON slice summary: %v", err)
+			}
+			return &s, s.N, nil
+		}
+		var s quantile.Summary
+		if err := json.Unmarshal(trimmed, &s); err != nil {
+			return nil, 0, fmt.Errorf("cannot decode JSON summary: %v", err)
+		}
+		return &s, s.N, nil
+	}
+
+	var s quantile.Summary
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode gob summary: %v", err)
+	}
+	return &s, s.N, nil
+}
+
+// decodeSummary writes to w a description of the summary serialized in path
+func decodeSummary(w io.Writer, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s, n, err := readSummary(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	fmt.Fprintf(w, "N: %d\n", n)
+	if n == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "min: %g\nmax: %g\n", s.Quantile(0), s.Quantile(1))
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99} {
+		fmt.Fprintf(w, "p%g: %g\n", q*100, s.Quantile(q))
+	}
+	fmt.Fprintf(w, "slices:\n")
+	for _, ss := range s.BySlices() {
+		fmt.Fprintf(w, "  [%g, %g]: %d\n", ss.Start, ss.End, ss.Weight)
+	}
+
+	return nil
+}
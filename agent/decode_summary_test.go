@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestSummary(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "trace-agent-summary")
+	if err != nil {
+		t.Fatalf("cannot create summary file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("cannot write summary file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestDecodeSummary(t *testing.T) {
+	s := quantile.NewSummary()
+	ss := quantile.NewSliceSummary()
+	for i := 1; i <= 40; i++ {
+		s.Insert(float64(i), uint64(i))
+		ss.Insert(float64(i), uint64(i))
+	}
+
+	js, err := json.Marshal(s)
+	assert.Nil(t, err)
+	sliceJS, err := json.Marshal(ss)
+	assert.Nil(t, err)
+	var gobBuf bytes.Buffer
+	assert.Nil(t, gob.NewEncoder(&gobBuf).Encode(s))
+
+	for name, data := range map[string][]byte{
+		"json":       js,
+		"slice json": sliceJS,
+		"gob":        gobBuf.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			path := writeTestSummary(t, data)
+			defer os.Remove(path)
+
+			var buf bytes.Buffer
+			assert.Nil(decodeSummary(&buf, path))
+			out := buf.String()
+			for _, line := range []string{
+				"N: 40\n",
+				"min: 1\n",
+				"max: 40\n",
+				"p50: 20\n",
+				"p99: 40\n",
+				"slices:\n",
+				"  [1, 1]: 1\n",
+				"40]: 1\n",
+			} {
+				assert.Contains(out, line)
+			}
+		})
+	}
+
+	path := writeTestSummary(t, []byte("garbage"))
+	defer os.Remove(path)
+	var buf bytes.Buffer
+	assert.NotNil(t, decodeSummary(&buf, path))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+const (
+	// How long we remember a trace to drop its duplicates
+	defaultDedupeTTL time.Duration = 10 * time.Second
+	// Maximum number of traces remembered at once, older ones are forgotten first
+	defaultDedupeMaxSize int = 50000
+)
+
+// dedupeKey identifies a trace by its ID and the ID of its root: the partial
+// flushes of a distributed trace share their trace ID, not their root.
+type dedupeKey struct {
+	traceID uint64
+	rootID  uint64
+}
+
+type dedupeEntry struct {
+	key  dedupeKey
+	seen time.Time
+}
+
+// traceDeduper remembers the traces seen recently, to detect traces sent
+// several times by clients retrying their requests.
+// Since all the entries have the same TTL, they expire in insertion order:
+// they are stored in a ring buffer which also bounds the memory used.
+type traceDeduper struct {
+	ttl time.Duration
+
+	seen    map[dedupeKey]time.Time
+	entries []dedupeEntry // ring buffer, oldest entry at index head
+	head    int
+	size    int
+
+	mu sync.Mutex
+}
+
+// newTraceDeduperFromConfig returns the deduper of the agent, nil unless
+// conf.DedupeTraces is set
+func newTraceDeduperFromConfig(conf *config.AgentConfig) *traceDeduper {
+	if !conf.DedupeTraces {
+		return nil
+	}
+	return newTraceDeduper(defaultDedupeTTL, defaultDedupeMaxSize)
+}
+
+func newTraceDeduper(ttl time.Duration, maxSize int) *traceDeduper {
+	return &traceDeduper{
+		ttl:     ttl,
+		seen:    make(map[dedupeKey]time.Time),
+		entries: make([]dedupeEntry, maxSize),
+	}
+}
+
+// Seen records the trace of root and tells if it was already seen within the
+// TTL. It is nil-safe, a nil deduper sees no trace twice.
+func (d *traceDeduper) Seen(root *model.Span, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	key := dedupeKey{traceID: root.TraceID, rootID: root.SpanID}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+
+	if d.size == len(d.entries) {
+		// full, forget the oldest trace
+		d.pop()
+	}
+
+	d.entries[(d.head+d.size)%len(d.entries)] = dedupeEntry{key: key, seen: now}
+	d.size++
+	d.seen[key] = now
+
+	return false
+}
+
+// expire forgets all the traces older than the TTL
+func (d *traceDeduper) expire(now time.Time) {
+	limit := now.Add(-d.ttl)
+	for d.size > 0 && !d.entries[d.head].seen.After(limit) {
+		d.pop()
+	}
+}
+
+func (d *traceDeduper) pop() {
+	delete(d.seen, d.entries[d.head].key)
+	d.head = (d.head + 1) % len(d.entries)
+	d.size--
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceDeduper(t *testing.T) {
+	assert := assert.New(t)
+	d := newTraceDeduper(10*time.Second, 3)
+	now := time.Now()
+	root := func(traceID uint64) *model.Span { return &model.Span{TraceID: traceID, SpanID: 1} }
+
+	assert.False(d.Seen(root(1), now))
+	assert.True(d.Seen(root(1), now.Add(time.Second)))
+	assert.False(d.Seen(root(2), now.Add(time.Second)))
+
+	// expired after the TTL
+	assert.False(d.Seen(root(1), now.Add(11*time.Second)))
+
+	// bounded size, the oldest IDs are forgotten first
+	assert.False(d.Seen(root(3), now.Add(11*time.Second)))
+	assert.False(d.Seen(root(4), now.Add(11*time.Second)))
+	assert.Equal(3, len(d.seen))
+	assert.False(d.Seen(root(2), now.Add(11*time.Second)))
+	assert.True(d.Seen(root(4), now.Add(11*time.Second)))
+
+	// partial flushes of a trace have other roots
+	assert.False(d.Seen(&model.Span{TraceID: 4, SpanID: 2}, now.Add(11*time.Second)))
+
+	// disabled
+	assert.Nil(newTraceDeduperFromConfig(config.NewDefaultAgentConfig()))
+	var nilDeduper *traceDeduper
+	assert.False(nilDeduper.Seen(root(1), now))
+	assert.False(nilDeduper.Seen(root(1), now))
+}
+
+// concentratorHits returns the hits counted by c for resource
+func concentratorHits(c *Concentrator, resource string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var hits float64
+	for _, b := range c.buckets {
+		for key, count := range b.Export().Counts {
+			if strings.Contains(key, "|hits|") && strings.Contains(key, "resource:"+resource+",") {
+				hits += count.Value
+			}
+		}
+	}
+	return hits
+}
+
+func TestAgentDedupeTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	conf.DedupeTraces = true
+	// the deterministic engine does not look at the traces received before
+	conf.SamplerEngine = config.SamplerEngineDeterministic
+	a := NewAgent(context.Background(), conf)
+
+	now := model.Now()
+	trace := func(resource string) model.Trace {
+		return model.Trace{model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request",
+			Resource: resource, Start: now, Duration: 1}}
+	}
+	waitHits := func(resource string) {
+		deadline := time.Now().Add(time.Second)
+		for concentratorHits(a.Concentrator, resource) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	a.Process(trace("GET /users"))
+	waitHits("GET /users")
+	// sent again by a retrying client: dropped before the concentrator
+	a.Process(trace("GET /users"))
+	assert.Equal(int64(1), atomic.LoadInt64(&a.Receiver.stats.TracesDuplicate))
+
+	// another root is not a duplicate
+	other := trace("GET /orders")
+	other[0].SpanID = 2
+	a.Process(other)
+	waitHits("GET /orders")
+
+	assert.Equal(1.0, concentratorHits(a.Concentrator, "GET /users"))
+	assert.Equal(1.0, concentratorHits(a.Concentrator, "GET /orders"))
+	assert.Equal(int64(1), atomic.LoadInt64(&a.Receiver.stats.TracesDuplicate))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+)
+
+// signatureGroup is the traces of a same signature, by index
+type signatureGroup struct {
+	indexes []int
+	quota   int
+	// remainder is the fraction of a trace the proportional quota was
+	// rounded down by, the largest ones get the traces left
+	remainder float64
+}
+
+// downsampleTraces returns at most max of the traces, keeping them
+// representative of the whole: every signature keeps at least one trace and
+// the rest of the budget is shared in proportion to the frequency of the
+// signatures. If there are more signatures than max, one trace of each of the
+// most frequent ones is kept. The traces are picked evenly among those of
+// their signature, and kept in their order. The sample rate of their root is
+// scaled down by the fraction of their signature they stand for.
+func downsampleTraces(traces []model.Trace, max int, signatureOf func(model.Trace) sampler.Signature) []model.Trace {
+	if max <= 0 || len(traces) <= max {
+		return traces
+	}
+
+	bySignature := make(map[sampler.Signature]*signatureGroup)
+	var groups []*signatureGroup // in the order of the first trace of each
+	for i, t := range traces {
+		sig := signatureOf(t)
+		g, ok := bySignature[sig]
+		if !ok {
+			g = &signatureGroup{}
+			bySignature[sig] = g
+			groups = append(groups, g)
+		}
+		g.indexes = append(g.indexes, i)
+	}
+
+	if len(groups) >= max {
+		sort.SliceStable(groups, func(i, j int) bool {
+			return len(groups[i].indexes) > len(groups[j].indexes)
+		})
+		groups = groups[:max]
+		for _, g := range groups {
+			g.quota = 1
+		}
+	} else {
+		// one trace each, then the extra ones in proportion to the
+		// traces left, by largest remainder so that they add up to max
+		extra := max - len(groups)
+		left := len(traces) - len(groups)
+		given := 0
+		for _, g := range groups {
+			share := float64(extra) * float64(len(g.indexes)-1) / float64(left)
+			g.quota = 1 + int(share)
+			g.remainder = share - float64(int(share))
+			given += g.quota - 1
+		}
+		byRemainder := make([]*signatureGroup, len(groups))
+		copy(byRemainder, groups)
+		sort.SliceStable(byRemainder, func(i, j int) bool {
+			return byRemainder[i].remainder > byRemainder[j].remainder
+		})
+		for _, g := range byRemainder[:extra-given] {
+			g.quota++
+		}
+	}
+
+	keep := make([]bool, len(traces))
+	for _, g := range groups {
+		n := len(g.indexes)
+		rate := float64(g.quota) / float64(n)
+		for j := 0; j < g.quota; j++ {
+			i := g.indexes[j*n/g.quota]
+			keep[i] = true
+			if root := traces[i].GetRoot(); rate < 1 && root != nil {
+				sampler.SetTraceAppliedSampleRate(root, sampler.GetTraceAppliedSampleRate(root)*rate)
+			}
+		}
+	}
+
+	kept := make([]model.Trace, 0, max)
+	for i, t := range traces {
+		if keep[i] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+)
+
+// skewedTraces returns n traces of each resource, in turn
+func skewedTraces(counts map[string]int) []model.Trace {
+	var traces []model.Trace
+	id := uint64(1)
+	for resource, n := range counts {
+		for i := 0; i < n; i++ {
+			traces = append(traces, model.Trace{
+				model.Span{TraceID: id, SpanID: 1, Service: "mcnulty", Name: "query", Resource: resource},
+			})
+			id++
+		}
+	}
+	return traces
+}
+
+func countBySignature(traces []model.Trace) map[sampler.Signature]int {
+	counts := make(map[sampler.Signature]int)
+	for _, t := range traces {
+		counts[sampler.ComputeSignature(t)]++
+	}
+	return counts
+}
+
+func TestDownsampleTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := skewedTraces(map[string]int{"GET /": 900, "POST /": 90, "DELETE /": 9, "PUT /": 1})
+	before := countBySignature(traces)
+
+	kept := downsampleTraces(traces, 100, sampler.ComputeSignature)
+	assert.Len(kept, 100)
+	after := countBySignature(kept)
+	assert.Len(after, 4, "every signature should be represented")
+	for sig, n := range after {
+		assert.True(n >= 1 && n <= before[sig])
+	}
+	// the rest in proportion to their frequency
+	byResource := map[string]int{}
+	for _, t := range kept {
+		byResource[t[0].Resource]++
+	}
+	assert.Equal(map[string]int{"GET /": 88, "POST /": 9, "DELETE /": 2, "PUT /": 1}, byResource)
+
+	// the order is kept
+	for i := 1; i < len(kept); i++ {
+		assert.True(kept[i-1][0].TraceID < kept[i][0].TraceID)
+	}
+
+	// the kept traces stand for the dropped ones of their signature
+	for _, t := range kept {
+		rate := sampler.GetTraceAppliedSampleRate(&t[0])
+		switch t[0].Resource {
+		case "GET /":
+			assert.InDelta(88.0/900, rate, 1e-9)
+		case "PUT /":
+			assert.Equal(1.0, rate)
+		}
+	}
+
+	// under the budget, or without, nothing changes
+	assert.Len(downsampleTraces(traces, 1000, sampler.ComputeSignature), 1000)
+	assert.Len(downsampleTraces(traces, 0, sampler.ComputeSignature), 1000)
+
+	// fewer slots than signatures, the most frequent ones win
+	kept = downsampleTraces(traces, 2, sampler.ComputeSignature)
+	assert.Len(kept, 2)
+	resources := map[string]bool{}
+	for _, t := range kept {
+		resources[t[0].Resource] = true
+	}
+	assert.Equal(map[string]bool{"GET /": true, "POST /": true}, resources)
+}
+
+func TestDownsampleTracesBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		counts[fmt.Sprintf("GET /%d", i)] = 1 + i*i
+	}
+	traces := skewedTraces(counts)
+	for _, max := range []int{30, 31, 47, 100, 1000, len(traces) - 1} {
+		kept := downsampleTraces(traces, max, sampler.ComputeSignature)
+		assert.Len(kept, max)
+		assert.Len(countBySignature(kept), 30)
+	}
+}
+
+func TestDownsampleTracesSignatureOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	// errors and successes differ by default
+	traces := skewedTraces(map[string]int{"GET /": 10})
+	for i := 0; i < 5; i++ {
+		traces[i][0].Error = 1
+	}
+	assert.Len(countBySignature(traces), 2)
+
+	// not for a sampler ignoring the errors, one trace is enough
+	engine := sampler.NewSampler(1, 10)
+	engine.UpdateSignatureIgnoreError(true)
+	kept := downsampleTraces(traces, 1, engine.TraceSignature)
+	assert.Len(kept, 1)
+	assert.InDelta(0.1, sampler.GetTraceAppliedSampleRate(&kept[0][0]), 1e-9)
+}
+
+func TestSamplerMaxTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.MaxTracesPerFlush = 10
+	s := newSamplerWithEngine(conf, &fakeEngine{keep: func(int) bool { return true }})
+	for _, t := range skewedTraces(map[string]int{"GET /": 50, "POST /": 5}) {
+		s.Add(processedTrace{Trace: t, Root: &t[0], Env: "none"})
+	}
+	p := s.FlushPayload()
+	assert.Len(p.Traces, 10)
+	assert.Equal(10, p.SampledCount)
+	assert.Equal(55, p.SeenCount)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +24,9 @@ import (
 type apiError struct {
 	errs     []error // the errors, one for each endpoint
 	endpoint *APIEndpoint
+
+	// how long the endpoints asked to wait before retrying, see Retry-After
+	retryDelay time.Duration
 }
 
 func newAPIError() *apiError {
@@ -41,6 +47,14 @@ func (err *apiError) Append(url, apiKey string, e error) {
 	err.endpoint.apiKeys = append(err.endpoint.apiKeys, apiKey)
 }
 
+func (err *apiError) retryEndpoint() AgentEndpoint {
+	return err.endpoint
+}
+
+func (err *apiError) retryAfter() time.Duration {
+	return err.retryDelay
+}
+
 func (err *apiError) Error() string {
 	var buf bytes.Buffer
 
@@ -55,6 +69,58 @@ func (err *apiError) Error() string {
 	return buf.String()
 }
 
+// rejectedError is returned by APIEndpoint.Write when no endpoint failed but
+// for good, like with a 4xx error other than 429: the write failed, but it is
+// no endpointError, for writing the payload again would fail the same way.
+type rejectedError struct {
+	errs []error
+}
+
+func (err *rejectedError) Error() string {
+	var buf bytes.Buffer
+
+	for i, e := range err.errs {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(e.Error())
+	}
+
+	return buf.String()
+}
+
+// endpointError is an error returned by AgentEndpoint.Write when the payload
+// can be written again later, to the endpoint it tells
+type endpointError interface {
+	error
+	retryEndpoint() AgentEndpoint
+}
+
+// retryAfterError is an endpointError telling the minimum delay to wait
+// before writing the payload again
+type retryAfterError interface {
+	endpointError
+	retryAfter() time.Duration
+}
+
+// parseRetryAfter returns the delay asked by a Retry-After header, either in
+// seconds, or as an HTTP date, or 0 if it is missing or invalid
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
 // AgentEndpoint is an interface where we write the data
 // that comes out of the agent
 type AgentEndpoint interface {
@@ -74,6 +140,13 @@ type APIEndpoint struct {
 	urls    []string
 	stats   endpointStats
 	client  *http.Client
+
+	// to build the client when any of them is set
+	proxy     func(*http.Request) (*url.URL, error)
+	tlsConfig *tls.Config
+	settings  *config.HTTPClientSettings
+
+	exit chan struct{}
 }
 
 // NewAPIEndpoint returns a new APIEndpoint from a given config
@@ -88,10 +161,13 @@ func NewAPIEndpoint(urls, apiKeys []string) *APIEndpoint {
 		panic(fmt.Errorf("APIEndpoint should be initialized with same number of url/api keys"))
 	}
 
+	// unless SetProxy is called, the default client proxies the
+	// requests according to HTTP_PROXY, HTTPS_PROXY and NO_PROXY
 	a := APIEndpoint{
 		apiKeys: apiKeys,
 		urls:    urls,
 		client:  http.DefaultClient,
+		exit:    make(chan struct{}),
 	}
 	watchdog.Go(func() {
 		a.logStats()
@@ -99,17 +175,73 @@ func NewAPIEndpoint(urls, apiKeys []string) *APIEndpoint {
 	return &a
 }
 
-// SetProxy updates the http client used by APIEndpoint to report via the given proxy
+// Stop stops reporting the endpoint stats
+func (a *APIEndpoint) Stop() {
+	close(a.exit)
+}
+
+// only returns an APIEndpoint writing to the URLs of a which are in urls,
+// with their API keys, or nil if there is none
+func (a *APIEndpoint) only(urls []string) *APIEndpoint {
+	e := &APIEndpoint{client: a.client}
+	for i, url := range a.urls {
+		for _, u := range urls {
+			if u == url {
+				e.urls = append(e.urls, url)
+				e.apiKeys = append(e.apiKeys, a.apiKeys[i])
+				break
+			}
+		}
+	}
+	if len(e.urls) == 0 {
+		return nil
+	}
+	return e
+}
+
+// SetProxy updates the http client used by APIEndpoint to report via the given proxy,
+// either an HTTP(S) or a SOCKS5 (socks5 scheme) one. It takes precedence over the
+// proxy set in the environment.
 func (a *APIEndpoint) SetProxy(settings *config.ProxySettings) {
 	proxyPath, err := settings.URL()
 	if err != nil {
 		log.Errorf("failed to configure proxy: %v", err)
 		return
 	}
+	a.proxy = http.ProxyURL(proxyPath)
+	a.resetClient()
+}
+
+// SetTLSConfig updates the http client used by APIEndpoint to connect with
+// the given TLS configuration
+func (a *APIEndpoint) SetTLSConfig(tlsConfig *tls.Config) {
+	a.tlsConfig = tlsConfig
+	a.resetClient()
+}
+
+// SetHTTPClientSettings updates the http client used by APIEndpoint to
+// apply the given timeouts and connection pooling
+func (a *APIEndpoint) SetHTTPClientSettings(settings config.HTTPClientSettings) {
+	a.settings = &settings
+	a.resetClient()
+}
+
+func (a *APIEndpoint) resetClient() {
+	proxy := a.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	transport := &http.Transport{}
+	var timeout time.Duration
+	if a.settings != nil {
+		transport = a.settings.Transport()
+		timeout = a.settings.RequestTimeout
+	}
+	transport.Proxy = proxy
+	transport.TLSClientConfig = a.tlsConfig
 	a.client = &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyPath),
-		},
+		Transport: transport,
+		Timeout:   timeout,
 	}
 }
 
@@ -132,6 +264,8 @@ func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
 	// we need to pass the client along for future submissions
 	// FIXME(aaditya)
 	endpointErr.SetClient(a.client)
+	// the errors it is no use retrying
+	var rejected []error
 
 	for i := range a.urls {
 		atomic.AddInt64(&a.stats.TracesPayload, 1)
@@ -146,6 +280,7 @@ func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
 			// same result.
 			log.Errorf("could not create request for endpoint %s: %v", url, err)
 			atomic.AddInt64(&a.stats.TracesPayloadError, 1)
+			rejected = append(rejected, err)
 			continue
 		}
 
@@ -170,9 +305,18 @@ func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
 
 			// Only retry for 5xx (server) errors; for 4xx errors,
 			// something is wrong with the request and there is
-			// usually no point in trying again.
-			if resp.StatusCode/100 == 5 {
+			// usually no point in trying again. The exception is 429,
+			// we are just sending too much, so try again when told.
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests:
+				endpointErr.Append(a.urls[i], a.apiKeys[i], err)
+				if d := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); d > endpointErr.retryDelay {
+					endpointErr.retryDelay = d
+				}
+			case resp.StatusCode/100 == 5:
 				endpointErr.Append(a.urls[i], a.apiKeys[i], err)
+			default:
+				rejected = append(rejected, err)
 			}
 
 			continue
@@ -184,12 +328,16 @@ func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
 			flushTime.Seconds(), nil, 1)
 	}
 
-	if endpointErr.IsEmpty() {
-		// The payload was sent to all endpoints without any error
-		return payloadSize, nil
+	if !endpointErr.IsEmpty() {
+		// retry with the endpoints which may accept it later
+		return payloadSize, endpointErr
+	}
+	if len(rejected) > 0 {
+		return payloadSize, &rejectedError{errs: rejected}
 	}
 
-	return payloadSize, endpointErr
+	// The payload was sent to all endpoints without any error
+	return payloadSize, nil
 }
 
 // WriteServices writes services to the services endpoint
@@ -257,7 +405,16 @@ func (ne NullEndpoint) WriteServices(s model.ServicesMetadata) {
 func (a *APIEndpoint) logStats() {
 	var accStats endpointStats
 
-	for range time.Tick(time.Minute) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-a.exit:
+			return
+		}
+
 		// Load counters and reset them for the next flush
 		accStats.TracesPayload = atomic.SwapInt64(&a.stats.TracesPayload, 0)
 		accStats.TracesPayloadError = atomic.SwapInt64(&a.stats.TracesPayloadError, 0)
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
 )
 
 func newBenchPayload(traces, spans, stats int) model.AgentPayload {
@@ -41,3 +55,172 @@ func BenchmarkEncodeAgentPayload(b *testing.B) {
 		}
 	}
 }
+
+func TestAPIEndpointProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	type proxied struct {
+		host, auth string
+	}
+	requests := make(chan proxied, 1)
+
+	// a plain HTTP proxy receives the absolute URL of the target
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- proxied{host: r.URL.Host, auth: r.Header.Get("Proxy-Authorization")}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.Nil(err)
+	port, err := strconv.Atoi(proxyURL.Port())
+	assert.Nil(err)
+
+	e := NewAPIEndpoint([]string{"http://intake.example.com"}, []string{"key"})
+	defer e.Stop()
+	e.SetProxy(&config.ProxySettings{
+		User:     "user",
+		Password: "password",
+		Host:     proxyURL.Hostname(),
+		Port:     port,
+		Scheme:   "http",
+	})
+
+	_, err = e.Write(newTestPayload("test"))
+	assert.Nil(err)
+
+	select {
+	case r := <-requests:
+		assert.Equal("intake.example.com", r.host)
+		assert.Equal("Basic dXNlcjpwYXNzd29yZA==", r.auth)
+	case <-time.After(time.Second):
+		t.Fatal("the request did not go through the proxy")
+	}
+}
+
+func TestAPIEndpointTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data <- dataFromAPI{urlPath: r.URL.Path}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// the test server certificate is self-signed, trust it as a private CA
+	ca, err := ioutil.TempFile("", "ca")
+	assert.Nil(err)
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	ca.Close()
+
+	e := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	defer e.Stop()
+
+	// unknown authority with the system CAs
+	_, err = e.Write(newTestPayload("test"))
+	assert.NotNil(err)
+
+	tlsConfig, err := (&config.TLSSettings{CAFile: ca.Name()}).Config()
+	assert.Nil(err)
+	e.SetTLSConfig(tlsConfig)
+
+	_, err = e.Write(newTestPayload("test"))
+	assert.Nil(err)
+
+	select {
+	case received := <-data:
+		assert.Equal("/api/v0.1/collector", received.urlPath)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the payload in time")
+	}
+}
+
+func TestAPIEndpointHTTPClientSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	e := NewAPIEndpoint([]string{"http://intake.example.com"}, []string{"key"})
+	defer e.Stop()
+
+	e.SetHTTPClientSettings(config.HTTPClientSettings{
+		ConnectTimeout:  5 * time.Second,
+		RequestTimeout:  time.Minute,
+		MaxIdleConns:    4,
+		IdleConnTimeout: 30 * time.Second,
+		KeepAlive:       true,
+	})
+	assert.Equal(time.Minute, e.client.Timeout)
+	transport := e.client.Transport.(*http.Transport)
+	assert.Equal(5*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(4, transport.MaxIdleConns)
+	assert.Equal(4, transport.MaxIdleConnsPerHost)
+	assert.Equal(30*time.Second, transport.IdleConnTimeout)
+	assert.False(transport.DisableKeepAlives)
+	assert.NotNil(transport.Proxy)
+
+	// the TLS configuration is kept with the new settings
+	e.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	e.SetHTTPClientSettings(config.HTTPClientSettings{})
+	transport = e.client.Transport.(*http.Transport)
+	assert.Equal(time.Duration(0), e.client.Timeout)
+	assert.True(transport.DisableKeepAlives)
+	assert.True(transport.TLSClientConfig.InsecureSkipVerify)
+}
+
+func TestAPIEndpointRequestTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	e := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	defer e.Stop()
+	settings := config.NewDefaultHTTPClientSettings()
+	settings.ConnectTimeout = 0
+	settings.RequestTimeout = 50 * time.Millisecond
+	e.SetHTTPClientSettings(settings)
+
+	start := time.Now()
+	_, err := e.Write(newTestPayload("test"))
+	assert.NotNil(err)
+	assert.True(time.Since(start) < time.Second, "the request should have timed out")
+}
+
+func TestAPIEndpointCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 1)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	e := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	defer e.Stop()
+
+	payload := newTestPayload("test")
+	expected, err := json.Marshal(payload)
+	assert.Nil(err)
+
+	_, err = e.Write(payload)
+	assert.Nil(err)
+	received := <-data
+	assert.Equal("gzip", received.header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(strings.NewReader(received.body))
+	assert.Nil(err)
+	body, err := ioutil.ReadAll(gz)
+	assert.Nil(err)
+	assert.JSONEq(string(expected), string(body))
+
+	model.GlobalAgentPayloadCompression = false
+	defer func() { model.GlobalAgentPayloadCompression = true }()
+
+	_, err = e.Write(payload)
+	assert.Nil(err)
+	received = <-data
+	assert.Equal("", received.header.Get("Content-Encoding"))
+	assert.JSONEq(string(expected), received.body)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// rootExcluder tells the traces to exclude from both the sampling and the
+// stats, such as health checks, from the resource or name of their root
+type rootExcluder struct {
+	patterns []*regexp.Regexp
+}
+
+// newRootExcluder returns the excluder of the roots whose resource or name
+// matches one of the patterns, either exactly or as a glob: * matching any
+// characters and ? one. It returns nil without pattern.
+func newRootExcluder(patterns []string) *rootExcluder {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	e := &rootExcluder{}
+	for _, p := range patterns {
+		e.patterns = append(e.patterns, globToRegexp(p))
+	}
+	return e
+}
+
+// globToRegexp returns the regexp matching the glob p as a whole
+func globToRegexp(p string) *regexp.Regexp {
+	var b bytes.Buffer
+	b.WriteByte('^')
+	for _, r := range p {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+	// the meta characters are all quoted, it always compiles
+	return regexp.MustCompile(b.String())
+}
+
+// Excluded tells if the trace of root has to be excluded. It is nil-safe, a
+// nil excluder excludes nothing.
+func (e *rootExcluder) Excluded(root *model.Span) bool {
+	if e == nil {
+		return false
+	}
+	for _, p := range e.patterns {
+		if p.MatchString(root.Resource) || p.MatchString(root.Name) {
+			return true
+		}
+	}
+	return false
+}
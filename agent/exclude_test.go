@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestRootExcluder(t *testing.T) {
+	assert := assert.New(t)
+
+	e := newRootExcluder([]string{"GET /healthz", "*/ping", "synthetics.?"})
+	for _, tc := range []struct {
+		name, resource string
+		excluded       bool
+	}{
+		{"http.request", "GET /healthz", true},
+		{"http.request", "GET /healthz/db", false}, // exact
+		{"http.request", "GET /v1/ping", true},
+		{"http.request", "GET /ping/pong", false},
+		{"synthetics.a", "GET /", true}, // by name
+		{"synthetics.ab", "GET /", false},
+		{"http.request", "GET /.*healthz", false}, // no regexp
+		{"http.request", "SELECT * FROM ab", false},
+	} {
+		root := &model.Span{Name: tc.name, Resource: tc.resource}
+		assert.Equal(tc.excluded, e.Excluded(root), "%s %s", tc.name, tc.resource)
+	}
+
+	var none *rootExcluder
+	assert.False(none.Excluded(&model.Span{Resource: "GET /healthz"}))
+	assert.Nil(newRootExcluder(nil))
+}
+
+func TestAgentExcludeRoots(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	conf.ExcludeRoots = []string{"GET /healthz"}
+	a := NewAgent(context.Background(), conf)
+
+	engine := &fakeEngine{sampled: make(chan model.Trace), keep: func(int) bool { return true }}
+	a.Sampler = newSamplerWithEngine(conf, engine)
+
+	now := model.Now()
+	healthCheck := model.Trace{model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request",
+		Resource: "GET /healthz", Start: now, Duration: 1}}
+	a.Process(healthCheck)
+
+	// excluded right away, neither sampled nor counted in the stats
+	assert.Equal(int64(1), atomic.LoadInt64(&a.Receiver.stats.TracesExcluded))
+	assert.Equal(0, engine.count)
+	a.Concentrator.mu.Lock()
+	assert.Len(a.Concentrator.buckets, 0)
+	a.Concentrator.mu.Unlock()
+
+	// while the other traces are
+	other := model.Trace{model.Span{TraceID: 2, SpanID: 1, Service: "web", Name: "http.request",
+		Resource: "GET /users", Start: now, Duration: 1}}
+	a.Process(other)
+	select {
+	case sampled := <-engine.sampled:
+		assert.Equal("GET /users", sampled[0].Resource)
+	case <-time.After(time.Second):
+		t.Fatal("the trace did not reach the sampler engine")
+	}
+}
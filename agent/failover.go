@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// failoverThreshold is how many writes in a row have to fail on the active
+// endpoint before we rotate to the next one
+const failoverThreshold = 3
+
+// failoverProbeInterval is how long after failing over the main endpoints are
+// tried first again, to go back to them once they recover
+const failoverProbeInterval = 5 * time.Minute
+
+// failoverError is returned when a payload could not be written to any of the
+// endpoints of a FailoverEndpoint. The whole chain can be retried later.
+type failoverError struct {
+	errs     []error
+	endpoint *FailoverEndpoint
+}
+
+func (err *failoverError) Error() string {
+	return fmt.Sprintf("all %d endpoints failed, last error: %v", len(err.errs), err.errs[len(err.errs)-1])
+}
+
+func (err *failoverError) retryEndpoint() AgentEndpoint {
+	return err.endpoint
+}
+
+func (err *failoverError) retryAfter() time.Duration {
+	var d time.Duration
+	for _, e := range err.errs {
+		if terr, ok := e.(retryAfterError); ok && terr.retryAfter() > d {
+			d = terr.retryAfter()
+		}
+	}
+	return d
+}
+
+// FailoverEndpoint implements AgentEndpoint on top of a list of endpoints,
+// tried in order: a payload is written to the active endpoint first, then to
+// the next ones until one succeeds. The active endpoint rotates to the next
+// one after failing failoverThreshold times in a row, and back to the main
+// endpoints every failoverProbeInterval.
+type FailoverEndpoint struct {
+	endpoints []*APIEndpoint
+	names     []string // to tag the failover metrics
+
+	mu           sync.Mutex
+	active       int       // index of the endpoint we try first
+	failures     []int     // consecutive failures per endpoint
+	failedOverAt time.Time // when the active endpoint last rotated
+
+	now func() time.Time
+}
+
+// NewFailoverEndpoint returns a FailoverEndpoint writing to the endpoints
+// configured in conf, the main endpoints first, then the failover ones.
+func NewFailoverEndpoint(conf *config.AgentConfig) *FailoverEndpoint {
+	f := &FailoverEndpoint{
+		endpoints: []*APIEndpoint{NewAPIEndpoint(conf.APIEndpoints, conf.APIKeys)},
+		names:     []string{"main"},
+		now:       time.Now,
+	}
+	for _, e := range conf.APIFailoverEndpoints {
+		f.endpoints = append(f.endpoints, NewAPIEndpoint([]string{e.URL}, []string{e.APIKey}))
+		f.names = append(f.names, e.URL)
+	}
+	f.failures = make([]int, len(f.endpoints))
+
+	return f
+}
+
+// SetProxy makes all the endpoints report via the given proxy
+func (f *FailoverEndpoint) SetProxy(settings *config.ProxySettings) {
+	for _, e := range f.endpoints {
+		e.SetProxy(settings)
+	}
+}
+
+// SetTLSConfig makes all the endpoints connect with the given TLS configuration
+func (f *FailoverEndpoint) SetTLSConfig(tlsConfig *tls.Config) {
+	for _, e := range f.endpoints {
+		e.SetTLSConfig(tlsConfig)
+	}
+}
+
+// SetHTTPClientSettings makes all the endpoints apply the given timeouts and connection pooling
+func (f *FailoverEndpoint) SetHTTPClientSettings(settings config.HTTPClientSettings) {
+	for _, e := range f.endpoints {
+		e.SetHTTPClientSettings(settings)
+	}
+}
+
+// Stop stops all the endpoints
+func (f *FailoverEndpoint) Stop() {
+	for _, e := range f.endpoints {
+		e.Stop()
+	}
+}
+
+// Write writes the payload to the first healthy endpoint
+func (f *FailoverEndpoint) Write(p model.AgentPayload) (int, error) {
+	f.mu.Lock()
+	f.probeMain()
+	active := f.active
+	f.mu.Unlock()
+
+	var size int
+	var errs []error
+
+	for n := 0; n < len(f.endpoints); n++ {
+		i := (active + n) % len(f.endpoints)
+
+		s, err := f.endpoints[i].Write(p)
+		size = s
+		aerr, ok := err.(*apiError)
+		if !ok {
+			// written, or failed for good, in both cases there is
+			// no point in trying the next endpoints
+			f.success(i)
+			return size, err
+		}
+		if len(aerr.endpoint.urls) < len(f.endpoints[i].urls) {
+			// some of the URLs accepted it, it must only be sent
+			// again to the others, not to the next endpoints
+			return size, err
+		}
+
+		errs = append(errs, err)
+		f.failure(i)
+	}
+
+	return size, &failoverError{errs: errs, endpoint: f}
+}
+
+// probeMain makes the main endpoints the active ones again once
+// failoverProbeInterval passed since failing over. It must be called with the
+// lock held.
+func (f *FailoverEndpoint) probeMain() {
+	if f.active == 0 || f.now().Sub(f.failedOverAt) < failoverProbeInterval {
+		return
+	}
+
+	log.Infof("trying endpoint %s again", f.names[0])
+	f.active = 0
+	f.failedOverAt = f.now()
+	// a single failure is enough to fail over again
+	f.failures[0] = failoverThreshold - 1
+}
+
+// success resets the health of an endpoint
+func (f *FailoverEndpoint) success(i int) {
+	f.mu.Lock()
+	f.failures[i] = 0
+	f.mu.Unlock()
+}
+
+// failure accounts for a failed write, rotating the active endpoint if needed
+func (f *FailoverEndpoint) failure(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[i]++
+	if i != f.active || f.failures[i] < failoverThreshold {
+		return
+	}
+
+	from := f.active
+	f.active = (f.active + 1) % len(f.endpoints)
+	f.failures[f.active] = 0
+	f.failedOverAt = f.now()
+
+	log.Warnf("endpoint %s failed %d times in a row, failing over to %s",
+		f.names[from], f.failures[from], f.names[f.active])
+	statsd.Client.Count("datadog.trace_agent.writer.failover", 1,
+		[]string{"from:" + f.names[from], "to:" + f.names[f.active]}, 1)
+}
+
+// WriteServices writes services to the active endpoint
+func (f *FailoverEndpoint) WriteServices(s model.ServicesMetadata) {
+	f.mu.Lock()
+	active := f.active
+	f.mu.Unlock()
+
+	f.endpoints[active].WriteServices(s)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	var primaryHits int64
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&primaryHits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+
+	data := make(chan dataFromAPI, failoverThreshold+1)
+	secondary := newTestServer(t, data)
+	defer secondary.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{primary.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIFailoverEndpoints = []config.APIEndpointSettings{{URL: secondary.URL, APIKey: "backup_key"}}
+
+	f := NewFailoverEndpoint(conf)
+	defer f.Stop()
+
+	for i := 0; i < failoverThreshold; i++ {
+		_, err := f.Write(newTestPayload("test"))
+		assert.Nil(err)
+
+		select {
+		case received := <-data:
+			assert.Equal("/api/v0.1/collector", received.urlPath)
+			assert.Equal([]string{"backup_key"}, received.urlParams["api_key"])
+		case <-time.After(time.Second):
+			t.Fatal("payload did not reach the secondary endpoint")
+		}
+	}
+	assert.Equal(int64(failoverThreshold), atomic.LoadInt64(&primaryHits))
+
+	// the primary failed enough times, the secondary is now tried first
+	assert.Equal(1, f.active)
+	_, err := f.Write(newTestPayload("test"))
+	assert.Nil(err)
+	<-data
+	assert.Equal(int64(failoverThreshold), atomic.LoadInt64(&primaryHits))
+}
+
+func TestFailoverEndpointAllFailing(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := newFailingTestServer(t, http.StatusInternalServerError)
+	defer primary.Close()
+	secondary := newFailingTestServer(t, http.StatusServiceUnavailable)
+	defer secondary.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{primary.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIFailoverEndpoints = []config.APIEndpointSettings{{URL: secondary.URL, APIKey: "backup_key"}}
+
+	f := NewFailoverEndpoint(conf)
+	defer f.Stop()
+
+	_, err := f.Write(newTestPayload("test"))
+	terr, ok := err.(endpointError)
+	assert.True(ok)
+	// the whole chain is retried later
+	assert.Equal(f, terr.retryEndpoint())
+}
+
+func TestFailoverEndpointPartialFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 1)
+	primary := newTestServer(t, data)
+	defer primary.Close()
+	failing := newFailingTestServer(t, http.StatusInternalServerError)
+	defer failing.Close()
+	backupData := make(chan dataFromAPI, 1)
+	secondary := newTestServer(t, backupData)
+	defer secondary.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{primary.URL, failing.URL}
+	conf.APIKeys = []string{"key", "key2"}
+	conf.APIFailoverEndpoints = []config.APIEndpointSettings{{URL: secondary.URL, APIKey: "backup_key"}}
+
+	f := NewFailoverEndpoint(conf)
+	defer f.Stop()
+
+	// only the failing URL is tried again, the backup does not get it
+	_, err := f.Write(newTestPayload("test"))
+	terr, ok := err.(endpointError)
+	assert.True(ok)
+	assert.Equal([]string{failing.URL}, terr.retryEndpoint().(*APIEndpoint).urls)
+	assert.Len(data, 1)
+	assert.Len(backupData, 0)
+	assert.Equal(0, f.active)
+}
+
+func TestFailoverEndpointProbeMain(t *testing.T) {
+	assert := assert.New(t)
+
+	var primaryHits int64
+	primaryStatus := int64(http.StatusInternalServerError)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&primaryHits, 1)
+		w.WriteHeader(int(atomic.LoadInt64(&primaryStatus)))
+	}))
+	defer primary.Close()
+
+	data := make(chan dataFromAPI, failoverThreshold+3)
+	secondary := newTestServer(t, data)
+	defer secondary.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{primary.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIFailoverEndpoints = []config.APIEndpointSettings{{URL: secondary.URL, APIKey: "backup_key"}}
+
+	f := NewFailoverEndpoint(conf)
+	defer f.Stop()
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	for i := 0; i < failoverThreshold; i++ {
+		f.Write(newTestPayload("test"))
+	}
+	assert.Equal(1, f.active)
+
+	// the main endpoint is tried again after a while, a single failure
+	// failing over again
+	now = now.Add(failoverProbeInterval)
+	_, err := f.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal(int64(failoverThreshold+1), atomic.LoadInt64(&primaryHits))
+	assert.Equal(1, f.active)
+	f.Write(newTestPayload("test"))
+	assert.Equal(int64(failoverThreshold+1), atomic.LoadInt64(&primaryHits))
+
+	// until it recovers
+	atomic.StoreInt64(&primaryStatus, http.StatusOK)
+	now = now.Add(failoverProbeInterval)
+	_, err = f.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal(0, f.active)
+	assert.Equal(int64(failoverThreshold+2), atomic.LoadInt64(&primaryHits))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// forcedFlushMinInterval is the minimum time between two flushes forced
+// through the /flush endpoint
+const forcedFlushMinInterval = 10 * time.Second
+
+// forcedFlushTimeout is how long a /flush request waits for the agent to flush
+const forcedFlushTimeout = 5 * time.Second
+
+// flushHandler serves /flush, forcing the agent to flush and ship its sampled
+// traces and stats right away instead of waiting for the next flush tick
+type flushHandler struct {
+	agent *Agent
+
+	mu   sync.Mutex
+	last time.Time // last time a flush was forced
+
+	now func() time.Time
+}
+
+func newFlushHandler(a *Agent) *flushHandler {
+	return &flushHandler{agent: a, now: time.Now}
+}
+
+// authorized tells if the request carries one of the API keys of the agent
+func authorized(req *http.Request, apiKeys []string) bool {
+	key := []byte(req.Header.Get("DD-Api-Key"))
+	if len(key) == 0 {
+		return false
+	}
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare(key, []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// allow tells if a flush can be forced at now, and if so records it
+func (h *flushHandler) allow(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.last.IsZero() && now.Sub(h.last) < forcedFlushMinInterval {
+		return false
+	}
+	h.last = now
+	return true
+}
+
+func (h *flushHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(req, h.agent.conf.APIKeys) {
+		http.Error(w, "invalid API key", http.StatusForbidden)
+		return
+	}
+	if !h.allow(h.now()) {
+		http.Error(w, "too many flush requests", http.StatusTooManyRequests)
+		return
+	}
+
+	// the flush happens in the agent loop, not to race with the regular one
+	reply := make(chan int, 1)
+	select {
+	case h.agent.flushRequests <- reply:
+	case <-time.After(forcedFlushTimeout):
+		http.Error(w, "agent is not flushing", http.StatusServiceUnavailable)
+		return
+	}
+
+	traces := <-reply
+	log.Infof("forced flush of %d traces", traces)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Traces int `json:"traces"`
+	}{traces})
+}
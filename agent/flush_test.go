@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"secret"}
+	conf.APIPayloadQueueSize = 10
+	a := NewAgent(context.Background(), conf)
+
+	// stand for the agent loop, serving the flush requests
+	go func() {
+		for reply := range a.flushRequests {
+			reply <- a.flush()
+		}
+	}()
+	defer close(a.flushRequests)
+
+	now := time.Unix(1500000000, 0)
+	h := newFlushHandler(a)
+	h.now = func() time.Time { return now }
+
+	flush := func(method, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/flush", nil)
+		if key != "" {
+			req.Header.Set("DD-Api-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(http.StatusMethodNotAllowed, flush("GET", "secret").Code)
+	assert.Equal(http.StatusForbidden, flush("POST", "").Code)
+	assert.Equal(http.StatusForbidden, flush("POST", "wrong").Code)
+
+	trace := model.Trace{model.Span{TraceID: 1, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /",
+		Metrics: map[string]float64{model.SpanSamplingPriorityMetricKey: sampler.PriorityUserKeep}}}
+	a.Sampler.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+
+	rec := flush("POST", "secret")
+	assert.Equal(http.StatusOK, rec.Code)
+	var resp struct{ Traces int }
+	assert.Nil(json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(1, resp.Traces)
+
+	// the flush path ran, the traces went to the writer
+	select {
+	case p := <-a.Writer.inPayloads:
+		assert.Len(p.Traces, 1)
+	default:
+		t.Fatal("no payload sent to the writer")
+	}
+
+	// forced flushes are rate limited
+	now = now.Add(forcedFlushMinInterval / 2)
+	assert.Equal(http.StatusTooManyRequests, flush("POST", "secret").Code)
+
+	now = now.Add(forcedFlushMinInterval)
+	rec = flush("POST", "secret")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Nil(json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(0, resp.Traces)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// flushStallIntervals is how many flush intervals can go by without a
+// completed flush before the agent reports itself unhealthy
+const flushStallIntervals = 3
+
+// flushWatchdog serves /health, reporting the agent unhealthy when its flushes
+// stall: a deadlocked flush, or a writer blocking it, leaves the agent running
+// but shipping nothing. It runs out of the agent loop, which a stalled flush
+// blocks too.
+type flushWatchdog struct {
+	interval time.Duration
+
+	last    int64 // unix time in nanoseconds of the last completed flush, atomic
+	stalled int32 // 1 while the stall is reported, atomic
+
+	now  func() time.Time
+	exit chan struct{}
+}
+
+func newFlushWatchdog(interval time.Duration) *flushWatchdog {
+	w := &flushWatchdog{
+		interval: interval,
+		now:      time.Now,
+		exit:     make(chan struct{}),
+	}
+	// the agent gets as much time for its first flush
+	w.flushed()
+	return w
+}
+
+// flushed records that a flush just completed
+func (w *flushWatchdog) flushed() {
+	atomic.StoreInt64(&w.last, w.now().UnixNano())
+}
+
+// since returns the time since the last completed flush
+func (w *flushWatchdog) since() time.Duration {
+	return w.now().Sub(time.Unix(0, atomic.LoadInt64(&w.last)))
+}
+
+// check tells if the flushes are stalled, logging when it starts and stops
+func (w *flushWatchdog) check() bool {
+	since := w.since()
+	stalled := since > flushStallIntervals*w.interval
+
+	if stalled {
+		if atomic.CompareAndSwapInt32(&w.stalled, 0, 1) {
+			log.Errorf("no flush completed for %s, the agent is not shipping anything, flush interval: %s", since, w.interval)
+		}
+	} else if atomic.CompareAndSwapInt32(&w.stalled, 1, 0) {
+		log.Infof("flushes resumed")
+	}
+
+	return stalled
+}
+
+// Run periodically checks the flushes until Stop is called
+func (w *flushWatchdog) Run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var v float64
+			if w.check() {
+				v = 1
+			}
+			statsd.Client.Gauge("datadog.trace_agent.flush.stalled", v, nil, 1)
+		case <-w.exit:
+			return
+		}
+	}
+}
+
+// Stop stops Run
+func (w *flushWatchdog) Stop() {
+	close(w.exit)
+}
+
+func (w *flushWatchdog) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	since := w.since()
+	if w.check() {
+		http.Error(rw, fmt.Sprintf("flush stalled, last one completed %s ago", since), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(rw, "OK, last flush completed %s ago\n", since)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushWatchdog(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1500000000, 0)
+	w := newFlushWatchdog(10 * time.Second)
+	w.now = func() time.Time { return now }
+	w.flushed()
+
+	health := func() int {
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		return rec.Code
+	}
+
+	assert.Equal(http.StatusOK, health())
+
+	// a late flush is fine
+	now = now.Add(25 * time.Second)
+	assert.False(w.check())
+	assert.Equal(http.StatusOK, health())
+
+	// but not missing several of them
+	now = now.Add(10 * time.Second)
+	assert.True(w.check())
+	assert.Equal(http.StatusServiceUnavailable, health())
+
+	w.flushed()
+	assert.False(w.check())
+	assert.Equal(http.StatusOK, health())
+}
+
+func TestFlushWatchdogStalledFlusher(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newFlushWatchdog(10 * time.Millisecond)
+	watchdogDone := make(chan struct{})
+	go func() {
+		w.Run()
+		close(watchdogDone)
+	}()
+	defer func() {
+		w.Stop()
+		<-watchdogDone
+	}()
+
+	// a flusher which gets stuck, like on a deadlock or a blocked writer
+	var stuck sync.Mutex
+	stuck.Lock()
+	flusherDone := make(chan struct{})
+	go func() {
+		defer close(flusherDone)
+		for i := 0; i < 5; i++ {
+			w.flushed()
+			time.Sleep(5 * time.Millisecond)
+		}
+		stuck.Lock()
+		w.flushed()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&w.stalled) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the watchdog did not trip on a stalled flusher")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(w.since() > flushStallIntervals*w.interval)
+
+	// and recovers once the flushes are back
+	stuck.Unlock()
+	<-flusherDone
+	assert.False(w.check())
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// hostTagsProvider collects tags describing the host the agent runs on, such
+// as its cloud region, from one source
+type hostTagsProvider interface {
+	// Name identifies the provider in the logs
+	Name() string
+	// Tags returns the tags of the host, or an error when they are not
+	// available, e.g. because the host does not run on that cloud
+	Tags() (map[string]string, error)
+}
+
+// hostTagsCollector merges the tags of several providers, in order, and
+// caches them for ttl: the providers query remote endpoints, too slow to do
+// at each flush. A failing provider is retried after ttl too, meanwhile its
+// last tags, if any, are still used.
+type hostTagsCollector struct {
+	providers []hostTagsProvider
+	ttl       time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	tags     map[string]string
+	byName   map[string]map[string]string // the last tags of each provider
+	expireAt time.Time
+}
+
+func newHostTagsCollector(providers []hostTagsProvider, ttl time.Duration) *hostTagsCollector {
+	return &hostTagsCollector{
+		providers: providers,
+		ttl:       ttl,
+		now:       time.Now,
+		byName:    make(map[string]map[string]string),
+	}
+}
+
+// newHostTagsCollectorFromConfig returns the collector of the providers
+// enabled in conf, nil if there is none
+func newHostTagsCollectorFromConfig(conf *config.AgentConfig) *hostTagsCollector {
+	var providers []hostTagsProvider
+	for _, name := range conf.HostTagsProviders {
+		switch name {
+		case config.HostTagsProviderEC2:
+			providers = append(providers, newEC2TagsProvider())
+		case config.HostTagsProviderContainer:
+			providers = append(providers, &containerTagsProvider{path: "/proc/self/cgroup"})
+		}
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+	return newHostTagsCollector(providers, conf.HostTagsTTL)
+}
+
+// Tags returns the tags of the host, refreshing them if they expired. They
+// must not be modified. It is nil-safe, a nil collector has no tags.
+func (c *hostTagsCollector) Tags() map[string]string {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.tags != nil && now.Before(c.expireAt) {
+		return c.tags
+	}
+
+	for _, p := range c.providers {
+		tags, err := p.Tags()
+		if err != nil {
+			log.Debugf("cannot collect host tags from %s: %v", p.Name(), err)
+			continue
+		}
+		c.byName[p.Name()] = tags
+	}
+
+	merged := make(map[string]string)
+	for _, p := range c.providers {
+		for k, v := range c.byName[p.Name()] {
+			merged[k] = v
+		}
+	}
+	c.tags = merged
+	c.expireAt = now.Add(c.ttl)
+
+	return c.tags
+}
+
+// ec2MetadataURL is the root of the EC2 instance metadata
+const ec2MetadataURL = "http://169.254.169.254/latest/meta-data"
+
+// ec2TagsProvider reads the placement and type of an EC2 instance from its
+// metadata endpoint
+type ec2TagsProvider struct {
+	url    string
+	client *http.Client
+}
+
+func newEC2TagsProvider() *ec2TagsProvider {
+	// the endpoint is local, a host out of EC2 should not hold the flush
+	return &ec2TagsProvider{url: ec2MetadataURL, client: &http.Client{Timeout: 300 * time.Millisecond}}
+}
+
+func (p *ec2TagsProvider) Name() string { return config.HostTagsProviderEC2 }
+
+func (p *ec2TagsProvider) Tags() (map[string]string, error) {
+	zone, err := p.get("placement/availability-zone")
+	if err != nil {
+		return nil, err
+	}
+	instanceType, err := p.get("instance-type")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{
+		"availability-zone": zone,
+		"instance-type":     instanceType,
+	}
+	// the region is the zone without its letter, e.g. us-east-1 for us-east-1a
+	if len(zone) > 1 {
+		tags["region"] = zone[:len(zone)-1]
+	}
+	return tags, nil
+}
+
+func (p *ec2TagsProvider) get(path string) (string, error) {
+	resp, err := p.client.Get(p.url + "/" + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected status %s", path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// containerIDPattern matches the container IDs in the cgroup paths, e.g.
+// /docker/<id> or /kubepods/burstable/pod<uid>/<id>
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerTagsProvider finds the ID of the container the agent runs in
+// from its cgroups
+type containerTagsProvider struct {
+	path string
+}
+
+func (p *containerTagsProvider) Name() string { return config.HostTagsProviderContainer }
+
+func (p *containerTagsProvider) Tags() (map[string]string, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := containerIDPattern.FindString(scanner.Text()); id != "" {
+			return map[string]string{"container_id": id}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no container ID in %s", p.path)
+}
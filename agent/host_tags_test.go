@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// fakeTagsProvider returns tags, or err, and counts its calls
+type fakeTagsProvider struct {
+	name  string
+	tags  map[string]string
+	err   error
+	calls int
+}
+
+func (p *fakeTagsProvider) Name() string { return p.name }
+
+func (p *fakeTagsProvider) Tags() (map[string]string, error) {
+	p.calls++
+	return p.tags, p.err
+}
+
+func TestHostTagsCollector(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := &fakeTagsProvider{name: "cloud", tags: map[string]string{"region": "us-east-1", "instance-type": "m4.large"}}
+	container := &fakeTagsProvider{name: "container", err: errors.New("not in a container")}
+	c := newHostTagsCollector([]hostTagsProvider{cloud, container}, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	// the failing provider is skipped
+	assert.Equal(map[string]string{"region": "us-east-1", "instance-type": "m4.large"}, c.Tags())
+
+	// cached
+	c.Tags()
+	assert.Equal(1, cloud.calls)
+
+	// refreshed once expired, keeping the last tags of a provider failing since
+	now = now.Add(time.Minute)
+	cloud.err = errors.New("metadata endpoint down")
+	container.tags, container.err = map[string]string{"container_id": "abc"}, nil
+	assert.Equal(map[string]string{"region": "us-east-1", "instance-type": "m4.large", "container_id": "abc"}, c.Tags())
+	assert.Equal(2, cloud.calls)
+
+	// without provider, no tags
+	var none *hostTagsCollector
+	assert.Nil(none.Tags())
+	assert.Nil(newHostTagsCollectorFromConfig(config.NewDefaultAgentConfig()))
+}
+
+func TestAgentFlushHostTags(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	a := NewAgent(context.Background(), conf)
+	a.hostTags = newHostTagsCollector([]hostTagsProvider{
+		&fakeTagsProvider{name: "fake", tags: map[string]string{"availability-zone": "us-east-1a"}},
+	}, time.Minute)
+
+	a.flush()
+	p := <-a.Writer.inPayloads
+	assert.Equal(map[string]string{"availability-zone": "us-east-1a"}, p.Tags)
+}
+
+func TestEC2TagsProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/placement/availability-zone":
+			w.Write([]byte("eu-west-3b"))
+		case "/instance-type":
+			w.Write([]byte("c5.xlarge\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := newEC2TagsProvider()
+	p.url = server.URL
+	tags, err := p.Tags()
+	assert.NoError(err)
+	assert.Equal(map[string]string{"availability-zone": "eu-west-3b", "region": "eu-west-3", "instance-type": "c5.xlarge"}, tags)
+
+	p.url = server.URL + "/missing"
+	_, err = p.Tags()
+	assert.Error(err)
+}
+
+func TestContainerTagsProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "trace-agent-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	id := "3726184226f5d3147c25fdeab5b60097e378e8a720503a5e19ecfdf29f869860"
+	f.WriteString("12:memory:/\n11:cpu,cpuacct:/kubepods/burstable/pod2e5cc3b2/" + id + "\n")
+	f.Close()
+
+	p := &containerTagsProvider{path: f.Name()}
+	tags, err := p.Tags()
+	assert.NoError(err)
+	assert.Equal(map[string]string{"container_id": id}, tags)
+
+	p.path = "/does-not-exist"
+	_, err = p.Tags()
+	assert.Error(err)
+}
@@ -5,6 +5,7 @@ import (
 	"expvar" // automatically publish `/debug/vars` on HTTP port
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -170,19 +171,11 @@ func initInfo(conf *config.AgentConfig) error {
 		expvar.Publish("sampler", expvar.Func(publishSamplerInfo))
 		expvar.Publish("watchdog", expvar.Func(publishWatchdogInfo))
 
-		c := *conf
-		c.APIKeys = nil // should not be exported by JSON, but just to make sure
-		var buf []byte
-		buf, err = json.Marshal(&c)
-		if err != nil {
-			return
-		}
-
 		// We keep a static copy of the config, already marshalled and stored
 		// as a plain string. This saves the hassle of rebuilding it all the time
 		// and avoids race issues as the source object is never used again.
 		// Config is parsed at the beginning and never changed again, anyway.
-		expvar.Publish("config", infoString(string(buf)))
+		expvar.Publish("config", infoString(conf.RedactedString()))
 
 		infoTmpl, err = template.New("info").Funcs(funcMap).Parse(infoTmplSrc)
 		if err != nil {
@@ -203,6 +196,24 @@ func initInfo(conf *config.AgentConfig) error {
 	return err
 }
 
+// configHandler serves the effective config of the running agent, as
+// resolved from the config files and the environment, with secrets redacted.
+// Like /flush, it requires one of the API keys of the agent, for it may be
+// served along with the traces.
+func configHandler(conf *config.AgentConfig) http.HandlerFunc {
+	// config is never changed once parsed, marshal it once and for all
+	redacted := conf.RedactedString()
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(req, conf.APIKeys) {
+			http.Error(w, "invalid API key", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, redacted)
+	}
+}
+
 // StatusInfo is what we use to parse expvar response.
 // It does not need to contain all the fields, only those we need
 // to display when called with `-info` as JSON unmarshaller will
@@ -292,11 +303,16 @@ func getProgramBanner(version string) (string, string) {
 // -----8<-------------------------------------------------------
 //
 func Info(w io.Writer, conf *config.AgentConfig) error {
-	host := conf.ReceiverHost
-	if host == "0.0.0.0" {
-		host = "127.0.0.1" // [FIXME:christian] not fool-proof
+	host, port := conf.ReceiverHost, conf.ReceiverPort
+	if conf.DebugPort > 0 {
+		// the debug endpoints are served on their own listener
+		host, port = conf.DebugHost, conf.DebugPort
+	}
+	if host == "" || host == "0.0.0.0" {
+		// listening on all the interfaces, the loopback one included
+		host = "127.0.0.1"
 	}
-	url := "http://localhost:" + strconv.Itoa(conf.ReceiverPort) + "/debug/vars"
+	url := "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/debug/vars"
 	client := http.Client{Timeout: 3 * time.Second}
 	resp, err := client.Get(url)
 	if err != nil {
@@ -312,7 +328,7 @@ func Info(w io.Writer, conf *config.AgentConfig) error {
 		}{
 			Banner:       banner,
 			Program:      program,
-			ReceiverPort: conf.ReceiverPort,
+			ReceiverPort: port,
 		})
 		return err
 	}
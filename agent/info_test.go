@@ -315,6 +315,34 @@ func TestError(t *testing.T) {
 	assert.Equal("", lines[7])
 }
 
+func TestInfoDebugListener(t *testing.T) {
+	assert := assert.New(t)
+	conf := testInit(t)
+	assert.NotNil(conf)
+
+	server := testServerError(t)
+	defer server.Close()
+
+	url, err := url.Parse(server.URL)
+	assert.Nil(err)
+	port, err := strconv.Atoi(url.Port())
+	assert.Nil(err)
+
+	// the debug listener, on all the interfaces, is queried on the loopback one
+	for _, host := range []string{"0.0.0.0", ""} {
+		conf.ReceiverHost = "192.0.2.1"
+		conf.ReceiverPort = 1
+		conf.DebugHost = host
+		conf.DebugPort = port
+
+		var buf bytes.Buffer
+		assert.NotNil(Info(&buf, conf))
+		lines := strings.Split(buf.String(), "\n")
+		assert.Equal(8, len(lines), host)
+		assert.Equal(fmt.Sprintf("  URL: http://127.0.0.1:%d/debug/vars", port), lines[5], host)
+	}
+}
+
 func TestInfoReceiverStats(t *testing.T) {
 	assert := assert.New(t)
 	conf := testInit(t)
@@ -382,6 +410,7 @@ func TestInfoConfig(t *testing.T) {
 
 	js := expvar.Get("config").String() // this is what expvar will call
 	assert.NotEqual("", js)
+	assert.NotContains(js, "ooops", "API Keys should *NEVER* be exported")
 	var confCopy config.AgentConfig
 	err := json.Unmarshal([]byte(js), &confCopy)
 	assert.Nil(err)
@@ -389,3 +418,41 @@ func TestInfoConfig(t *testing.T) {
 	conf.APIKeys = nil            // patch upstream source so that we can use equality testing
 	assert.Equal(*conf, confCopy) // ensure all fields have been exported then parsed correctly
 }
+
+func TestInfoConfigHandler(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"ooops"}
+	conf.APIFailoverEndpoints = []config.APIEndpointSettings{{URL: "https://backup.example.com", APIKey: "ooops_failover"}}
+	conf.Proxy = &config.ProxySettings{Host: "proxy.example.com", Port: 3128, User: "user", Password: "ooops_proxy"}
+
+	server := httptest.NewServer(configHandler(conf))
+	defer server.Close()
+
+	// the API key is required
+	resp, err := http.Get(server.URL + "/config")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	req, err := http.NewRequest("GET", server.URL+"/config", nil)
+	assert.Nil(err)
+	req.Header.Set("DD-Api-Key", "ooops")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(resp.Body)
+	assert.Nil(err)
+	assert.NotContains(buf.String(), "ooops", "secrets should *NEVER* be exported")
+
+	var confCopy config.AgentConfig
+	assert.Nil(json.Unmarshal(buf.Bytes(), &confCopy))
+	assert.Equal(conf.ReceiverPort, confCopy.ReceiverPort)
+	assert.Equal("https://backup.example.com", confCopy.APIFailoverEndpoints[0].URL)
+	assert.Equal("proxy.example.com", confCopy.Proxy.Host)
+	assert.Contains(buf.String(), `"APIKeys":["***"]`)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// jitteredInterval gives intervals randomly spread around a base interval,
+// so that agents started together do not all flush to the API at once
+type jitteredInterval struct {
+	interval time.Duration
+	jitter   float64 // the intervals are within interval*(1±jitter)
+	rand     *rand.Rand
+}
+
+// newJitteredInterval returns intervals of interval ± jitter (a fraction of
+// it), jitter <= 0 disables it. The random sequence is seeded from hostname,
+// different hosts spreading differently.
+func newJitteredInterval(interval time.Duration, jitter float64, hostname string) *jitteredInterval {
+	h := fnv.New64a()
+	h.Write([]byte(hostname))
+	return &jitteredInterval{
+		interval: interval,
+		jitter:   jitter,
+		rand:     rand.New(rand.NewSource(int64(h.Sum64()))),
+	}
+}
+
+// setJitter changes the jitter of the next intervals, it is not safe for
+// concurrent use
+func (j *jitteredInterval) setJitter(jitter float64) {
+	j.jitter = jitter
+}
+
+// next returns the next interval, it is not safe for concurrent use
+func (j *jitteredInterval) next() time.Duration {
+	if j.jitter <= 0 {
+		return j.interval
+	}
+	offset := j.jitter * (2*j.rand.Float64() - 1)
+	return time.Duration(float64(j.interval) * (1 + offset))
+}
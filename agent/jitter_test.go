@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitteredInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	j := newJitteredInterval(10*time.Second, 0.2, "host1")
+	seen := make(map[time.Duration]struct{})
+	var intervals []time.Duration
+	for i := 0; i < 100; i++ {
+		d := j.next()
+		assert.True(d >= 8*time.Second && d <= 12*time.Second, "interval %s out of the jitter band", d)
+		seen[d] = struct{}{}
+		intervals = append(intervals, d)
+	}
+	assert.True(len(seen) > 50, "only %d distinct intervals", len(seen))
+
+	// seeded per host
+	same := newJitteredInterval(10*time.Second, 0.2, "host1")
+	other := newJitteredInterval(10*time.Second, 0.2, "host2")
+	differ := false
+	for _, d := range intervals {
+		assert.Equal(d, same.next())
+		if other.next() != d {
+			differ = true
+		}
+	}
+	assert.True(differ, "different hosts should get different intervals")
+
+	// disabled
+	j = newJitteredInterval(10*time.Second, 0, "host1")
+	for i := 0; i < 10; i++ {
+		assert.Equal(10*time.Second, j.next())
+	}
+}
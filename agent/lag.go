@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// lagSummary returns the summary of how long after their end, in
+// nanoseconds, the traces are flushed at now. A growing lag is the sign of
+// backpressure, before traces get dropped.
+func lagSummary(traces []model.Trace, now int64) *quantile.SliceSummary {
+	s := quantile.NewSliceSummaryWithUnit(quantile.Nanosecond)
+	for i, t := range traces {
+		if len(t) == 0 {
+			continue
+		}
+		lag := now - t.GetRoot().End()
+		if lag < 0 {
+			// clock skew with the client, not a lag
+			lag = 0
+		}
+		s.Insert(float64(lag), uint64(i))
+	}
+	return s
+}
+
+// reportLag emits the median and 99th percentile of the lag of the traces
+// flushed at now, in seconds
+func reportLag(traces []model.Trace, now int64) {
+	if len(traces) == 0 {
+		return
+	}
+	s := lagSummary(traces, now)
+	statsd.Client.Gauge("datadog.trace_agent.lag.p50",
+		time.Duration(s.Quantile(0.5)).Seconds(), nil, 1)
+	statsd.Client.Gauge("datadog.trace_agent.lag.p99",
+		time.Duration(s.Quantile(0.99)).Seconds(), nil, 1)
+}
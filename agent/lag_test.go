@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+)
+
+func TestLagSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+
+	// traces ending 1s to 100s before the flush, with a 1s long root
+	var traces []model.Trace
+	for i := 1; i <= 100; i++ {
+		end := now - int64(i)*int64(time.Second)
+		traces = append(traces, model.Trace{
+			{TraceID: uint64(i), SpanID: 1, Start: end - int64(time.Second), Duration: int64(time.Second)},
+			{TraceID: uint64(i), SpanID: 2, ParentID: 1, Start: end - int64(time.Second), Duration: 1},
+		})
+	}
+	// ignored
+	traces = append(traces, model.Trace{})
+
+	s := lagSummary(traces, now)
+	assert.Equal(quantile.Nanosecond, s.Unit)
+	assert.Equal(int64(100), s.N)
+	assert.InDelta(float64(50*time.Second), s.Quantile(0.5), float64(2*time.Second))
+	assert.InDelta(float64(99*time.Second), s.Quantile(0.99), float64(2*time.Second))
+	assert.Equal(float64(time.Second), s.Quantile(0))
+	assert.Equal(float64(100*time.Second), s.Quantile(1))
+
+	// traces from the future, client clocks are not always in sync
+	future := model.Trace{{TraceID: 1, SpanID: 1, Start: now + int64(time.Minute), Duration: 1}}
+	assert.Equal(0.0, lagSummary([]model.Trace{future}, now).Quantile(1))
+}
@@ -31,9 +31,17 @@ func NewStoppableListener(l net.Listener, exit chan struct{}, conns int) (*Stopp
 
 // Refresh periodically refreshes the connection lease, and thus cancels any rate limits in place
 func (sl *StoppableListener) Refresh(conns int) {
-	for range time.Tick(30 * time.Second) {
-		atomic.StoreInt32(&sl.connLease, int32(conns))
-		log.Debugf("Refreshed the connection lease: %d conns available", conns)
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			atomic.StoreInt32(&sl.connLease, int32(conns))
+			log.Debugf("Refreshed the connection lease: %d conns available", conns)
+		case <-sl.exit:
+			return
+		}
 	}
 }
 
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -16,29 +20,113 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
 	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
-// handleSignal closes a channel to exit cleanly from routines
-func handleSignal(exit chan struct{}) {
+// handleSignal cancels the agent context to exit cleanly from routines
+func handleSignal(cancel context.CancelFunc) {
 	sigChan := make(chan os.Signal, 10)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	handleSignals(sigChan, cancel, func(code int) {
+		log.Flush()
+		os.Exit(code)
+	})
+}
+
+// handleSignals cancels the agent context on the first termination signal
+// received from sigChan, to exit cleanly. Since a clean exit waits for the
+// pending data to be flushed, a second termination signal calls exit instead,
+// as a way out of a stuck shutdown.
+func handleSignals(sigChan <-chan os.Signal, cancel context.CancelFunc, exit func(code int)) {
+	terminating := false
 	for signo := range sigChan {
 		switch signo {
 		case syscall.SIGINT, syscall.SIGTERM:
+			if terminating {
+				log.Warnf("received signal %d (%v) again, exiting now", signo, signo)
+				exit(1)
+				return
+			}
 			log.Infof("received signal %d (%v)", signo, signo)
-			close(exit)
-			return
+			terminating = true
+			cancel()
 		default:
 			log.Warnf("unhandled signal %d (%v)", signo, signo)
 		}
 	}
 }
 
+// loadConfig reads the configuration files (when they exist), merges them with
+// the environment and returns the resulting AgentConfig. If none exist, it
+// fails if requireConfig, else the environment must be enough to run.
+func loadConfig(ddConfigFile, configFile string, requireConfig bool) (*config.AgentConfig, error) {
+	// a missing configuration file is fine since the agent can be
+	// configured with environment variables only, but a broken one is
+	// not, we would silently run with something else than intended
+	legacyConf, err := config.New(configFile)
+	switch err {
+	case nil:
+		log.Infof("using legacy configuration from %s", configFile)
+	case config.ErrConfigNotFound:
+		log.Warnf("ignoring %s: %v", configFile, err)
+	default:
+		return nil, err
+	}
+
+	conf, err := config.New(ddConfigFile)
+	switch err {
+	case nil:
+		log.Infof("using configuration from %s", ddConfigFile)
+	case config.ErrConfigNotFound:
+		log.Warnf("ignoring %s: %v", ddConfigFile, err)
+	default:
+		return nil, err
+	}
+
+	if conf != nil || legacyConf != nil {
+		return config.NewAgentConfig(conf, legacyConf)
+	}
+
+	if requireConfig {
+		return nil, fmt.Errorf("no configuration file found at %s nor %s, create one of them or point to it with -ddconfig or -config",
+			ddConfigFile, configFile)
+	}
+	log.Warn("no configuration file found, using the environment and the defaults only")
+	agentConf, err := config.NewAgentConfig(nil, nil)
+	if verr, ok := err.(*config.ValidationError); ok {
+		// say why the environment alone was used, rather than what it lacks only
+		err = &config.ValidationError{Err: fmt.Errorf("no configuration file found at %s nor %s, and the environment is not enough to run: %v",
+			ddConfigFile, configFile, verr.Err)}
+	}
+	return agentConf, err
+}
+
+// checkConfig writes the effective configuration to w, or the reason why it
+// is invalid, and returns a non-nil error in the latter case.
+func checkConfig(w io.Writer, conf *config.AgentConfig, err error) error {
+	if err == nil {
+		err = conf.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Invalid configuration: %v\n", err)
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(conf.RedactedString()), "", "  "); err != nil {
+		fmt.Fprintf(w, "Cannot display configuration: %v\n", err)
+		return err
+	}
+	fmt.Fprintf(w, "Configuration OK\n%s\n", buf.String())
+	return nil
+}
+
 // die logs an error message and makes the program exit immediately.
 func die(format string, args ...interface{}) {
-	if opts.info || opts.version {
+	if opts.info || opts.version || opts.checkConfig || opts.decodeSummary != "" || opts.replayTraces != "" {
 		// here, we've silenced the logger, and just want plain console output
 		fmt.Printf(format, args...)
 		fmt.Print("")
@@ -56,6 +144,13 @@ var opts struct {
 	logLevel     string
 	version      bool
 	info         bool
+	checkConfig  bool
+	// requireConfig refuses to run from the environment only
+	requireConfig bool
+	// decodeSummary is the file to decode with the decode-summary subcommand
+	decodeSummary string
+	// replayTraces is the file to replay with the replay-traces subcommand
+	replayTraces string
 	cpuprofile   string
 	memprofile   string
 }
@@ -105,21 +200,43 @@ func init() {
 	flag.StringVar(&opts.configFile, "config", "/etc/datadog/trace-agent.ini", "Trace agent ini config file.")
 	flag.BoolVar(&opts.version, "version", false, "Show version information and exit")
 	flag.BoolVar(&opts.info, "info", false, "Show info about running trace agent process and exit")
+	flag.BoolVar(&opts.checkConfig, "check-config", false, "Validate the configuration, print the effective settings and exit")
+	flag.BoolVar(&opts.requireConfig, "require-config", false, "Exit if none of the config files exist, instead of using the environment only")
 
 	// profiling arguments
 	flag.StringVar(&opts.cpuprofile, "cpuprofile", "", "Write cpu profile to file")
 	flag.StringVar(&opts.memprofile, "memprofile", "", "Write memory profile to `file`")
 
 	flag.Parse()
+
+	if flag.Arg(0) == decodeSummaryCommand {
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s %s <file>\n", os.Args[0], decodeSummaryCommand)
+			os.Exit(2)
+		}
+		opts.decodeSummary = flag.Arg(1)
+	}
+
+	if flag.Arg(0) == replayTracesCommand {
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s %s <file>\n", os.Args[0], replayTracesCommand)
+			os.Exit(2)
+		}
+		opts.replayTraces = flag.Arg(1)
+	}
 }
 
 // main is the entrypoint of our code
 func main() {
 	// configure a default logger before anything so we can observe initialization
-	if opts.info || opts.version {
+	if opts.info || opts.version || opts.checkConfig || opts.decodeSummary != "" || opts.replayTraces != "" {
 		log.UseLogger(log.Disabled)
 	} else {
-		config.NewLoggerLevelCustom("DEBUG", "/var/log/datadog/trace-agent.log")
+		logFile := config.DefaultLogFilePath
+		if v := os.Getenv("DD_LOG_FILE"); v != "" {
+			logFile = v
+		}
+		config.NewLoggerLevelCustom("DEBUG", logFile)
 		defer log.Flush()
 	}
 
@@ -141,32 +258,29 @@ func main() {
 		return
 	}
 
-	// Instantiate the config
-	var agentConf *config.AgentConfig
-	var err error
-
-	// if a configuration file cannot be loaded, log an error but do not
-	// panic since the agent can be configured with environment variables
-	// only.
-	legacyConf, err := config.NewIfExists(opts.configFile)
-	if err != nil {
-		log.Errorf("%s: %v", opts.configFile, err)
-		log.Warnf("ignoring %s", opts.configFile)
-	}
-	if legacyConf != nil {
-		log.Infof("using legacy configuration from %s", opts.configFile)
+	if opts.decodeSummary != "" {
+		if err := decodeSummary(os.Stdout, opts.decodeSummary); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	conf, err := config.NewIfExists(opts.ddConfigFile)
-	if err != nil {
-		log.Errorf("%s: %v", opts.ddConfigFile, err)
-		log.Warnf("ignoring %s", opts.ddConfigFile)
+	agentConf, err := loadConfig(opts.ddConfigFile, opts.configFile, opts.requireConfig)
+	if opts.checkConfig {
+		if err := checkConfig(os.Stdout, agentConf, err); err != nil {
+			os.Exit(1)
+		}
+		return
 	}
-	if conf != nil {
-		log.Infof("using configuration from %s", opts.ddConfigFile)
+	if _, invalid := err.(*config.ValidationError); opts.replayTraces != "" && (err == nil || invalid) {
+		// only the sampler settings matter, e.g. no API key is needed
+		if err := replayTraces(os.Stdout, agentConf, opts.replayTraces); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
 	}
-
-	agentConf, err = config.NewAgentConfig(conf, legacyConf)
 	if err != nil {
 		die("%v", err)
 	}
@@ -200,25 +314,49 @@ func main() {
 	if err != nil {
 		die("cannot create logger: %v", err)
 	}
+	log.Debugf("effective configuration: %s", agentConf.RedactedString())
+	traceLog.SetEvery(agentConf.LogSampleEvery)
+
+	model.GlobalAgentPayloadCompression = agentConf.APIPayloadCompression
+	model.GlobalRootBySpanKind = agentConf.RootBySpanKind
 
 	// Initialize dogstatsd client
 	err = statsd.Configure(agentConf)
 	if err != nil {
 		die("cannot configure dogstatsd: %v", err)
 	}
+	if statsd.Prometheus != nil {
+		// served by the receiver, along with the other debug endpoints
+		http.Handle("/metrics", statsd.Prometheus)
+	}
+
+	// summaries are compressed every few inserts, only report some of them
+	quantile.OnCompress = func(entries int, d time.Duration) {
+		statsd.Client.Histogram("datadog.trace_agent.distribution.compress_duration", d.Seconds(), nil, 0.01)
+	}
 
 	// Seed rand
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	agent := NewAgent(agentConf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Handle stops properly
-	watchdog.Go(func() {
-		handleSignal(agent.exit)
-	})
+	agent := NewAgent(ctx, agentConf)
+	agent.registerHandlers(http.DefaultServeMux)
 
 	log.Infof("trace-agent running on host %s", agentConf.HostName)
-	agent.Run()
+	isService, err := runService(agent.Run, cancel)
+	if err != nil {
+		die("cannot run as a service: %v", err)
+	}
+	if !isService {
+		// Handle stops properly
+		watchdog.Go(func() {
+			handleSignal(cancel)
+		})
+
+		agent.Run()
+	}
 
 	// collect memory profile
 	if opts.memprofile != "" {
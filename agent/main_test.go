@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+func writeTestConfig(t *testing.T, lines ...string) string {
+	f, err := ioutil.TempFile("", "trace-agent-check-config")
+	if err != nil {
+		t.Fatalf("cannot create config file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(lines, "\n")); err != nil {
+		t.Fatalf("cannot write config file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := writeTestConfig(t,
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.sampler]",
+		"extra_sample_rate = 0.5",
+	)
+	defer os.Remove(valid)
+
+	conf, err := loadConfig(valid, "/does-not-exist", false)
+	var buf bytes.Buffer
+	assert.Nil(checkConfig(&buf, conf, err))
+	assert.Contains(buf.String(), "Configuration OK")
+	assert.Contains(buf.String(), `"HostName": "thing"`)
+	assert.NotContains(buf.String(), "apikey_12")
+
+	invalid := writeTestConfig(t,
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.sampler]",
+		"extra_sample_rate = 3",
+	)
+	defer os.Remove(invalid)
+
+	conf, err = loadConfig(invalid, "/does-not-exist", false)
+	buf.Reset()
+	assert.NotNil(checkConfig(&buf, conf, err))
+	assert.Contains(buf.String(), "Invalid configuration")
+
+	badRules := writeTestConfig(t,
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.sampler]",
+		"sampling_rules = service=web => 1, service => 1",
+	)
+	defer os.Remove(badRules)
+
+	conf, err = loadConfig(badRules, "/does-not-exist", false)
+	buf.Reset()
+	assert.NotNil(checkConfig(&buf, conf, err))
+	assert.Contains(buf.String(), "invalid sampling rule")
+
+	// a missing file is ignored, but not a malformed one
+	malformed := writeTestConfig(t,
+		"[Main",
+		"api_key = apikey_12",
+	)
+	defer os.Remove(malformed)
+
+	conf, err = loadConfig(valid, malformed, false)
+	assert.IsType(&config.ParseError{}, err)
+	buf.Reset()
+	assert.NotNil(checkConfig(&buf, conf, err))
+	assert.Contains(buf.String(), malformed)
+}
+
+func TestLoadConfigWithoutFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.Setenv("DD_API_KEY", os.Getenv("DD_API_KEY"))
+	os.Setenv("DD_API_KEY", "")
+
+	// the environment alone lacks the API key
+	conf, err := loadConfig("/does-not-exist/datadog.conf", "/does-not-exist/trace-agent.ini", false)
+	assert.IsType(&config.ValidationError{}, err)
+	assert.NotNil(conf)
+	assert.Contains(err.Error(), "no configuration file found at /does-not-exist/datadog.conf nor /does-not-exist/trace-agent.ini")
+	assert.Contains(err.Error(), "DD_API_KEY")
+
+	// which is enough, unless a file is required
+	os.Setenv("DD_API_KEY", "apikey_from_env")
+	conf, err = loadConfig("/does-not-exist/datadog.conf", "/does-not-exist/trace-agent.ini", false)
+	assert.Nil(err)
+	assert.Equal([]string{"apikey_from_env"}, conf.APIKeys)
+
+	conf, err = loadConfig("/does-not-exist/datadog.conf", "/does-not-exist/trace-agent.ini", true)
+	assert.Nil(conf)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "-ddconfig")
+}
+
+func TestHandleSignals(t *testing.T) {
+	assert := assert.New(t)
+
+	sigChan := make(chan os.Signal, 10)
+	var cancels int
+	exitCode := -1
+	done := make(chan struct{})
+	go func() {
+		handleSignals(sigChan, func() { cancels++ }, func(code int) { exitCode = code })
+		close(done)
+	}()
+
+	// not a termination signal, ignored
+	sigChan <- syscall.SIGHUP
+	// the first one asks for a clean exit, the second one forces it
+	sigChan <- syscall.SIGTERM
+	sigChan <- syscall.SIGINT
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("signals not handled")
+	}
+	assert.Equal(1, cancels)
+	assert.Equal(1, exitCode)
+
+	// a single signal only cancels
+	sigChan = make(chan os.Signal, 10)
+	cancels, exitCode = 0, -1
+	sigChan <- syscall.SIGINT
+	close(sigChan)
+	handleSignals(sigChan, func() { cancels++ }, func(code int) { exitCode = code })
+	assert.Equal(1, cancels)
+	assert.Equal(-1, exitCode)
+}
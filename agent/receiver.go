@@ -82,27 +82,43 @@ func NewHTTPReceiver(conf *config.AgentConfig) *HTTPReceiver {
 
 // Run starts doing the HTTP server and is ready to receive traces
 func (r *HTTPReceiver) Run() {
+	mux := http.NewServeMux()
+
 	// FIXME[1.x]: remove all those legacy endpoints + code that goes with it
-	http.HandleFunc("/spans", r.httpHandleWithVersion(v01, r.handleTraces))
-	http.HandleFunc("/services", r.httpHandleWithVersion(v01, r.handleServices))
-	http.HandleFunc("/v0.1/spans", r.httpHandleWithVersion(v01, r.handleTraces))
-	http.HandleFunc("/v0.1/services", r.httpHandleWithVersion(v01, r.handleServices))
-	http.HandleFunc("/v0.2/traces", r.httpHandleWithVersion(v02, r.handleTraces))
-	http.HandleFunc("/v0.2/services", r.httpHandleWithVersion(v02, r.handleServices))
+	mux.HandleFunc("/spans", r.httpHandleWithVersion(v01, r.handleTraces))
+	mux.HandleFunc("/services", r.httpHandleWithVersion(v01, r.handleServices))
+	mux.HandleFunc("/v0.1/spans", r.httpHandleWithVersion(v01, r.handleTraces))
+	mux.HandleFunc("/v0.1/services", r.httpHandleWithVersion(v01, r.handleServices))
+	mux.HandleFunc("/v0.2/traces", r.httpHandleWithVersion(v02, r.handleTraces))
+	mux.HandleFunc("/v0.2/services", r.httpHandleWithVersion(v02, r.handleServices))
 
 	// current collector API
-	http.HandleFunc("/v0.3/traces", r.httpHandleWithVersion(v03, r.handleTraces))
-	http.HandleFunc("/v0.3/services", r.httpHandleWithVersion(v03, r.handleServices))
+	mux.HandleFunc("/v0.3/traces", r.httpHandleWithVersion(v03, r.handleTraces))
+	mux.HandleFunc("/v0.3/services", r.httpHandleWithVersion(v03, r.handleServices))
+
+	// the debug endpoints are registered on the default mux, by the agent
+	// (see registerHandlers) as well as by expvar ("/debug/vars") and pprof
+	debug := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.DefaultServeMux.ServeHTTP(w, req)
+	})
 
-	// expvar implicitely publishes "/debug/vars" on the same port
+	if r.conf.DebugPort > 0 {
+		// served apart, not to expose them along with the receiver
+		debugAddr := fmt.Sprintf("%s:%d", r.conf.DebugHost, r.conf.DebugPort)
+		if err := r.Listen(debugAddr, "debug requests", debug); err != nil {
+			die("%v", err)
+		}
+	} else {
+		mux.Handle("/", debug)
+	}
 
 	addr := fmt.Sprintf("%s:%d", r.conf.ReceiverHost, r.conf.ReceiverPort)
-	if err := r.Listen(addr, ""); err != nil {
+	if err := r.Listen(addr, "traces", mux); err != nil {
 		die("%v", err)
 	}
 
 	legacyAddr := fmt.Sprintf("%s:%d", r.conf.ReceiverHost, legacyReceiverPort)
-	if err := r.Listen(legacyAddr, " (legacy)"); err != nil {
+	if err := r.Listen(legacyAddr, "traces (legacy)", mux); err != nil {
 		log.Error(err)
 	}
 
@@ -111,8 +127,9 @@ func (r *HTTPReceiver) Run() {
 	})
 }
 
-// Listen creates a new HTTP server listening on the provided address.
-func (r *HTTPReceiver) Listen(addr, logExtra string) error {
+// Listen creates a new HTTP server listening on the provided address,
+// serving what with handler.
+func (r *HTTPReceiver) Listen(addr, what string, handler http.Handler) error {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("cannot listen on %s: %v", addr, err)
@@ -130,11 +147,12 @@ func (r *HTTPReceiver) Listen(addr, logExtra string) error {
 	}
 
 	server := http.Server{
+		Handler:      handler,
 		ReadTimeout:  time.Second * time.Duration(timeout),
 		WriteTimeout: time.Second * time.Duration(timeout),
 	}
 
-	log.Infof("listening for traces at http://%s%s", addr, logExtra)
+	log.Infof("listening for %s at http://%s", what, addr)
 
 	watchdog.Go(func() {
 		stoppableListener.Refresh(r.conf.ConnectionLimit)
@@ -218,6 +236,13 @@ func (r *HTTPReceiver) handleTraces(v APIVersion, w http.ResponseWriter, req *ht
 	// normalize data
 	for i := range traces {
 		spans := len(traces[i])
+		if max := r.conf.MaxSpansPerTrace; max > 0 && spans > max {
+			// oversized traces would make the processing way too expensive
+			traces[i] = truncateTrace(traces[i], max)
+			atomic.AddInt64(&r.stats.TracesTruncated, 1)
+			r.logger.Errorf("truncating trace with %d spans to %d spans", spans, max)
+		}
+
 		normTrace, err := model.NormalizeTrace(traces[i])
 		if err != nil {
 			atomic.AddInt64(&r.stats.TracesDropped, 1)
@@ -249,6 +274,33 @@ func (r *HTTPReceiver) handleTraces(v APIVersion, w http.ResponseWriter, req *ht
 	}
 }
 
+// truncateTrace reduces a trace to max spans, keeping its root and spans evenly
+// picked among the others so that the subset stays representative
+func truncateTrace(t model.Trace, max int) model.Trace {
+	root := t.GetRoot()
+	var r int
+	for r = range t {
+		if &t[r] == root {
+			break
+		}
+	}
+
+	truncated := make(model.Trace, 0, max)
+	truncated = append(truncated, *root)
+
+	// pick among the spans other than the root, skipping over it
+	others := len(t) - 1
+	for i := 0; i < max-1; i++ {
+		j := i * others / (max - 1)
+		if j >= r {
+			j++
+		}
+		truncated = append(truncated, t[j])
+	}
+
+	return truncated
+}
+
 // handleServices handle a request with a list of several services
 func (r *HTTPReceiver) handleServices(v APIVersion, w http.ResponseWriter, req *http.Request) {
 
@@ -277,7 +329,17 @@ func (r *HTTPReceiver) logStats() {
 	var accStats receiverStats
 	var lastLog time.Time
 
-	for now := range time.Tick(10 * time.Second) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-r.exit:
+			return
+		}
+
 		// Load counters and reset them for the next flush
 		tracesBytes := atomic.SwapInt64(&r.stats.TracesBytes, 0)
 		accStats.TracesBytes += tracesBytes
@@ -294,9 +356,21 @@ func (r *HTTPReceiver) logStats() {
 		sdropped := atomic.SwapInt64(&r.stats.SpansDropped, 0)
 		accStats.SpansDropped += sdropped
 
+		sfixed := atomic.SwapInt64(&r.stats.SpansFixed, 0)
+		accStats.SpansFixed += sfixed
+
 		tdropped := atomic.SwapInt64(&r.stats.TracesDropped, 0)
 		accStats.TracesDropped += tdropped
 
+		ttruncated := atomic.SwapInt64(&r.stats.TracesTruncated, 0)
+		accStats.TracesTruncated += ttruncated
+
+		texcluded := atomic.SwapInt64(&r.stats.TracesExcluded, 0)
+		accStats.TracesExcluded += texcluded
+
+		tduplicate := atomic.SwapInt64(&r.stats.TracesDuplicate, 0)
+		accStats.TracesDuplicate += tduplicate
+
 		statsd.Client.Gauge("datadog.trace_agent.heartbeat", 1, []string{fmt.Sprintf("version:%s", Version)}, 1)
 
 		statsd.Client.Count("datadog.trace_agent.receiver.traces", tracesBytes, []string{"endpoint:traces"}, 1)
@@ -304,7 +378,11 @@ func (r *HTTPReceiver) logStats() {
 		statsd.Client.Count("datadog.trace_agent.receiver.span", spans, nil, 1)
 		statsd.Client.Count("datadog.trace_agent.receiver.trace", traces, nil, 1)
 		statsd.Client.Count("datadog.trace_agent.receiver.span_dropped", sdropped, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.span_fixed", sfixed, nil, 1)
 		statsd.Client.Count("datadog.trace_agent.receiver.trace_dropped", tdropped, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.trace_truncated", ttruncated, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.trace_excluded", texcluded, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.trace_duplicate", tduplicate, nil, 1)
 
 		if now.Sub(lastLog) >= time.Minute {
 			updateReceiverStats(accStats)
@@ -331,8 +409,16 @@ type receiverStats struct {
 	TracesReceived int64
 	// SpansDropped is the number of spans dropped
 	SpansDropped int64
+	// SpansFixed is the number of spans which needed their defaults filled, see model.Span.FillDefaults
+	SpansFixed int64
 	// SpansReceived is the number of traces dropped
 	TracesDropped int64
+	// TracesTruncated is the number of traces truncated for having too many spans
+	TracesTruncated int64
+	// TracesExcluded is the number of traces excluded from the sampling and the stats
+	TracesExcluded int64
+	// TracesDuplicate is the number of traces dropped as received again, see traceDeduper
+	TracesDuplicate int64
 }
 
 func decodeReceiverPayload(r io.Reader, dest msgp.Decodable, v APIVersion, contentType string) error {
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -189,6 +191,70 @@ func TestReceiverJSONDecoder(t *testing.T) {
 	}
 }
 
+func TestTruncateTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	// a huge trace, with its root somewhere in the middle
+	trace := make(model.Trace, 200000)
+	for i := range trace {
+		trace[i] = model.Span{TraceID: 42, SpanID: uint64(i + 1), ParentID: 100000}
+	}
+	trace[99999].ParentID = 0
+
+	start := time.Now()
+	truncated := truncateTrace(trace, 1000)
+	assert.True(time.Since(start) < time.Second, "truncating should be cheap")
+
+	assert.Len(truncated, 1000)
+	assert.Equal(uint64(100000), truncated[0].SpanID)
+
+	// the root is kept once, and the other spans spread across the trace
+	seen := make(map[uint64]bool)
+	for _, s := range truncated {
+		assert.False(seen[s.SpanID], "span %d kept twice", s.SpanID)
+		seen[s.SpanID] = true
+	}
+	assert.Equal(uint64(1), truncated[1].SpanID)
+	assert.True(truncated[len(truncated)-1].SpanID > 199000)
+}
+
+func TestReceiverMaxSpansPerTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.MaxSpansPerTrace = 10
+	r := NewHTTPReceiver(conf)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+	)
+	defer server.Close()
+
+	trace := make(model.Trace, 50)
+	for i := range trace {
+		trace[i] = fixtures.GetTestSpan()
+		trace[i].SpanID = uint64(i + 1)
+		trace[i].ParentID = 1
+	}
+	trace[0].ParentID = 0
+
+	data, err := json.Marshal(model.Traces{trace})
+	assert.Nil(err)
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	select {
+	case rt := <-r.traces:
+		assert.Len(rt, 10)
+		assert.Equal(uint64(1), rt[0].SpanID)
+	case <-time.After(time.Second):
+		t.Fatalf("no data received")
+	}
+	assert.Equal(int64(1), atomic.LoadInt64(&r.stats.TracesTruncated))
+}
+
 func TestReceiverMsgpackDecoder(t *testing.T) {
 	// testing traces without content-type in agent endpoints, it should use Msgpack decoding
 	// or it should raise a 415 Unsupported media type
@@ -477,3 +543,70 @@ func BenchmarkDecoderMsgpack(b *testing.B) {
 		_ = msgp.Decode(reader, &traces)
 	}
 }
+
+func TestReceiverBindAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	freePort := func() int {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"test"}
+	conf.ReceiverHost = "127.0.0.1"
+	conf.ReceiverPort = freePort()
+	conf.DebugHost = "127.0.0.1"
+	conf.DebugPort = freePort()
+
+	// save the global mux aside, we don't want to break other tests
+	defaultMux := http.DefaultServeMux
+	http.DefaultServeMux = http.NewServeMux()
+	http.HandleFunc("/debug/test", func(w http.ResponseWriter, r *http.Request) {})
+
+	receiver := NewHTTPReceiver(conf)
+	receiver.Run()
+
+	defer func() {
+		close(receiver.exit)
+		// we need to wait more than on second (time for StoppableListener.Accept
+		// to acknowledge the connection has been closed)
+		time.Sleep(2 * time.Second)
+		http.DefaultServeMux = defaultMux
+	}()
+
+	get := func(host string, port int, path string) (int, error) {
+		resp, err := http.Get(fmt.Sprintf("http://%s:%d%s", host, port, path))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// the traces are only received on the receiver port, the debug
+	// endpoints only served on the debug one
+	status, err := get("127.0.0.1", conf.ReceiverPort, "/v0.3/services")
+	assert.Nil(err)
+	assert.NotEqual(http.StatusNotFound, status)
+	status, err = get("127.0.0.1", conf.ReceiverPort, "/debug/test")
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, status)
+	status, err = get("127.0.0.1", conf.DebugPort, "/debug/test")
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, status)
+	status, err = get("127.0.0.1", conf.DebugPort, "/v0.3/services")
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, status)
+
+	// and both only listen on the configured interface, not on the other
+	// addresses of the loopback
+	for _, port := range []int{conf.ReceiverPort, conf.DebugPort} {
+		_, err = get("127.0.0.2", port, "/debug/test")
+		assert.NotNil(err, "port %d", port)
+	}
+}
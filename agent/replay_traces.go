@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+)
+
+// replayTracesCommand is the subcommand replaying captured traces through
+// the signature sampler
+const replayTracesCommand = "replay-traces"
+
+// replayTraces runs the traces serialized in JSON in path through a signature
+// sampler set up from conf, and writes its decisions to w, see sampler.Replay.
+// It reproduces offline how the sampler behaved with these traces.
+func replayTraces(w io.Writer, conf *config.AgentConfig, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	traces, err := sampler.ReadTraces(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	s, err := sampler.NewSignatureSampler(conf)
+	if err != nil {
+		return err
+	}
+	sampler.Replay(w, s, traces, conf.DefaultEnv)
+
+	return nil
+}
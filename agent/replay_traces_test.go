@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+func TestReplayTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "trace-agent-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"service":"web","name":"http.request","resource":"GET /","trace_id":1,"span_id":1,"start":1500000000000000000,"duration":1000000}]
+[{"service":"web","name":"http.request","resource":"GET /","trace_id":2,"span_id":1,"start":1500000001000000000,"duration":1000000}]
+`)
+	f.Close()
+
+	conf := config.DefaultAgentConfig()
+	conf.SamplingRules = []string{"service=web => 0"}
+
+	var buf bytes.Buffer
+	assert.Nil(replayTraces(&buf, conf, f.Name()))
+	assert.True(strings.HasPrefix(buf.String(), "drop 1 web http.request GET /\ndrop 2 web http.request GET /\nseen: 2, kept: 0\n"), buf.String())
+
+	assert.NotNil(replayTraces(&buf, conf, "/does-not-exist"))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+)
+
+// traceLog logs the debug lines written for each trace, which would flood
+// the logs at high throughput, see config.AgentConfig.LogSampleEvery
+var traceLog = &sampledLogger{every: 1}
+
+// sampledLogger only logs 1 line in every, and all of them if every <= 1
+type sampledLogger struct {
+	every int64
+	lines int64 // lines written so far, logged or not
+}
+
+// SetEvery sets how many lines are written for 1 logged
+func (l *sampledLogger) SetEvery(every int) {
+	atomic.StoreInt64(&l.every, int64(every))
+}
+
+// Debugf logs the line at the debug level if it is sampled
+func (l *sampledLogger) Debugf(format string, params ...interface{}) {
+	if l.sample() {
+		log.Debugf(format, params...)
+	}
+}
+
+func (l *sampledLogger) sample() bool {
+	every := atomic.LoadInt64(&l.every)
+	if every <= 1 {
+		return true
+	}
+	return (atomic.AddInt64(&l.lines, 1)-1)%every == 0
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/cihub/seelog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampledLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.DebugLvl, "%Msg%n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := log.Current
+	log.UseLogger(logger)
+	defer log.UseLogger(previous)
+
+	l := &sampledLogger{every: 1}
+	for i := 0; i < 10; i++ {
+		l.Debugf("trace %d", i)
+	}
+	assert.Equal(10, strings.Count(buf.String(), "\n"), "every line is logged by default")
+
+	buf.Reset()
+	l.SetEvery(100)
+	for i := 0; i < 1000; i++ {
+		l.Debugf("trace %d", i)
+	}
+	logger.Flush()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 10)
+	assert.Equal("trace 0", lines[0])
+	assert.Equal("trace 100", lines[1])
+}
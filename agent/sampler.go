@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -9,6 +12,7 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
@@ -18,16 +22,38 @@ type Sampler struct {
 	sampledTraces []model.Trace
 	traceCount    int
 	lastFlush     time.Time
+	hostName      string
+	clock         sampler.Clock
+	// maxTraces caps the traces flushed at once, see downsampleTraces
+	maxTraces int
 
 	samplerEngine SamplerEngine
 }
 
+// FlushPayload is what the sampler returns at flush, the sampled traces along
+// with a description of the period they were sampled over
+type FlushPayload struct {
+	Traces []model.Trace
+	// Start and End delimit the flushed period
+	Start time.Time
+	End   time.Time
+	// HostName is the host the traces were sampled on
+	HostName string
+	// SampledCount is the number of traces kept
+	SampledCount int
+	// SeenCount is the total number of traces sampled over the period
+	SeenCount int
+}
+
 // samplerStats contains sampler statistics
 type samplerStats struct {
 	// KeptTPS is the number of traces kept (average per second for last flush)
 	KeptTPS float64
 	// TotalTPS is the total number of traces (average per second for last flush)
 	TotalTPS float64
+	// NewSignaturesPS is the number of signatures not seen recently (average
+	// per second for last flush), a jump reveals a cardinality explosion
+	NewSignaturesPS float64
 }
 
 type samplerInfo struct {
@@ -44,13 +70,277 @@ type SamplerEngine interface {
 	Sample(t model.Trace, root *model.Span, env string) bool
 }
 
-// NewSampler creates a new empty sampler ready to be started
-func NewSampler(conf *config.AgentConfig) *Sampler {
+// NewSampler creates a new empty sampler ready to be started, using the
+// sampler engine selected in the config. It returns an error if an engine is
+// unknown, see config.AgentConfig.Validate.
+func NewSampler(conf *config.AgentConfig) (*Sampler, error) {
+	engine, err := newSamplerEngines(conf, conf.SamplerEngine)
+	if err != nil {
+		return nil, err
+	}
+	if conf.SamplerShadowEngine != "" {
+		shadow, err := newSamplerEngines(conf, conf.SamplerShadowEngine)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shadow engine: %v", err)
+		}
+		engine = newShadowEngine(engine, shadow)
+	}
+
+	return newSamplerWithEngine(conf, engine), nil
+}
+
+// newSamplerEngines returns the engine of a comma separated list of them,
+// combined by a compositeEngine if there are several
+func newSamplerEngines(conf *config.AgentConfig, list string) (SamplerEngine, error) {
+	names := strings.Split(list, ",")
+	if len(names) == 1 {
+		return newSamplerEngine(conf, strings.TrimSpace(names[0]))
+	}
+
+	engines := make([]SamplerEngine, len(names))
+	for i, name := range names {
+		e, err := newSamplerEngine(conf, strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		engines[i] = e
+	}
+
+	return newCompositeEngine(engines, conf.SamplerCombine == config.SamplerCombineAny), nil
+}
+
+// newSamplerEngine returns the engine of a trimmed name, or an error if it is
+// unknown
+func newSamplerEngine(conf *config.AgentConfig, name string) (SamplerEngine, error) {
+	switch name {
+	case config.SamplerEngineDeterministic:
+		return newDeterministicEngine(conf.ExtraSampleRate), nil
+	case config.SamplerEngineSignature:
+		e, err := sampler.NewSignatureSampler(conf)
+		if err != nil {
+			log.Errorf("ignoring sampling rules: %v", err)
+		}
+		return e, nil
+	default:
+		return nil, fmt.Errorf("invalid sampler engine: %q", name)
+	}
+}
+
+func newSamplerWithEngine(conf *config.AgentConfig, engine SamplerEngine) *Sampler {
 	return &Sampler{
 		sampledTraces: []model.Trace{},
 		traceCount:    0,
-		samplerEngine: sampler.NewSampler(conf.ExtraSampleRate, conf.MaxTPS),
+		lastFlush:     sampler.SystemClock.Now(),
+		hostName:      conf.HostName,
+		clock:         sampler.SystemClock,
+		maxTraces:     conf.MaxTracesPerFlush,
+		samplerEngine: engine,
+	}
+}
+
+// signatureEngine returns the signature sampler engine, if any, the one of
+// a shadow engine being ignored
+func (s *Sampler) signatureEngine() *sampler.Sampler {
+	engine := s.samplerEngine
+	if shadow, ok := engine.(*shadowEngine); ok {
+		engine = shadow.active
+	}
+	return signatureEngineOf(engine)
+}
+
+// signatureEngineOf returns the signature sampler engine of engine, if any
+func signatureEngineOf(engine SamplerEngine) *sampler.Sampler {
+	engines := []SamplerEngine{engine}
+	if c, ok := engine.(*compositeEngine); ok {
+		engines = c.engines
+	}
+	for _, engine := range engines {
+		if e, ok := engine.(*sampler.Sampler); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// deterministicEngine is a SamplerEngine keeping a fixed ratio of the traces,
+// chosen by trace ID so that all the agents keep the same traces
+type deterministicEngine struct {
+	rate float64
+	exit chan struct{}
+}
+
+func newDeterministicEngine(rate float64) *deterministicEngine {
+	return &deterministicEngine{rate: rate, exit: make(chan struct{})}
+}
+
+// Run blocks until Stop is called, there is no state to maintain
+func (e *deterministicEngine) Run() {
+	<-e.exit
+}
+
+// Stop stops the Run loop
+func (e *deterministicEngine) Stop() {
+	close(e.exit)
+}
+
+// Sample tells if a trace has to be kept
+func (e *deterministicEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	return sampler.ApplySampleRate(root, e.rate)
+}
+
+// compositeEngine is a SamplerEngine combining the decisions of several engines,
+// keeping a trace if all of them keep it, or if any of them does when keepIfAny
+// is set. Every engine sees every trace, so that they all keep their state up to
+// date. Since a decision is taken once per trace, a trace kept by several engines
+// is still only kept once.
+type compositeEngine struct {
+	engines   []SamplerEngine
+	keepIfAny bool
+	exit      chan struct{}
+}
+
+func newCompositeEngine(engines []SamplerEngine, keepIfAny bool) *compositeEngine {
+	return &compositeEngine{engines: engines, keepIfAny: keepIfAny, exit: make(chan struct{})}
+}
+
+// Run runs all the engines, it blocks until Stop is called
+func (e *compositeEngine) Run() {
+	for _, engine := range e.engines {
+		engine := engine
+		watchdog.Go(func() {
+			engine.Run()
+		})
+	}
+	<-e.exit
+}
+
+// Stop stops all the engines
+func (e *compositeEngine) Stop() {
+	for _, engine := range e.engines {
+		engine.Stop()
 	}
+	close(e.exit)
+}
+
+// Sample tells if a trace has to be kept, combining the decisions of all the
+// engines. Each engine samples the trace with the sample rate it came in with,
+// not the one applied by the engines before it, and the combined rate is set
+// once at the end. The engines keep a trace by comparing the same hash of its
+// ID to their rate, see sampler.SampleByRate, so the traces kept by all of them
+// are the ones kept at the lowest rate, and by any of them at the highest.
+func (e *compositeEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	incoming, hasRate := root.Metrics[model.SpanSampleRateMetricKey]
+	if !hasRate {
+		incoming = 1
+	}
+	resetRate := func() {
+		if hasRate {
+			sampler.SetTraceAppliedSampleRate(root, incoming)
+		} else {
+			delete(root.Metrics, model.SpanSampleRateMetricKey)
+		}
+	}
+
+	keep := !e.keepIfAny
+	combined := 1.0
+	for i, engine := range e.engines {
+		resetRate()
+		if engine.Sample(t, root, env) == e.keepIfAny {
+			keep = e.keepIfAny
+		}
+
+		rate := 1.0
+		if incoming > 0 {
+			rate = sampler.GetTraceAppliedSampleRate(root) / incoming
+		}
+		if i == 0 || (e.keepIfAny && rate > combined) || (!e.keepIfAny && rate < combined) {
+			combined = rate
+		}
+	}
+
+	resetRate()
+	if combined != 1 {
+		sampler.SetTraceAppliedSampleRate(root, incoming*combined)
+	}
+	return keep
+}
+
+// shadowEngine is a SamplerEngine taking the decisions of its active engine,
+// and only counting how the ones of its candidate engine diverge from them,
+// to try out an engine before rolling it out. The candidate sees every trace
+// too, so that its decisions are the ones it would take if active.
+type shadowEngine struct {
+	active    SamplerEngine
+	candidate SamplerEngine
+
+	// counted since the last flushDivergence
+	traces        int64 // traces sampled
+	candidateKept int64 // traces kept by the candidate only
+	candidateDrop int64 // traces dropped by the candidate only
+
+	exit chan struct{}
+}
+
+func newShadowEngine(active, candidate SamplerEngine) *shadowEngine {
+	return &shadowEngine{active: active, candidate: candidate, exit: make(chan struct{})}
+}
+
+// Run runs both engines, it blocks until Stop is called
+func (e *shadowEngine) Run() {
+	for _, engine := range []SamplerEngine{e.active, e.candidate} {
+		engine := engine
+		watchdog.Go(func() {
+			engine.Run()
+		})
+	}
+	<-e.exit
+}
+
+// Stop stops both engines
+func (e *shadowEngine) Stop() {
+	e.active.Stop()
+	e.candidate.Stop()
+	close(e.exit)
+}
+
+// Sample tells if a trace has to be kept, as the active engine does. The
+// candidate samples a copy of the root as it came in, for the sample rate
+// it applies not to weigh the kept trace, nor to be applied on top of the
+// one of the active engine.
+func (e *shadowEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	shadowRoot := *root
+	shadowRoot.Metrics = make(map[string]float64, len(root.Metrics))
+	for k, v := range root.Metrics {
+		shadowRoot.Metrics[k] = v
+	}
+
+	keep := e.active.Sample(t, root, env)
+	candidateKeep := e.candidate.Sample(t, &shadowRoot, env)
+
+	atomic.AddInt64(&e.traces, 1)
+	if candidateKeep != keep {
+		if candidateKeep {
+			atomic.AddInt64(&e.candidateKept, 1)
+		} else {
+			atomic.AddInt64(&e.candidateDrop, 1)
+		}
+	}
+	return keep
+}
+
+// flushDivergence returns the number of traces sampled since the last call,
+// and among them the ones only the candidate keeps and the ones only the
+// candidate drops. The candidate is flushed along, as the active engine is,
+// for its state not to grow forever, nor its signatures kept once per flush
+// to stay kept.
+func (e *shadowEngine) flushDivergence() (traces, candidateKept, candidateDrop int64) {
+	if engine := signatureEngineOf(e.candidate); engine != nil {
+		engine.FlushTraceCounts()
+		engine.FlushSignatureCacheStats()
+		engine.FlushKeptSignatures()
+		engine.FlushNewSignatures()
+	}
+	return atomic.SwapInt64(&e.traces, 0), atomic.SwapInt64(&e.candidateKept, 0), atomic.SwapInt64(&e.candidateDrop, 0)
 }
 
 // Run starts sampling traces
@@ -62,9 +352,13 @@ func (s *Sampler) Run() {
 
 // Add samples a trace then keep it until the next flush
 func (s *Sampler) Add(t processedTrace) {
+	// the engines are safe for concurrent use, sampler.Sampler guards its
+	// parameters updated while sampling: only lock to keep the trace
+	sampled := s.samplerEngine.Sample(t.Trace, t.Root, t.Env)
+
 	s.mu.Lock()
 	s.traceCount++
-	if s.samplerEngine.Sample(t.Trace, t.Root, t.Env) {
+	if sampled {
 		s.sampledTraces = append(s.sampledTraces, t.Trace)
 	}
 	s.mu.Unlock()
@@ -77,6 +371,12 @@ func (s *Sampler) Stop() {
 
 // Flush returns representative spans based on GetSamples and reset its internal memory
 func (s *Sampler) Flush() []model.Trace {
+	return s.FlushPayload().Traces
+}
+
+// FlushPayload is the same as Flush, except that it also describes the
+// flushed traces
+func (s *Sampler) FlushPayload() FlushPayload {
 	s.mu.Lock()
 
 	traces := s.sampledTraces
@@ -84,17 +384,41 @@ func (s *Sampler) Flush() []model.Trace {
 	traceCount := s.traceCount
 	s.traceCount = 0
 
-	now := time.Now()
-	duration := now.Sub(s.lastFlush)
+	now := s.clock.Now()
+	start := s.lastFlush
+	duration := now.Sub(start)
 	s.lastFlush = now
 
 	s.mu.Unlock()
 
-	state := s.samplerEngine.(*sampler.Sampler).GetState()
+	// only the signature sampler has an internal state to report, and
+	// signature options to group the traces with
+	engine := s.signatureEngine()
+	signatureOf := sampler.ComputeSignature
+	if engine != nil {
+		signatureOf = engine.TraceSignature
+	}
+
+	downsampled := len(traces)
+	traces = downsampleTraces(traces, s.maxTraces, signatureOf)
+	downsampled -= len(traces)
+
+	var state sampler.InternalState
+	var counts sampler.TraceCounts
+	var cacheHits, cacheMisses, newSignatures int64
+	var keptSignatures int
+	if engine != nil {
+		state = engine.GetState()
+		counts = engine.FlushTraceCounts()
+		cacheHits, cacheMisses = engine.FlushSignatureCacheStats()
+		keptSignatures = engine.FlushKeptSignatures()
+		newSignatures = engine.FlushNewSignatures()
+	}
 	var stats samplerStats
 	if duration > 0 {
 		stats.KeptTPS = float64(len(traces)) / duration.Seconds()
 		stats.TotalTPS = float64(traceCount) / duration.Seconds()
+		stats.NewSignaturesPS = float64(newSignatures) / duration.Seconds()
 	}
 
 	log.Debugf("flushed %d sampled traces out of %d", len(traces), traceCount)
@@ -104,5 +428,42 @@ func (s *Sampler) Flush() []model.Trace {
 	// publish through expvar
 	updateSamplerInfo(samplerInfo{Stats: stats, State: state})
 
-	return traces
+	statsd.Client.Count("datadog.trace_agent.sampler.kept", int64(len(traces)), nil, 1)
+	statsd.Client.Count("datadog.trace_agent.sampler.downsampled", int64(downsampled), nil, 1)
+	statsd.Client.Count("datadog.trace_agent.sampler.seen", int64(traceCount), nil, 1)
+	statsd.Client.Gauge("datadog.trace_agent.sampler.cardinality", float64(state.Cardinality), nil, 1)
+	statsd.Client.Count("datadog.trace_agent.sampler.new_signatures", newSignatures, nil, 1)
+	statsd.Client.Gauge("datadog.trace_agent.sampler.new_signatures_per_second", stats.NewSignaturesPS, nil, 1)
+	if keptSignatures > 0 {
+		statsd.Client.Gauge("datadog.trace_agent.sampler.kept_signatures", float64(keptSignatures), nil, 1)
+	}
+	if shadow, ok := s.samplerEngine.(*shadowEngine); ok {
+		shadowTraces, candidateKept, candidateDrop := shadow.flushDivergence()
+		statsd.Client.Count("datadog.trace_agent.sampler.shadow.seen", shadowTraces, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.sampler.shadow.kept", candidateKept, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.sampler.shadow.dropped", candidateDrop, nil, 1)
+		if candidateKept+candidateDrop > 0 {
+			log.Infof("shadow sampler diverged on %d traces out of %d: %d kept and %d dropped by the candidate only",
+				candidateKept+candidateDrop, shadowTraces, candidateKept, candidateDrop)
+		}
+	}
+	if lookups := cacheHits + cacheMisses; lookups > 0 {
+		statsd.Client.Count("datadog.trace_agent.sampler.signature_cache.hits", cacheHits, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.sampler.signature_cache.misses", cacheMisses, nil, 1)
+		statsd.Client.Gauge("datadog.trace_agent.sampler.signature_cache.hit_rate", float64(cacheHits)/float64(lookups), nil, 1)
+	}
+
+	for key, count := range counts {
+		tags := []string{"service:" + key.Service, "resource:" + key.Resource}
+		statsd.Client.Count("datadog.trace_agent.sampler.traces", count, tags, 1)
+	}
+
+	return FlushPayload{
+		Traces:       traces,
+		Start:        start,
+		End:          now,
+		HostName:     s.hostName,
+		SampledCount: len(traces),
+		SeenCount:    traceCount,
+	}
 }
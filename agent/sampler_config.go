@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// samplerConfig is the part of the sampler configuration which can be
+// changed while running, see samplerConfigHandler
+type samplerConfig struct {
+	ExtraSampleRate float64 `json:"extra_sample_rate"`
+	MaxTPS          float64 `json:"max_traces_per_second"`
+	FlushJitter     float64 `json:"flush_jitter"`
+}
+
+func newSamplerConfig(conf *config.AgentConfig) samplerConfig {
+	return samplerConfig{
+		ExtraSampleRate: conf.ExtraSampleRate,
+		MaxTPS:          conf.MaxTPS,
+		FlushJitter:     conf.FlushJitter,
+	}
+}
+
+// samplerConfigUpdate holds the parameters to change, the nil ones are kept
+type samplerConfigUpdate struct {
+	ExtraSampleRate *float64 `json:"extra_sample_rate"`
+	MaxTPS          *float64 `json:"max_traces_per_second"`
+	FlushJitter     *float64 `json:"flush_jitter"`
+}
+
+// samplerConfigRequest asks the agent loop to apply update, it replies with
+// the configuration in effect
+type samplerConfigRequest struct {
+	update samplerConfigUpdate
+	reply  chan samplerConfigReply
+}
+
+type samplerConfigReply struct {
+	conf samplerConfig
+	err  error
+}
+
+// updateSamplerConfig applies update if the resulting configuration is
+// valid, with the same rules as at startup. It must be called from the agent
+// loop, which flushes with the jitter and owns samplerConfig. The sampler
+// engine guards its own parameters, read by concurrent calls to Sample.
+func (a *Agent) updateSamplerConfig(update samplerConfigUpdate) samplerConfigReply {
+	next := a.samplerConfig
+	if update.ExtraSampleRate != nil {
+		next.ExtraSampleRate = *update.ExtraSampleRate
+	}
+	if update.MaxTPS != nil {
+		next.MaxTPS = *update.MaxTPS
+	}
+	if update.FlushJitter != nil {
+		next.FlushJitter = *update.FlushJitter
+	}
+
+	conf := *a.conf
+	conf.ExtraSampleRate = next.ExtraSampleRate
+	conf.MaxTPS = next.MaxTPS
+	conf.FlushJitter = next.FlushJitter
+	if err := conf.Validate(); err != nil {
+		return samplerConfigReply{conf: a.samplerConfig, err: err}
+	}
+
+	if engine := a.Sampler.signatureEngine(); engine != nil {
+		engine.UpdateExtraRate(next.ExtraSampleRate)
+		engine.UpdateMaxTPS(next.MaxTPS)
+	}
+	a.flushInterval.setJitter(next.FlushJitter)
+	a.samplerConfig = next
+
+	log.Infof("sampler configuration updated: extra_sample_rate=%v, max_traces_per_second=%v, flush_jitter=%v",
+		next.ExtraSampleRate, next.MaxTPS, next.FlushJitter)
+	return samplerConfigReply{conf: next}
+}
+
+// samplerConfigHandler serves /sampler/config, changing the sampler
+// configuration without a restart, to tune it live: a POST of a JSON object
+// with any of the fields of samplerConfig, authenticated with one of the API
+// keys of the agent, returns the configuration in effect
+type samplerConfigHandler struct {
+	agent *Agent
+}
+
+func (h *samplerConfigHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(req, h.agent.conf.APIKeys) {
+		http.Error(w, "invalid API key", http.StatusForbidden)
+		return
+	}
+
+	var update samplerConfigUpdate
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		http.Error(w, "invalid sampler configuration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// applied in the agent loop, not to race with the flushes
+	r := samplerConfigRequest{update: update, reply: make(chan samplerConfigReply, 1)}
+	select {
+	case h.agent.samplerConfigRequests <- r:
+	case <-time.After(forcedFlushTimeout):
+		http.Error(w, "agent is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	reply := <-r.reply
+	if reply.err != nil {
+		http.Error(w, "invalid sampler configuration: "+reply.err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply.conf)
+}
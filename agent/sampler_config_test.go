@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSamplerConfigHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"secret"}
+	a := NewAgent(context.Background(), conf)
+
+	// stand for the agent loop, serving the configuration requests
+	go func() {
+		for req := range a.samplerConfigRequests {
+			req.reply <- a.updateSamplerConfig(req.update)
+		}
+	}()
+	defer close(a.samplerConfigRequests)
+
+	h := &samplerConfigHandler{agent: a}
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/sampler/config", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("DD-Api-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	engine := a.Sampler.signatureEngine()
+	trace := model.Trace{model.Span{TraceID: 1, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /"}}
+	signature := sampler.ComputeSignature(trace)
+	assert.True(engine.GetSampleRate(trace, &trace[0], signature) > 0)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/sampler/config", nil))
+	assert.Equal(http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(http.StatusForbidden, post("", `{"extra_sample_rate": 0}`).Code)
+	assert.Equal(http.StatusForbidden, post("wrong", `{"extra_sample_rate": 0}`).Code)
+	assert.Equal(http.StatusBadRequest, post("secret", `extra_sample_rate=0`).Code)
+
+	rec = post("secret", `{"extra_sample_rate": 0, "flush_jitter": 0.3}`)
+	assert.Equal(http.StatusOK, rec.Code)
+	var effective samplerConfig
+	assert.Nil(json.NewDecoder(rec.Body).Decode(&effective))
+	assert.Equal(samplerConfig{ExtraSampleRate: 0, MaxTPS: 10, FlushJitter: 0.3}, effective)
+
+	// the next traces are scored with the new parameters
+	assert.Equal(0.0, engine.GetSampleRate(trace, &trace[0], signature))
+	assert.Equal(0.3, a.flushInterval.jitter)
+
+	// which are validated as at startup, keeping the previous ones if invalid
+	for _, body := range []string{
+		`{"extra_sample_rate": 2}`,
+		`{"max_traces_per_second": -1}`,
+		`{"flush_jitter": 1}`,
+	} {
+		assert.Equal(http.StatusBadRequest, post("secret", body).Code, body)
+	}
+	rec = post("secret", `{"max_traces_per_second": 20}`)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Nil(json.NewDecoder(rec.Body).Decode(&effective))
+	assert.Equal(samplerConfig{ExtraSampleRate: 0, MaxTPS: 20, FlushJitter: 0.3}, effective)
+}
+
+func TestSamplerConfigWhileSampling(t *testing.T) {
+	// run with -race: the traces are sampled in their own goroutines
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"secret"}
+	a := NewAgent(context.Background(), conf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				trace := model.Trace{model.Span{TraceID: uint64(i*1000 + j + 1), SpanID: 1, Service: "mcnulty", Name: "query"}}
+				a.Sampler.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+			}
+		}(i)
+	}
+	for j := 0; j < 100; j++ {
+		rate, tps := float64(j%10)/10, float64(j+1)
+		reply := a.updateSamplerConfig(samplerConfigUpdate{ExtraSampleRate: &rate, MaxTPS: &tps})
+		assert.NoError(t, reply.err)
+	}
+	wg.Wait()
+}
+
+func TestAgentRegisterHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"secret"}
+	mux := http.NewServeMux()
+	NewAgent(context.Background(), conf).registerHandlers(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/sampler/config", nil))
+	assert.Equal(http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/flush", nil))
+	assert.Equal(http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.NotEqual(http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+	assert.Equal(http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSamplerFlushPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.HostName = "testhost"
+	s, err := NewSampler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		trace := model.Trace{
+			model.Span{TraceID: uint64(i + 1), SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /"},
+		}
+		if i == 0 {
+			// the client asks to drop this one
+			trace[0].Metrics = map[string]float64{model.SpanSamplingPriorityMetricKey: sampler.PriorityUserDrop}
+		}
+		s.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+	}
+
+	before := time.Now()
+	p := s.FlushPayload()
+
+	assert.Len(p.Traces, 4)
+	assert.Equal(4, p.SampledCount)
+	assert.Equal(5, p.SeenCount)
+	assert.Equal("testhost", p.HostName)
+	assert.True(p.Start.Before(before))
+	assert.False(p.End.Before(before))
+
+	// the next payload starts where the previous one ended
+	next := s.FlushPayload()
+	assert.Equal(p.End, next.Start)
+	assert.Len(next.Traces, 0)
+	assert.Equal(0, next.SeenCount)
+}
+
+func TestSamplerKeepOnePerSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ExtraSampleRate = 0 // drop every trace on its score
+	conf.KeepOnePerSignature = true
+	s, err := NewSampler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resources := []string{"GET /", "POST /users", "DELETE /users", "GET /health"}
+	traceID := uint64(0)
+	addTraces := func() {
+		for i := 0; i < 20; i++ {
+			for _, resource := range resources {
+				traceID++
+				trace := model.Trace{
+					model.Span{TraceID: traceID, SpanID: 1, Service: "mcnulty", Name: "query", Resource: resource},
+				}
+				s.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+			}
+		}
+	}
+
+	// every signature is in each flush, once
+	for flush := 0; flush < 2; flush++ {
+		addTraces()
+		p := s.FlushPayload()
+
+		kept := make(map[string]int)
+		for _, trace := range p.Traces {
+			kept[trace[0].Resource]++
+		}
+		for _, resource := range resources {
+			assert.Equal(1, kept[resource], "flush %d, resource %s", flush, resource)
+		}
+		assert.Len(p.Traces, len(resources))
+		assert.Equal(20*len(resources), p.SeenCount)
+	}
+
+	// but the traces the client asks to drop are still dropped
+	trace := model.Trace{
+		model.Span{TraceID: traceID + 1, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "PUT /users",
+			Metrics: map[string]float64{model.SpanSamplingPriorityMetricKey: sampler.PriorityUserDrop}},
+	}
+	s.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+	assert.Len(s.FlushPayload().Traces, 0)
+}
+
+// fakeEngine keeps the n-th trace if keep(n), and signals each sampled trace
+type fakeEngine struct {
+	sampled chan model.Trace
+	count   int
+	keep    func(n int) bool
+}
+
+func (e *fakeEngine) Run()  {}
+func (e *fakeEngine) Stop() {}
+func (e *fakeEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	if e.sampled != nil {
+		defer func() { e.sampled <- t }()
+	}
+	e.count++
+	return e.keep(e.count)
+}
+
+func keepOdd(n int) bool { return n%2 == 1 }
+
+func TestAgentSamplerEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	a := NewAgent(context.Background(), conf)
+
+	engine := &fakeEngine{sampled: make(chan model.Trace), keep: keepOdd}
+	a.Sampler = newSamplerWithEngine(conf, engine)
+
+	for i := 0; i < 4; i++ {
+		a.Process(model.Trace{fixtures.RandomSpan()})
+		select {
+		case <-engine.sampled:
+		case <-time.After(time.Second):
+			t.Fatal("the trace did not reach the sampler engine")
+		}
+	}
+
+	a.flush()
+	p := <-a.Writer.inPayloads
+	assert.Len(p.Traces, 2)
+}
+
+func TestDeterministicEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SamplerEngine = config.SamplerEngineDeterministic
+	conf.ExtraSampleRate = 0.5
+	s, err := NewSampler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := s.samplerEngine.(*deterministicEngine)
+	assert.True(ok)
+
+	for i := 0; i < 1000; i++ {
+		trace := model.Trace{fixtures.RandomSpan()}
+		s.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+	}
+	p := s.FlushPayload()
+	assert.Equal(1000, p.SeenCount)
+	assert.InDelta(500, p.SampledCount, 100)
+}
+
+func TestSamplerEngineNames(t *testing.T) {
+	assert := assert.New(t)
+
+	// trimmed, whether alone or in a list
+	conf := config.NewDefaultAgentConfig()
+	conf.SamplerEngine = config.SamplerEngineDeterministic + " "
+	s, err := NewSampler(conf)
+	if assert.NoError(err) {
+		assert.IsType(&deterministicEngine{}, s.samplerEngine)
+	}
+	conf.SamplerEngine = " signature"
+	s, err = NewSampler(conf)
+	if assert.NoError(err) {
+		assert.IsType(&sampler.Sampler{}, s.samplerEngine)
+	}
+
+	// unknown, rather than replaced by another engine
+	conf.SamplerEngine = "scorer"
+	_, err = NewSampler(conf)
+	assert.Error(err)
+	conf.SamplerEngine = "deterministic, scorer"
+	_, err = NewSampler(conf)
+	assert.Error(err)
+	conf.SamplerEngine = config.SamplerEngineSignature
+	conf.SamplerShadowEngine = "scorer"
+	_, err = NewSampler(conf)
+	assert.Error(err)
+}
+
+func TestCompositeEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		keepIfAny bool
+		kept      []bool
+	}{
+		{false, []bool{false, false, true, false, false, false}},
+		{true, []bool{true, false, true, false, true, true}},
+	} {
+		odd := &fakeEngine{keep: keepOdd}
+		third := &fakeEngine{keep: func(n int) bool { return n%3 == 0 }}
+		e := newCompositeEngine([]SamplerEngine{odd, third}, tc.keepIfAny)
+
+		var kept []bool
+		for i := 0; i < 6; i++ {
+			trace := model.Trace{fixtures.RandomSpan()}
+			kept = append(kept, e.Sample(trace, &trace[0], "none"))
+		}
+		assert.Equal(tc.kept, kept, "keepIfAny: %v", tc.keepIfAny)
+
+		// every engine saw every trace
+		assert.Equal(6, odd.count)
+		assert.Equal(6, third.count)
+	}
+
+	// the sample rates do not compound, the combined one is set once
+	for _, tc := range []struct {
+		keepIfAny bool
+		rate      float64
+	}{
+		{false, 0.2},
+		{true, 0.5},
+	} {
+		e := newCompositeEngine([]SamplerEngine{newDeterministicEngine(0.5), newDeterministicEngine(0.2)}, tc.keepIfAny)
+		for i := 0; i < 100; i++ {
+			span := fixtures.RandomSpan()
+			span.Metrics = map[string]float64{model.SpanSampleRateMetricKey: 0.5}
+			trace := model.Trace{span}
+			kept := e.Sample(trace, &trace[0], "none")
+			assert.Equal(sampler.SampleByRate(span.TraceID, 0.5*tc.rate), kept, "keepIfAny: %v", tc.keepIfAny)
+			assert.Equal(0.5*tc.rate, sampler.GetTraceAppliedSampleRate(&trace[0]), "keepIfAny: %v", tc.keepIfAny)
+		}
+	}
+
+	// engines applying no rate leave none
+	e := newCompositeEngine([]SamplerEngine{&fakeEngine{keep: keepOdd}, &fakeEngine{keep: keepOdd}}, false)
+	trace := model.Trace{model.Span{TraceID: 1, SpanID: 1}}
+	e.Sample(trace, &trace[0], "none")
+	assert.Nil(trace[0].Metrics)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SamplerEngine = "deterministic,signature"
+	conf.SamplerCombine = config.SamplerCombineAny
+	s, err := NewSampler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := s.samplerEngine.(*compositeEngine)
+	assert.True(ok)
+	assert.True(c.keepIfAny)
+	assert.Len(c.engines, 2)
+	assert.NotNil(s.signatureEngine())
+}
+
+func TestShadowEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	third := &fakeEngine{keep: func(n int) bool { return n%3 == 0 }}
+	e := newShadowEngine(&fakeEngine{keep: keepOdd}, third)
+	var kept []bool
+	for i := 0; i < 6; i++ {
+		trace := model.Trace{fixtures.RandomSpan()}
+		kept = append(kept, e.Sample(trace, &trace[0], "none"))
+	}
+	assert.Equal([]bool{true, false, true, false, true, false}, kept, "decided by the active engine")
+	assert.Equal(6, third.count, "the candidate saw every trace")
+
+	// only the 3rd trace is kept by both, the 6th by the candidate only and
+	// the 1st and 5th by the active engine only
+	traces, candidateKept, candidateDrop := e.flushDivergence()
+	assert.Equal(int64(6), traces)
+	assert.Equal(int64(1), candidateKept)
+	assert.Equal(int64(2), candidateDrop)
+	traces, candidateKept, candidateDrop = e.flushDivergence()
+	assert.Equal(int64(0), traces+candidateKept+candidateDrop, "reset by the flush")
+
+	// a signature candidate, applying its own sample rate, leaves the kept
+	// traces as the active engine alone does
+	conf := config.NewDefaultAgentConfig()
+	conf.ExtraSampleRate = 0.25
+	candidate, err := sampler.NewSignatureSampler(conf)
+	assert.NoError(err)
+	s := newSamplerWithEngine(conf, newShadowEngine(newDeterministicEngine(0.5), candidate))
+	ref := newSamplerWithEngine(conf, newDeterministicEngine(0.5))
+	newTrace := func(i int) model.Trace {
+		return model.Trace{
+			model.Span{TraceID: uint64(i + 1), SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /"},
+		}
+	}
+	for i := 0; i < 100; i++ {
+		trace, refTrace := newTrace(i), newTrace(i)
+		s.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+		ref.Add(processedTrace{Trace: refTrace, Root: &refTrace[0], Env: "none"})
+	}
+
+	p, expected := s.FlushPayload(), ref.FlushPayload()
+	assert.NotEmpty(p.Traces)
+	assert.Equal(expected.Traces, p.Traces)
+	assert.Equal(expected.SeenCount, p.SeenCount)
+	for _, trace := range p.Traces {
+		assert.Equal(0.5, sampler.GetTraceAppliedSampleRate(&trace[0]))
+	}
+	assert.Empty(candidate.FlushTraceCounts(), "the candidate is flushed along")
+
+	conf.SamplerShadowEngine = config.SamplerEngineDeterministic
+	s, err = NewSampler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow, ok := s.samplerEngine.(*shadowEngine)
+	if assert.True(ok) {
+		_, ok = shadow.candidate.(*deterministicEngine)
+		assert.True(ok)
+		assert.Equal(shadow.active, s.signatureEngine())
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestSamplerFlushPayloadClock(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	s, err := NewSampler(config.NewDefaultAgentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.clock = clock
+	s.lastFlush = clock.now
+
+	clock.now = clock.now.Add(10 * time.Second)
+	p := s.FlushPayload()
+	assert.Equal(time.Unix(1500000000, 0), p.Start)
+	assert.Equal(time.Unix(1500000010, 0), p.End)
+}
+
+func TestSamplerNewSignaturesPS(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	s, err := NewSampler(config.NewDefaultAgentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.clock = clock
+	s.lastFlush = clock.now
+
+	var traceID uint64
+	add := func(resource string) {
+		traceID++
+		trace := model.Trace{
+			model.Span{TraceID: traceID, SpanID: 1, Service: "mcnulty", Name: "query", Resource: resource},
+		}
+		s.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "none"})
+	}
+	flush := func() float64 {
+		clock.now = clock.now.Add(10 * time.Second)
+		s.FlushPayload()
+		return publishSamplerInfo().(samplerInfo).Stats.NewSignaturesPS
+	}
+
+	// a burst of resources holding an ID, each a new signature
+	for i := 0; i < 50; i++ {
+		add(fmt.Sprintf("GET /users/%d", i))
+	}
+	assert.Equal(5.0, flush())
+
+	// the same signatures again
+	for i := 0; i < 50; i++ {
+		add(fmt.Sprintf("GET /users/%d", i%10))
+	}
+	assert.Equal(0.0, flush())
+
+	// some new ones among repeated ones
+	for i := 0; i < 50; i++ {
+		add(fmt.Sprintf("GET /users/%d", 40+i))
+	}
+	assert.Equal(4.0, flush())
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "context"
+
+// runService returns false, only Windows has services: the agent is run from
+// the console, or by a supervisor, and stopped with signals
+func runService(run func(), cancel context.CancelFunc) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,73 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is the name the agent is registered under in the Service
+// Control Manager
+const serviceName = "datadog-trace-agent"
+
+// runService runs the agent with run as a Windows service, if the process was
+// started by the Service Control Manager, until it asks the service to stop.
+// It returns false when the agent is run from a console instead.
+func runService(run func(), cancel context.CancelFunc) (bool, error) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return false, err
+	}
+	if interactive {
+		return false, nil
+	}
+
+	log.Infof("running as the %s service", serviceName)
+	return true, svc.Run(serviceName, &serviceHandler{run: run, cancel: cancel})
+}
+
+// serviceHandler bridges the Service Control Manager and the agent lifecycle:
+// the service runs for as long as run does, and stopping the service cancels
+// the agent for a clean exit, like SIGTERM does on other platforms
+type serviceHandler struct {
+	run    func()
+	cancel context.CancelFunc
+}
+
+// Execute implements svc.Handler
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	changes <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.run()
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Infof("received service control request %d, stopping", req.Cmd)
+				changes <- svc.Status{State: svc.StopPending}
+				h.cancel()
+			default:
+				log.Warnf("unexpected service control request %d", req.Cmd)
+			}
+		case <-done:
+			changes <- svc.Status{State: svc.Stopped}
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestServiceHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &serviceHandler{
+		// stands for agent.Run, which returns once its context is cancelled
+		run:    func() { <-ctx.Done() },
+		cancel: cancel,
+	}
+
+	requests := make(chan svc.ChangeRequest)
+	changes := make(chan svc.Status, 10)
+	exited := make(chan uint32)
+	go func() {
+		_, code := h.Execute(nil, requests, changes)
+		exited <- code
+	}()
+
+	assert.Equal(svc.StartPending, (<-changes).State)
+	running := <-changes
+	assert.Equal(svc.Running, running.State)
+	assert.Equal(svc.AcceptStop|svc.AcceptShutdown, running.Accepts)
+
+	requests <- svc.ChangeRequest{Cmd: svc.Interrogate, CurrentStatus: running}
+	assert.Equal(running, <-changes)
+
+	requests <- svc.ChangeRequest{Cmd: svc.Stop}
+	assert.Equal(svc.StopPending, (<-changes).State)
+	assert.Error(ctx.Err(), "stopping the service should cancel the agent")
+
+	select {
+	case code := <-exited:
+		assert.Equal(uint32(0), code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service did not exit once the agent stopped")
+	}
+	assert.Equal(svc.Stopped, (<-changes).State)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// spoolFileExt is the extension of the payload files written in the spool
+const spoolFileExt = ".payload.json"
+
+// spool persists the payloads which could not be shipped before exiting, so
+// that they can be replayed at the next startup, or once the API recovers
+type spool struct {
+	dir     string
+	maxSize int           // the spooled payloads cannot take more bytes than this
+	maxAge  time.Duration // older spooled payloads are dropped at replay
+}
+
+// spooledPayload is a payload replayed from the spool
+type spooledPayload struct {
+	payload      model.AgentPayload
+	urls         []string // the URLs it still has to be sent to, all of them if empty
+	creationDate time.Time
+}
+
+// spoolEntry is what a spooled payload file holds. The files spooled before
+// the URLs were spooled along hold the payload alone.
+type spoolEntry struct {
+	Payload *model.AgentPayload `json:"payload"`
+	URLs    []string            `json:"urls,omitempty"`
+}
+
+func newSpool(dir string, maxSize int, maxAge time.Duration) *spool {
+	return &spool{dir: dir, maxSize: maxSize, maxAge: maxAge}
+}
+
+// Write persists the payloads, the newest ones are dropped once the spool is full
+func (s *spool) Write(payloads []*writerPayload) {
+	if len(payloads) == 0 {
+		return
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		log.Errorf("cannot create spool directory: %v", err)
+		return
+	}
+
+	size := s.size()
+	nbSpooled := 0
+	for i, p := range payloads {
+		entry := spoolEntry{Payload: &p.payload}
+		if e, ok := p.endpoint.(*APIEndpoint); ok {
+			// not to send it again where it was already accepted
+			entry.URLs = e.urls
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Errorf("cannot encode spooled payload: %v", err)
+			continue
+		}
+		if size+len(data) > s.maxSize {
+			log.Infof("dropping %d payloads (spool full)", len(payloads)-i)
+			break
+		}
+
+		name := fmt.Sprintf("%d-%d%s", p.creationDate.UnixNano(), i, spoolFileExt)
+		path := filepath.Join(s.dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			log.Errorf("cannot spool payload: %v", err)
+			continue
+		}
+		// keep the creation date so that the payload ages across restarts
+		os.Chtimes(path, p.creationDate, p.creationDate)
+
+		size += len(data)
+		nbSpooled++
+	}
+
+	log.Infof("spooled %d payloads to %s", nbSpooled, s.dir)
+}
+
+// Replay returns the spooled payloads, oldest first, and removes them from the spool
+func (s *spool) Replay() []spooledPayload {
+	files := s.files()
+	payloads := make([]spooledPayload, 0, len(files))
+	now := time.Now()
+
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+
+		if now.Sub(f.ModTime()) > s.maxAge {
+			log.Infof("dropping spooled payload %s (too old)", f.Name())
+		} else if data, err := ioutil.ReadFile(path); err != nil {
+			log.Errorf("cannot read spooled payload: %v", err)
+		} else {
+			var entry spoolEntry
+			err := json.Unmarshal(data, &entry)
+			if err == nil && entry.Payload == nil {
+				entry.Payload = &model.AgentPayload{}
+				err = json.Unmarshal(data, entry.Payload)
+			}
+			if err != nil {
+				log.Errorf("cannot decode spooled payload %s: %v", f.Name(), err)
+			} else {
+				payloads = append(payloads, spooledPayload{payload: *entry.Payload, urls: entry.URLs, creationDate: f.ModTime()})
+			}
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Errorf("cannot remove spooled payload: %v", err)
+		}
+	}
+
+	if len(payloads) > 0 {
+		log.Infof("replaying %d spooled payloads from %s", len(payloads), s.dir)
+	}
+
+	return payloads
+}
+
+// files lists the spooled payload files, oldest first
+func (s *spool) files() []os.FileInfo {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("cannot read spool directory: %v", err)
+		}
+		return nil
+	}
+
+	var files []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), spoolFileExt) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	return files
+}
+
+// size returns the size of the spooled payloads
+func (s *spool) size() int {
+	var size int
+	for _, f := range s.files() {
+		size += int(f.Size())
+	}
+	return size
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterSpoolReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// left by a previous run
+	sp := newSpool(dir, 1024*1024, time.Hour)
+	sp.Write([]*writerPayload{newWriterPayload(newTestPayload("spooled"), nil)})
+	assert.Len(sp.files(), 1)
+
+	data := make(chan dataFromAPI, 1)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APISpoolDir = dir
+
+	w := NewWriter(conf)
+	w.Run()
+
+	select {
+	case received := <-data:
+		assert.Equal("/api/v0.1/collector", received.urlPath)
+	case <-time.After(time.Second):
+		t.Fatal("the spooled payload was not shipped")
+	}
+
+	w.Stop()
+
+	assert.Len(sp.files(), 0)
+}
+
+func TestWriterSpoolReplayRemainingURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	accepted := make(chan dataFromAPI, 1)
+	acceptedServer := newTestServer(t, accepted)
+	defer acceptedServer.Close()
+	remaining := make(chan dataFromAPI, 1)
+	remainingServer := newTestServer(t, remaining)
+	defer remainingServer.Close()
+
+	// left by a previous run, after the first endpoint accepted it
+	sp := newSpool(dir, 1024*1024, time.Hour)
+	narrowed := NewAPIEndpoint([]string{remainingServer.URL}, []string{"key2"})
+	narrowed.Stop()
+	sp.Write([]*writerPayload{newWriterPayload(newTestPayload("spooled"), narrowed)})
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{acceptedServer.URL, remainingServer.URL}
+	conf.APIKeys = []string{"key1", "key2"}
+	conf.APISpoolDir = dir
+
+	w := NewWriter(conf)
+	w.Run()
+
+	select {
+	case <-remaining:
+	case <-time.After(time.Second):
+		t.Fatal("the spooled payload was not shipped")
+	}
+
+	w.Stop()
+
+	select {
+	case <-accepted:
+		t.Fatal("the spooled payload was sent again where it was accepted")
+	default:
+	}
+	assert.Len(sp.files(), 0)
+}
+
+func TestSpoolReplayBarePayload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// spooled before the URLs were spooled along
+	data, err := json.Marshal(newTestPayload("bare"))
+	assert.Nil(err)
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "1-0"+spoolFileExt), data, 0600))
+
+	payloads := newSpool(dir, 1024*1024, time.Hour).Replay()
+	assert.Len(payloads, 1)
+	assert.Equal("bare", payloads[0].payload.Env)
+	assert.Len(payloads[0].urls, 0)
+}
+
+func TestWriterSpoolOnExit(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	server := newFailingTestServer(t, http.StatusInternalServerError)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APISpoolDir = dir
+
+	w := NewWriter(conf)
+	w.Run()
+	w.Enqueue(newTestPayload("unshipped"))
+	w.Stop()
+
+	sp := newSpool(dir, 1024*1024, time.Hour)
+	payloads := sp.Replay()
+	assert.Len(payloads, 1)
+	assert.Equal("unshipped", payloads[0].payload.Env)
+	assert.Len(payloads[0].payload.Traces, 1)
+	assert.Len(sp.files(), 0)
+}
+
+func TestSpoolBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	p := newWriterPayload(newTestPayload("test"), nil)
+
+	// only room for one payload
+	sp := newSpool(dir, 1, time.Hour)
+	sp.Write([]*writerPayload{p})
+	assert.Len(sp.files(), 0)
+	sp.maxSize = 1024 * 1024
+	sp.Write([]*writerPayload{p})
+	size := sp.size()
+	sp.maxSize = size + 1
+	sp.Write([]*writerPayload{p, p})
+	assert.Len(sp.files(), 1)
+
+	// too old payloads are dropped
+	p.creationDate = time.Now().Add(-2 * time.Hour)
+	sp.maxSize = 1024 * 1024
+	sp.Write([]*writerPayload{p})
+	assert.Len(sp.files(), 2)
+	assert.Len(sp.Replay(), 1)
+	assert.Len(sp.files(), 0)
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -12,12 +17,19 @@ import (
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
-// the amount of time in seconds to wait before resending a payload
+// the amount of time in seconds to wait before resending a payload the first
+// time, doubled at each retry up to payloadMaxResendDelay
 const payloadResendDelay = 5 * time.Second
 
+// the maximum amount of time to wait before resending a payload
+const payloadMaxResendDelay = 2 * time.Minute
+
 // the amount of time in seconds a payload can stay buffered before being dropped
 const payloadMaxAge = 10 * time.Minute
 
+// how often the spooled payloads are sent again while the API is reachable
+const spoolReplayInterval = 5 * time.Minute
+
 // writerPayload wraps a model.AgentPayload and keeps track of a list of
 // endpoints the payload must be sent to.
 type writerPayload struct {
@@ -26,6 +38,7 @@ type writerPayload struct {
 	endpoint     AgentEndpoint      // the endpoints the payload must be sent to
 	creationDate time.Time          // the creation date of the payload
 	nextFlush    time.Time          // The earliest moment we can flush
+	retries      int                // how many times the payload was sent again
 }
 
 func newWriterPayload(p model.AgentPayload, endpoint AgentEndpoint) *writerPayload {
@@ -36,6 +49,25 @@ func newWriterPayload(p model.AgentPayload, endpoint AgentEndpoint) *writerPaylo
 	}
 }
 
+// backoff tells how long to wait before sending a payload again
+type backoff struct {
+	base time.Duration // delay before the first retry, doubled at each retry
+	max  time.Duration // the delay never gets longer than this
+}
+
+// delay returns the delay before the retry-th retry, starting at 0. Half of
+// it is random, so that agents failing at the same time do not all retry at
+// the same time.
+func (b backoff) delay(retry int) time.Duration {
+	d := b.max
+	if retry < 32 {
+		if exp := b.base << uint(retry); exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func (p *writerPayload) write() error {
 	size, err := p.endpoint.Write(p.payload)
 	p.size = size
@@ -46,7 +78,8 @@ func (p *writerPayload) write() error {
 // pre-processed data from channels and tentatively output them
 // to a given endpoint.
 type Writer struct {
-	endpoint AgentEndpoint // where the data will end
+	endpoint     AgentEndpoint            // where the data will end
+	envEndpoints map[string]AgentEndpoint // where the data of these envs ends instead, see splitByEnv
 
 	// input data
 	inPayloads chan model.AgentPayload     // main payloads for processed traces/stats
@@ -55,34 +88,85 @@ type Writer struct {
 	payloadBuffer []*writerPayload       // buffer of payloads ready to send
 	serviceBuffer model.ServicesMetadata // services are merged into this map continuously
 
+	queueDropped int64 // number of payloads dropped because inPayloads was full
+
+	spool *spool // where unshipped payloads are kept across restarts, nil if disabled
+
+	backoff backoff // how long to wait before sending failed payloads again
+
+	breaker     *circuitBreaker            // stops the writes while the main endpoint keeps failing, nil if disabled
+	envBreakers map[string]*circuitBreaker // the same for each of the envEndpoints
+
 	exit   chan struct{}
 	exitWG *sync.WaitGroup
 
 	conf *config.AgentConfig
 }
 
+// configurableEndpoint is an AgentEndpoint whose HTTP client is configurable
+type configurableEndpoint interface {
+	AgentEndpoint
+	SetProxy(*config.ProxySettings)
+	SetTLSConfig(*tls.Config)
+	SetHTTPClientSettings(config.HTTPClientSettings)
+}
+
 // NewWriter returns a new Writer
 func NewWriter(conf *config.AgentConfig) *Writer {
 	var endpoint AgentEndpoint
+	var envEndpoints map[string]AgentEndpoint
 
 	if conf.APIEnabled {
-		endpoint = NewAPIEndpoint(conf.APIEndpoints, conf.APIKeys)
+		var e configurableEndpoint
+		if len(conf.APIFailoverEndpoints) > 0 {
+			e = NewFailoverEndpoint(conf)
+		} else {
+			e = NewAPIEndpoint(conf.APIEndpoints, conf.APIKeys)
+		}
 		if conf.Proxy != nil {
-			// we have some kind of proxy configured.
-			// make sure our http client uses it
 			log.Infof("configuring proxy through host %s", conf.Proxy.Host)
-			endpoint.(*APIEndpoint).SetProxy(conf.Proxy)
+		}
+		if !conf.TLS.IsEmpty() && conf.TLS.SkipVerify {
+			log.Warn("TLS certificate verification of the API is DISABLED, the connection is INSECURE")
+		}
+		configureEndpoint(e, conf)
+		endpoint = e
+
+		envEndpoints = make(map[string]AgentEndpoint, len(conf.APIEnvEndpoints))
+		for env, settings := range conf.APIEnvEndpoints {
+			e := NewAPIEndpoint([]string{settings.URL}, []string{settings.APIKey})
+			configureEndpoint(e, conf)
+			envEndpoints[env] = e
 		}
 	} else {
 		log.Info("API interface is disabled, flushing to /dev/null instead")
 		endpoint = NullEndpoint{}
 	}
 
+	var envBreakers map[string]*circuitBreaker
+	if conf.APIBreakerThreshold > 0 {
+		// one per destination, for one failing not to stop the others
+		envBreakers = make(map[string]*circuitBreaker, len(envEndpoints))
+		for env := range envEndpoints {
+			envBreakers[env] = newCircuitBreaker(conf.APIBreakerThreshold, conf.APIBreakerCooldown)
+		}
+	}
+
+	var sp *spool
+	if conf.APISpoolDir != "" {
+		sp = newSpool(conf.APISpoolDir, conf.APISpoolMaxSize, conf.APISpoolMaxAge)
+	}
+
 	return &Writer{
-		endpoint: endpoint,
+		endpoint:     endpoint,
+		envEndpoints: envEndpoints,
+		spool:        sp,
+		backoff:      backoff{base: payloadResendDelay, max: payloadMaxResendDelay},
+		breaker:      newCircuitBreaker(conf.APIBreakerThreshold, conf.APIBreakerCooldown),
+		envBreakers:  envBreakers,
 
 		// small buffer to not block in case we're flushing
-		inPayloads: make(chan model.AgentPayload, 1),
+		inPayloads: make(chan model.AgentPayload, conf.APIPayloadQueueSize),
 
 		payloadBuffer: make([]*writerPayload, 0, 5),
 		serviceBuffer: make(model.ServicesMetadata),
@@ -94,6 +178,41 @@ func NewWriter(conf *config.AgentConfig) *Writer {
 	}
 }
 
+// configureEndpoint applies the HTTP client settings of conf to e
+func configureEndpoint(e configurableEndpoint, conf *config.AgentConfig) {
+	e.SetHTTPClientSettings(conf.HTTPClient)
+	if conf.Proxy != nil {
+		// we have some kind of proxy configured.
+		// make sure our http client uses it
+		e.SetProxy(conf.Proxy)
+	}
+	if !conf.TLS.IsEmpty() {
+		// already checked by the config validation
+		if tlsConfig, err := conf.TLS.Config(); err != nil {
+			log.Errorf("failed to configure TLS: %v", err)
+		} else {
+			e.SetTLSConfig(tlsConfig)
+		}
+	}
+}
+
+// endpointFor returns where the payloads of env are written
+func (w *Writer) endpointFor(env string) AgentEndpoint {
+	if e, ok := w.envEndpoints[env]; ok {
+		return e
+	}
+	return w.endpoint
+}
+
+// breakerFor returns the circuit breaker of the endpoint the payloads of env
+// are sent to, nil if disabled
+func (w *Writer) breakerFor(env string) *circuitBreaker {
+	if b, ok := w.envBreakers[env]; ok {
+		return b
+	}
+	return w.breaker
+}
+
 // isPayloadBufferingEnabled returns true if payload buffering is enabled or
 // false if it is not.
 func (w *Writer) isPayloadBufferingEnabled() bool {
@@ -118,17 +237,32 @@ func (w *Writer) main() {
 	flushTicker := time.NewTicker(time.Second)
 	defer flushTicker.Stop()
 
+	var spoolReplay <-chan time.Time
+	if w.spool != nil {
+		w.replaySpool()
+		if len(w.payloadBuffer) > 0 {
+			w.Flush()
+		}
+		spoolTicker := time.NewTicker(spoolReplayInterval)
+		defer spoolTicker.Stop()
+		spoolReplay = spoolTicker.C
+	}
+
 	for {
 		select {
 		case p := <-w.inPayloads:
 			if p.IsEmpty() {
 				continue
 			}
-			w.payloadBuffer = append(w.payloadBuffer,
-				newWriterPayload(p, w.endpoint))
+			w.bufferPayload(p)
 			w.Flush()
 		case <-flushTicker.C:
 			w.Flush()
+		case <-spoolReplay:
+			// the payloads of the endpoints still failing are
+			// short-circuited back to the spool
+			w.replaySpool()
+			w.Flush()
 		case sm := <-w.inServices:
 			updated := w.serviceBuffer.Update(sm)
 			if updated {
@@ -136,16 +270,268 @@ func (w *Writer) main() {
 			}
 		case <-w.exit:
 			log.Info("exiting, trying to flush all remaining data")
+			w.drainPayloads()
 			w.Flush()
+			if w.spool != nil {
+				w.spool.Write(w.payloadBuffer)
+				w.payloadBuffer = nil
+			}
 			return
 		}
 	}
 }
 
+// replaySpool buffers the spooled payloads to be written
+func (w *Writer) replaySpool() {
+	for _, sp := range w.spool.Replay() {
+		endpoint := w.endpointFor(sp.payload.Env)
+		if e, ok := endpoint.(*APIEndpoint); ok && len(sp.urls) > 0 {
+			// only where it was not accepted yet
+			narrowed := e.only(sp.urls)
+			if narrowed == nil {
+				log.Infof("dropping spooled payload, none of %v is configured anymore", sp.urls)
+				continue
+			}
+			endpoint = narrowed
+		}
+		p := newWriterPayload(sp.payload, endpoint)
+		p.creationDate = sp.creationDate
+		w.payloadBuffer = append(w.payloadBuffer, p)
+	}
+}
+
+// drainPayloads buffers the payloads still waiting in the queue
+func (w *Writer) drainPayloads() {
+	for {
+		select {
+		case p := <-w.inPayloads:
+			if !p.IsEmpty() {
+				w.bufferPayload(p)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// bufferPayload buffers p to be written, split in several payloads if it is
+// larger than the max payload size
+func (w *Writer) bufferPayload(p model.AgentPayload) {
+	if max := w.conf.APIMaxTraceDepth; max > 0 {
+		truncateTraceDepths(p.Traces, max)
+	}
+
+	for _, ep := range splitByEnv(p, w.envEndpoints) {
+		payloads, dropped := splitPayload(ep, w.conf.APIMaxPayloadSize)
+		if dropped > 0 {
+			log.Infof("dropping %d traces (larger than the max payload size of %d bytes)", dropped, w.conf.APIMaxPayloadSize)
+			statsd.Client.Count("datadog.trace_agent.writer.dropped_traces",
+				int64(dropped), []string{"reason:too_large"}, 1)
+		}
+		if len(payloads) > 1 {
+			statsd.Client.Count("datadog.trace_agent.writer.split_payload",
+				int64(len(payloads)), nil, 1)
+		}
+		endpoint := w.endpointFor(ep.Env)
+		for _, sp := range payloads {
+			w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(sp, endpoint))
+		}
+	}
+}
+
+// splitByEnv splits p in a payload for each env of routed, with that Env,
+// holding its traces and stats, and one with the rest, keeping the Env of p.
+// Traces are routed by their env meta, stats by their env tag. The empty
+// payloads are left out.
+func splitByEnv(p model.AgentPayload, routed map[string]AgentEndpoint) []model.AgentPayload {
+	if len(routed) == 0 {
+		return []model.AgentPayload{p}
+	}
+
+	rest := model.AgentPayload{HostName: p.HostName, Env: p.Env, Tags: p.Tags}
+	byEnv := make(map[string]*model.AgentPayload)
+	payloadFor := func(env string) *model.AgentPayload {
+		if _, ok := routed[env]; !ok {
+			return &rest
+		}
+		ep, ok := byEnv[env]
+		if !ok {
+			ep = &model.AgentPayload{HostName: p.HostName, Env: env, Tags: p.Tags}
+			byEnv[env] = ep
+		}
+		return ep
+	}
+
+	for _, t := range p.Traces {
+		ep := payloadFor(t.GetEnv())
+		ep.Traces = append(ep.Traces, t)
+	}
+
+	for _, b := range p.Stats {
+		buckets := make(map[*model.AgentPayload]model.StatsBucket)
+		bucketFor := func(env string) model.StatsBucket {
+			ep := payloadFor(env)
+			eb, ok := buckets[ep]
+			if !ok {
+				eb = model.NewStatsBucket(b.Start, b.Duration)
+				buckets[ep] = eb
+			}
+			return eb
+		}
+		for k, c := range b.Counts {
+			bucketFor(c.TagSet.Get("env").Value).Counts[k] = c
+		}
+		for k, d := range b.Distributions {
+			bucketFor(d.TagSet.Get("env").Value).Distributions[k] = d
+		}
+		for ep, eb := range buckets {
+			ep.Stats = append(ep.Stats, eb)
+		}
+	}
+
+	envs := make([]string, 0, len(byEnv))
+	for env := range byEnv {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	payloads := make([]model.AgentPayload, 0, len(envs)+1)
+	if !rest.IsEmpty() {
+		payloads = append(payloads, rest)
+	}
+	for _, env := range envs {
+		payloads = append(payloads, *byEnv[env])
+	}
+	return payloads
+}
+
+// truncateTraceDepths truncates in place the traces nested deeper than max,
+// see model.Trace.TruncateDepth
+func truncateTraceDepths(traces []model.Trace, max int) {
+	for i, t := range traces {
+		truncated, removed := t.TruncateDepth(max)
+		if removed == 0 {
+			continue
+		}
+		traceLog.Debugf("truncating trace %d: %d spans deeper than %d levels", t[0].TraceID, removed, max)
+		statsd.Client.Count("datadog.trace_agent.writer.truncated_traces", 1, []string{"reason:too_deep"}, 1)
+		statsd.Client.Count("datadog.trace_agent.writer.truncated_spans", int64(removed), []string{"reason:too_deep"}, 1)
+		traces[i] = truncated
+	}
+}
+
+// splitPayload splits p in payloads whose JSON encoding is at most maxSize
+// bytes before compression, the worst case of the size of the requests.
+// The stats all go in the first payload, and the traces fill the payloads in
+// order. The traces too large to fit in any payload are dropped, splitPayload
+// returns how many. A maxSize <= 0 disables the splitting.
+func splitPayload(p model.AgentPayload, maxSize int) ([]model.AgentPayload, int) {
+	if maxSize <= 0 {
+		return []model.AgentPayload{p}, 0
+	}
+
+	// the size of an empty payload, without the traces nor the stats,
+	// which encode as null: the same size as [] and a separator
+	empty := model.AgentPayload{HostName: p.HostName, Env: p.Env, Tags: p.Tags}
+	baseSize := encodedSize(empty)
+
+	cur := empty
+	cur.Stats = p.Stats
+	curSize := baseSize
+	if len(p.Stats) > 0 {
+		curSize = encodedSize(cur)
+	}
+
+	var payloads []model.AgentPayload
+	dropped := 0
+	for _, t := range p.Traces {
+		size := encodedSize(t) + 1 // and a comma
+		if baseSize+size > maxSize {
+			dropped++
+			continue
+		}
+		if curSize+size > maxSize {
+			payloads = append(payloads, cur)
+			cur, curSize = empty, baseSize
+		}
+		cur.Traces = append(cur.Traces, t)
+		curSize += size
+	}
+	if !cur.IsEmpty() {
+		payloads = append(payloads, cur)
+	}
+
+	return payloads, dropped
+}
+
+// encodedSize returns the size of the JSON encoding of v
+func encodedSize(v interface{}) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// Enqueue queues a payload to be written, applying the configured queue
+// policy when the writer is lagging behind and the queue is full
+func (w *Writer) Enqueue(p model.AgentPayload) {
+	switch w.conf.APIPayloadQueuePolicy {
+	case config.QueuePolicyDropNewest:
+		select {
+		case w.inPayloads <- p:
+		default:
+			w.dropQueued()
+		}
+	case config.QueuePolicyDropOldest:
+		for queued := false; !queued; {
+			select {
+			case w.inPayloads <- p:
+				queued = true
+			default:
+				select {
+				case <-w.inPayloads:
+					w.dropQueued()
+				default:
+				}
+			}
+		}
+	default:
+		w.inPayloads <- p
+	}
+
+	statsd.Client.Gauge("datadog.trace_agent.writer.payload_queue_depth",
+		float64(len(w.inPayloads)), nil, 1)
+}
+
+func (w *Writer) dropQueued() {
+	atomic.AddInt64(&w.queueDropped, 1)
+	log.Info("dropping 1 payload (payload queue full)")
+	statsd.Client.Count("datadog.trace_agent.writer.dropped_payload",
+		int64(1), []string{"reason:queue_full"}, 1)
+}
+
+// QueueDropped returns the number of payloads dropped because the queue was full
+func (w *Writer) QueueDropped() int64 {
+	return atomic.LoadInt64(&w.queueDropped)
+}
+
 // Stop stops the main Run loop
 func (w *Writer) Stop() {
 	close(w.exit)
 	w.exitWG.Wait()
+
+	switch endpoint := w.endpoint.(type) {
+	case *APIEndpoint:
+		endpoint.Stop()
+	case *FailoverEndpoint:
+		endpoint.Stop()
+	}
+	for _, endpoint := range w.envEndpoints {
+		if e, ok := endpoint.(*APIEndpoint); ok {
+			e.Stop()
+		}
+	}
 }
 
 // FlushServices initiate a flush of the services to the services endpoint
@@ -168,6 +554,10 @@ func (w *Writer) Flush() {
 
 	nbSuccesses := 0
 	nbErrors := 0
+	nbRetries := 0
+	var exhausted []*writerPayload
+	var shortCircuited []*writerPayload
+	recovered := false
 
 	for _, p := range w.payloadBuffer {
 		if w.isPayloadBufferingEnabled() && p.nextFlush.After(now) {
@@ -177,8 +567,21 @@ func (w *Writer) Flush() {
 			continue
 		}
 
+		breaker := w.breakerFor(p.payload.Env)
+		if !breaker.Allow() {
+			// The endpoint kept failing, do not even try for now
+			shortCircuited = append(shortCircuited, p)
+			continue
+		}
+
 		err := p.write()
 
+		if err != nil {
+			breaker.Failure()
+		} else if breaker.Success() {
+			recovered = true
+		}
+
 		if err == nil {
 			nbSuccesses++
 		} else {
@@ -189,7 +592,7 @@ func (w *Writer) Flush() {
 			continue
 		}
 
-		if terr, ok := err.(*apiError); ok {
+		if terr, ok := err.(endpointError); ok {
 			// We could not send the payload and this is an API
 			// endpoint error, so we can try again later.
 
@@ -200,15 +603,74 @@ func (w *Writer) Flush() {
 				continue
 			}
 
-			p.nextFlush = now.Add(payloadResendDelay)
+			if max := w.conf.APIPayloadMaxRetries; max > 0 && p.retries >= max {
+				// We tried enough, spool it if we can to try again
+				// after a restart, or drop it.
+				exhausted = append(exhausted, p)
+				continue
+			}
+
+			delay := w.backoff.delay(p.retries)
+			if rerr, ok := err.(retryAfterError); ok && rerr.retryAfter() > delay {
+				// The endpoint told us when to come back
+				delay = rerr.retryAfter()
+			}
+			p.nextFlush = now.Add(delay)
+			p.retries++
+			nbRetries++
 
 			// Keep this payload in the buffer to try again later,
 			// but only with the endpoints that failed.
-			p.endpoint = terr.endpoint
+			p.endpoint = terr.retryEndpoint()
 			bufferPayload(p)
 		}
 	}
 
+	if nbRetries > 0 {
+		statsd.Client.Count("datadog.trace_agent.writer.retries",
+			int64(nbRetries), nil, 1)
+	}
+
+	if len(exhausted) > 0 {
+		if w.spool != nil {
+			log.Infof("spooling %d payloads (max retries reached)", len(exhausted))
+			statsd.Client.Count("datadog.trace_agent.writer.retries_exhausted",
+				int64(len(exhausted)), []string{"action:spool"}, 1)
+			w.spool.Write(exhausted)
+		} else {
+			log.Infof("dropping %d payloads (max retries reached)", len(exhausted))
+			statsd.Client.Count("datadog.trace_agent.writer.dropped_payload",
+				int64(len(exhausted)), []string{"reason:max_retries"}, 1)
+		}
+	}
+
+	if len(shortCircuited) > 0 {
+		if w.spool != nil {
+			log.Debugf("spooling %d payloads (circuit open)", len(shortCircuited))
+			statsd.Client.Count("datadog.trace_agent.writer.circuit_open",
+				int64(len(shortCircuited)), []string{"action:spool"}, 1)
+			w.spool.Write(shortCircuited)
+		} else if w.isPayloadBufferingEnabled() {
+			statsd.Client.Count("datadog.trace_agent.writer.circuit_open",
+				int64(len(shortCircuited)), []string{"action:buffer"}, 1)
+			for _, p := range shortCircuited {
+				bufferPayload(p)
+			}
+		} else {
+			log.Infof("dropping %d payloads (circuit open)", len(shortCircuited))
+			statsd.Client.Count("datadog.trace_agent.writer.dropped_payload",
+				int64(len(shortCircuited)), []string{"reason:circuit_open"}, 1)
+		}
+	}
+	if w.breaker != nil {
+		statsd.Client.Gauge("datadog.trace_agent.writer.circuit_breaker",
+			float64(w.breaker.State()), []string{"endpoint:main"}, 1)
+	}
+	for env, b := range w.envBreakers {
+		statsd.Client.Gauge("datadog.trace_agent.writer.circuit_breaker",
+			float64(b.State()), []string{"endpoint:" + env}, 1)
+	}
+
 	if nbSuccesses > 0 {
 		statsd.Client.Count("datadog.trace_agent.writer.flush",
 			int64(nbSuccesses), []string{"status:success"}, 1)
@@ -238,4 +700,9 @@ func (w *Writer) Flush() {
 		float64(bufSize), nil, 1)
 
 	w.payloadBuffer = payloads
+
+	if recovered && w.spool != nil {
+		// send what was spooled while the circuit was open
+		w.replaySpool()
+	}
 }
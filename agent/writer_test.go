@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -258,3 +261,424 @@ func TestWriterDisabledBuffering(t *testing.T) {
 	// dropped and the buffer should be empty.
 	assert.Equal(0, len(w.payloadBuffer))
 }
+
+func TestWriterQueuePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	newStalledWriter := func(policy string) *Writer {
+		conf := config.NewDefaultAgentConfig()
+		conf.APIEnabled = false
+		conf.APIPayloadQueueSize = 2
+		conf.APIPayloadQueuePolicy = policy
+		// never Run, so the queue is never consumed
+		return NewWriter(conf)
+	}
+
+	queued := func(w *Writer) []string {
+		var envs []string
+		for len(w.inPayloads) > 0 {
+			envs = append(envs, (<-w.inPayloads).Env)
+		}
+		return envs
+	}
+
+	w := newStalledWriter(config.QueuePolicyDropNewest)
+	for _, env := range []string{"p0", "p1", "p2", "p3"} {
+		w.Enqueue(newTestPayload(env))
+	}
+	assert.Equal(int64(2), w.QueueDropped())
+	assert.Equal([]string{"p0", "p1"}, queued(w))
+
+	w = newStalledWriter(config.QueuePolicyDropOldest)
+	for _, env := range []string{"p0", "p1", "p2", "p3"} {
+		w.Enqueue(newTestPayload(env))
+	}
+	assert.Equal(int64(2), w.QueueDropped())
+	assert.Equal([]string{"p2", "p3"}, queued(w))
+
+	w = newStalledWriter(config.QueuePolicyBlock)
+	w.Enqueue(newTestPayload("p0"))
+	w.Enqueue(newTestPayload("p1"))
+	done := make(chan struct{})
+	go func() {
+		w.Enqueue(newTestPayload("p2"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("enqueue should block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Equal("p0", (<-w.inPayloads).Env)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue should resume once the queue has room")
+	}
+	assert.Equal(int64(0), w.QueueDropped())
+	assert.Equal([]string{"p1", "p2"}, queued(w))
+}
+
+func TestBackoffDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	b := backoff{base: time.Second, max: 10 * time.Second}
+	for retry, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		for i := 0; i < 100; i++ {
+			d := b.delay(retry)
+			assert.True(d >= max/2 && d <= max, "retry %d: %s not in [%s, %s]", retry, d, max/2, max)
+		}
+	}
+	// no overflow on large retry counts
+	for _, retry := range []int{31, 32, 64, 1000} {
+		d := b.delay(retry)
+		assert.True(d >= 5*time.Second && d <= 10*time.Second, "retry %d: %s", retry, d)
+	}
+}
+
+// newFlakyTestServer returns a server answering status to the first fails
+// requests, and then forwarding them to data
+func newFlakyTestServer(t *testing.T, data chan dataFromAPI, fails int, status int, header http.Header) *httptest.Server {
+	var requests int
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= fails {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		data <- dataFromAPI{urlPath: r.URL.Path, urlParams: r.URL.Query(), header: r.Header}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestWriterRetryBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 1)
+	server := newFlakyTestServer(t, data, 2, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	w := NewWriter(conf)
+	defer w.endpoint.(*APIEndpoint).Stop()
+	w.backoff = backoff{base: 10 * time.Millisecond, max: 50 * time.Millisecond}
+
+	w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload("test"), w.endpoint))
+
+	deadline := time.After(5 * time.Second)
+	for {
+		w.Flush()
+		select {
+		case received := <-data:
+			assert.Equal("/api/v0.1/collector", received.urlPath)
+			assert.Empty(w.payloadBuffer)
+			return
+		case <-deadline:
+			t.Fatal("the payload should have landed after two failures")
+		case <-time.After(10 * time.Millisecond):
+			if assert.Len(w.payloadBuffer, 1) {
+				assert.True(w.payloadBuffer[0].retries <= 2)
+			}
+		}
+	}
+}
+
+func TestWriterRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 1)
+	server := newFlakyTestServer(t, data, 1, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"60"}})
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	w := NewWriter(conf)
+	defer w.endpoint.(*APIEndpoint).Stop()
+	w.backoff = backoff{base: time.Millisecond, max: time.Millisecond}
+
+	start := time.Now()
+	w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload("test"), w.endpoint))
+	w.Flush()
+
+	// 429 is retried, but not before the server asked to
+	if assert.Len(w.payloadBuffer, 1) {
+		p := w.payloadBuffer[0]
+		assert.Equal(1, p.retries)
+		assert.True(p.nextFlush.Sub(start) >= time.Minute, "next flush in %s", p.nextFlush.Sub(start))
+	}
+
+	assert.Equal(30*time.Second, parseRetryAfter("30", start))
+	assert.Equal(time.Duration(0), parseRetryAfter("", start))
+	assert.Equal(time.Duration(0), parseRetryAfter("soon", start))
+	assert.Equal(time.Duration(0), parseRetryAfter("-1", start))
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(2*time.Minute, parseRetryAfter(now.Add(2*time.Minute).Format(http.TimeFormat), now))
+}
+
+func TestWriterMaxRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newFailingTestServer(t, http.StatusInternalServerError)
+	defer server.Close()
+
+	newWriter := func(spoolDir string) *Writer {
+		conf := config.NewDefaultAgentConfig()
+		conf.APIEndpoints = []string{server.URL}
+		conf.APIKeys = []string{"key"}
+		conf.APIPayloadMaxRetries = 2
+		conf.APISpoolDir = spoolDir
+		w := NewWriter(conf)
+		w.backoff = backoff{}
+		w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload("test"), w.endpoint))
+		return w
+	}
+
+	// the first write and two retries, then the payload is dropped
+	w := newWriter("")
+	defer w.endpoint.(*APIEndpoint).Stop()
+	for i := 0; i < 2; i++ {
+		w.Flush()
+		assert.Len(w.payloadBuffer, 1)
+	}
+	w.Flush()
+	assert.Empty(w.payloadBuffer)
+
+	// or spooled when possible
+	dir, err := ioutil.TempDir("", "trace-agent-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w = newWriter(dir)
+	defer w.endpoint.(*APIEndpoint).Stop()
+	for i := 0; i < 3; i++ {
+		w.Flush()
+	}
+	assert.Empty(w.payloadBuffer)
+	replayed := w.spool.Replay()
+	if assert.Len(replayed, 1) {
+		assert.Equal("test", replayed[0].payload.Env)
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newTestPayload("test")
+	p.Traces = nil
+	for i := 0; i < 100; i++ {
+		p.Traces = append(p.Traces, model.Trace{fixtures.TestSpan()})
+	}
+
+	// no limit, no split
+	payloads, dropped := splitPayload(p, 0)
+	assert.Equal([]model.AgentPayload{p}, payloads)
+	assert.Equal(0, dropped)
+
+	maxSize := encodedSize(p) / 4
+	payloads, dropped = splitPayload(p, maxSize)
+	assert.Equal(0, dropped)
+	assert.True(len(payloads) >= 4, "expected at least 4 payloads, got %d", len(payloads))
+
+	var traces []model.Trace
+	for i, sp := range payloads {
+		assert.True(encodedSize(sp) <= maxSize, "payload %d is %d bytes", i, encodedSize(sp))
+		assert.Equal(p.HostName, sp.HostName)
+		assert.Equal(p.Env, sp.Env)
+		if i == 0 {
+			assert.Equal(p.Stats, sp.Stats)
+		} else {
+			assert.Empty(sp.Stats)
+		}
+		traces = append(traces, sp.Traces...)
+	}
+	// nothing lost, in order
+	assert.Equal(p.Traces, traces)
+
+	// a trace too large on its own is dropped instead of being sent alone
+	large := model.Trace{}
+	for i := 0; i < 100; i++ {
+		large = append(large, fixtures.TestSpan())
+	}
+	p.Traces = []model.Trace{p.Traces[0], large, p.Traces[1]}
+	payloads, dropped = splitPayload(p, encodedSize(large))
+	assert.Equal(1, dropped)
+	if assert.Len(payloads, 1) {
+		assert.Len(payloads[0].Traces, 2)
+	}
+}
+
+func TestWriterMaxPayloadSize(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 100)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	model.GlobalAgentPayloadCompression = false
+	defer func() { model.GlobalAgentPayloadCompression = true }()
+
+	p := newTestPayload("test")
+	p.Traces = nil
+	for i := 0; i < 1000; i++ {
+		p.Traces = append(p.Traces, model.Trace{fixtures.TestSpan()})
+	}
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIMaxPayloadSize = 64 * 1024
+	w := NewWriter(conf)
+	w.Run()
+	w.Enqueue(p)
+	w.Stop()
+
+	requests := len(data)
+	assert.True(requests > 1, "expected several requests, got %d", requests)
+	traces := 0
+	for i := 0; i < requests; i++ {
+		received := <-data
+		assert.True(len(received.body) <= conf.APIMaxPayloadSize, "request of %d bytes", len(received.body))
+		var sp model.AgentPayload
+		assert.NoError(json.Unmarshal([]byte(received.body), &sp))
+		traces += len(sp.Traces)
+	}
+	assert.Equal(len(p.Traces), traces)
+}
+
+func TestWriterMaxTraceDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 100)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	model.GlobalAgentPayloadCompression = false
+	defer func() { model.GlobalAgentPayloadCompression = true }()
+
+	// a pathological trace, nested 100000 levels deep
+	deep := make(model.Trace, 100000)
+	for i := range deep {
+		deep[i] = model.Span{TraceID: 42, SpanID: uint64(i + 1), ParentID: uint64(i), Service: "s", Name: "n"}
+	}
+	p := newTestPayload("test")
+	p.Traces = []model.Trace{deep, {fixtures.TestSpan()}}
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIMaxTraceDepth = 64
+	w := NewWriter(conf)
+	w.Run()
+	w.Enqueue(p)
+	w.Stop()
+
+	if !assert.Equal(1, len(data)) {
+		return
+	}
+	var sp model.AgentPayload
+	assert.NoError(json.Unmarshal([]byte((<-data).body), &sp))
+	if assert.Len(sp.Traces, 2) {
+		// the root, 64 levels below it and the truncation marker
+		assert.Len(sp.Traces[0], 66)
+		marker := sp.Traces[0][65]
+		assert.Equal(model.TruncatedSpanName, marker.Name)
+		assert.Equal(float64(100000-65), marker.Metrics[model.TruncatedSpansMetricKey])
+		assert.Len(sp.Traces[1], 1)
+	}
+}
+
+func TestWriterEnvEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	model.GlobalAgentPayloadCompression = false
+	defer func() { model.GlobalAgentPayloadCompression = true }()
+
+	servers := make(map[string]*httptest.Server)
+	data := make(map[string]chan dataFromAPI)
+	for _, name := range []string{"main", "prod", "staging"} {
+		data[name] = make(chan dataFromAPI, 10)
+		servers[name] = newTestServer(t, data[name])
+		defer servers[name].Close()
+	}
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{servers["main"].URL}
+	conf.APIKeys = []string{"main_key"}
+	conf.APIEnvEndpoints = map[string]config.APIEndpointSettings{
+		"prod":    {URL: servers["prod"].URL, APIKey: "prod_key"},
+		"staging": {URL: servers["staging"].URL, APIKey: "staging_key"},
+	}
+
+	// a trace and stats of each env, and of an env without its own endpoint
+	p := model.AgentPayload{HostName: "test.host", Env: conf.DefaultEnv}
+	srb := model.NewStatsRawBucket(0, 1e9)
+	for i, env := range []string{"prod", "staging", "qa", conf.DefaultEnv} {
+		span := fixtures.TestSpan()
+		span.TraceID = uint64(i + 1)
+		span.Meta = map[string]string{"env": env}
+		if env == conf.DefaultEnv {
+			delete(span.Meta, "env")
+		}
+		p.Traces = append(p.Traces, model.Trace{span})
+		srb.HandleSpan(span, env, nil, 1, nil)
+	}
+	p.Stats = []model.StatsBucket{srb.Export()}
+
+	w := NewWriter(conf)
+	w.Run()
+	w.Enqueue(p)
+	w.Stop()
+
+	for name, envs := range map[string][]string{
+		"main":    {conf.DefaultEnv, "qa"},
+		"prod":    {"prod"},
+		"staging": {"staging"},
+	} {
+		if !assert.Len(data[name], 1, name) {
+			continue
+		}
+		received := <-data[name]
+		assert.Equal([]string{name + "_key"}, received.urlParams["api_key"], name)
+
+		var sp model.AgentPayload
+		assert.NoError(json.Unmarshal([]byte(received.body), &sp))
+		if name != "main" {
+			assert.Equal(name, sp.Env)
+		}
+		var traceEnvs []string
+		for _, t := range sp.Traces {
+			env := t.GetEnv()
+			if env == "" {
+				env = conf.DefaultEnv
+			}
+			traceEnvs = append(traceEnvs, env)
+		}
+		sort.Strings(traceEnvs)
+		assert.Equal(envs, traceEnvs, name)
+
+		statsEnvs := make(map[string]bool)
+		if assert.Len(sp.Stats, 1, name) {
+			assert.Equal(p.Stats[0].Start, sp.Stats[0].Start)
+			assert.NotEmpty(sp.Stats[0].Distributions, name)
+			for _, c := range sp.Stats[0].Counts {
+				statsEnvs[c.TagSet.Get("env").Value] = true
+			}
+			for _, d := range sp.Stats[0].Distributions {
+				assert.Contains(envs, d.TagSet.Get("env").Value, name)
+			}
+		}
+		assert.Len(statsEnvs, len(envs), name)
+		for _, env := range envs {
+			assert.True(statsEnvs[env], "%s: no stats of %s", name, env)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
@@ -27,33 +30,96 @@ type AgentConfig struct {
 	HostName   string
 	DefaultEnv string // the traces will default to this environment
 
+	// ExcludeRoots are the resources or names of the roots of the traces
+	// neither sampled nor aggregated, exactly or as globs with * and ?
+	ExcludeRoots []string
+
+	// RootBySpanKind prefers the server or consumer spans as roots of the
+	// traces having several spans without parent, see model.SpanKindMetaKey
+	RootBySpanKind bool
+
+	// Host tags, attached to the flushed payloads
+	HostTagsProviders []string      // where to collect them from, see HostTagsProviderEC2
+	HostTagsTTL       time.Duration // how long they are cached
+
 	// API
 	APIEndpoints            []string
 	APIKeys                 []string `json:"-"` // never publish this
 	APIEnabled              bool
 	APIPayloadBufferMaxSize int
+	APIPayloadCompression   bool                  // gzip the payloads
+	APIPayloadQueueSize     int                   // how many flushed payloads can wait for the writer
+	APIPayloadQueuePolicy   string                // what to do when the payload queue is full, see QueuePolicyBlock
+	APIPayloadMaxRetries    int                   // how many times a failed payload is sent again before spooling or dropping it, 0 for no limit
+	APIMaxPayloadSize       int                   // flushes larger than this, in bytes before compression, are split in several payloads, 0 for no limit
+	APIMaxTraceDepth        int                   // spans nested deeper than this below their root are not shipped, 0 for no limit
+	APIFailoverEndpoints    []APIEndpointSettings // tried in order when the main endpoints fail
+	APISpoolDir             string                // where unshipped payloads are kept across restarts, disabled if empty
+	APISpoolMaxSize         int                   // the maximum size of the spool in bytes
+	APISpoolMaxAge          time.Duration         // spooled payloads older than this are not replayed
+	APIBreakerThreshold     int                   // consecutive failed writes after which the writes stop for a while, disabled if 0
+	APIBreakerCooldown      time.Duration         // how long the writes stop before testing the API again
+
+	// Where the traces and stats of these envs are sent instead of the
+	// main endpoints, keyed by normalized env
+	APIEnvEndpoints map[string]APIEndpointSettings
 
 	// Concentrator
 	BucketInterval   time.Duration // the size of our pre-aggregation per bucket
+	FlushJitter      float64       // the flushes happen every BucketInterval ± this fraction of it
 	ExtraAggregators []string
+	MaxResources     int // distinct (service, resource) aggregated per bucket, the others are aggregated together, 0 for no limit
+
+	// Checkpoints of the stats being aggregated, restored at startup not to
+	// lose them on a crash
+	StatsCheckpointDir      string        // where they are written, disabled if empty
+	StatsCheckpointInterval time.Duration // how often they are written, at least MinStatsCheckpointInterval
+	StatsCheckpointMaxSize  int           // the maximum size of a checkpoint in bytes, larger ones are not written
 
 	// Sampler configuration
-	ExtraSampleRate float64
-	MaxTPS          float64
+	SamplerEngine         string // the sampling strategy, see SamplerEngineSignature, or a comma separated list of them
+	SamplerCombine        string // how the decisions of several engines are combined, see SamplerCombineAll
+	SamplerShadowEngine   string // engines whose decisions are only compared to the ones of SamplerEngine, disabled if empty
+	ExtraSampleRate       float64
+	MaxTPS                float64
+	MaxTracesPerFlush     int           // the sampled traces are downsampled to this many at flush, disabled if 0
+	HonorSamplingPriority bool          // keep or drop traces as requested by their client sampling priority
+	KeepTypes             []string      // always keep traces having a span of one of these types
+	KeepTypesBypassMaxTPS bool          // traces kept for their types are not subject to MaxTPS
+	KeepTags              []string      // keep traces having a span with one of these key:value (or key) meta, subject to MaxTPS
+	SignatureWithVersion  bool          // sample each version of a service, from the root "version" meta, independently
+	SignatureIgnoreError  bool          // sample the errors and successes of a same endpoint together
+	SignatureRootFields   []string      // what the signatures cover of the root span, see SignatureFieldService
+	SignatureSpanFields   []string      // what the signatures cover of each span, see SignatureFieldService
+	SignatureCacheSize    int           // number of trace shapes whose signature is memoized, disabled if 0
+	SamplerWarmup         time.Duration // for how long after the start the sample rate is capped
+	SamplerWarmupRate     float64       // the sample rate cap during the warmup
+	AnomalyBoost          float64       // multiplies the sample rate of anomalous traces, disabled if <= 1
+	AnomalyThreshold      float64       // roots slower than this many standard deviations of their signature are anomalies
+	FullSampleBelowTPS    float64       // keep all the traces of the signatures with a lower throughput, disabled if 0
+	KeepOnePerSignature   bool          // keep at least one trace of each signature seen between two flushes, within the max TPS
+	DedupeTraces          bool          // drop the traces received again, with the same trace and root IDs
+	SamplingRules         []string      // rate of the traces whose root matches, see model.ParseSamplingRule
 
 	// Receiver
-	ReceiverHost    string
-	ReceiverPort    int
-	ConnectionLimit int // for rate-limiting, how many unique connections to allow in a lease period (30s)
-	ReceiverTimeout int
+	ReceiverHost     string
+	ReceiverPort     int
+	ConnectionLimit  int // for rate-limiting, how many unique connections to allow in a lease period (30s)
+	ReceiverTimeout  int
+	MaxSpansPerTrace int    // traces with more spans are truncated, no limit if 0
+	DebugHost        string // where the debug endpoints (expvar, pprof, /health...) listen, along with DebugPort
+	DebugPort        int    // listen on this port for the debug endpoints, instead of the receiver one if 0
 
 	// internal telemetry
-	StatsdHost string
-	StatsdPort int
+	StatsdHost        string
+	StatsdPort        int
+	StatsdPrefix      string // prepended to the names of the metrics instead of "datadog.trace_agent."
+	PrometheusMetrics bool   // also expose the internal metrics on the receiver port, at /metrics
 
 	// logging
-	LogLevel    string
-	LogFilePath string
+	LogLevel       string
+	LogFilePath    string
+	LogSampleEvery int // only log 1 in this many of the debug lines written for each trace
 
 	// watchdog
 	MaxMemory        float64       // MaxMemory is the threshold (bytes allocated) above which program panics and exits, to be restarted
@@ -62,6 +128,98 @@ type AgentConfig struct {
 
 	// http/s proxying
 	Proxy *ProxySettings
+
+	// TLS configuration of the connections to the intake
+	TLS TLSSettings
+
+	// timeouts and pooling of the connections to the intake
+	HTTPClient HTTPClientSettings
+}
+
+// APIEndpointSettings describes an intake endpoint along with the API key to use
+type APIEndpointSettings struct {
+	URL    string
+	APIKey string `json:"-"` // never publish this
+}
+
+// Sampling strategies the agent can use
+const (
+	// SamplerEngineSignature keeps traces based on the score of their signature
+	SamplerEngineSignature = "signature"
+	// SamplerEngineDeterministic keeps a fixed ratio, extra_sample_rate, of the traces
+	SamplerEngineDeterministic = "deterministic"
+)
+
+// Span fields the signatures can cover, besides the env which they always do
+const (
+	SignatureFieldService  = "service"
+	SignatureFieldName     = "name"
+	SignatureFieldResource = "resource"
+	SignatureFieldError    = "error"
+	SignatureFieldType     = "type"
+	// SignatureFieldMetaPrefix followed by a key covers the value of that
+	// meta, e.g. meta.http.status_code
+	SignatureFieldMetaPrefix = "meta."
+)
+
+// Providers of tags describing the host
+const (
+	// HostTagsProviderEC2 reads the region, zone and instance type from the EC2 metadata
+	HostTagsProviderEC2 = "ec2"
+	// HostTagsProviderContainer reads the ID of the container the agent runs in from its cgroups
+	HostTagsProviderContainer = "container"
+)
+
+// How the decisions of several sampler engines are combined
+const (
+	// SamplerCombineAll keeps a trace if all the engines keep it
+	SamplerCombineAll = "all"
+	// SamplerCombineAny keeps a trace if any engine keeps it
+	SamplerCombineAny = "any"
+)
+
+// Policies applied when a flushed payload does not fit in the writer payload queue
+const (
+	// QueuePolicyBlock waits for the writer to make room, stalling the flushes
+	QueuePolicyBlock = "block"
+	// QueuePolicyDropOldest drops the oldest queued payload to make room
+	QueuePolicyDropOldest = "drop_oldest"
+	// QueuePolicyDropNewest drops the payload being queued
+	QueuePolicyDropNewest = "drop_newest"
+)
+
+// MinStatsCheckpointInterval is the shortest StatsCheckpointInterval, not to
+// spend the time writing the stats rather than aggregating them
+const MinStatsCheckpointInterval = 10 * time.Second
+
+// redactedSecret replaces any secret in the output of RedactedString
+const redactedSecret = "***"
+
+// RedactedString returns a JSON representation of the configuration with
+// every secret (API keys, proxy password) masked, so it is safe to log.
+func (c *AgentConfig) RedactedString() string {
+	redacted := *c
+	if c.Proxy != nil {
+		p := *c.Proxy
+		if p.Password != "" {
+			p.Password = redactedSecret
+		}
+		redacted.Proxy = &p
+	}
+
+	keys := make([]string, len(c.APIKeys))
+	for i := range keys {
+		keys[i] = redactedSecret
+	}
+
+	buf, err := json.Marshal(struct {
+		*AgentConfig
+		APIKeys []string
+	}{&redacted, keys})
+	if err != nil {
+		return fmt.Sprintf("cannot marshal config: %v", err)
+	}
+	return string(buf)
 }
 
 // mergeEnv applies overrides from environment variables to the trace agent configuration
@@ -112,6 +270,10 @@ func mergeEnv(c *AgentConfig) {
 	if v := os.Getenv("DD_LOG_LEVEL"); v != "" {
 		c.LogLevel = v
 	}
+
+	if v := os.Getenv("DD_LOG_FILE"); v != "" {
+		c.LogFilePath = v
+	}
 }
 
 // getHostname shells out to obtain the hostname used by the infra agent
@@ -145,34 +307,69 @@ func getHostname() (string, error) {
 
 // NewDefaultAgentConfig returns a configuration with the default values
 func NewDefaultAgentConfig() *AgentConfig {
-	hostname, err := getHostname()
-	if err != nil {
-		hostname = ""
+	ac := DefaultAgentConfig()
+	if hostname, err := getHostname(); err == nil {
+		ac.HostName = hostname
 	}
+	return ac
+}
+
+// DefaultAgentConfig returns the default configuration, like
+// NewDefaultAgentConfig except that it looks nothing up on the host, leaving
+// the HostName empty. It is meant to build a configuration from code, without
+// any file: set the fields, then check the result with Validate.
+func DefaultAgentConfig() *AgentConfig {
 	ac := &AgentConfig{
 		Enabled:                 true,
-		HostName:                hostname,
 		DefaultEnv:              "none",
+		ExcludeRoots:            []string{},
+		HostTagsProviders:       []string{},
+		HostTagsTTL:             5 * time.Minute,
 		APIEndpoints:            []string{"https://trace.agent.datadoghq.com"},
 		APIKeys:                 []string{},
 		APIEnabled:              true,
 		APIPayloadBufferMaxSize: 16 * 1024 * 1024,
+		APIPayloadCompression:   true,
+		APIPayloadQueueSize:     1,
+		APIPayloadQueuePolicy:   QueuePolicyBlock,
+		APISpoolMaxSize:         16 * 1024 * 1024,
+		APISpoolMaxAge:          time.Hour,
+		APIBreakerCooldown:      30 * time.Second,
+		HTTPClient:              NewDefaultHTTPClientSettings(),
 
 		BucketInterval:   time.Duration(10) * time.Second,
+		FlushJitter:      0.1,
 		ExtraAggregators: []string{},
 
-		ExtraSampleRate: 1.0,
-		MaxTPS:          10,
-
-		ReceiverHost:    "localhost",
-		ReceiverPort:    8126,
-		ConnectionLimit: 2000,
-
-		StatsdHost: "localhost",
-		StatsdPort: 8125,
-
-		LogLevel:    "INFO",
-		LogFilePath: "/var/log/datadog/trace-agent.log",
+		StatsCheckpointInterval: 30 * time.Second,
+		StatsCheckpointMaxSize:  16 * 1024 * 1024,
+
+		SamplerEngine:         SamplerEngineSignature,
+		SamplerCombine:        SamplerCombineAll,
+		ExtraSampleRate:       1.0,
+		MaxTPS:                10,
+		HonorSamplingPriority: true,
+		KeepTypes:             []string{},
+		KeepTypesBypassMaxTPS: true,
+		KeepTags:              []string{},
+		SignatureRootFields:   []string{SignatureFieldService, SignatureFieldName, SignatureFieldResource, SignatureFieldError},
+		SignatureSpanFields:   []string{SignatureFieldService, SignatureFieldName, SignatureFieldError},
+		SamplerWarmupRate:     0.1,
+		AnomalyThreshold:      3,
+
+		ReceiverHost:     "localhost",
+		DebugHost:        "localhost",
+		ReceiverPort:     8126,
+		ConnectionLimit:  2000,
+		MaxSpansPerTrace: 10000,
+
+		StatsdHost:   "localhost",
+		StatsdPort:   8125,
+		StatsdPrefix: "datadog.trace_agent.",
+
+		LogLevel:       "INFO",
+		LogFilePath:    DefaultLogFilePath,
+		LogSampleEvery: 1,
 
 		MaxMemory:        1e9,
 		MaxConnections:   5000,
@@ -182,7 +379,8 @@ func NewDefaultAgentConfig() *AgentConfig {
 	return ac
 }
 
-// NewAgentConfig creates the AgentConfig from the standard config
+// NewAgentConfig creates the AgentConfig from the standard config. If the
+// result is invalid, it is returned along with a *ValidationError.
 func NewAgentConfig(conf *File, legacyConf *File) (*AgentConfig, error) {
 	c := NewDefaultAgentConfig()
 	var m *ini.Section
@@ -207,6 +405,14 @@ func NewAgentConfig(conf *File, legacyConf *File) (*AgentConfig, error) {
 			log.Info("Failed to parse api_key from dd-agent config")
 		}
 
+		if v := m.Key("api_key_file").MustString(""); v != "" {
+			if keys, err := readAPIKeysFile(v); err == nil {
+				c.APIKeys = keys
+			} else {
+				log.Errorf("Failed to read api_key_file from dd-agent config: %v", err)
+			}
+		}
+
 		if v := m.Key("bind_host").MustString(""); v != "" {
 			c.StatsdHost = v
 			c.ReceiverHost = v
@@ -251,6 +457,32 @@ APM_CONF:
 		c.DefaultEnv = model.NormalizeTag(v)
 	}
 
+	if v, e := conf.GetStrArray("trace.config", "exclude_roots", ","); e == nil {
+		c.ExcludeRoots = []string{}
+		for _, p := range v {
+			if p = strings.TrimSpace(p); p != "" {
+				c.ExcludeRoots = append(c.ExcludeRoots, p)
+			}
+		}
+	}
+
+	if v := strings.ToLower(conf.GetDefault("trace.config", "root_by_span_kind", "")); v == "yes" || v == "true" {
+		c.RootBySpanKind = true
+	}
+
+	if v, e := conf.GetStrArray("trace.config", "host_tags_providers", ","); e == nil {
+		c.HostTagsProviders = []string{}
+		for _, p := range v {
+			if p = strings.TrimSpace(p); p != "" {
+				c.HostTagsProviders = append(c.HostTagsProviders, p)
+			}
+		}
+	}
+
+	if v, e := conf.GetInt("trace.config", "host_tags_ttl_seconds"); e == nil {
+		c.HostTagsTTL = time.Duration(v) * time.Second
+	}
+
 	if v, _ := conf.Get("trace.config", "log_level"); v != "" {
 		c.LogLevel = v
 	}
@@ -259,6 +491,14 @@ APM_CONF:
 		c.LogFilePath = v
 	}
 
+	if v, e := conf.GetInt("trace.config", "log_sample_every"); e == nil {
+		c.LogSampleEvery = v
+	}
+
+	if v, err := conf.Get("trace.config", "statsd_prefix"); err == nil {
+		c.StatsdPrefix = v
+	}
+
 	if v, _ := conf.Get("trace.api", "api_key"); v != "" {
 		vals := strings.Split(v, ",")
 		for i := range vals {
@@ -267,6 +507,14 @@ APM_CONF:
 		c.APIKeys = vals
 	}
 
+	if v, _ := conf.Get("trace.api", "api_key_file"); v != "" {
+		if keys, err := readAPIKeysFile(v); err == nil {
+			c.APIKeys = keys
+		} else {
+			log.Errorf("Failed to read api_key_file: %v", err)
+		}
+	}
+
 	if v, _ := conf.Get("trace.api", "endpoint"); v != "" {
 		vals := strings.Split(v, ",")
 		for i := range vals {
@@ -279,6 +527,106 @@ APM_CONF:
 		c.APIPayloadBufferMaxSize = v
 	}
 
+	if v, _ := conf.Get("trace.api", "failover_endpoint"); v != "" {
+		urls := strings.Split(v, ",")
+		keys := []string{}
+		if k, _ := conf.Get("trace.api", "failover_api_key"); k != "" {
+			keys = strings.Split(k, ",")
+		}
+		c.APIFailoverEndpoints = make([]APIEndpointSettings, len(urls))
+		for i := range urls {
+			c.APIFailoverEndpoints[i].URL = strings.TrimSpace(urls[i])
+			if i < len(keys) {
+				c.APIFailoverEndpoints[i].APIKey = strings.TrimSpace(keys[i])
+			}
+		}
+	}
+
+	if v, _ := conf.Get("trace.api", "env_endpoints"); v != "" {
+		c.APIEnvEndpoints = make(map[string]APIEndpointSettings)
+		for env, url := range parseEnvPairs(v) {
+			c.APIEnvEndpoints[env] = APIEndpointSettings{URL: url}
+		}
+		if k, _ := conf.Get("trace.api", "env_api_keys"); k != "" {
+			for env, key := range parseEnvPairs(k) {
+				e := c.APIEnvEndpoints[env]
+				e.APIKey = key
+				c.APIEnvEndpoints[env] = e
+			}
+		}
+	}
+
+	if v := strings.ToLower(conf.GetDefault("trace.api", "payload_compression", "")); v == "no" || v == "false" {
+		c.APIPayloadCompression = false
+	}
+
+	if v, _ := conf.Get("trace.api", "tls_ca_file"); v != "" {
+		c.TLS.CAFile = v
+	}
+	if v, _ := conf.Get("trace.api", "tls_cert_file"); v != "" {
+		c.TLS.CertFile = v
+	}
+	if v, _ := conf.Get("trace.api", "tls_key_file"); v != "" {
+		c.TLS.KeyFile = v
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.api", "tls_skip_verify", "")); v == "yes" || v == "true" {
+		c.TLS.SkipVerify = true
+	}
+
+	if v, e := conf.GetInt("trace.api", "circuit_breaker_threshold"); e == nil {
+		c.APIBreakerThreshold = v
+	}
+	if v, e := conf.GetInt("trace.api", "circuit_breaker_cooldown_seconds"); e == nil {
+		c.APIBreakerCooldown = time.Duration(v) * time.Second
+	}
+	if v, e := conf.GetInt("trace.api", "connect_timeout_seconds"); e == nil {
+		c.HTTPClient.ConnectTimeout = time.Duration(v) * time.Second
+	}
+	if v, e := conf.GetInt("trace.api", "request_timeout_seconds"); e == nil {
+		c.HTTPClient.RequestTimeout = time.Duration(v) * time.Second
+	}
+	if v, e := conf.GetInt("trace.api", "max_idle_connections"); e == nil {
+		c.HTTPClient.MaxIdleConns = v
+	}
+	if v, e := conf.GetInt("trace.api", "idle_connection_timeout_seconds"); e == nil {
+		c.HTTPClient.IdleConnTimeout = time.Duration(v) * time.Second
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.api", "keep_alive", "")); v == "no" || v == "false" {
+		c.HTTPClient.KeepAlive = false
+	}
+
+	if v, _ := conf.Get("trace.api", "spool_dir"); v != "" {
+		c.APISpoolDir = v
+	}
+
+	if v, e := conf.GetInt("trace.api", "spool_max_size"); e == nil {
+		c.APISpoolMaxSize = v
+	}
+
+	if v, e := conf.GetInt("trace.api", "spool_max_age_seconds"); e == nil {
+		c.APISpoolMaxAge = time.Duration(v) * time.Second
+	}
+
+	if v, e := conf.GetInt("trace.api", "payload_queue_size"); e == nil {
+		c.APIPayloadQueueSize = v
+	}
+
+	if v, _ := conf.Get("trace.api", "payload_queue_policy"); v != "" {
+		c.APIPayloadQueuePolicy = strings.ToLower(v)
+	}
+
+	if v, e := conf.GetInt("trace.api", "payload_max_retries"); e == nil {
+		c.APIPayloadMaxRetries = v
+	}
+
+	if v, e := conf.GetInt("trace.api", "max_payload_size"); e == nil {
+		c.APIMaxPayloadSize = v
+	}
+
+	if v, e := conf.GetInt("trace.api", "max_trace_depth"); e == nil {
+		c.APIMaxTraceDepth = v
+	}
+
 	if v, e := conf.GetInt("trace.concentrator", "bucket_size_seconds"); e == nil {
 		c.BucketInterval = time.Duration(v) * time.Second
 	}
@@ -289,6 +637,36 @@ APM_CONF:
 		log.Debug("No aggregator configuration, using defaults")
 	}
 
+	if v, e := conf.GetFloat("trace.concentrator", "flush_jitter"); e == nil {
+		c.FlushJitter = v
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "max_resources"); e == nil {
+		c.MaxResources = v
+	}
+
+	if v, _ := conf.Get("trace.concentrator", "checkpoint_dir"); v != "" {
+		c.StatsCheckpointDir = v
+	}
+	if v, e := conf.GetInt("trace.concentrator", "checkpoint_interval_seconds"); e == nil {
+		c.StatsCheckpointInterval = time.Duration(v) * time.Second
+	}
+	if v, e := conf.GetInt("trace.concentrator", "checkpoint_max_size"); e == nil {
+		c.StatsCheckpointMaxSize = v
+	}
+
+	if v, _ := conf.Get("trace.sampler", "engine"); v != "" {
+		c.SamplerEngine = strings.ToLower(v)
+	}
+
+	if v, _ := conf.Get("trace.sampler", "combine"); v != "" {
+		c.SamplerCombine = strings.ToLower(v)
+	}
+
+	if v, _ := conf.Get("trace.sampler", "shadow_engine"); v != "" {
+		c.SamplerShadowEngine = strings.ToLower(v)
+	}
+
 	if v, e := conf.GetFloat("trace.sampler", "extra_sample_rate"); e == nil {
 		c.ExtraSampleRate = v
 	}
@@ -296,10 +674,84 @@ APM_CONF:
 		c.MaxTPS = v
 	}
 
+	if v, e := conf.GetInt("trace.sampler", "max_traces_per_flush"); e == nil {
+		c.MaxTracesPerFlush = v
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.sampler", "honor_sampling_priority", "")); v == "no" || v == "false" {
+		c.HonorSamplingPriority = false
+	}
+	if v, e := conf.GetStrArray("trace.sampler", "keep_types", ","); e == nil {
+		c.KeepTypes = v
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.sampler", "keep_types_bypass_max_tps", "")); v == "no" || v == "false" {
+		c.KeepTypesBypassMaxTPS = false
+	}
+	if v, e := conf.GetStrArray("trace.sampler", "keep_tags", ","); e == nil {
+		c.KeepTags = v
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.sampler", "signature_with_version", "")); v == "yes" || v == "true" {
+		c.SignatureWithVersion = true
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.sampler", "signature_ignore_error", "")); v == "yes" || v == "true" {
+		c.SignatureIgnoreError = true
+	}
+	if v, e := conf.GetStrArray("trace.sampler", "signature_root_fields", ","); e == nil {
+		c.SignatureRootFields = v
+	}
+	if v, e := conf.GetStrArray("trace.sampler", "signature_span_fields", ","); e == nil {
+		c.SignatureSpanFields = v
+	}
+	if v, e := conf.GetInt("trace.sampler", "warmup_seconds"); e == nil {
+		c.SamplerWarmup = time.Duration(v) * time.Second
+	}
+	if v, e := conf.GetFloat("trace.sampler", "warmup_sample_rate"); e == nil {
+		c.SamplerWarmupRate = v
+	}
+
+	if v, e := conf.GetFloat("trace.sampler", "anomaly_boost"); e == nil {
+		c.AnomalyBoost = v
+	}
+
+	if v, e := conf.GetFloat("trace.sampler", "anomaly_threshold"); e == nil {
+		c.AnomalyThreshold = v
+	}
+
+	if v := strings.ToLower(conf.GetDefault("trace.sampler", "keep_one_per_signature", "")); v == "yes" || v == "true" {
+		c.KeepOnePerSignature = true
+	}
+	if v := strings.ToLower(conf.GetDefault("trace.sampler", "dedupe_traces", "")); v == "yes" || v == "true" {
+		c.DedupeTraces = true
+	}
+	if v, e := conf.GetInt("trace.sampler", "signature_cache_size"); e == nil {
+		c.SignatureCacheSize = v
+	}
+
+	if v, e := conf.GetFloat("trace.sampler", "full_sample_below_tps"); e == nil {
+		c.FullSampleBelowTPS = v
+	}
+	if v, e := conf.GetStrArray("trace.sampler", "sampling_rules", ","); e == nil {
+		c.SamplingRules = make([]string, 0, len(v))
+		for _, r := range v {
+			c.SamplingRules = append(c.SamplingRules, strings.TrimSpace(r))
+		}
+	}
+
+	if v, _ := conf.Get("trace.receiver", "receiver_host"); v != "" {
+		c.ReceiverHost = v
+	}
+
 	if v, e := conf.GetInt("trace.receiver", "receiver_port"); e == nil {
 		c.ReceiverPort = v
 	}
 
+	if v, _ := conf.Get("trace.receiver", "debug_host"); v != "" {
+		c.DebugHost = v
+	}
+
+	if v, e := conf.GetInt("trace.receiver", "debug_port"); e == nil {
+		c.DebugPort = v
+	}
+
 	if v, e := conf.GetInt("trace.receiver", "connection_limit"); e == nil {
 		c.ConnectionLimit = v
 	}
@@ -308,6 +760,14 @@ APM_CONF:
 		c.ReceiverTimeout = v
 	}
 
+	if v, e := conf.GetInt("trace.receiver", "max_spans_per_trace"); e == nil {
+		c.MaxSpansPerTrace = v
+	}
+
+	if v := strings.ToLower(conf.GetDefault("trace.receiver", "prometheus_metrics", "")); v == "yes" || v == "true" {
+		c.PrometheusMetrics = true
+	}
+
 	if v, e := conf.GetFloat("trace.watchdog", "max_memory"); e == nil {
 		c.MaxMemory = v
 	}
@@ -324,13 +784,257 @@ ENV_CONF:
 	// environment variables have precedence among defaults and the config file
 	mergeEnv(c)
 
-	// check for api-endpoint parity after all possible overrides have been applied
+	// validate after all possible overrides have been applied
+	if err := c.Validate(); err != nil {
+		return c, &ValidationError{Err: err}
+	}
+	return c, nil
+}
+
+// Validate checks that the configuration is usable to run the agent and
+// returns the first problem found, if any.
+func (c *AgentConfig) Validate() error {
+	// check for api-endpoint parity
 	if len(c.APIKeys) == 0 {
-		return c, errors.New("you must specify an API Key, either via a configuration file or the DD_API_KEY env var")
+		return errors.New("you must specify an API Key, either via a configuration file or the DD_API_KEY env var")
 	}
 
 	if len(c.APIKeys) != len(c.APIEndpoints) {
-		return c, errors.New("every API key needs to have an explicit endpoint associated")
+		return errors.New("every API key needs to have an explicit endpoint associated")
 	}
-	return c, nil
+
+	for _, e := range c.APIFailoverEndpoints {
+		if e.URL == "" || e.APIKey == "" {
+			return errors.New("every failover endpoint needs an explicit API key associated")
+		}
+	}
+
+	for env, e := range c.APIEnvEndpoints {
+		if env == "" || e.URL == "" || e.APIKey == "" {
+			return fmt.Errorf("the endpoint of env %q needs an explicit API key associated", env)
+		}
+	}
+	if _, ok := c.APIEnvEndpoints[c.DefaultEnv]; ok {
+		return fmt.Errorf("the default env %q always uses the main endpoints", c.DefaultEnv)
+	}
+
+	if _, err := c.TLS.Config(); err != nil {
+		return fmt.Errorf("invalid TLS settings: %v", err)
+	}
+
+	if c.LogSampleEvery < 1 {
+		return fmt.Errorf("log sample every must be at least 1, got %d", c.LogSampleEvery)
+	}
+
+	if err := c.HTTPClient.Validate(); err != nil {
+		return err
+	}
+
+	if c.APIBreakerThreshold < 0 {
+		return fmt.Errorf("circuit breaker threshold cannot be negative, got %d", c.APIBreakerThreshold)
+	}
+	if c.APIBreakerThreshold > 0 && c.APIBreakerCooldown <= 0 {
+		return fmt.Errorf("circuit breaker cooldown must be positive, got %s", c.APIBreakerCooldown)
+	}
+
+	if c.ReceiverPort <= 0 || c.ReceiverPort > 65535 {
+		return fmt.Errorf("invalid receiver port: %d", c.ReceiverPort)
+	}
+	if err := validateBindHost(c.ReceiverHost); err != nil {
+		return fmt.Errorf("invalid receiver host: %v", err)
+	}
+
+	if c.DebugPort < 0 || c.DebugPort > 65535 || (c.DebugPort > 0 && c.DebugPort == c.ReceiverPort) {
+		return fmt.Errorf("invalid debug port: %d", c.DebugPort)
+	}
+	if c.DebugPort > 0 {
+		if err := validateBindHost(c.DebugHost); err != nil {
+			return fmt.Errorf("invalid debug host: %v", err)
+		}
+	}
+
+	if c.MaxSpansPerTrace < 0 {
+		return fmt.Errorf("max spans per trace cannot be negative, got %d", c.MaxSpansPerTrace)
+	}
+
+	if c.BucketInterval <= 0 {
+		return fmt.Errorf("invalid bucket interval: %s", c.BucketInterval)
+	}
+
+	if c.FlushJitter < 0 || c.FlushJitter >= 1 {
+		return fmt.Errorf("flush jitter must be between 0 and 1 (excluded), got %v", c.FlushJitter)
+	}
+
+	if c.MaxResources < 0 {
+		return fmt.Errorf("max resources cannot be negative, got %d", c.MaxResources)
+	}
+
+	if c.StatsCheckpointDir != "" {
+		if c.StatsCheckpointInterval < MinStatsCheckpointInterval {
+			return fmt.Errorf("stats checkpoint interval must be at least %s, got %s", MinStatsCheckpointInterval, c.StatsCheckpointInterval)
+		}
+		if c.StatsCheckpointMaxSize <= 0 {
+			return fmt.Errorf("stats checkpoint max size must be positive, got %d", c.StatsCheckpointMaxSize)
+		}
+	}
+
+	if c.ExtraSampleRate < 0 || c.ExtraSampleRate > 1 {
+		return fmt.Errorf("extra sample rate must be between 0 and 1, got %v", c.ExtraSampleRate)
+	}
+
+	if c.MaxTPS < 0 {
+		return fmt.Errorf("max traces per second cannot be negative, got %v", c.MaxTPS)
+	}
+
+	if c.MaxTracesPerFlush < 0 {
+		return fmt.Errorf("max traces per flush cannot be negative, got %d", c.MaxTracesPerFlush)
+	}
+
+	if c.SamplerWarmup < 0 {
+		return fmt.Errorf("sampler warmup cannot be negative, got %s", c.SamplerWarmup)
+	}
+
+	if c.SamplerWarmupRate < 0 || c.SamplerWarmupRate > 1 {
+		return fmt.Errorf("warmup sample rate must be between 0 and 1, got %v", c.SamplerWarmupRate)
+	}
+
+	if c.AnomalyBoost < 0 {
+		return fmt.Errorf("anomaly boost cannot be negative, got %v", c.AnomalyBoost)
+	}
+
+	if c.AnomalyThreshold <= 0 {
+		return fmt.Errorf("anomaly threshold must be positive, got %v", c.AnomalyThreshold)
+	}
+
+	if c.SignatureCacheSize < 0 {
+		return fmt.Errorf("signature cache size cannot be negative, got %d", c.SignatureCacheSize)
+	}
+
+	if c.FullSampleBelowTPS < 0 {
+		return fmt.Errorf("full sample TPS threshold cannot be negative, got %v", c.FullSampleBelowTPS)
+	}
+
+	for _, p := range c.HostTagsProviders {
+		switch p {
+		case HostTagsProviderEC2, HostTagsProviderContainer:
+		default:
+			return fmt.Errorf("invalid host tags provider: %q", p)
+		}
+	}
+
+	if c.HostTagsTTL <= 0 {
+		return fmt.Errorf("host tags TTL must be positive, got %v", c.HostTagsTTL)
+	}
+
+	if err := validateSamplerEngines(c.SamplerEngine); err != nil {
+		return err
+	}
+	if c.SamplerShadowEngine != "" {
+		if err := validateSamplerEngines(c.SamplerShadowEngine); err != nil {
+			return fmt.Errorf("invalid shadow engine: %v", err)
+		}
+	}
+
+	if err := validateSignatureFields(c.SignatureRootFields); err != nil {
+		return fmt.Errorf("invalid signature root fields: %v", err)
+	}
+	if err := validateSignatureFields(c.SignatureSpanFields); err != nil {
+		return fmt.Errorf("invalid signature span fields: %v", err)
+	}
+
+	if _, err := model.ParseSamplingRules(c.SamplingRules); err != nil {
+		return err
+	}
+
+	switch c.SamplerCombine {
+	case SamplerCombineAll, SamplerCombineAny:
+	default:
+		return fmt.Errorf("invalid sampler combine mode: %q", c.SamplerCombine)
+	}
+
+	if c.APIPayloadQueueSize < 1 {
+		return fmt.Errorf("payload queue size must be at least 1, got %d", c.APIPayloadQueueSize)
+	}
+
+	if c.APIPayloadMaxRetries < 0 {
+		return fmt.Errorf("payload max retries cannot be negative, got %d", c.APIPayloadMaxRetries)
+	}
+
+	if c.APIMaxPayloadSize < 0 {
+		return fmt.Errorf("max payload size cannot be negative, got %d", c.APIMaxPayloadSize)
+	}
+
+	if c.APIMaxTraceDepth < 0 {
+		return fmt.Errorf("max trace depth cannot be negative, got %d", c.APIMaxTraceDepth)
+	}
+
+	switch c.APIPayloadQueuePolicy {
+	case QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyDropNewest:
+	default:
+		return fmt.Errorf("invalid payload queue policy: %q", c.APIPayloadQueuePolicy)
+	}
+
+	return nil
+}
+
+// parseEnvPairs parses a comma separated list of env=value pairs, the envs
+// normalized as the DefaultEnv is
+func parseEnvPairs(v string) map[string]string {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		env := model.NormalizeTag(strings.TrimSpace(parts[0]))
+		if len(parts) == 1 {
+			pairs[env] = ""
+			continue
+		}
+		pairs[env] = strings.TrimSpace(parts[1])
+	}
+	return pairs
+}
+
+// validateBindHost returns an error if host, an IP or a name, cannot be
+// listened on. An empty host listens on all the interfaces.
+func validateBindHost(host string) error {
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("cannot resolve %q: %v", host, err)
+	}
+	return nil
+}
+
+// validateSamplerEngines checks a comma separated list of sampler engines
+func validateSamplerEngines(engines string) error {
+	for _, engine := range strings.Split(engines, ",") {
+		switch strings.TrimSpace(engine) {
+		case SamplerEngineSignature, SamplerEngineDeterministic:
+		default:
+			return fmt.Errorf("invalid sampler engine: %q", engine)
+		}
+	}
+	return nil
+}
+
+// validateSignatureFields returns an error if fields, once trimmed, has an
+// unknown field or none at all
+func validateSignatureFields(fields []string) error {
+	n := 0
+	for _, f := range fields {
+		switch f = strings.TrimSpace(f); {
+		case f == "":
+			continue
+		case f == SignatureFieldService, f == SignatureFieldName, f == SignatureFieldResource,
+			f == SignatureFieldError, f == SignatureFieldType:
+		case strings.HasPrefix(f, SignatureFieldMetaPrefix) && len(f) > len(SignatureFieldMetaPrefix):
+		default:
+			return fmt.Errorf("unknown field %q", f)
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no field")
+	}
+	return nil
 }
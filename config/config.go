@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -18,13 +19,44 @@ type File struct {
 	Path     string
 }
 
+// ErrConfigNotFound is returned by New when the config file does not exist,
+// which is fine since the agent can be configured from the environment only
+var ErrConfigNotFound = errors.New("config file not found")
+
+// ParseError is returned by New when the config file exists but cannot be
+// used, because it cannot be read or is malformed
+type ParseError struct {
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot load config file %s: %v", e.Path, e.Err)
+}
+
+// ValidationError is returned by NewAgentConfig when the resulting
+// configuration cannot be used to run the agent
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
 // New reads the file in configPath and returns a corresponding *File
-// or an error if encountered.  This File is set as the default active
-// config file.
+// or an error if encountered, either ErrConfigNotFound or a *ParseError.
+// The files it includes are merged with it, see loadWithIncludes.
+// This File is set as the default active config file.
 func New(configPath string) (*File, error) {
-	config, err := ini.Load(configPath)
+	config, err := loadWithIncludes(configPath, 0)
 	if err != nil {
-		return nil, err
+		if terr, ok := err.(*os.PathError); ok {
+			if terr, ok := terr.Err.(syscall.Errno); ok && terr == syscall.ENOENT {
+				return nil, ErrConfigNotFound
+			}
+		}
+		return nil, &ParseError{Path: configPath, Err: err}
 	}
 	globalConfig = &File{instance: config, Path: configPath}
 	return globalConfig, nil
@@ -34,10 +66,8 @@ func New(configPath string) (*File, error) {
 // exist. Instead, it returns a null File pointer.
 func NewIfExists(configPath string) (*File, error) {
 	config, err := New(configPath)
-	if terr, ok := err.(*os.PathError); ok {
-		if terr, ok := terr.Err.(syscall.Errno); ok && terr == syscall.ENOENT {
-			return nil, nil
-		}
+	if err == ErrConfigNotFound {
+		return nil, nil
 	}
 	return config, err
 }
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -87,13 +89,57 @@ func TestDDAgentConfigWithLegacy(t *testing.T) {
 	// check that legacy conf file overrides dd-agent.conf
 	dd, _ := ini.Load([]byte("[Main]\n\nhostname=thing\napi_key=apikey_12"))
 	legacy, _ := ini.Load([]byte(strings.Join([]string{
+		"[trace.config]",
+		"host_tags_providers=ec2, container",
+		"host_tags_ttl_seconds=60",
+		"exclude_roots=GET /healthz, *ping",
+		"root_by_span_kind=yes",
+		"log_sample_every=100",
+		"statsd_prefix=mycompany.trace_agent.",
 		"[trace.api]",
 		"api_key = pommedapi",
 		"endpoint = an_endpoint",
+		"payload_max_retries = 5",
+		"max_payload_size = 1048576",
+		"max_trace_depth = 256",
+		"request_timeout_seconds = 60",
+		"max_idle_connections = 4",
+		"keep_alive = no",
+		"circuit_breaker_threshold = 3",
+		"env_endpoints = prod=https://prod.example.com, Staging = https://staging.example.com",
+		"env_api_keys = prod=prod_key, staging=staging_key",
+		"circuit_breaker_cooldown_seconds = 10",
 		"[trace.concentrator]",
 		"extra_aggregators=resource,error",
+		"max_resources=1000",
+		"checkpoint_dir=/var/lib/trace-agent/checkpoint",
+		"checkpoint_interval_seconds=60",
+		"flush_jitter=0.25",
 		"[trace.sampler]",
 		"extra_sample_rate=0.33",
+		"honor_sampling_priority=false",
+		"keep_types=db,cache",
+		"keep_types_bypass_max_tps=no",
+		"keep_tags=feature_flag:x,canary",
+		"signature_with_version=yes",
+		"signature_ignore_error=true",
+		"signature_root_fields=service,resource,meta.http.method",
+		"signature_span_fields=service,type",
+		"shadow_engine=Deterministic",
+		"warmup_seconds=30",
+		"warmup_sample_rate=0.2",
+		"anomaly_boost=10",
+		"anomaly_threshold=4.5",
+		"full_sample_below_tps=0.5",
+		"keep_one_per_signature=yes",
+		"dedupe_traces=yes",
+		"signature_cache_size=1000",
+		"max_traces_per_flush=500",
+		"sampling_rules=http.status_code>=500 => 1, service=web => 0.05",
+		"[trace.receiver]",
+		"prometheus_metrics=yes",
+		"receiver_host=127.0.0.2",
+		"debug_port=5012",
 	}, "\n")))
 
 	conf := &File{instance: dd, Path: "whatever"}
@@ -104,12 +150,61 @@ func TestDDAgentConfigWithLegacy(t *testing.T) {
 	// Properly loaded attributes
 	assert.Equal([]string{"pommedapi"}, agentConfig.APIKeys)
 	assert.Equal([]string{"an_endpoint"}, agentConfig.APIEndpoints)
+	assert.Equal([]string{"ec2", "container"}, agentConfig.HostTagsProviders)
+	assert.Equal(time.Minute, agentConfig.HostTagsTTL)
+	assert.Equal([]string{"GET /healthz", "*ping"}, agentConfig.ExcludeRoots)
+	assert.True(agentConfig.RootBySpanKind)
 	assert.Equal([]string{"resource", "error"}, agentConfig.ExtraAggregators)
 	assert.Equal(0.33, agentConfig.ExtraSampleRate)
+	assert.False(agentConfig.HonorSamplingPriority)
+	assert.Equal([]string{"db", "cache"}, agentConfig.KeepTypes)
+	assert.False(agentConfig.KeepTypesBypassMaxTPS)
+	assert.Equal([]string{"feature_flag:x", "canary"}, agentConfig.KeepTags)
+	assert.True(agentConfig.SignatureWithVersion)
+	assert.True(agentConfig.SignatureIgnoreError)
+	assert.Equal([]string{"service", "resource", "meta.http.method"}, agentConfig.SignatureRootFields)
+	assert.Equal([]string{"service", "type"}, agentConfig.SignatureSpanFields)
+	assert.Equal("deterministic", agentConfig.SamplerShadowEngine)
+	assert.True(agentConfig.PrometheusMetrics)
+	assert.Equal("127.0.0.2", agentConfig.ReceiverHost)
+	assert.Equal(5012, agentConfig.DebugPort)
+	assert.Equal("localhost", agentConfig.DebugHost)
+	assert.Equal(30*time.Second, agentConfig.SamplerWarmup)
+	assert.Equal(0.2, agentConfig.SamplerWarmupRate)
+	assert.Equal(10.0, agentConfig.AnomalyBoost)
+	assert.Equal(4.5, agentConfig.AnomalyThreshold)
+	assert.Equal(0.5, agentConfig.FullSampleBelowTPS)
+	assert.True(agentConfig.KeepOnePerSignature)
+	assert.True(agentConfig.DedupeTraces)
+	assert.Equal(1000, agentConfig.SignatureCacheSize)
+	assert.Equal(500, agentConfig.MaxTracesPerFlush)
+	assert.Equal(100, agentConfig.LogSampleEvery)
+	assert.Equal("mycompany.trace_agent.", agentConfig.StatsdPrefix)
+	assert.Equal(5, agentConfig.APIPayloadMaxRetries)
+	assert.Equal(1048576, agentConfig.APIMaxPayloadSize)
+	assert.Equal(256, agentConfig.APIMaxTraceDepth)
+	assert.Equal(60*time.Second, agentConfig.HTTPClient.RequestTimeout)
+	assert.Equal(4, agentConfig.HTTPClient.MaxIdleConns)
+	assert.False(agentConfig.HTTPClient.KeepAlive)
+	assert.Equal(3, agentConfig.APIBreakerThreshold)
+	assert.Equal(map[string]APIEndpointSettings{
+		"prod":    {URL: "https://prod.example.com", APIKey: "prod_key"},
+		"staging": {URL: "https://staging.example.com", APIKey: "staging_key"},
+	}, agentConfig.APIEnvEndpoints)
+	assert.Equal(10*time.Second, agentConfig.APIBreakerCooldown)
+	assert.Equal(defaultConfig.HTTPClient.ConnectTimeout, agentConfig.HTTPClient.ConnectTimeout)
+	assert.Equal(1000, agentConfig.MaxResources)
+	assert.Equal("/var/lib/trace-agent/checkpoint", agentConfig.StatsCheckpointDir)
+	assert.Equal(time.Minute, agentConfig.StatsCheckpointInterval)
+	assert.Equal(16*1024*1024, agentConfig.StatsCheckpointMaxSize)
+	assert.Equal(0.25, agentConfig.FlushJitter)
+	assert.Equal([]string{"http.status_code>=500 => 1", "service=web => 0.05"}, agentConfig.SamplingRules)
 
 	// Check some defaults
 	assert.Equal(defaultConfig.BucketInterval, agentConfig.BucketInterval)
 	assert.Equal(defaultConfig.StatsdHost, agentConfig.StatsdHost)
+	assert.True(defaultConfig.KeepTypesBypassMaxTPS)
+	assert.False(defaultConfig.RootBySpanKind)
 }
 
 func TestDDAgentConfigWithNewOpts(t *testing.T) {
@@ -150,8 +245,251 @@ func TestConfigNewIfExists(t *testing.T) {
 	os.Remove(filename)
 }
 
+func TestConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	// missing files are expected, and told apart
+	conf, err := New("/does-not-exist")
+	assert.Equal(ErrConfigNotFound, err)
+	assert.Nil(conf)
+
+	// malformed ones are not
+	f, err := ioutil.TempFile("", "trace-agent-test-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("[Main\napi_key = 1234\n")
+	f.Close()
+
+	conf, err = New(f.Name())
+	assert.Nil(conf)
+	if perr, ok := err.(*ParseError); assert.True(ok, "expected a *ParseError, got %#v", err) {
+		assert.Equal(f.Name(), perr.Path)
+		assert.Contains(perr.Error(), f.Name())
+	}
+	conf, err = NewIfExists(f.Name())
+	assert.Nil(conf)
+	assert.IsType(&ParseError{}, err)
+
+	// and neither are invalid settings, the config is still returned
+	dd, _ := ini.Load([]byte("[Main]\napi_key=1234\n[trace.sampler]\nextra_sample_rate=3"))
+	c, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(c)
+	if verr, ok := err.(*ValidationError); assert.True(ok, "expected a *ValidationError, got %#v", err) {
+		assert.Equal(c.Validate().Error(), verr.Error())
+	}
+}
+
 func TestGetHostname(t *testing.T) {
 	h, err := getHostname()
 	assert.Nil(t, err)
 	assert.NotEqual(t, "", h)
 }
+
+func TestDefaultAgentConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := DefaultAgentConfig()
+	assert.Equal("", c.HostName)
+	assert.Equal(NewDefaultAgentConfig().BucketInterval, c.BucketInterval)
+	assert.Equal(0, c.APIBreakerThreshold, "the circuit breaker is opt-in")
+
+	// only the API keys have no sane default
+	assert.NotNil(c.Validate())
+	c.APIKeys = []string{"key"}
+	assert.Nil(c.Validate())
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	c.APIKeys = []string{"key"}
+	assert.Nil(c.Validate())
+
+	c.ExtraSampleRate = 1.5
+	assert.NotNil(c.Validate())
+	c.ExtraSampleRate = 1
+
+	c.ReceiverPort = 0
+	assert.NotNil(c.Validate())
+	c.ReceiverPort = 8126
+
+	c.ReceiverHost = "not a host"
+	assert.NotNil(c.Validate())
+	c.ReceiverHost = "0.0.0.0"
+	assert.Nil(c.Validate())
+
+	c.DebugPort = 8126
+	assert.NotNil(c.Validate(), "debug port taken by the receiver")
+	c.DebugPort = 5012
+	c.DebugHost = "not a host"
+	assert.NotNil(c.Validate())
+	c.DebugHost = "127.0.0.1"
+	assert.Nil(c.Validate())
+	c.DebugPort = 0
+
+	c.APIFailoverEndpoints = []APIEndpointSettings{{URL: "https://backup.example.com"}}
+	assert.NotNil(c.Validate())
+	c.APIFailoverEndpoints[0].APIKey = "backup_key"
+	assert.Nil(c.Validate())
+
+	c.APIEnvEndpoints = map[string]APIEndpointSettings{"prod": {URL: "https://prod.example.com"}}
+	assert.NotNil(c.Validate())
+	c.APIEnvEndpoints["prod"] = APIEndpointSettings{URL: "https://prod.example.com", APIKey: "prod_key"}
+	assert.Nil(c.Validate())
+	c.APIEnvEndpoints[c.DefaultEnv] = c.APIEnvEndpoints["prod"]
+	assert.NotNil(c.Validate())
+	delete(c.APIEnvEndpoints, c.DefaultEnv)
+
+	c.TLS.CAFile = "/does/not/exist.pem"
+	assert.NotNil(c.Validate())
+	c.TLS.CAFile = ""
+	c.TLS.CertFile = "/etc/datadog/client.pem"
+	assert.NotNil(c.Validate())
+	c.TLS.CertFile = ""
+
+	c.HTTPClient.ConnectTimeout = -time.Second
+	assert.NotNil(c.Validate())
+	c.HTTPClient.ConnectTimeout = time.Minute
+	assert.NotNil(c.Validate(), "request timeout shorter than the connect one")
+	c.HTTPClient.RequestTimeout = 0
+	assert.Nil(c.Validate())
+	c.HTTPClient.MaxIdleConns = -1
+	assert.NotNil(c.Validate())
+	c.HTTPClient = NewDefaultHTTPClientSettings()
+
+	c.LogSampleEvery = 0
+	assert.NotNil(c.Validate())
+	c.LogSampleEvery = 1
+
+	c.APIBreakerThreshold = -1
+	assert.NotNil(c.Validate())
+	c.APIBreakerThreshold = 5
+	c.APIBreakerCooldown = 0
+	assert.NotNil(c.Validate())
+	c.APIBreakerThreshold = 0
+	assert.Nil(c.Validate())
+	c.APIBreakerCooldown = 30 * time.Second
+
+	c.APIPayloadQueuePolicy = "drop_everything"
+	assert.NotNil(c.Validate())
+	c.APIPayloadQueuePolicy = QueuePolicyDropOldest
+	assert.Nil(c.Validate())
+
+	c.APIPayloadMaxRetries = -1
+	assert.NotNil(c.Validate())
+	c.APIPayloadMaxRetries = 3
+	assert.Nil(c.Validate())
+
+	c.APIMaxPayloadSize = -1
+	assert.NotNil(c.Validate())
+	c.APIMaxPayloadSize = 0
+	assert.Nil(c.Validate())
+
+	c.APIMaxTraceDepth = -1
+	assert.NotNil(c.Validate())
+	c.APIMaxTraceDepth = 0
+	assert.Nil(c.Validate())
+
+	c.AnomalyBoost = -1
+	assert.NotNil(c.Validate())
+	c.AnomalyBoost = 10
+	c.AnomalyThreshold = 0
+	assert.NotNil(c.Validate())
+	c.AnomalyThreshold = 3
+	assert.Nil(c.Validate())
+
+	c.FullSampleBelowTPS = -1
+	assert.NotNil(c.Validate())
+	c.FullSampleBelowTPS = 0
+	assert.Nil(c.Validate())
+
+	c.SignatureCacheSize = -1
+	assert.NotNil(c.Validate())
+	c.SignatureCacheSize = 0
+	assert.Nil(c.Validate())
+
+	c.SignatureRootFields = []string{"service", "host"}
+	assert.NotNil(c.Validate())
+	c.SignatureRootFields = []string{"service", "meta."}
+	assert.NotNil(c.Validate())
+	c.SignatureRootFields = []string{"service", "meta.http.method"}
+	assert.Nil(c.Validate())
+	c.SignatureSpanFields = []string{""}
+	assert.NotNil(c.Validate())
+	c.SignatureSpanFields = []string{"type"}
+	assert.Nil(c.Validate())
+
+	c.SamplingRules = []string{"service=web => 2"}
+	assert.NotNil(c.Validate())
+	c.SamplingRules = []string{"service=web => 0.05"}
+	assert.Nil(c.Validate())
+
+	c.SamplerShadowEngine = "deterministic,scorer"
+	assert.NotNil(c.Validate())
+	c.SamplerShadowEngine = "deterministic, signature"
+	assert.Nil(c.Validate())
+
+	c.MaxTracesPerFlush = -1
+	assert.NotNil(c.Validate())
+	c.MaxTracesPerFlush = 0
+	assert.Nil(c.Validate())
+
+	c.HostTagsProviders = []string{"azure"}
+	assert.NotNil(c.Validate())
+	c.HostTagsProviders = []string{HostTagsProviderEC2}
+	c.HostTagsTTL = 0
+	assert.NotNil(c.Validate())
+	c.HostTagsTTL = time.Minute
+	assert.Nil(c.Validate())
+
+	c.FlushJitter = 1
+	assert.NotNil(c.Validate())
+	c.FlushJitter = -0.1
+	assert.NotNil(c.Validate())
+	c.FlushJitter = 0
+	assert.Nil(c.Validate())
+
+	c.MaxResources = -1
+	assert.NotNil(c.Validate())
+	c.MaxResources = 0
+	assert.Nil(c.Validate())
+
+	// the checkpoints settings only matter when enabled
+	c.StatsCheckpointInterval = time.Second
+	assert.Nil(c.Validate())
+	c.StatsCheckpointDir = "/var/lib/trace-agent/checkpoint"
+	assert.NotNil(c.Validate())
+	c.StatsCheckpointInterval = MinStatsCheckpointInterval
+	assert.Nil(c.Validate())
+	c.StatsCheckpointMaxSize = 0
+	assert.NotNil(c.Validate())
+	c.StatsCheckpointMaxSize = 1024
+	assert.Nil(c.Validate())
+
+	c.APIKeys = nil
+	assert.NotNil(c.Validate())
+}
+
+func TestRedactedString(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	c.APIKeys = []string{"secret_api_key_1", "secret_api_key_2"}
+	c.Proxy = &ProxySettings{User: "aaditya", Password: "secret_password", Host: "myhost", Port: 3128}
+
+	s := c.RedactedString()
+	assert.NotContains(s, "secret_api_key")
+	assert.NotContains(s, "secret_password")
+	assert.Contains(s, `"APIKeys":["***","***"]`)
+	assert.Contains(s, `"User":"aaditya"`)
+
+	c.APIFailoverEndpoints = []APIEndpointSettings{{URL: "https://backup.example.com", APIKey: "secret_api_key_3"}}
+	assert.NotContains(c.RedactedString(), "secret_api_key")
+
+	// the source config must be left untouched
+	assert.Equal("secret_password", c.Proxy.Password)
+	assert.Equal("secret_api_key_1", c.APIKeys[0])
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPClientSettings contains the configuration of the connections to the intake
+type HTTPClientSettings struct {
+	ConnectTimeout  time.Duration // how long to wait for a connection, no limit if 0
+	RequestTimeout  time.Duration // how long a whole request can take, no limit if 0
+	MaxIdleConns    int           // connections kept open to each endpoint between two requests, 2 if 0
+	IdleConnTimeout time.Duration // how long an idle connection is kept open, no limit if 0
+	KeepAlive       bool          // reuse the connections across requests
+}
+
+// NewDefaultHTTPClientSettings returns the settings used unless configured otherwise
+func NewDefaultHTTPClientSettings() HTTPClientSettings {
+	return HTTPClientSettings{
+		ConnectTimeout:  10 * time.Second,
+		RequestTimeout:  30 * time.Second,
+		MaxIdleConns:    10,
+		IdleConnTimeout: 90 * time.Second,
+		KeepAlive:       true,
+	}
+}
+
+// Validate returns an error if the settings cannot apply
+func (s *HTTPClientSettings) Validate() error {
+	if s.ConnectTimeout < 0 || s.RequestTimeout < 0 || s.IdleConnTimeout < 0 {
+		return errors.New("HTTP client timeouts cannot be negative")
+	}
+	if s.RequestTimeout > 0 && s.RequestTimeout < s.ConnectTimeout {
+		return errors.New("HTTP client request timeout cannot be shorter than the connect timeout")
+	}
+	if s.MaxIdleConns < 0 {
+		return errors.New("HTTP client max idle connections cannot be negative")
+	}
+	return nil
+}
+
+// Transport builds the http.Transport described by the settings, to which
+// the proxy and TLS configuration are left to add
+func (s *HTTPClientSettings) Transport() *http.Transport {
+	dialer := &net.Dialer{Timeout: s.ConnectTimeout}
+	if s.KeepAlive {
+		dialer.KeepAlive = 30 * time.Second
+	}
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: s.ConnectTimeout,
+		MaxIdleConns:        s.MaxIdleConns,
+		MaxIdleConnsPerHost: s.MaxIdleConns,
+		IdleConnTimeout:     s.IdleConnTimeout,
+		DisableKeepAlives:   !s.KeepAlive,
+	}
+}
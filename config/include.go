@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+const (
+	// includeKey is the key, out of any section, listing the files that a
+	// config file includes, separated by commas. Relative paths are relative
+	// to the directory of the including file.
+	includeKey = "include"
+	// appendSuffix ends the keys whose value is appended to the included
+	// value, separated by a comma, instead of replacing it
+	appendSuffix = "+"
+	// maxIncludeDepth bounds the chains of includes, to break cycles
+	maxIncludeDepth = 8
+)
+
+// loadWithIncludes loads the ini file in path, on top of the files it
+// includes, so that a base config can be shared and overridden per
+// environment:
+//   - the included files are merged in order, then the including file;
+//   - a key replaces the same key of the same section in the files merged
+//     before it, other keys are left as they are;
+//   - a key ending with appendSuffix, e.g. "extra_aggregators+", appends
+//     its value to the list merged before it.
+//
+// Environment variables still override the result, see NewAgentConfig.
+func loadWithIncludes(path string, depth int) (*ini.File, error) {
+	f, err := ini.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := ini.Empty()
+	for _, inc := range f.Section(ini.DEFAULT_SECTION).Key(includeKey).Strings(",") {
+		if depth >= maxIncludeDepth {
+			return nil, fmt.Errorf("too many nested includes, is %s including itself?", inc)
+		}
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		included, err := loadWithIncludes(inc, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("cannot include %s: %v", inc, err)
+		}
+		mergeFile(merged, included)
+	}
+	mergeFile(merged, f)
+
+	return merged, nil
+}
+
+// mergeFile merges the keys of src into dst, see loadWithIncludes
+func mergeFile(dst, src *ini.File) {
+	for _, section := range src.Sections() {
+		dstSection := dst.Section(section.Name())
+		for _, key := range section.Keys() {
+			name, value := key.Name(), key.Value()
+			if section.Name() == ini.DEFAULT_SECTION && name == includeKey {
+				continue
+			}
+			if strings.HasSuffix(name, appendSuffix) {
+				name = strings.TrimSuffix(name, appendSuffix)
+				if inSection(dstSection, name) {
+					if prev := dstSection.Key(name).Value(); prev != "" {
+						value = prev + "," + value
+					}
+				}
+			}
+			dstSection.NewKey(name, value)
+		}
+	}
+}
+
+// inSection tells if the section itself has the key, not one of its parents
+func inSection(section *ini.Section, name string) bool {
+	for _, k := range section.KeyStrings() {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
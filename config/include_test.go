@@ -0,0 +1,98 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeIncludeTestFile(t *testing.T, dir, name string, lines ...string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigInclude(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeIncludeTestFile(t, dir, "base.ini",
+		"[Main]",
+		"hostname = base-host",
+		"api_key = base_key",
+		"[trace.sampler]",
+		"extra_sample_rate = 0.5",
+		"max_traces_per_second = 10",
+		"[trace.concentrator]",
+		"extra_aggregators = resource",
+		"[trace.receiver]",
+		"receiver_port = 8126",
+	)
+	prod := writeIncludeTestFile(t, dir, "prod.ini",
+		"include = base.ini",
+		"[Main]",
+		"hostname = prod-host",
+		"[trace.sampler]",
+		"extra_sample_rate = 0.1",
+		"[trace.concentrator]",
+		"extra_aggregators+ = error",
+		"[trace.api]",
+		"endpoint = https://prod.example.com",
+	)
+
+	f, err := New(prod)
+	assert.NoError(err)
+	c, err := NewAgentConfig(f, nil)
+	assert.NoError(err)
+
+	// scalars are replaced key by key, the others inherited
+	assert.Equal("prod-host", c.HostName)
+	assert.Equal([]string{"base_key"}, c.APIKeys)
+	assert.Equal(0.1, c.ExtraSampleRate)
+	assert.Equal(10.0, c.MaxTPS)
+	assert.Equal(8126, c.ReceiverPort)
+	assert.Equal([]string{"https://prod.example.com"}, c.APIEndpoints)
+	// lists are appended to on demand
+	assert.Equal([]string{"resource", "error"}, c.ExtraAggregators)
+
+	// environment variables still have the last word
+	os.Setenv("DD_HOSTNAME", "env-host")
+	defer os.Unsetenv("DD_HOSTNAME")
+	c, err = NewAgentConfig(f, nil)
+	assert.NoError(err)
+	assert.Equal("env-host", c.HostName)
+}
+
+func TestConfigIncludeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// included files must exist
+	missing := writeIncludeTestFile(t, dir, "missing.ini", "include = nope.ini")
+	_, err = New(missing)
+	assert.IsType(&ParseError{}, err)
+
+	// cycles are broken
+	writeIncludeTestFile(t, dir, "a.ini", "include = b.ini")
+	b := writeIncludeTestFile(t, dir, "b.ini", "include = a.ini")
+	_, err = New(b)
+	if assert.IsType(&ParseError{}, err) {
+		assert.Contains(err.Error(), "too many nested includes")
+	}
+}
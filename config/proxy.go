@@ -5,6 +5,8 @@ import (
 	"github.com/go-ini/ini"
 	"net/url"
 	"strings"
+
+	log "github.com/cihub/seelog"
 )
 
 // mirror default behavior of the infra agent
@@ -41,6 +43,13 @@ func getProxySettings(m *ini.Section) *ProxySettings {
 	if v := m.Key("proxy_password").MustString(""); v != "" {
 		p.Password = v
 	}
+	if v := m.Key("proxy_password_file").MustString(""); v != "" {
+		if pass, err := readSecretFile(v); err == nil {
+			p.Password = pass
+		} else {
+			log.Errorf("Failed to read proxy_password_file: %v", err)
+		}
+	}
 
 	return &p
 }
@@ -64,5 +73,11 @@ func (p *ProxySettings) URL() (*url.URL, error) {
 		path = fmt.Sprintf("%s://%s:%v", p.Scheme, p.Host, p.Port)
 	}
 
-	return url.Parse(path)
+	u, err := url.Parse(path)
+	if err != nil {
+		// the parsing error holds the whole URL, do not leak the password
+		return nil, fmt.Errorf("invalid proxy URL %s://%s:%v", p.Scheme, p.Host, p.Port)
+	}
+
+	return u, nil
 }
@@ -114,3 +114,12 @@ func TestGetProxySettings(t *testing.T) {
 	pass, _ := s.User.Password()
 	assert.Equal("/:!?&=@éÔγλῶσσα", pass)
 }
+
+func TestProxyURLErrorRedacted(t *testing.T) {
+	assert := assert.New(t)
+
+	p := ProxySettings{User: "aaditya", Password: "secret_password", Host: "my host%", Port: 3128, Scheme: "http"}
+	_, err := p.URL()
+	assert.NotNil(err)
+	assert.NotContains(err.Error(), "secret_password")
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// readSecretFile returns the secret stored in the file at path, such as a
+// Kubernetes secret mounted as a file, without its surrounding whitespaces.
+// It warns when the file can be read by anyone.
+func readSecretFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret file: %v", err)
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("cannot read secret file %s: is a directory", path)
+	}
+	if fi.Mode().Perm()&0004 != 0 {
+		log.Warnf("secret file %s is world-readable (mode %v), consider restricting its permissions", path, fi.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret file: %v", err)
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// readAPIKeysFile reads the comma separated API keys stored in the file at
+// path, see readSecretFile
+func readAPIKeysFile(path string) ([]string, error) {
+	v, err := readSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vals := strings.Split(v, ",")
+	for i := range vals {
+		vals[i] = strings.TrimSpace(vals[i])
+	}
+	return vals, nil
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-ini/ini"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "api_key")
+	assert.Nil(ioutil.WriteFile(keyFile, []byte("key_from_file\n"), 0600))
+	passFile := filepath.Join(dir, "proxy_password")
+	assert.Nil(ioutil.WriteFile(passFile, []byte("secret\n"), 0644)) // world-readable, only warned about
+
+	s, err := readSecretFile(passFile)
+	assert.Nil(err)
+	assert.Equal("secret", s)
+
+	emptyFile := filepath.Join(dir, "empty")
+	assert.Nil(ioutil.WriteFile(emptyFile, []byte(" \n"), 0600))
+	for _, path := range []string{filepath.Join(dir, "missing"), dir, emptyFile} {
+		_, err := readSecretFile(path)
+		assert.NotNil(err, path)
+	}
+
+	// the files take precedence over the inline secrets
+	dd, _ := ini.Load([]byte(fmt.Sprintf(
+		"[Main]\napi_key=inline\nproxy_host=myproxy\nproxy_user=user\nproxy_password=inline\nproxy_password_file=%s",
+		passFile,
+	)))
+	legacy, _ := ini.Load([]byte(fmt.Sprintf("[trace.api]\napi_key_file=%s", keyFile)))
+	c, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, &File{instance: legacy, Path: "whatever"})
+	assert.Nil(err)
+	assert.Equal([]string{"key_from_file"}, c.APIKeys)
+	assert.Equal("secret", c.Proxy.Password)
+
+	dd, _ = ini.Load([]byte(fmt.Sprintf("[Main]\napi_key_file=%s", keyFile)))
+	c, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal([]string{"key_from_file"}, c.APIKeys)
+
+	// an unreadable file leaves the agent without API key
+	dd, _ = ini.Load([]byte(fmt.Sprintf("[Main]\napi_key_file=%s", filepath.Join(dir, "missing"))))
+	_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.IsType(&ValidationError{}, err)
+}
@@ -3,11 +3,27 @@ package config
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
 	log "github.com/cihub/seelog"
 )
 
+// DefaultLogFilePath is where the agent logs when nothing else is configured.
+const DefaultLogFilePath = "/var/log/datadog/trace-agent.log"
+
+// Special log file paths routing logs to the console instead of a file.
+// An empty path is equivalent to "stdout".
+const (
+	logFileStdout = "stdout"
+	logFileStderr = "stderr"
+)
+
+const logFormat = "%Date %Time %LEVEL (%File:%Line) - %Msg%n"
+
 type outputs struct {
 	FormatID string `xml:"formatid,attr"`
 	Console  string `xml:",innerxml"`
@@ -40,22 +56,72 @@ func newSeelogConfig(logFilePath string) seelog {
 		Formats: formats{
 			format{
 				ID:     "common",
-				Format: "%Date %Time %LEVEL (%File:%Line) - %Msg%n",
+				Format: logFormat,
 			},
 		},
 		LogLevel: "info",
 	}
 }
 
-// NewLoggerLevelCustom creates a logger with the given level.
+// consoleWriter returns the console stream logs should be written to given
+// logFilePath, or nil if they should go to a rolling file at that path.
+// We fall back to stdout when the log directory is not writable, or when
+// running in a container with the default path, since minimal images usually
+// don't have /var/log/datadog and a silent logger is the worst outcome.
+func consoleWriter(logFilePath string) io.Writer {
+	switch strings.ToLower(strings.TrimSpace(logFilePath)) {
+	case "", logFileStdout:
+		return os.Stdout
+	case logFileStderr:
+		return os.Stderr
+	}
+
+	if logFilePath == DefaultLogFilePath && inContainer() {
+		return os.Stdout
+	}
+	if !isDirWritable(filepath.Dir(logFilePath)) {
+		return os.Stdout
+	}
+	return nil
+}
+
+// inContainer tells if the agent is likely running inside a container.
+func inContainer() bool {
+	if os.Getenv("DOCKER_DD_AGENT") != "" {
+		return true
+	}
+	_, err := os.Stat("/.dockerenv")
+	return err == nil
+}
+
+// isDirWritable tells if we can create files in dir.
+func isDirWritable(dir string) bool {
+	f, err := ioutil.TempFile(dir, ".trace-agent-log-check")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
+// NewLoggerLevelCustom creates a logger with the given level. logFilePath can
+// be "stdout" or "stderr" (or empty) to log to the console only.
 func NewLoggerLevelCustom(level, logFilePath string) error {
-	cfg := newSeelogConfig(logFilePath)
 	ll, ok := log.LogLevelFromString(strings.ToLower(level))
 	if !ok {
 		ll = log.InfoLvl
 	}
-	cfg.LogLevel = ll.String()
-	l, err := log.LoggerFromConfigAsString(cfg.String())
+
+	var l log.LoggerInterface
+	var err error
+	if w := consoleWriter(logFilePath); w != nil {
+		l, err = log.LoggerFromWriterWithMinLevelAndFormat(w, ll, logFormat)
+	} else {
+		cfg := newSeelogConfig(logFilePath)
+		cfg.LogLevel = ll.String()
+		l, err = log.LoggerFromConfigAsString(cfg.String())
+	}
 	if err != nil {
 		return err
 	}
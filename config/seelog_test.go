@@ -0,0 +1,31 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsoleWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(os.Stdout, consoleWriter(""))
+	assert.Equal(os.Stdout, consoleWriter("stdout"))
+	assert.Equal(os.Stdout, consoleWriter(" STDOUT "))
+	assert.Equal(os.Stderr, consoleWriter("stderr"))
+
+	// the log directory does not exist: fall back to stdout
+	assert.Equal(os.Stdout, consoleWriter("/does-not-exist/trace-agent.log"))
+
+	// a writable directory: log to the file
+	assert.Nil(consoleWriter(filepath.Join(os.TempDir(), "trace-agent.log")))
+}
+
+func TestNewLoggerLevelCustomConsole(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewLoggerLevelCustom("INFO", "stderr"))
+	assert.Nil(NewLoggerLevelCustom("INFO", "/does-not-exist/trace-agent.log"))
+}
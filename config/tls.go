@@ -0,0 +1,51 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSSettings contains the TLS configuration of the connections to the intake
+type TLSSettings struct {
+	CAFile     string // PEM bundle of the CAs to trust instead of the system ones
+	CertFile   string // PEM client certificate, along with KeyFile
+	KeyFile    string
+	SkipVerify bool // do not verify the intake certificate, insecure
+}
+
+// IsEmpty returns true if the settings do not change the default TLS behavior
+func (s *TLSSettings) IsEmpty() bool {
+	return s.CAFile == "" && s.CertFile == "" && s.KeyFile == "" && !s.SkipVerify
+}
+
+// Config builds the tls.Config described by the settings, loading the files
+func (s *TLSSettings) Config() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: s.SkipVerify}
+
+	if s.CAFile != "" {
+		pem, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %v", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", s.CAFile)
+		}
+	}
+
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return nil, errors.New("a TLS client certificate needs both a cert and a key file")
+	}
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -28,6 +29,13 @@ const (
 	MaxEndDateOffset = 10 * time.Minute
 )
 
+const (
+	// DefaultServiceName is the service given to spans without one by FillDefaults
+	DefaultServiceName = "unnamed-service"
+	// DefaultSpanName is the name given to spans without one by FillDefaults
+	DefaultSpanName = "unnamed-operation"
+)
+
 var (
 	// Year2000NanosecTS is an arbitrary cutoff to spot weird-looking values
 	Year2000NanosecTS = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC).UnixNano()
@@ -155,6 +163,36 @@ func (s *Span) Normalize() error {
 	return nil
 }
 
+// FillDefaults fixes, instead of rejecting like Normalize does, the fields
+// used to group similar spans together: an empty service or name gets a
+// default value, too long ones are truncated and the service and type are
+// lowercased. It returns true if the span had to be fixed.
+func (s *Span) FillDefaults() bool {
+	fixed := false
+	fix := func(field *string, def string, maxLen int, lower bool) {
+		v := *field
+		if v == "" {
+			v = def
+		}
+		if len(v) > maxLen {
+			v = v[:maxLen]
+		}
+		if lower {
+			v = strings.ToLower(v)
+		}
+		if v != *field {
+			*field = v
+			fixed = true
+		}
+	}
+
+	fix(&s.Service, DefaultServiceName, MaxServiceLen, true)
+	fix(&s.Name, DefaultSpanName, MaxNameLen, false)
+	fix(&s.Type, "", MaxTypeLen, true)
+
+	return fixed
+}
+
 // NormalizeTrace takes a trace and
 // * rejects the trace if there is a trace ID discrepancy between 2 spans
 // * rejects the trace if two spans have the same span_id
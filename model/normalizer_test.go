@@ -51,6 +51,44 @@ func TestNormalizeLongName(t *testing.T) {
 	assert.Error(t, s.Normalize())
 }
 
+func TestSpanFillDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		service, sname  string
+		typ             string
+		expService      string
+		expName, expTyp string
+		fixed           bool
+	}{
+		{"ok", "django", "django.request", "web", "django", "django.request", "web", false},
+		{"empty service", "", "django.request", "web", DefaultServiceName, "django.request", "web", true},
+		{"empty name", "django", "", "web", "django", DefaultSpanName, "web", true},
+		{"empty type", "django", "django.request", "", "django", "django.request", "", false},
+		{"long service", strings.Repeat("x", MaxServiceLen+1), "django.request", "web",
+			strings.Repeat("x", MaxServiceLen), "django.request", "web", true},
+		{"long name", "django", strings.Repeat("x", MaxNameLen+1), "web",
+			"django", strings.Repeat("x", MaxNameLen), "web", true},
+		{"long type", "django", "django.request", strings.Repeat("x", MaxTypeLen+1),
+			"django", "django.request", strings.Repeat("x", MaxTypeLen), true},
+		{"uppercase service", "DjAnGo", "django.request", "web", "django", "django.request", "web", true},
+		{"uppercase type", "django", "django.request", "WEB", "django", "django.request", "web", true},
+		{"uppercase name is kept", "django", "Django.Request", "web", "django", "Django.Request", "web", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testSpan()
+			s.Service, s.Name, s.Type = tc.service, tc.sname, tc.typ
+
+			assert.Equal(t, tc.fixed, s.FillDefaults())
+			assert.Equal(t, tc.expService, s.Service)
+			assert.Equal(t, tc.expName, s.Name)
+			assert.Equal(t, tc.expTyp, s.Type)
+
+			// once fixed, there is nothing left to fix
+			assert.False(t, s.FillDefaults())
+		})
+	}
+}
+
 func TestNormalizeName(t *testing.T) {
 	expNames := map[string]string{
 		"pylons.controller": "pylons.controller",
@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+
+	log "github.com/cihub/seelog"
 )
 
 // AgentPayload is the main payload to carry data that has been
@@ -16,6 +19,8 @@ type AgentPayload struct {
 	Env      string        `json:"env"`      // the default environment this agent uses
 	Traces   []Trace       `json:"traces"`   // the traces we sampled
 	Stats    []StatsBucket `json:"stats"`    // the statistics we pre-computed
+	// Tags describe the host, e.g. its cloud region, for filtering
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // IsEmpty tells if a payload contains data. If not, it's useless
@@ -37,8 +42,23 @@ var (
 	// GlobalAgentPayloadVersion is a default that will be used
 	// in all the AgentPayload method. Override for special cases.
 	GlobalAgentPayloadVersion = AgentPayloadV01
+	// GlobalAgentPayloadCompression tells if the AgentPayload methods
+	// gzip the payloads.
+	GlobalAgentPayloadCompression = true
 )
 
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
 // EncodeAgentPayload will return a slice of bytes representing the
 // payload (according to GlobalAgentPayloadVersion)
 func EncodeAgentPayload(p AgentPayload) ([]byte, error) {
@@ -47,12 +67,22 @@ func EncodeAgentPayload(p AgentPayload) ([]byte, error) {
 
 	switch GlobalAgentPayloadVersion {
 	case AgentPayloadV01:
-		gz, err := gzip.NewWriterLevel(&b, gzip.BestSpeed)
-		if err != nil {
+		if !GlobalAgentPayloadCompression {
+			err = json.NewEncoder(&b).Encode(p)
+			break
+		}
+
+		var gz *gzip.Writer
+		if gz, err = gzip.NewWriterLevel(&b, gzip.BestSpeed); err != nil {
 			return nil, err
 		}
-		err = json.NewEncoder(gz).Encode(p)
+		raw := &countingWriter{w: gz}
+		err = json.NewEncoder(raw).Encode(p)
 		gz.Close()
+		if b.Len() > 0 {
+			log.Debugf("compressed payload from %d to %d bytes, ratio: %.2f",
+				raw.n, b.Len(), float64(raw.n)/float64(b.Len()))
+		}
 	default:
 		err = errors.New("unknown payload version")
 	}
@@ -73,7 +103,9 @@ func SetAgentPayloadHeaders(h http.Header) {
 	switch GlobalAgentPayloadVersion {
 	case AgentPayloadV01:
 		h.Set("Content-Type", "application/json")
-		h.Set("Content-Encoding", "gzip")
+		if GlobalAgentPayloadCompression {
+			h.Set("Content-Encoding", "gzip")
+		}
 	default:
 	}
 }
@@ -0,0 +1,180 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// samplingRuleOperators are the comparisons a rule condition can use, the longest
+// first so that ">=" is not parsed as ">"
+var samplingRuleOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// SamplingRuleCondition compares a tag of the trace root to a value. The tag is
+// either one of the root span fields "service", "name", "resource" or
+// "type", or a key of its Meta or Metrics.
+type SamplingRuleCondition struct {
+	Tag      string
+	Operator string
+	Value    string
+
+	// numValue is Value as a number, when it is one
+	numValue  float64
+	isNumeric bool
+}
+
+// SamplingRule gives the sample rate of the traces matching all its conditions
+type SamplingRule struct {
+	Conditions []SamplingRuleCondition
+	Rate       float64
+}
+
+// ParseSamplingRule parses a rule written as conditions separated by spaces,
+// followed by "=>" and the sample rate, e.g.
+// "service=web http.status_code>=500 => 1"
+func ParseSamplingRule(s string) (SamplingRule, error) {
+	var rule SamplingRule
+
+	parts := strings.Split(s, "=>")
+	if len(parts) != 2 {
+		return rule, fmt.Errorf("invalid sampling rule %q: expected conditions => rate", s)
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return rule, fmt.Errorf("invalid sampling rule %q: rate must be between 0 and 1", s)
+	}
+	rule.Rate = rate
+
+	for _, c := range strings.Fields(parts[0]) {
+		cond, err := parseSamplingRuleCondition(c)
+		if err != nil {
+			return rule, fmt.Errorf("invalid sampling rule %q: %v", s, err)
+		}
+		rule.Conditions = append(rule.Conditions, cond)
+	}
+	if len(rule.Conditions) == 0 {
+		return rule, fmt.Errorf("invalid sampling rule %q: no condition", s)
+	}
+
+	return rule, nil
+}
+
+// ParseSamplingRules parses a list of rules, see ParseSamplingRule
+func ParseSamplingRules(rules []string) ([]SamplingRule, error) {
+	parsed := make([]SamplingRule, 0, len(rules))
+	for _, s := range rules {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		rule, err := ParseSamplingRule(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func parseSamplingRuleCondition(s string) (SamplingRuleCondition, error) {
+	var cond SamplingRuleCondition
+
+	i := strings.IndexAny(s, "=!<>")
+	if i <= 0 {
+		return cond, fmt.Errorf("invalid condition %q", s)
+	}
+	cond.Tag = s[:i]
+	for _, op := range samplingRuleOperators {
+		if strings.HasPrefix(s[i:], op) {
+			cond.Operator = op
+			break
+		}
+	}
+	if cond.Operator == "" {
+		return cond, fmt.Errorf("invalid condition %q", s)
+	}
+	cond.Value = s[i+len(cond.Operator):]
+	if cond.Value == "" {
+		return cond, fmt.Errorf("invalid condition %q: no value", s)
+	}
+
+	if v, err := strconv.ParseFloat(cond.Value, 64); err == nil {
+		cond.numValue, cond.isNumeric = v, true
+	}
+	switch cond.Operator {
+	case ">=", "<=", ">", "<":
+		if !cond.isNumeric {
+			return cond, fmt.Errorf("invalid condition %q: %s needs a number", s, cond.Operator)
+		}
+	}
+
+	return cond, nil
+}
+
+// Match tells if the trace root matches the condition. A condition on a tag
+// the root does not have never matches.
+func (c SamplingRuleCondition) Match(root *Span) bool {
+	var str string
+	var num float64
+	var hasNum bool
+
+	switch c.Tag {
+	case "service":
+		str = root.Service
+	case "name":
+		str = root.Name
+	case "resource":
+		str = root.Resource
+	case "type":
+		str = root.Type
+	default:
+		if v, ok := root.Meta[c.Tag]; ok {
+			str = v
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				num, hasNum = f, true
+			}
+		} else if v, ok := root.Metrics[c.Tag]; ok {
+			str = strconv.FormatFloat(v, 'f', -1, 64)
+			num, hasNum = v, true
+		} else {
+			return false
+		}
+	}
+
+	switch c.Operator {
+	case "=":
+		if hasNum && c.isNumeric {
+			return num == c.numValue
+		}
+		return str == c.Value
+	case "!=":
+		if hasNum && c.isNumeric {
+			return num != c.numValue
+		}
+		return str != c.Value
+	}
+
+	if !hasNum {
+		return false
+	}
+	switch c.Operator {
+	case ">=":
+		return num >= c.numValue
+	case "<=":
+		return num <= c.numValue
+	case ">":
+		return num > c.numValue
+	default:
+		return num < c.numValue
+	}
+}
+
+// Match tells if the trace root matches all the conditions of the rule
+func (r SamplingRule) Match(root *Span) bool {
+	for _, c := range r.Conditions {
+		if !c.Match(root) {
+			return false
+		}
+	}
+	return true
+}
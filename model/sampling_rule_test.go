@@ -0,0 +1,74 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSamplingRule(t *testing.T) {
+	assert := assert.New(t)
+
+	rule, err := ParseSamplingRule("service=web  http.status_code>=500 => 0.5")
+	assert.NoError(err)
+	assert.Equal(0.5, rule.Rate)
+	if assert.Len(rule.Conditions, 2) {
+		assert.Equal("service", rule.Conditions[0].Tag)
+		assert.Equal("=", rule.Conditions[0].Operator)
+		assert.Equal("web", rule.Conditions[0].Value)
+		assert.Equal("http.status_code", rule.Conditions[1].Tag)
+		assert.Equal(">=", rule.Conditions[1].Operator)
+		assert.Equal("500", rule.Conditions[1].Value)
+	}
+
+	for _, s := range []string{
+		"service=web",                // no rate
+		"service=web => 2",           // rate out of bounds
+		"service=web => half",        // rate not a number
+		"=> 1",                       // no condition
+		"service => 1",               // no operator
+		"=web => 1",                  // no tag
+		"service= => 1",              // no value
+		"http.status_code>=5xx => 1", // not a number to compare to
+	} {
+		_, err := ParseSamplingRule(s)
+		assert.Error(err, s)
+	}
+
+	rules, err := ParseSamplingRules([]string{"service=web => 1", " ", "type!=sql => 0"})
+	assert.NoError(err)
+	assert.Len(rules, 2)
+	_, err = ParseSamplingRules([]string{"service=web => 1", "service"})
+	assert.Error(err)
+}
+
+func TestSamplingRuleMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Span{
+		Service: "web",
+		Name:    "http.request",
+		Meta:    map[string]string{"http.status_code": "503", "env": "prod"},
+		Metrics: map[string]float64{"retries": 2},
+	}
+
+	for s, match := range map[string]bool{
+		"service=web => 1":                   true,
+		"service!=web => 1":                  false,
+		"name=http.request env=prod => 1":    true,
+		"name=http.request env=staging => 1": false,
+		"http.status_code>=500 => 1":         true,
+		"http.status_code<500 => 1":          false,
+		"http.status_code=503.0 => 1":        true,
+		"retries>1 => 1":                     true,
+		"retries<=1 => 1":                    false,
+		"retries=2 => 1":                     true,
+		"env>1 => 1":                         false, // not a number
+		"missing!=anything => 1":             false, // missing tags never match
+	} {
+		rule, err := ParseSamplingRule(s)
+		if assert.NoError(err) {
+			assert.Equal(match, rule.Match(root), s)
+		}
+	}
+}
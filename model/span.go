@@ -8,6 +8,8 @@ import (
 const (
 	// SpanSampleRateMetricKey is the metric key holding the sample rate
 	SpanSampleRateMetricKey = "_sample_rate"
+	// SpanSamplingPriorityMetricKey is the metric key holding the sampling priority set by the client
+	SpanSamplingPriorityMetricKey = "_sampling_priority_v1"
 )
 
 // Span is the common struct we use to represent a dapper-like span
@@ -95,7 +95,9 @@ func (d Distribution) Add(v float64, sampleID uint64) {
 // Merge is used when 2 Distributions represent the same thing and it merges the 2 underlying summaries
 func (d Distribution) Merge(d2 Distribution) {
 	// We don't check tagsets for distributions as we reaggregate without reallocating new structs
-	d.Summary.Merge(d2.Summary)
+	if err := d.Summary.Merge(d2.Summary); err != nil {
+		panic(fmt.Errorf("Trying to merge non-homogoneous distributions [%s]: %v", d.Key, err))
+	}
 }
 
 // Weigh applies a weight factor to a distribution and return the result as a
@@ -134,6 +136,24 @@ func NewStatsBucket(ts, d int64) StatsBucket {
 	}
 }
 
+// Merge adds the counts and distributions of sb2 to the ones of sb, with
+// copies of the distributions sb does not have yet
+func (sb StatsBucket) Merge(sb2 StatsBucket) {
+	for k, c := range sb2.Counts {
+		if c1, ok := sb.Counts[k]; ok {
+			c = c1.Merge(c)
+		}
+		sb.Counts[k] = c
+	}
+	for k, d := range sb2.Distributions {
+		if d1, ok := sb.Distributions[k]; ok {
+			d1.Merge(d)
+			continue
+		}
+		sb.Distributions[k] = d.Copy()
+	}
+}
+
 // IsEmpty just says if this stats bucket has no information (in which case it's useless)
 func (sb StatsBucket) IsEmpty() bool {
 	return len(sb.Counts) == 0 && len(sb.Distributions) == 0
@@ -122,6 +122,39 @@ func TestStatsBucketDefault(t *testing.T) {
 	}
 }
 
+func TestStatsBucketMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	spans := testSpans()
+	srb1, srb2 := NewStatsRawBucket(0, 1e9), NewStatsRawBucket(0, 1e9)
+	for i, s := range spans {
+		s.Duration *= 10
+		if i < 6 {
+			srb1.HandleSpan(s, defaultEnv, nil, 1.0, nil)
+		}
+		if i >= 3 {
+			srb2.HandleSpan(s, defaultEnv, nil, 1.0, nil)
+		}
+	}
+	sb1, sb2 := srb1.Export(), srb2.Export()
+
+	sb := NewStatsBucket(0, 1e9)
+	sb.Merge(sb1)
+	sb.Merge(sb2)
+
+	assert.Len(sb.Counts, 7*3)
+	assert.Equal(2.0, sb.Counts["B.foo|hits|env:default,resource:ε,service:B"].Value)
+	assert.Equal(1.0, sb.Counts["A.foo|hits|env:default,resource:α,service:A"].Value)
+	assert.Equal(2.0, sb.Counts["sql.query|hits|env:default,resource:δ,service:C"].Value)
+	d := sb.Distributions["B.foo|duration|env:default,resource:ζ,service:B"]
+	assert.Equal(int64(2), d.Summary.N)
+	assert.Equal(50.0, d.Summary.Quantile(0.5))
+
+	// the distributions merged are left as they were
+	assert.Equal(int64(1), sb1.Distributions["B.foo|duration|env:default,resource:ζ,service:B"].Summary.N)
+	assert.Equal(int64(1), sb2.Distributions["B.foo|duration|env:default,resource:ζ,service:B"].Summary.N)
+}
+
 func TestStatsBucketExtraAggregators(t *testing.T) {
 	assert := assert.New(t)
 
@@ -41,6 +41,11 @@ type statsKey struct {
 	aggr string
 }
 
+type resourceKey struct {
+	service  string
+	resource string
+}
+
 type statsSubKey struct {
 	name    string
 	measure string
@@ -60,6 +65,11 @@ type StatsRawBucket struct {
 	data         map[statsKey]groupedStats
 	sublayerData map[statsSubKey]sublayerStats
 
+	// optional cap on the distinct (service, resource), see SetMaxResources
+	maxResources int
+	resources    map[resourceKey]struct{}
+	overflowed   int
+
 	// internal buffer for aggregate strings - not threadsafe
 	keyBuf bytes.Buffer
 }
@@ -75,6 +85,44 @@ func NewStatsRawBucket(ts, d int64) *StatsRawBucket {
 	}
 }
 
+// OverflowResource is the resource the spans of the (service, resource)
+// above the cap of a bucket are aggregated under, see SetMaxResources
+const OverflowResource = "other"
+
+// SetMaxResources caps the number of distinct (service, resource) the bucket
+// aggregates, each costing a distribution: once max of them are tracked, the
+// spans of the other resources are aggregated under the OverflowResource of
+// their service. A max <= 0 means no limit.
+func (sb *StatsRawBucket) SetMaxResources(max int) {
+	sb.maxResources = max
+	if max > 0 && sb.resources == nil {
+		sb.resources = make(map[resourceKey]struct{})
+	}
+}
+
+// Overflowed returns the number of spans aggregated under the OverflowResource
+func (sb *StatsRawBucket) Overflowed() int {
+	return sb.overflowed
+}
+
+// capResource returns the resource to aggregate the span under
+func (sb *StatsRawBucket) capResource(s Span) string {
+	if sb.maxResources <= 0 {
+		return s.Resource
+	}
+
+	key := resourceKey{service: s.Service, resource: s.Resource}
+	if _, ok := sb.resources[key]; ok {
+		return s.Resource
+	}
+	if len(sb.resources) >= sb.maxResources {
+		sb.overflowed++
+		return OverflowResource
+	}
+	sb.resources[key] = struct{}{}
+	return s.Resource
+}
+
 // Export transforms a StatsRawBucket into a StatsBucket, typically used
 // before communicating data to the API, as StatsRawBucket is the internal
 // type while StatsBucket is the public, shared one.
@@ -178,7 +226,7 @@ func (sb *StatsRawBucket) HandleSpan(s Span, env string, aggregators []string, w
 		}
 	}
 
-	grain, tags := assembleGrain(&sb.keyBuf, env, s.Resource, s.Service, m)
+	grain, tags := assembleGrain(&sb.keyBuf, env, sb.capResource(s), s.Service, m)
 	sb.add(s, weight, grain, tags)
 
 	// sublayers - special case
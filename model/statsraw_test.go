@@ -27,3 +27,34 @@ func TestGrainWithExtraTags(t *testing.T) {
 	assert.Equal("env:default,resource:yo,service:thing,meta1:ONE,meta2:two", aggr)
 	assert.Equal(TagSet{Tag{"env", "default"}, Tag{"resource", "yo"}, Tag{"service", "thing"}, Tag{"meta1", "ONE"}, Tag{"meta2", "two"}}, tgs)
 }
+
+func TestStatsRawBucketMaxResources(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetMaxResources(2)
+
+	for _, s := range []Span{
+		{Service: "web", Name: "http.request", Resource: "/users/1", Duration: 1},
+		{Service: "web", Name: "http.request", Resource: "/users/2", Duration: 1},
+		{Service: "web", Name: "http.request", Resource: "/users/1", Duration: 1},
+		// the cap is reached, new resources are aggregated together
+		{Service: "web", Name: "http.request", Resource: "/users/3", Duration: 1},
+		{Service: "web", Name: "http.request", Resource: "/users/4", Duration: 1},
+		{Service: "db", Name: "query", Resource: "SELECT", Duration: 1},
+	} {
+		srb.HandleSpan(s, "default", nil, 1, nil)
+	}
+	assert.Equal(3, srb.Overflowed())
+
+	sb := srb.Export()
+	hits := func(name, service, resource string) float64 {
+		return sb.Counts[GrainKey(name, HITS, "env:default,resource:"+resource+",service:"+service)].Value
+	}
+	assert.Len(sb.Distributions, 4)
+	assert.Equal(2.0, hits("http.request", "web", "/users/1"))
+	assert.Equal(1.0, hits("http.request", "web", "/users/2"))
+	assert.Equal(0.0, hits("http.request", "web", "/users/3"))
+	assert.Equal(2.0, hits("http.request", "web", OverflowResource))
+	assert.Equal(1.0, hits("query", "db", OverflowResource))
+}
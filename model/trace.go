@@ -32,6 +32,11 @@ func (t Trace) GetRoot() *Span {
 	if len(t) == 0 {
 		return nil
 	}
+	if GlobalRootBySpanKind {
+		if root := t.rootBySpanKind(); root != nil {
+			return root
+		}
+	}
 	// General case: go over all spans and check for one which matching parent
 	parentIDToChild := map[uint64]*Span{}
 
@@ -66,7 +71,165 @@ func (t Trace) GetRoot() *Span {
 	return &t[len(t)-1]
 }
 
+// SpanKindMetaKey is the meta key holding the kind of a span, as the
+// "server" or "consumer" kind of the entry points of the services
+const SpanKindMetaKey = "span.kind"
+
+// GlobalRootBySpanKind tells if GetRoot prefers the server or consumer spans
+// among the root candidates, see config.AgentConfig.RootBySpanKind
+var GlobalRootBySpanKind = false
+
+// rootBySpanKind returns the last server or consumer span among the spans
+// without parent in the trace, or nil if there are not several of them to
+// choose from or none has such a kind
+func (t Trace) rootBySpanKind() *Span {
+	spanIDs := make(map[uint64]struct{}, len(t))
+	for i := range t {
+		spanIDs[t[i].SpanID] = struct{}{}
+	}
+
+	candidates := 0
+	var root *Span
+	for i := len(t) - 1; i >= 0; i-- {
+		if t[i].ParentID != 0 {
+			if _, ok := spanIDs[t[i].ParentID]; ok {
+				continue
+			}
+		}
+		candidates++
+		if root == nil {
+			switch t[i].Meta[SpanKindMetaKey] {
+			case "server", "consumer":
+				root = &t[i]
+			}
+		}
+	}
+	if candidates < 2 {
+		return nil
+	}
+	return root
+}
+
 // NewTraceFlushMarker returns a trace with a single span as flush marker
 func NewTraceFlushMarker() Trace {
 	return []Span{NewFlushMarker()}
 }
+
+const (
+	// TruncatedSpanName is the name of the span TruncateDepth adds to the
+	// traces it truncates
+	TruncatedSpanName = "trace.truncated"
+	// TruncatedSpansMetricKey is the metric of the TruncatedSpanName span
+	// holding the number of spans removed from the trace
+	TruncatedSpansMetricKey = "_dd.truncated.spans"
+	// TruncatedDepthMetricKey is the metric of the TruncatedSpanName span
+	// holding the depth the trace was truncated at
+	TruncatedDepthMetricKey = "_dd.truncated.depth"
+)
+
+// IsTruncatedMarker tells if s is the span TruncateDepth adds to the traces it
+// truncates, which stands for the removed spans and is no operation itself
+func (s *Span) IsTruncatedMarker() bool {
+	if s.Name != TruncatedSpanName {
+		return false
+	}
+	_, ok := s.Metrics[TruncatedSpansMetricKey]
+	return ok
+}
+
+// TruncateDepth removes the spans nested deeper than maxDepth levels below the
+// root of the trace, the root being at depth 0, and returns the number of
+// spans removed. Spans whose parent is not in the trace are roots too, and the
+// spans which are no root's descendants, like in parenting cycles, are
+// removed. When spans are removed, a TruncatedSpanName span is added as child
+// of the root, for the backend to know the trace is not complete. It runs from
+// the start of the first removed span to the end of the last one, see
+// Span.IsTruncatedMarker to tell it apart from the real spans.
+// The spans are not walked recursively, so any nesting is safe.
+func (t Trace) TruncateDepth(maxDepth int) (Trace, int) {
+	if len(t) == 0 {
+		return t, 0
+	}
+
+	ids := make(map[uint64]struct{}, len(t))
+	for i := range t {
+		ids[t[i].SpanID] = struct{}{}
+	}
+	root := t.GetRoot()
+	children := make(map[uint64][]int, len(t))
+	depths := make([]int, len(t))
+	var queue []int
+	for i := range t {
+		depths[i] = -1
+		if _, ok := ids[t[i].ParentID]; !ok || &t[i] == root {
+			depths[i] = 0
+			queue = append(queue, i)
+		} else {
+			children[t[i].ParentID] = append(children[t[i].ParentID], i)
+		}
+	}
+
+	// breadth-first, so that each span gets the depth of its shortest path
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if depths[i] >= maxDepth {
+			continue
+		}
+		for _, c := range children[t[i].SpanID] {
+			if depths[c] < 0 {
+				depths[c] = depths[i] + 1
+				queue = append(queue, c)
+			}
+		}
+		// a span ID shared by several spans only has its children once
+		delete(children, t[i].SpanID)
+	}
+
+	kept := 0
+	for i := range t {
+		if depths[i] >= 0 {
+			kept++
+		}
+	}
+	removed := len(t) - kept
+	if removed == 0 {
+		return t, 0
+	}
+
+	truncated := make(Trace, 0, kept+1)
+	var start, end int64
+	first := true
+	for i := range t {
+		if depths[i] >= 0 {
+			truncated = append(truncated, t[i])
+			continue
+		}
+		if first || t[i].Start < start {
+			start = t[i].Start
+		}
+		if first || t[i].End() > end {
+			end = t[i].End()
+		}
+		first = false
+	}
+	if end < start {
+		end = start
+	}
+	truncated = append(truncated, Span{
+		TraceID:  root.TraceID,
+		SpanID:   RandomID(),
+		ParentID: root.SpanID,
+		Service:  root.Service,
+		Name:     TruncatedSpanName,
+		Resource: TruncatedSpanName,
+		Start:    start,
+		Duration: end - start,
+		Metrics: map[string]float64{
+			TruncatedSpansMetricKey: float64(removed),
+			TruncatedDepthMetricKey: float64(maxDepth),
+		},
+	})
+
+	return truncated, removed
+}
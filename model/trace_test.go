@@ -31,3 +31,87 @@ func TestGetRootFromPartialTrace(t *testing.T) {
 
 	assert.Equal(trace.GetRoot().SpanID, uint64(12341))
 }
+
+func TestTruncateDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	// a chain of 10000 spans, each the child of the previous one
+	deep := make(Trace, 10000)
+	for i := range deep {
+		deep[i] = Span{TraceID: 1, SpanID: uint64(i + 1), ParentID: uint64(i), Service: "s", Name: "n",
+			Start: int64(i), Duration: int64(20000 - 2*i)}
+	}
+	// and a sibling of the root's child
+	deep = append(deep, Span{TraceID: 1, SpanID: 20000, ParentID: 1, Service: "s", Name: "n"})
+
+	truncated, removed := deep.TruncateDepth(100)
+	assert.Equal(9899, removed)
+	// the root, 100 levels of descendants, the sibling and the marker
+	if assert.Len(truncated, 103) {
+		marker := truncated[len(truncated)-1]
+		assert.Equal(TruncatedSpanName, marker.Name)
+		assert.Equal(uint64(1), marker.ParentID)
+		assert.Equal(uint64(1), marker.TraceID)
+		assert.Equal(9899.0, marker.Metrics[TruncatedSpansMetricKey])
+		assert.Equal(100.0, marker.Metrics[TruncatedDepthMetricKey])
+		// it spans the removed spans, from span 102 to span 10000
+		assert.Equal(int64(101), marker.Start)
+		assert.Equal(int64(20000-101-101), marker.Duration)
+		assert.True(marker.IsTruncatedMarker())
+	}
+	for _, s := range truncated[:102] {
+		assert.False(s.IsTruncatedMarker())
+	}
+	for _, s := range truncated[:102] {
+		assert.True(s.SpanID <= 101 || s.SpanID == 20000, "span %d kept", s.SpanID)
+	}
+
+	// shallow enough
+	shallow := deep[:50]
+	same, removed := shallow.TruncateDepth(100)
+	assert.Equal(0, removed)
+	assert.Equal(shallow, same)
+
+	// parenting cycles are no root's descendants
+	cycle := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0},
+		Span{TraceID: 1, SpanID: 2, ParentID: 3},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2},
+	}
+	truncated, removed = cycle.TruncateDepth(10)
+	assert.Equal(2, removed)
+	assert.Len(truncated, 2)
+}
+
+func TestGetRootBySpanKind(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(enabled bool) { GlobalRootBySpanKind = enabled }(GlobalRootBySpanKind)
+
+	// a client span and a server span both without parent, such as when the
+	// parent of the client span is in a process which did not report
+	trace := Trace{
+		Span{TraceID: 1234, SpanID: 12341, Service: "s1", Name: "n1", Meta: map[string]string{"span.kind": "server"}},
+		Span{TraceID: 1234, SpanID: 12342, ParentID: 12341, Service: "s1", Name: "n1"},
+		Span{TraceID: 1234, SpanID: 12343, ParentID: 12340, Service: "s2", Name: "n2", Meta: map[string]string{"span.kind": "client"}},
+		Span{TraceID: 1234, SpanID: 12344, ParentID: 12343, Service: "s2", Name: "n2"},
+	}
+
+	GlobalRootBySpanKind = false
+	assert.Equal(uint64(12341), trace.GetRoot().SpanID)
+	trace[0].Meta["span.kind"] = "client"
+	trace[2].Meta["span.kind"] = "consumer"
+	assert.Equal(uint64(12341), trace.GetRoot().SpanID, "the ParentID is used unless enabled")
+
+	GlobalRootBySpanKind = true
+	assert.Equal(uint64(12343), trace.GetRoot().SpanID)
+
+	// falls back to the ParentID when no candidate has the kind
+	trace[2].Meta["span.kind"] = "client"
+	assert.Equal(uint64(12341), trace.GetRoot().SpanID)
+
+	// or when there is a single candidate
+	trace[2].ParentID = 12342
+	trace[2].Meta["span.kind"] = "server"
+	assert.Equal(uint64(12341), trace.GetRoot().SpanID)
+}
@@ -0,0 +1,94 @@
+package quantile
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+/************************************************************************************
+	ACCURACY REGRESSION, every quantile of known distributions must be within
+	the EPSILON*N rank guarantee of the true one
+************************************************************************************/
+
+// accuracyDistributions generate the values of the accuracy tests
+var accuracyDistributions = []struct {
+	name string
+	gen  func(r *rand.Rand) float64
+}{
+	{"uniform", func(r *rand.Rand) float64 { return r.Float64() * 1e6 }},
+	{"normal", func(r *rand.Rand) float64 { return r.NormFloat64()*1e4 + 1e5 }},
+	{"exponential", func(r *rand.Rand) float64 { return r.ExpFloat64() * 1e4 }},
+	{"bimodal", func(r *rand.Rand) float64 {
+		// fast cache hits and slow misses, as latencies often are
+		if r.Intn(10) < 8 {
+			return r.NormFloat64()*100 + 1e3
+		}
+		return r.NormFloat64()*1e4 + 1e5
+	}},
+}
+
+var accuracySizes = []int{10, 100, 1000, 10000, 100000}
+
+// quantiler is what the accuracy tests query, SliceSummary and Summary
+type quantiler interface {
+	Quantile(q float64) float64
+}
+
+// maxRankError returns the worst rankError of the testQuantiles of s, and the
+// quantile it happens at
+func maxRankError(s quantiler, sorted []float64) (float64, float64) {
+	var worst, worstQ float64
+	for _, q := range testQuantiles {
+		if e := rankError(sorted, q, s.Quantile(q)); e > worst {
+			worst, worstQ = e, q
+		}
+	}
+	return worst, worstQ
+}
+
+// testAccuracy inserts the values of every distribution and size in the
+// summary newSummary returns, and checks its rank errors. Run with -v for the
+// rank error of each case.
+func testAccuracy(t *testing.T, newSummary func() (quantiler, func(v float64, t uint64))) {
+	for _, dist := range accuracyDistributions {
+		for _, n := range accuracySizes {
+			dist, n := dist, n
+			t.Run(fmt.Sprintf("%s/%d", dist.name, n), func(t *testing.T) {
+				r := rand.New(rand.NewSource(int64(n)))
+				s, insert := newSummary()
+				sorted := make([]float64, n)
+				for i := range sorted {
+					v := dist.gen(r)
+					insert(v, uint64(i))
+					sorted[i] = v
+				}
+				sort.Float64s(sorted)
+
+				worst, q := maxRankError(s, sorted)
+				t.Logf("max rank error %.4f (quantile %v)", worst, q)
+				if worst > EPSILON {
+					t.Errorf("rank error %.4f at quantile %v above %v", worst, q, EPSILON)
+				}
+			})
+		}
+	}
+}
+
+// TestSliceSummaryAccuracy checks the SliceSummary the agent uses
+func TestSliceSummaryAccuracy(t *testing.T) {
+	testAccuracy(t, func() (quantiler, func(float64, uint64)) {
+		s := NewSliceSummary()
+		return s, s.Insert
+	})
+}
+
+// TestSummaryAccuracy checks the deprecated Summary, which is queried the
+// same way
+func TestSummaryAccuracy(t *testing.T) {
+	testAccuracy(t, func() (quantiler, func(float64, uint64)) {
+		s := NewSummary()
+		return s, s.Insert
+	})
+}
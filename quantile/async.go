@@ -0,0 +1,104 @@
+package quantile
+
+import "sync"
+
+// asyncBatchSize is the number of values buffered by an AsyncSliceSummary
+// before they are inserted, and the summary compressed, in the background
+const asyncBatchSize = 1000
+
+// AsyncSliceSummary is a SliceSummary safe for concurrent use, which moves the
+// insertions and compressions out of the Insert hot path: Insert only buffers
+// the values, a background goroutine adds them to the summary by batches.
+// Queries always see every value inserted before them.
+type AsyncSliceSummary struct {
+	mu      sync.Mutex // guards summary, held while inserting batches and compressing
+	summary *SliceSummary
+
+	pendingMu sync.Mutex // guards pending and flushed, never held for long
+	pending   []float64
+	// flushed is closed once the scheduled background insertion is done, it
+	// is nil when none is scheduled
+	flushed chan struct{}
+}
+
+// NewAsyncSliceSummary returns a new empty AsyncSliceSummary
+func NewAsyncSliceSummary() *AsyncSliceSummary {
+	return &AsyncSliceSummary{
+		summary: NewSliceSummary(),
+		pending: make([]float64, 0, asyncBatchSize),
+	}
+}
+
+// Insert buffers a new value v, paired with t (the ID of the span it was
+// reported from). It never waits for a compression.
+func (s *AsyncSliceSummary) Insert(v float64, t uint64) {
+	s.pendingMu.Lock()
+	s.pending = append(s.pending, v)
+	var done chan struct{}
+	if len(s.pending) >= asyncBatchSize && s.flushed == nil {
+		done = make(chan struct{})
+		s.flushed = done
+	}
+	s.pendingMu.Unlock()
+
+	if done != nil {
+		go s.flush(done)
+	}
+}
+
+// flush inserts the pending values in the background and closes done
+func (s *AsyncSliceSummary) flush(done chan struct{}) {
+	s.mu.Lock()
+	s.drain()
+	s.mu.Unlock()
+
+	s.pendingMu.Lock()
+	s.flushed = nil
+	s.pendingMu.Unlock()
+	close(done)
+}
+
+// Flush waits for the background insertion scheduled so far, if any, then
+// inserts the values still buffered.
+func (s *AsyncSliceSummary) Flush() {
+	s.pendingMu.Lock()
+	done := s.flushed
+	s.pendingMu.Unlock()
+	if done != nil {
+		<-done
+	}
+
+	s.mu.Lock()
+	s.drain()
+	s.mu.Unlock()
+}
+
+// drain inserts the pending values into the summary, s.mu must be held
+func (s *AsyncSliceSummary) drain() {
+	s.pendingMu.Lock()
+	batch := s.pending
+	s.pending = make([]float64, 0, asyncBatchSize)
+	s.pendingMu.Unlock()
+
+	for _, v := range batch {
+		s.summary.Insert(v, 0)
+	}
+}
+
+// Quantile returns an EPSILON estimate of the element at quantile 'q' (0 <= q <= 1)
+func (s *AsyncSliceSummary) Quantile(q float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drain()
+	return s.summary.Quantile(q)
+}
+
+// Snapshot returns a copy of the summary, including every value inserted so far
+func (s *AsyncSliceSummary) Snapshot() *SliceSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drain()
+	return s.summary.Copy()
+}
@@ -0,0 +1,67 @@
+package quantile
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSliceSummaryOnCompress(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int
+	OnCompress = func(entries int, d time.Duration) {
+		calls++
+		assert.True(entries > 0)
+		assert.True(d >= 0)
+	}
+	defer func() { OnCompress = nil }()
+
+	s := NewSliceSummary()
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	assert.Equal(1000/int(1/(2*EPSILON)), calls)
+}
+
+func TestAsyncSliceSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	// compressions block until released, an Insert waiting for one would
+	// never return
+	release := make(chan struct{})
+	var compressions int32
+	OnCompress = func(int, time.Duration) {
+		atomic.AddInt32(&compressions, 1)
+		<-release
+	}
+	defer func() { OnCompress = nil }()
+
+	s := NewAsyncSliceSummary()
+	inserted := make(chan struct{})
+	go func() {
+		for i := 0; i < 3*asyncBatchSize; i++ {
+			s.Insert(float64(i), uint64(i))
+		}
+		close(inserted)
+	}()
+	select {
+	case <-inserted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("inserts waited for a compression")
+	}
+
+	close(release)
+	s.Flush()
+	// the background insertion of the first batch compressed the summary
+	assert.True(atomic.LoadInt32(&compressions) > 0)
+
+	// queries see every value inserted before them
+	snapshot := s.Snapshot()
+	assert.Equal(int64(3*asyncBatchSize), snapshot.N)
+	assert.Nil(snapshot.CheckInvariant())
+	assert.Equal(0.0, s.Quantile(0))
+	assert.Equal(float64(3*asyncBatchSize-1), s.Quantile(1))
+}
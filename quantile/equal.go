@@ -0,0 +1,62 @@
+package quantile
+
+import (
+	"fmt"
+	"math"
+)
+
+// equalTolerance is the relative difference under which two values are equal
+// for Equal and Diff, to be robust to float round-trips through encodings
+const equalTolerance = 1e-9
+
+func equalValues(a, b float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= equalTolerance*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// diffEntries describes the first difference between two summaries, given as
+// their number of values and their entries sorted by value, or returns ""
+func diffEntries(n int64, entries []Entry, otherN int64, other []Entry) string {
+	if n != otherN {
+		return fmt.Sprintf("N differs: %d != %d", n, otherN)
+	}
+	for i := 0; i < len(entries) && i < len(other); i++ {
+		e, o := entries[i], other[i]
+		if !equalValues(e.V, o.V) || e.G != o.G || e.Delta != o.Delta {
+			return fmt.Sprintf("entry %d differs: %+v != %+v", i, e, o)
+		}
+	}
+	if len(entries) != len(other) {
+		return fmt.Sprintf("number of entries differs: %d != %d", len(entries), len(other))
+	}
+	return ""
+}
+
+// Diff describes the first difference between s and other, comparing their
+// number of values then their entries in order, the values within a relative
+// tolerance. It returns "" if they are equal.
+func (s *Summary) Diff(other *Summary) string {
+	return diffEntries(s.N, s.Entries(), other.N, other.Entries())
+}
+
+// Equal tells if s and other are the same summary, see Diff
+func (s *Summary) Equal(other *Summary) bool {
+	return s.Diff(other) == ""
+}
+
+// Diff describes the first difference between s and other, comparing their
+// unit, their number of values then their entries in order, the values within
+// a relative tolerance. It returns "" if they are equal.
+func (s *SliceSummary) Diff(other *SliceSummary) string {
+	if s.Unit != other.Unit {
+		return fmt.Sprintf("unit differs: %q != %q", s.Unit, other.Unit)
+	}
+	return diffEntries(s.N, s.Entries, other.N, other.Entries)
+}
+
+// Equal tells if s and other are the same summary, see Diff
+func (s *SliceSummary) Equal(other *SliceSummary) bool {
+	return s.Diff(other) == ""
+}
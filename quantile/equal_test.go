@@ -0,0 +1,83 @@
+package quantile
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummaryEqual(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummaryWithTestData()
+	assert.True(s.Equal(s))
+	assert.Equal("", s.Diff(s))
+	assert.True(NewSummary().Equal(NewSummary()))
+
+	// round-tripped
+	b, err := json.Marshal(s)
+	assert.NoError(err)
+	var fromJSON Summary
+	assert.NoError(json.Unmarshal(b, &fromJSON))
+	assert.True(s.Equal(&fromJSON), s.Diff(&fromJSON))
+
+	b, err = s.GobEncode()
+	assert.NoError(err)
+	fromGob := NewSummary()
+	assert.NoError(fromGob.GobDecode(b))
+	assert.True(s.Equal(fromGob), s.Diff(fromGob))
+
+	// different
+	other := NewSummaryWithTestData()
+	other.Insert(1e6, 0)
+	assert.False(s.Equal(other))
+	assert.Contains(s.Diff(other), "N differs")
+
+	other = NewSummary()
+	other.Insert(1, 0)
+	two := NewSummary()
+	two.Insert(2, 0)
+	assert.False(other.Equal(two))
+	assert.Contains(other.Diff(two), "entry 0 differs")
+}
+
+func TestSliceSummaryEqual(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(rand.ExpFloat64()*1000, uint64(i))
+	}
+	assert.True(s.Equal(s))
+	assert.True(s.Equal(s.Copy()))
+
+	// round-tripped
+	b, err := json.Marshal(s)
+	assert.NoError(err)
+	var fromJSON SliceSummary
+	assert.NoError(json.Unmarshal(b, &fromJSON))
+	assert.True(s.Equal(&fromJSON), s.Diff(&fromJSON))
+
+	// values are compared within a relative tolerance
+	near := s.Copy()
+	near.Entries[1].V *= 1 + 1e-12
+	assert.True(s.Equal(near), s.Diff(near))
+	near.Entries[1].V *= 1 + 1e-6
+	assert.False(s.Equal(near))
+	assert.Contains(s.Diff(near), "entry 1 differs")
+
+	// different
+	other := s.Copy()
+	other.Entries[2].G++
+	assert.Contains(s.Diff(other), "entry 2 differs")
+
+	other = s.Copy()
+	other.Entries = other.Entries[:len(other.Entries)-1]
+	assert.Contains(s.Diff(other), "number of entries differs")
+
+	other = s.Copy()
+	other.Unit = Millisecond
+	assert.Contains(s.Diff(other), "unit differs")
+}
@@ -0,0 +1,122 @@
+package quantile
+
+import (
+	"math"
+	"sort"
+)
+
+// HybridSummary keeps the exact values inserted until there are more than a
+// threshold of them, then converts to a GK summary: the quantiles of small
+// distributions, such as those of low-volume resources while debugging, are
+// exact, while the memory used by large ones stays bounded.
+type HybridSummary struct {
+	// exact holds the sorted values as long as there are at most
+	// threshold of them, approx takes over after
+	exact     []float64
+	approx    *SliceSummary
+	threshold int
+}
+
+// NewHybridSummary returns a summary exact up to threshold values, and an
+// EPSILON estimate past it
+func NewHybridSummary(threshold int) *HybridSummary {
+	return &HybridSummary{threshold: threshold}
+}
+
+// IsExact tells if the summary still holds the exact values
+func (s *HybridSummary) IsExact() bool {
+	return s.approx == nil
+}
+
+// N returns the number of values in the summary
+func (s *HybridSummary) N() int64 {
+	if s.approx != nil {
+		return s.approx.N
+	}
+	return int64(len(s.exact))
+}
+
+// Insert inserts a new value v in the summary paired with t (the ID of the
+// span it was reported from)
+func (s *HybridSummary) Insert(v float64, t uint64) {
+	if s.approx != nil {
+		s.approx.Insert(v, t)
+		return
+	}
+	// rejected, the same as SliceSummary does
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+
+	i := sort.SearchFloat64s(s.exact, v)
+	s.exact = append(s.exact, 0)
+	copy(s.exact[i+1:], s.exact[i:])
+	s.exact[i] = v
+
+	if len(s.exact) > s.threshold {
+		s.convert()
+	}
+}
+
+// convert moves the exact values to a GK summary
+func (s *HybridSummary) convert() {
+	s.approx = NewSliceSummary()
+	for _, v := range s.exact {
+		s.approx.Insert(v, 0)
+	}
+	s.exact = nil
+}
+
+// Quantile returns the element at quantile 'q' (0 <= q <= 1), exact while
+// the summary is, an EPSILON estimate after
+func (s *HybridSummary) Quantile(q float64) float64 {
+	if s.approx != nil {
+		return s.approx.Quantile(q)
+	}
+	if len(s.exact) == 0 {
+		return 0
+	}
+
+	// nearest rank, from the min for 0 to the max for 1
+	i := int(q*float64(len(s.exact))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.exact) {
+		i = len(s.exact) - 1
+	}
+	return s.exact[i]
+}
+
+// Merge merges s2 into s. The result stays exact only if both are and they
+// hold at most threshold values together. Like SliceSummary.Merge, it returns
+// an error if the summaries cannot be merged.
+func (s *HybridSummary) Merge(s2 *HybridSummary) error {
+	if s2.approx == nil && s.approx == nil && len(s.exact)+len(s2.exact) <= s.threshold {
+		merged := make([]float64, 0, len(s.exact)+len(s2.exact))
+		i, j := 0, 0
+		for i < len(s.exact) && j < len(s2.exact) {
+			if s.exact[i] <= s2.exact[j] {
+				merged = append(merged, s.exact[i])
+				i++
+			} else {
+				merged = append(merged, s2.exact[j])
+				j++
+			}
+		}
+		merged = append(merged, s.exact[i:]...)
+		s.exact = append(merged, s2.exact[j:]...)
+		return nil
+	}
+
+	if s.approx == nil {
+		s.convert()
+	}
+	if s2.approx == nil {
+		for _, v := range s2.exact {
+			s.approx.Insert(v, 0)
+		}
+		return nil
+	}
+	return s.approx.Merge(s2.approx)
+}
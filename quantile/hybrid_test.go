@@ -0,0 +1,92 @@
+package quantile
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHybridSummaryExact(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewHybridSummary(100)
+	assert.Equal(0.0, s.Quantile(0.5))
+
+	r := rand.New(rand.NewSource(42))
+	for _, i := range r.Perm(100) {
+		s.Insert(float64(i+1), uint64(i))
+	}
+	s.Insert(math.NaN(), 0)
+	assert.True(s.IsExact())
+	assert.Equal(int64(100), s.N())
+
+	assert.Equal(1.0, s.Quantile(0))
+	assert.Equal(50.0, s.Quantile(0.5))
+	assert.Equal(90.0, s.Quantile(0.9))
+	assert.Equal(99.0, s.Quantile(0.99))
+	assert.Equal(100.0, s.Quantile(1))
+
+	// a single value is every quantile
+	s = NewHybridSummary(100)
+	s.Insert(42, 0)
+	assert.Equal(42.0, s.Quantile(0))
+	assert.Equal(42.0, s.Quantile(0.5))
+	assert.Equal(42.0, s.Quantile(1))
+}
+
+func TestHybridSummaryConvert(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewHybridSummary(100)
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+		if i == 99 {
+			assert.True(s.IsExact())
+		}
+	}
+	assert.False(s.IsExact())
+	assert.Equal(int64(10000), s.N())
+	assert.Equal(0.0, s.Quantile(0))
+	assert.Equal(9999.0, s.Quantile(1))
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		assert.InDelta(q*10000, s.Quantile(q), EPSILON*10000, "quantile %v", q)
+	}
+	// bounded, unlike the values
+	assert.True(len(s.approx.Entries) < 1000, "%d entries", len(s.approx.Entries))
+}
+
+func TestHybridSummaryMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	odd, even := NewHybridSummary(100), NewHybridSummary(100)
+	for i := 0; i < 50; i++ {
+		even.Insert(float64(2*i), 0)
+		odd.Insert(float64(2*i+1), 0)
+	}
+
+	// exact together
+	assert.NoError(even.Merge(odd))
+	assert.True(even.IsExact())
+	assert.Equal(int64(100), even.N())
+	for i, v := range even.exact {
+		assert.Equal(float64(i), v)
+	}
+
+	// past the threshold, approximated
+	assert.NoError(even.Merge(odd))
+	assert.False(even.IsExact())
+	assert.Equal(int64(150), even.N())
+	assert.Equal(99.0, even.Quantile(1))
+
+	big := NewHybridSummary(100)
+	for i := 0; i < 1000; i++ {
+		big.Insert(float64(i), 0)
+	}
+	assert.NoError(odd.Merge(big))
+	assert.False(odd.IsExact())
+	assert.Equal(int64(1050), odd.N())
+	assert.Equal(999.0, odd.Quantile(1))
+	assert.NoError(odd.approx.CheckInvariant())
+}
@@ -0,0 +1,36 @@
+package quantile
+
+import "fmt"
+
+// checkInvariant verifies the GK invariant on the entries of a summary of n
+// values: no entry can cover more than 2*EPSILON*n ranks, that is g+delta <=
+// 2*EPSILON*n. One extra rank is allowed, inserted entries get a delta
+// rounded down from the 2*EPSILON*n at the time of their insertion.
+func checkInvariant(entries []Entry, n int64) error {
+	epsN := int64(2 * EPSILON * float64(n))
+	for i, e := range entries {
+		if e.G+e.Delta > epsN+1 {
+			return fmt.Errorf("GK invariant violated by entry %d %+v: g+delta=%d > 2*EPSILON*N=%d (N=%d)",
+				i, e, e.G+e.Delta, epsN, n)
+		}
+	}
+	return nil
+}
+
+// CheckInvariant returns an error if the summary breaks the GK invariant
+func (s *SliceSummary) CheckInvariant() error {
+	return checkInvariant(s.Entries, s.N)
+}
+
+// assertInvariant panics if the summary breaks the GK invariant, it is a
+// no-op unless the package is built with the quantile_debug build tag.
+// NOTE: the deprecated Summary is not checked, it folds equal values into the
+// delta of a single entry, which the invariant does not account for.
+func assertInvariant(s *SliceSummary) {
+	if !debugInvariants {
+		return
+	}
+	if err := s.CheckInvariant(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build quantile_debug
+// +build quantile_debug
+
+package quantile
+
+// debugInvariants enables assertInvariant after every compression
+const debugInvariants = true
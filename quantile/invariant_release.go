@@ -0,0 +1,8 @@
+//go:build !quantile_debug
+// +build !quantile_debug
+
+package quantile
+
+// debugInvariants enables assertInvariant after every compression, build with
+// the quantile_debug tag to turn it on
+const debugInvariants = false
@@ -0,0 +1,27 @@
+package quantile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSliceSummaryCheckInvariant(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	assert.Nil(s.CheckInvariant())
+
+	// corrupt an entry so that it covers way too many ranks
+	s.Entries[len(s.Entries)/2].Delta = s.N
+	assert.NotNil(s.CheckInvariant())
+
+	if debugInvariants {
+		assert.Panics(func() { assertInvariant(s) })
+	} else {
+		assert.NotPanics(func() { assertInvariant(s) })
+	}
+}
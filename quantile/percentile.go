@@ -0,0 +1,32 @@
+package quantile
+
+import "fmt"
+
+// checkPercentile returns an error if p is not a percentile, between 0 and 100
+func checkPercentile(p float64) error {
+	// also rejects NaN
+	if !(p >= 0 && p <= 100) {
+		return fmt.Errorf("percentile must be between 0 and 100, got %v", p)
+	}
+	return nil
+}
+
+// Percentile is the same as Quantile, except that it takes a percentile
+// between 0 and 100, e.g. 99 for Quantile(0.99). Unlike Quantile, which takes
+// any value and would silently return the max for 99, it returns an error
+// when p is out of range.
+func (s *Summary) Percentile(p float64) (float64, error) {
+	if err := checkPercentile(p); err != nil {
+		return 0, err
+	}
+	return s.Quantile(p / 100), nil
+}
+
+// Percentile is the same as Quantile, except that it takes a percentile
+// between 0 and 100, see Summary.Percentile
+func (s *SliceSummary) Percentile(p float64) (float64, error) {
+	if err := checkPercentile(p); err != nil {
+		return 0, err
+	}
+	return s.Quantile(p / 100), nil
+}
@@ -0,0 +1,36 @@
+package quantile
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	assert := assert.New(t)
+
+	s, ss := NewSummary(), NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+		ss.Insert(float64(i), uint64(i))
+	}
+
+	for _, p := range []float64{0, 50, 90, 99, 99.9, 100} {
+		v, err := s.Percentile(p)
+		assert.NoError(err)
+		assert.Equal(s.Quantile(p/100), v, "percentile %v", p)
+		v, err = ss.Percentile(p)
+		assert.NoError(err)
+		assert.Equal(ss.Quantile(p/100), v, "percentile %v", p)
+	}
+	v, _ := s.Percentile(99)
+	assert.Equal(s.Quantile(0.99), v)
+
+	for _, p := range []float64{-1, 100.1, 9900, math.NaN()} {
+		_, err := s.Percentile(p)
+		assert.Error(err, "percentile %v", p)
+		_, err = ss.Percentile(p)
+		assert.Error(err, "percentile %v", p)
+	}
+}
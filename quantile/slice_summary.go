@@ -3,13 +3,30 @@ package quantile
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sort"
+	"time"
 )
 
 // SliceSummary is a GK-summary with a slice backend
 type SliceSummary struct {
 	Entries []Entry
-	N       int
+	N       int64
+	// Unit of the inserted values, see NewSliceSummaryWithUnit
+	Unit Unit `json:",omitempty"`
+
+	// optional bounds out of which inserted values are rejected, see SetBounds
+	bounded  bool
+	floor    float64
+	ceiling  float64
+	rejected int
+
+	// incremental compression, see SetIncrementalCompress. compressPos is
+	// where the running compression resumes, below 2 when there is none, and
+	// compressEpsN the 2*EPSILON*N it started with.
+	compressStep int
+	compressPos  int
+	compressEpsN int64
 }
 
 // NewSliceSummary allocates a new GK summary backed by a DLL
@@ -21,9 +38,12 @@ func (s SliceSummary) String() string {
 	var b bytes.Buffer
 	b.WriteString("summary size: ")
 	b.WriteString(fmt.Sprintf("%d", s.N))
+	if s.Unit != NoUnit {
+		b.WriteString(fmt.Sprintf(" (%s)", s.Unit))
+	}
 	b.WriteRune('\n')
 
-	gsum := 0
+	var gsum int64
 
 	for i, e := range s.Entries {
 		gsum += e.G
@@ -36,12 +56,48 @@ func (s SliceSummary) String() string {
 	return b.String()
 }
 
+// SetBounds makes Insert reject the values below floor or above ceiling,
+// so that garbage, like durations from bad clocks, cannot skew the quantiles
+func (s *SliceSummary) SetBounds(floor, ceiling float64) {
+	s.bounded = true
+	s.floor = floor
+	s.ceiling = ceiling
+}
+
+// SetIncrementalCompress spreads the compression Insert triggers every
+// 1/(2*EPSILON) inserts over the following inserts, each one compressing at
+// most about step entries, to avoid latency spikes. The compressions happen
+// at the same pace as the full ones, so the accuracy is the same, as long as
+// step*1/(2*EPSILON) covers the entries of the summary: a few entries per
+// insert is plenty for typical summaries. Quantile finishes the running
+// compression first, a partly compressed summary gives worse estimates. A
+// step <= 0 restores the full compression.
+func (s *SliceSummary) SetIncrementalCompress(step int) {
+	if step < 0 {
+		step = 0
+	}
+	s.compressStep = step
+	s.compressPos = -1
+}
+
+// Rejected returns the number of values rejected by Insert, either because
+// they were out of bounds or not a number
+func (s *SliceSummary) Rejected() int {
+	return s.rejected
+}
+
 // Insert inserts a new value v in the summary paired with t (the ID of the span it was reported from)
 func (s *SliceSummary) Insert(v float64, t uint64) {
+	// NaN cannot be ordered and infinities would break the rank math
+	if math.IsNaN(v) || math.IsInf(v, 0) || (s.bounded && (v < s.floor || v > s.ceiling)) {
+		s.rejected++
+		return
+	}
+
 	newEntry := Entry{
 		V:     v,
 		G:     1,
-		Delta: int(2 * EPSILON * float64(s.N)),
+		Delta: int64(2 * EPSILON * float64(s.N)),
 	}
 
 	i := sort.Search(len(s.Entries), func(i int) bool { return v < s.Entries[i].V })
@@ -56,22 +112,75 @@ func (s *SliceSummary) Insert(v float64, t uint64) {
 	s.Entries[i] = newEntry
 	s.N++
 
-	if s.N%int(1.0/float64(2.0*EPSILON)) == 0 {
+	if s.compressStep > 0 {
+		s.compressIncremental(i)
+		return
+	}
+
+	if s.N%int64(1.0/float64(2.0*EPSILON)) == 0 {
 		s.compress()
 	}
 }
 
+// OnCompress, when set, is called after each full compression of a
+// SliceSummary with the number of entries left and the time the compression
+// took. It is called inline, from the goroutine compressing, so it has to be
+// cheap. Incremental compressions do not call it.
+var OnCompress func(entries int, d time.Duration)
+
 func (s *SliceSummary) compress() {
-	epsN := int(2 * EPSILON * float64(s.N))
+	if OnCompress != nil {
+		start := time.Now()
+		defer func() { OnCompress(len(s.Entries), time.Since(start)) }()
+	}
+
+	s.compressFrom(len(s.Entries)-1, int64(2*EPSILON*float64(s.N)), -1)
+	// nothing is left for a running incremental compression
+	s.compressPos = -1
+
+	assertInvariant(s)
+}
+
+// compressIncremental is called after inserting an entry at index inserted,
+// it starts a compression every 1/(2*EPSILON) inserts if none is running and
+// compresses the next compressStep entries of the running one
+func (s *SliceSummary) compressIncremental(inserted int) {
+	if s.compressPos >= 2 && inserted <= s.compressPos {
+		// keep resuming from the same entry, so that none is skipped
+		s.compressPos++
+	}
+	if s.compressPos < 2 && s.N%int64(1.0/float64(2.0*EPSILON)) == 0 {
+		s.compressPos = len(s.Entries) - 1
+		s.compressEpsN = int64(2 * EPSILON * float64(s.N))
+	}
+	if s.compressPos < 2 {
+		return
+	}
+
+	s.compressPos = s.compressFrom(s.compressPos, s.compressEpsN, s.compressStep)
+
+	assertInvariant(s)
+}
 
-	var j, sum int
-	for i := len(s.Entries) - 1; i >= 2; i = j - 1 {
+// compressFrom compresses the entries from index i down to the first ones,
+// examining at most budget entries, or all of them if budget is negative. It
+// returns the index to resume from, below 2 once all the entries are done.
+func (s *SliceSummary) compressFrom(i int, epsN int64, budget int) int {
+	var j int
+	var sum int64
+	for ; i >= 2 && budget != 0; i = j - 1 {
 		j = i - 1
 		sum = s.Entries[j].G
+		budget--
 
 		for j >= 1 && sum+s.Entries[i].G+s.Entries[i].Delta < epsN {
 			j--
 			sum += s.Entries[j].G
+			if budget == 0 {
+				// stopping early only merges fewer entries, which is valid
+				break
+			}
+			budget--
 		}
 		sum -= s.Entries[j].G
 		j++
@@ -86,6 +195,8 @@ func (s *SliceSummary) compress() {
 			s.Entries = s.Entries[:len(s.Entries)-(i-j)]
 		}
 	}
+
+	return i
 }
 
 // Quantile returns an EPSILON estimate of the element at quantile 'q' (0 <= q <= 1)
@@ -93,12 +204,15 @@ func (s *SliceSummary) Quantile(q float64) float64 {
 	if len(s.Entries) == 0 {
 		return 0
 	}
+	if s.compressPos >= 2 {
+		s.compressPos = s.compressFrom(s.compressPos, s.compressEpsN, -1)
+	}
 
 	// convert quantile to rank
-	r := int(q*float64(s.N) + 0.5)
+	r := int64(q*float64(s.N) + 0.5)
 
-	var rmin int
-	epsN := int(EPSILON * float64(s.N))
+	var rmin int64
+	epsN := int64(EPSILON * float64(s.N))
 
 	for i := 0; i < len(s.Entries)-1; i++ {
 		t := s.Entries[i]
@@ -106,27 +220,43 @@ func (s *SliceSummary) Quantile(q float64) float64 {
 
 		rmin += t.G
 
+		// t is the last entry whose rank is at most r+epsN for sure, and
+		// at least r-epsN as g+delta <= 2*epsN, n could be ranked above
 		if r+epsN < rmin+n.G+n.Delta {
-			if r+epsN < rmin+n.G {
-				return t.V
-			}
-			return n.V
+			return t.V
 		}
 	}
 
 	return s.Entries[len(s.Entries)-1].V
 }
 
-// Merge two summaries entries together
-func (s *SliceSummary) Merge(s2 *SliceSummary) {
+// Merge two summaries entries together. It returns an error, leaving s
+// untouched, if the summaries have different units.
+func (s *SliceSummary) Merge(s2 *SliceSummary) error {
+	if err := s.MergeNoCompress(s2); err != nil {
+		return err
+	}
+	s.compress()
+	return nil
+}
+
+// MergeNoCompress inserts the entries of s2 without compressing the result.
+// Every compression loses some precision, so when merging many summaries
+// together (e.g. aggregating up a hierarchy) it is more accurate to merge
+// them all with MergeNoCompress and call Compact exactly once at the end.
+// The tradeoff is memory: the summary grows with each merge until compacted.
+func (s *SliceSummary) MergeNoCompress(s2 *SliceSummary) error {
+	if err := s.checkUnit(s2); err != nil {
+		return err
+	}
 	if s2.N == 0 {
-		return
+		return nil
 	}
 	if s.N == 0 {
 		s.N = s2.N
 		s.Entries = make([]Entry, 0, len(s2.Entries))
 		s.Entries = append(s.Entries, s2.Entries...)
-		return
+		return nil
 	}
 
 	pos := 0
@@ -153,17 +283,21 @@ func (s *SliceSummary) Merge(s2 *SliceSummary) {
 		}
 	}
 	s.N += s2.N
+	return nil
+}
 
+// Compact compresses the summary, see MergeNoCompress.
+func (s *SliceSummary) Compact() {
 	s.compress()
 }
 
-// Copy allocates a new summary with the same data
+// Copy allocates a new summary with the same data and settings, including
+// where a running incremental compression is at
 func (s *SliceSummary) Copy() *SliceSummary {
-	s2 := NewSliceSummary()
+	s2 := *s
 	s2.Entries = make([]Entry, len(s.Entries))
 	copy(s2.Entries, s.Entries)
-	s2.N = s.N
-	return s2
+	return &s2
 }
 
 // BySlices returns a slice of Summary slices that represents weighted ranges of
@@ -174,27 +308,49 @@ func (s *SliceSummary) Copy() *SliceSummary {
 // data structure to ensure epsilon*s.N precision on quantiles, but it's bounded.
 // When the bounds of the interval are equal, the weight is the number of times
 // that exact value was inserted in the summary.
+// Every emitted slice has a positive weight and Start <= End; entries without
+// any weight are coalesced into the next slice.
 func (s *SliceSummary) BySlices() []SummarySlice {
 	var slices []SummarySlice
 
+	s.ForEachSlice(func(ss SummarySlice) bool {
+		slices = append(slices, ss)
+		return true
+	})
+
+	return slices
+}
+
+// BySlicesN is the same as BySlices, except that adjacent slices are merged
+// so that at most max slices are returned, trading precision for size.
+func (s *SliceSummary) BySlicesN(max int) []SummarySlice {
+	return downsampleSlices(s.BySlices(), max)
+}
+
+// ForEachSlice calls fn on each slice BySlices would return, in order, and
+// stops as soon as fn returns false. Unlike BySlices, it does not allocate
+// all the slices at once, which is useful to serialize them on the fly.
+func (s *SliceSummary) ForEachSlice(fn func(SummarySlice) bool) {
 	if len(s.Entries) == 0 {
-		return slices
+		return
 	}
 
 	// by def in GK first val is always the min
-	fs := SummarySlice{
+	ss := SummarySlice{
 		Start:  s.Entries[0].V,
 		End:    s.Entries[0].V,
 		Weight: 1,
 	}
-	slices = append(slices, fs)
 
-	last := fs.End
+	last := ss.End
 
 	for _, cur := range s.Entries[1:] {
-		lastSlice := &slices[len(slices)-1]
-		if cur.V == lastSlice.Start && cur.V == lastSlice.End {
-			lastSlice.Weight += cur.G
+		if cur.V == ss.Start && cur.V == ss.End {
+			ss.Weight += cur.G
+			continue
+		}
+
+		if cur.G <= 0 {
 			continue
 		}
 
@@ -202,15 +358,18 @@ func (s *SliceSummary) BySlices() []SummarySlice {
 			last = cur.V
 		}
 
-		ss := SummarySlice{
+		if !fn(ss) {
+			return
+		}
+
+		ss = SummarySlice{
 			Start:  last,
 			End:    cur.V,
 			Weight: cur.G,
 		}
-		slices = append(slices, ss)
 
 		last = cur.V
 	}
 
-	return slices
+	fn(ss)
 }
@@ -0,0 +1,44 @@
+package quantile
+
+import "unsafe"
+
+// SummaryStats describes the internals of a summary, to help tuning its
+// max height and precision. Sample IDs are not retained by the GK entries,
+// so the footprint is all about the number of entries.
+type SummaryStats struct {
+	N       int64 // number of points inserted
+	Entries int   // number of GK entries retained
+	Height  int   // number of skiplist levels in use, always 0 for a SliceSummary
+	Bytes   int   // estimated memory footprint, in bytes
+}
+
+var (
+	entrySize   = int(unsafe.Sizeof(Entry{}))
+	nodeSize    = int(unsafe.Sizeof(SkiplistNode{}))
+	pointerSize = int(unsafe.Sizeof(&SkiplistNode{}))
+)
+
+// Stats returns the current internal stats of the summary
+func (s *Summary) Stats() SummaryStats {
+	st := SummaryStats{
+		N:      s.N,
+		Height: s.data.height + 1,
+		Bytes:  nodeSize + len(s.data.head.next)*pointerSize,
+	}
+
+	for curr := s.data.head.next[0]; curr != nil; curr = curr.next[0] {
+		st.Entries++
+		st.Bytes += nodeSize + (len(curr.next)+len(curr.prev))*pointerSize
+	}
+
+	return st
+}
+
+// Stats returns the current internal stats of the summary
+func (s *SliceSummary) Stats() SummaryStats {
+	return SummaryStats{
+		N:       s.N,
+		Entries: len(s.Entries),
+		Bytes:   int(unsafe.Sizeof(*s)) + cap(s.Entries)*entrySize,
+	}
+}
@@ -0,0 +1,49 @@
+package quantile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummaryStats(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummaryWithMaxHeight(1)
+	assert.Equal(SummaryStats{Height: 1, Bytes: nodeSize + pointerSize}, s.Stats())
+
+	// not enough points to trigger a compression, every one is kept
+	for i := 0; i < 10; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	assert.Equal(SummaryStats{
+		N:       10,
+		Entries: 10,
+		Height:  1,
+		Bytes:   11*nodeSize + 21*pointerSize,
+	}, s.Stats())
+
+	s = NewSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	st := s.Stats()
+	assert.Equal(int64(10000), st.N)
+	assert.True(int64(st.Entries) < st.N, "summary should have been compressed")
+	assert.True(st.Height >= 1 && st.Height <= maxHeight)
+	assert.True(st.Bytes > st.Entries*nodeSize)
+}
+
+func TestSliceSummaryStats(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSliceSummary()
+	for i := 0; i < 10; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	st := s.Stats()
+	assert.Equal(int64(10), st.N)
+	assert.Equal(10, st.Entries)
+	assert.Equal(0, st.Height)
+	assert.True(st.Bytes >= 10*entrySize)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
 )
 
 /*
@@ -27,14 +28,16 @@ const EPSILON float64 = 0.01
 type Summary struct {
 	data        *Skiplist // where the real data is stored
 	EncodedData []Entry   `json:"data"` // flattened data user for ser/deser purposes
-	N           int       `json:"n"`    // number of unique points that have been added to this summary
+	N           int64     `json:"n"`    // number of unique points that have been added to this summary
+	// the skiplist max height for ser/deser purposes, 0 for the default one
+	EncodedMaxHeight int `json:"max_height,omitempty"`
 }
 
 // Entry is an element of the skiplist, see GK paper for description
 type Entry struct {
 	V     float64 `json:"v"`
-	G     int     `json:"g"`
-	Delta int     `json:"delta"`
+	G     int64   `json:"g"`
+	Delta int64   `json:"delta"`
 }
 
 // NewSummary returns a new approx-summary with accuracy EPSILON
@@ -44,6 +47,14 @@ func NewSummary() *Summary {
 	}
 }
 
+// NewSummaryWithMaxHeight returns a new approx-summary whose skiplist is
+// capped to maxHeight levels, see MaxHeightFor to size it from an expected N
+func NewSummaryWithMaxHeight(maxHeight int) *Summary {
+	return &Summary{
+		data: NewSkiplistWithMaxHeight(maxHeight),
+	}
+}
+
 func (s Summary) String() string {
 	var b bytes.Buffer
 	b.WriteString(fmt.Sprintf("samples: %d\n", s.N))
@@ -68,18 +79,16 @@ func (s Summary) MarshalJSON() ([]byte, error) {
 		panic(errors.New("Cannot marshal non-initialized Summary"))
 	}
 
-	// TODO[leo] preallocate, not sure: 1/ 2*EPSILON?
-	s.EncodedData = make([]Entry, 0)
-	curr := s.data.head.next[0]
-	for curr != nil {
-		s.EncodedData = append(s.EncodedData, curr.value)
-		curr = curr.next[0]
-	}
+	s.EncodedData = s.Entries()
 
-	return json.Marshal(map[string]interface{}{
+	m := map[string]interface{}{
 		"data": s.EncodedData,
 		"n":    s.N,
-	})
+	}
+	if s.data.maxHeight != maxHeight {
+		m["max_height"] = s.data.maxHeight
+	}
+	return json.Marshal(m)
 }
 
 // Avoid infinite recursion when unmarshalling
@@ -96,24 +105,15 @@ func (s *Summary) UnmarshalJSON(b []byte) error {
 		return err
 	}
 	*s = Summary(ss)
-
-	s.data = NewSkiplist()
-	for _, e := range s.EncodedData {
-		s.data.Insert(e)
-	}
+	s.restore()
 
 	return nil
 }
 
 // GobEncode is used by the Kafka payload now, it flattens our skiplist
 func (s *Summary) GobEncode() ([]byte, error) {
-	// TODO[leo] preallocate, not sure: 1/ 2*EPSILON?
-	s.EncodedData = make([]Entry, 0)
-	curr := s.data.head.next[0]
-	for curr != nil {
-		s.EncodedData = append(s.EncodedData, curr.value)
-		curr = curr.next[0]
-	}
+	s.EncodedData = s.Entries()
+	s.EncodedMaxHeight = s.data.maxHeight
 	ss := summary(*s)
 
 	var buf bytes.Buffer
@@ -132,12 +132,33 @@ func (s *Summary) GobDecode(data []byte) error {
 	}
 
 	*s = Summary(ss)
-	s.data = NewSkiplist()
+	s.restore()
+
+	return nil
+}
+
+// restore recreates the skiplist from the decoded EncodedData and
+// EncodedMaxHeight, the payloads without a max height get the default one
+func (s *Summary) restore() {
+	if s.EncodedMaxHeight > 0 {
+		s.data = NewSkiplistWithMaxHeight(s.EncodedMaxHeight)
+	} else {
+		s.data = NewSkiplist()
+	}
 	for _, e := range s.EncodedData {
 		s.data.Insert(e)
 	}
+}
 
-	return nil
+// Entries returns a copy of the entries of the summary, sorted by value, to
+// walk them without depending on the skiplist
+func (s *Summary) Entries() []Entry {
+	// TODO[leo] preallocate, not sure: 1/ 2*EPSILON?
+	entries := make([]Entry, 0)
+	for curr := s.data.head.next[0]; curr != nil; curr = curr.next[0] {
+		entries = append(entries, curr.value)
+	}
+	return entries
 }
 
 // Insert inserts a new value v in the summary paired with t (the ID of the span it was reported from)
@@ -153,17 +174,109 @@ func (s *Summary) Insert(v float64, t uint64) {
 	s.N++
 
 	if eptr.prev[0] != s.data.head && eptr.next[0] != nil {
-		eptr.value.Delta = int(2 * EPSILON * float64(s.N))
+		eptr.value.Delta = int64(2 * EPSILON * float64(s.N))
 	}
 
-	if s.N%int(1.0/float64(2.0*EPSILON)) == 0 {
+	if s.N%int64(1.0/float64(2.0*EPSILON)) == 0 {
 		s.compress()
 	}
 }
 
+// InsertSorted inserts the values vs, sorted in increasing order, as many
+// calls to Insert would, but merging them with the entries of the summary in
+// a single pass and compressing the result once, without walking the
+// skiplist for each value. samples holds the IDs of the spans each value was
+// reported from which, as the t of Insert, are not kept. vs not sorted are
+// inserted one at a time.
+func (s *Summary) InsertSorted(vs []int64, samples [][]uint64) {
+	for i := 1; i < len(vs); i++ {
+		if vs[i] < vs[i-1] {
+			for j, v := range vs {
+				var t uint64
+				if j < len(samples) && len(samples[j]) > 0 {
+					t = samples[j][0]
+				}
+				s.Insert(float64(v), t)
+			}
+			return
+		}
+	}
+	if len(vs) == 0 {
+		return
+	}
+
+	old := s.Entries()
+	entries := make([]Entry, 0, len(old)+len(vs))
+	j := 0
+	for _, v := range vs {
+		// the new values go after the equal entries, as with Insert
+		for j < len(old) && old[j].V <= float64(v) {
+			entries = append(entries, old[j])
+			j++
+		}
+		s.N++
+		e := Entry{V: float64(v), G: 1}
+		if len(entries) > 0 && j < len(old) {
+			e.Delta = int64(2 * EPSILON * float64(s.N))
+		}
+		entries = append(entries, e)
+	}
+	entries = append(entries, old[j:]...)
+
+	entries = compressEntries(entries, s.N)
+
+	data := NewSkiplistWithMaxHeight(s.data.maxHeight)
+	update := make([]*SkiplistNode, data.maxHeight)
+	for i := range update {
+		update[i] = data.head
+	}
+	for _, e := range entries {
+		data.insertAfter(update, e)
+	}
+	s.data = data
+}
+
+// compressEntries compresses the entries, sorted by value, of a summary of n
+// values in place, as Summary.compress does with a skiplist
+func compressEntries(entries []Entry, n int64) []Entry {
+	if len(entries) == 0 {
+		return entries
+	}
+
+	var missing int64
+	epsN := int64(2 * EPSILON * float64(n))
+
+	// keep first and last element
+	kept := entries[:0]
+	for i := 0; i < len(entries)-1; i++ {
+		t := entries[i]
+		nt := &entries[i+1]
+
+		// value merging
+		if t.V == nt.V {
+			missing += nt.G
+			nt.Delta += missing
+			nt.G = t.G
+			continue
+		} else if len(kept) > 0 {
+			if t.G+nt.G+missing+nt.Delta < epsN {
+				nt.G += t.G + missing
+				missing = 0
+				continue
+			}
+			nt.G += missing
+			missing = 0
+		}
+
+		kept = append(kept, t)
+	}
+
+	return append(kept, entries[len(entries)-1])
+}
+
 func (s *Summary) compress() {
-	var missing int
-	epsN := int(2 * EPSILON * float64(s.N))
+	var missing int64
+	epsN := int64(2 * EPSILON * float64(s.N))
 
 	// keep first and last element
 	for elt := s.data.head.next[0]; elt != nil && elt.next[0] != nil; {
@@ -192,12 +305,31 @@ func (s *Summary) compress() {
 	}
 }
 
-// Quantile returns an EPSILON estimate of the element at quantile 'q' (0 <= q <= 1)
+// Quantile returns an EPSILON estimate of the element at quantile 'q' (0 <= q <= 1).
+// It returns 0 on an empty summary.
 func (s *Summary) Quantile(q float64) float64 {
-	// convert quantile to rank
-	r := int(q*float64(s.N) + 0.5)
-	epsN := int(EPSILON * float64(s.N))
-	var rmin int
+	if s.data == nil {
+		return 0
+	}
+	return s.ValueAtRank(s.Rank(q))
+}
+
+// Rank returns the rank of quantile 'q' (0 <= q <= 1) among the N values, to
+// query several summaries of the same N with ValueAtRank
+func (s *Summary) Rank(q float64) int64 {
+	return int64(q*float64(s.N) + 0.5)
+}
+
+// ValueAtRank returns an EPSILON estimate of the element at rank r (0 <= r <= N),
+// as Quantile does for the quantile of this rank, without allocating. It
+// returns 0 on an empty summary.
+func (s *Summary) ValueAtRank(r int64) float64 {
+	if s.data == nil || s.data.head.next[0] == nil {
+		return 0
+	}
+
+	epsN := int64(EPSILON * float64(s.N))
+	var rmin int64
 
 	for elt := s.data.head.next[0]; elt != nil; elt = elt.next[0] {
 		t := elt.value
@@ -208,22 +340,85 @@ func (s *Summary) Quantile(q float64) float64 {
 			return t.V
 		}
 
+		// t is the last entry whose rank is at most r+epsN for sure, see
+		// SliceSummary.Quantile
 		if r+epsN < rmin+n.value.G+n.value.Delta {
-			if r+epsN < rmin+n.value.G {
-				return t.V
-			}
-			return n.value.V
+			return t.V
 		}
 	}
 
+	// the last element of a non-empty list always returns above
 	panic("not reached")
 }
 
+// approxMinLaneNodes is the minimum number of nodes of the skiplist level
+// ApproxQuantile walks, the more the slower but the more accurate
+const approxMinLaneNodes = 64
+
+// ApproxQuantile returns a coarse estimate of the element at quantile 'q' (0 <= q <= 1),
+// for callers under a tight time budget. Instead of walking all the entries like
+// Quantile, it only walks the highest skiplist level holding at least
+// approxMinLaneNodes nodes, and assumes the nodes of this express lane are evenly
+// spread over the ranks. The accuracy is NOT bounded by EPSILON anymore: the
+// rank error is typically a few percents, and grows for small summaries.
+// It returns 0 on an empty summary.
+func (s *Summary) ApproxQuantile(q float64) float64 {
+	if s.data == nil || s.data.head.next[0] == nil {
+		return 0
+	}
+
+	level := s.data.height
+	count := 0
+	for ; level >= 0; level-- {
+		count = 0
+		for elt := s.data.head.next[level]; elt != nil; elt = elt.next[level] {
+			count++
+		}
+		if count >= approxMinLaneNodes {
+			break
+		}
+	}
+	if level < 0 {
+		// too few nodes, the exact query is cheap enough
+		return s.Quantile(q)
+	}
+
+	target := int(q*float64(count-1) + 0.5)
+	elt := s.data.head.next[level]
+	for i := 0; i < target; i++ {
+		elt = elt.next[level]
+	}
+
+	return elt.value.V
+}
+
 // SummarySlice reprensents how many values are in a [Start, End] range
 type SummarySlice struct {
 	Start  float64
 	End    float64
-	Weight int
+	Weight int64
+}
+
+// downsampleSlices merges adjacent slices so that there are at most max of
+// them, each merged slice spanning about as many of the original ones. The
+// total weight is preserved. A max <= 0 means no limit.
+func downsampleSlices(slices []SummarySlice, max int) []SummarySlice {
+	n := len(slices)
+	if max <= 0 || n <= max {
+		return slices
+	}
+
+	// merge in place, the i-th slice only reads slices at or after i
+	for i := 0; i < max; i++ {
+		from, to := i*n/max, (i+1)*n/max
+		merged := SummarySlice{Start: slices[from].Start, End: slices[to-1].End}
+		for _, ss := range slices[from:to] {
+			merged.Weight += ss.Weight
+		}
+		slices[i] = merged
+	}
+
+	return slices[:max]
 }
 
 // BySlices returns a slice of Summary slices that represents weighted ranges of
@@ -233,25 +428,52 @@ type SummarySlice struct {
 // The number of intervals is related to the precision kept in the internal
 // data structure to ensure epsilon*s.N precision on quantiles, but it's bounded.
 // The weights are not exact, they're only upper bounds (see GK paper).
+// Every emitted slice has a positive weight and Start <= End; entries without
+// any weight are coalesced into the next slice.
 func (s *Summary) BySlices() []SummarySlice {
 	var slices []SummarySlice
 
-	last := s.data.head
-	cur := last.next[0]
+	s.ForEachSlice(func(ss SummarySlice) bool {
+		slices = append(slices, ss)
+		return true
+	})
+
+	return slices
+}
+
+// BySlicesN is the same as BySlices, except that adjacent slices are merged
+// so that at most max slices are returned, trading precision for size.
+func (s *Summary) BySlicesN(max int) []SummarySlice {
+	return downsampleSlices(s.BySlices(), max)
+}
+
+// ForEachSlice calls fn on each slice BySlices would return, in order, and
+// stops as soon as fn returns false.
+func (s *Summary) ForEachSlice(fn func(SummarySlice) bool) {
+	var last *SkiplistNode
+
+	for cur := s.data.head.next[0]; cur != nil; cur = cur.next[0] {
+		if cur.value.G <= 0 {
+			continue
+		}
+
+		// by def in GK first val is always the min
+		start := cur.value.V
+		if last != nil {
+			start = last.value.V
+		}
 
-	for cur != nil {
 		ss := SummarySlice{
-			Start:  last.value.V,
+			Start:  start,
 			End:    cur.value.V,
 			Weight: cur.value.G,
 		}
-		slices = append(slices, ss)
+		if !fn(ss) {
+			return
+		}
 
 		last = cur
-		cur = cur.next[0]
 	}
-
-	return slices
 }
 
 // Merge takes a summary and merge the values inside the current pointed object
@@ -260,28 +482,98 @@ func (s *Summary) Merge(s2 *Summary) {
 		return
 	}
 
+	s.MergeNoCompress(s2)
+	// Force compression
+	s.compress()
+}
+
+// MergeNoCompress merges s2 without compressing, see SliceSummary.MergeNoCompress
+func (s *Summary) MergeNoCompress(s2 *Summary) {
+	if s2.N == 0 || s2.data == nil {
+		return
+	}
+
 	s.N += s2.N
 	// Iterate on s2 elements and insert/merge them
 	for elt := s2.data.head.next[0]; elt != nil; elt = elt.next[0] {
 		s.data.Insert(elt.value)
 	}
-	// Force compression
+}
+
+// MergeInto merges src into s as Merge does, reusing the skiplist of s: both
+// skiplists are walked once, in order, to link the entries of src in place,
+// with pooled nodes, and the result compressed once.
+func (s *Summary) MergeInto(src *Summary) {
+	if src.N == 0 || src.data == nil {
+		return
+	}
+
+	var update [maxHeight]*SkiplistNode
+	for i := range update {
+		update[i] = s.data.head
+	}
+
+	s.N += src.N
+	for elt := src.data.head.next[0]; elt != nil; elt = elt.next[0] {
+		s.data.insertAfter(update[:s.data.maxHeight], elt.value)
+	}
+	s.compress()
+}
+
+// Compact compresses the summary, see SliceSummary.MergeNoCompress
+func (s *Summary) Compact() {
 	s.compress()
 }
 
 // Copy just returns a new summary with the same data
 func (s *Summary) Copy() *Summary {
-	other := NewSummary()
+	other := NewSummaryWithMaxHeight(s.data.maxHeight)
 	other.Merge(s) // cheez
 	return other
 }
 
+// Scale returns a new summary whose values are those of s multiplied by
+// factor, e.g. 1e-6 to convert nanoseconds to milliseconds, with the same G,
+// Delta and N so that its quantiles are those of s scaled. Multiplying by the
+// same positive factor keeps the values in order, and the equal ones equal.
+// It panics if factor is negative, which would reverse the order.
+func (s *Summary) Scale(factor float64) *Summary {
+	if factor < 0 {
+		panic(fmt.Sprintf("quantile: cannot scale a summary by a negative factor: %v", factor))
+	}
+
+	other := NewSummaryWithMaxHeight(s.data.maxHeight)
+	other.N = s.N
+	update := make([]*SkiplistNode, other.data.maxHeight)
+	for i := range update {
+		update[i] = other.data.head
+	}
+	for curr := s.data.head.next[0]; curr != nil; curr = curr.next[0] {
+		e := curr.value
+		e.V *= factor
+		other.data.insertAfter(update, e)
+	}
+	return other
+}
+
+// maxHeight is the default, and largest, number of levels of a Skiplist
 const maxHeight = 31
 
+// MaxHeightFor returns a Skiplist max height suited to hold n elements, that
+// is log2(n) bounded to [1, maxHeight]
+func MaxHeightFor(n int) int {
+	h := 1
+	for h < maxHeight && n > 1<<uint(h) {
+		h++
+	}
+	return h
+}
+
 // Skiplist is a pseudo-random data structure used to store nodes and find quickly what we want
 type Skiplist struct {
-	height int
-	head   *SkiplistNode
+	height    int
+	maxHeight int
+	head      *SkiplistNode
 }
 
 // SkiplistNode is holding the actual value and pointers to the neighbor nodes
@@ -291,16 +583,52 @@ type SkiplistNode struct {
 	prev  []*SkiplistNode
 }
 
+// nodePool recycles the nodes removed from any Skiplist, compressing a summary
+// removes about as many nodes as are inserted
+var nodePool = sync.Pool{
+	New: func() interface{} { return &SkiplistNode{} },
+}
+
+// newSkiplistNode returns a node holding e, linked on the given number of
+// levels. Pooled nodes have all their pointers reset, up to their capacity.
+func newSkiplistNode(e Entry, levels int) *SkiplistNode {
+	node := nodePool.Get().(*SkiplistNode)
+	node.value = e
+	if cap(node.next) >= levels {
+		node.next = node.next[:levels]
+		node.prev = node.prev[:levels]
+	} else {
+		node.next = make([]*SkiplistNode, levels)
+		node.prev = make([]*SkiplistNode, levels)
+	}
+	return node
+}
+
 // NewSkiplist returns a new empty Skiplist
 func NewSkiplist() *Skiplist {
+	return NewSkiplistWithMaxHeight(maxHeight)
+}
+
+// NewSkiplistWithMaxHeight returns a new empty Skiplist with at most
+// maxHeight levels, bounded to [1, 31]
+func NewSkiplistWithMaxHeight(h int) *Skiplist {
+	if h < 1 {
+		h = 1
+	}
+	if h > maxHeight {
+		h = maxHeight
+	}
+
 	return &Skiplist{
-		height: 0,
-		head:   &SkiplistNode{next: make([]*SkiplistNode, maxHeight)},
+		height:    0,
+		maxHeight: h,
+		head:      &SkiplistNode{next: make([]*SkiplistNode, h)},
 	}
 }
 
-// Insert adds a new Entry to the Skiplist and yields a pointer to the node where the data was inserted
-func (s *Skiplist) Insert(e Entry) *SkiplistNode {
+// randomLevel returns the highest level of a new node, growing the height
+// of the Skiplist if needed
+func (s *Skiplist) randomLevel() int {
 	level := 0
 
 	n := rand.Int31()
@@ -310,15 +638,50 @@ func (s *Skiplist) Insert(e Entry) *SkiplistNode {
 	}
 
 	if level > s.height {
-		s.height++
+		if s.height < s.maxHeight-1 {
+			s.height++
+		}
 		level = s.height
 	}
 
-	node := &SkiplistNode{
-		value: e,
-		next:  make([]*SkiplistNode, level+1),
-		prev:  make([]*SkiplistNode, level+1),
+	return level
+}
+
+// insertAfter adds a new Entry to the Skiplist, searching its place forward
+// from update, the nodes before it on each level, which it then updates to
+// search the place of a next, larger or equal, Entry from there.
+func (s *Skiplist) insertAfter(update []*SkiplistNode, e Entry) *SkiplistNode {
+	level := s.randomLevel()
+
+	node := newSkiplistNode(e, level+1)
+	for i := s.height; i >= 0; i-- {
+		curr := update[i]
+		for curr.next[i] != nil && e.V >= curr.next[i].value.V {
+			curr = curr.next[i]
+		}
+
+		if i > level {
+			update[i] = curr
+			continue
+		}
+
+		node.next[i] = curr.next[i]
+		if curr.next[i] != nil {
+			curr.next[i].prev[i] = node
+		}
+		curr.next[i] = node
+		node.prev[i] = curr
+		update[i] = node
 	}
+
+	return node
+}
+
+// Insert adds a new Entry to the Skiplist and yields a pointer to the node where the data was inserted
+func (s *Skiplist) Insert(e Entry) *SkiplistNode {
+	level := s.randomLevel()
+
+	node := newSkiplistNode(e, level+1)
 	curr := s.head
 	for i := s.height; i >= 0; i-- {
 
@@ -341,7 +704,8 @@ func (s *Skiplist) Insert(e Entry) *SkiplistNode {
 	return node
 }
 
-// Remove removes a node from the Skiplist
+// Remove removes a node from the Skiplist. The node is recycled, it must not
+// be used once removed.
 func (s *Skiplist) Remove(node *SkiplistNode) {
 
 	// remove n from each level of the Skiplist
@@ -359,4 +723,8 @@ func (s *Skiplist) Remove(node *SkiplistNode) {
 		node.next[i] = nil
 		node.prev[i] = nil
 	}
+
+	// nothing references the node anymore, it can be reused
+	node.value = Entry{}
+	nodePool.Put(node)
 }
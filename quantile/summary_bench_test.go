@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 const randlen = 1000
@@ -57,6 +58,27 @@ func BenchmarkGKSliceInsertionPreallocd(b *testing.B) {
 	}
 }
 
+func BGKSkiplistSmallSummary(b *testing.B, maxHeight int) {
+	vals := randSlice(randlen)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		s := NewSummaryWithMaxHeight(maxHeight)
+		for i := 0; i < 10; i++ {
+			s.Insert(vals[(n+i)%randlen], uint64(i))
+		}
+	}
+}
+
+func BenchmarkGKSkiplistSmallSummary(b *testing.B) {
+	BGKSkiplistSmallSummary(b, maxHeight)
+}
+func BenchmarkGKSkiplistSmallSummaryLowMaxHeight(b *testing.B) {
+	BGKSkiplistSmallSummary(b, MaxHeightFor(10))
+}
+
 func BGKQuantiles(b *testing.B, n int) {
 	s := NewSummary()
 	vals := randSlice(n)
@@ -87,6 +109,59 @@ func BenchmarkGKQuantiles100000(b *testing.B) {
 	BGKQuantiles(b, 100000)
 }
 
+// flushQuantiles are queried on each summary, as when flushing the stats
+var flushQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99}
+
+func BGKFlushQuantiles(b *testing.B, n int) {
+	s := NewSummary()
+	vals := randSlice(n)
+	for i := 0; i < n; i++ {
+		s.Insert(vals[i], uint64(i))
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for _, q := range flushQuantiles {
+			s.Quantile(q)
+		}
+	}
+}
+func BenchmarkGKFlushQuantiles1000(b *testing.B) {
+	BGKFlushQuantiles(b, 1000)
+}
+func BenchmarkGKFlushQuantiles100000(b *testing.B) {
+	BGKFlushQuantiles(b, 100000)
+}
+
+func BGKFlushValuesAtRanks(b *testing.B, n int) {
+	s := NewSummary()
+	vals := randSlice(n)
+	for i := 0; i < n; i++ {
+		s.Insert(vals[i], uint64(i))
+	}
+	ranks := make([]int64, len(flushQuantiles))
+	for i, q := range flushQuantiles {
+		ranks[i] = s.Rank(q)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for _, r := range ranks {
+			s.ValueAtRank(r)
+		}
+	}
+}
+func BenchmarkGKFlushValuesAtRanks1000(b *testing.B) {
+	BGKFlushValuesAtRanks(b, 1000)
+}
+func BenchmarkGKFlushValuesAtRanks100000(b *testing.B) {
+	BGKFlushValuesAtRanks(b, 100000)
+}
+
 func BGKSliceQuantiles(b *testing.B, n int) {
 	s := NewSliceSummary()
 	vals := randSlice(n)
@@ -174,3 +249,111 @@ func BenchmarkGKSliceEncoding100(b *testing.B) {
 func BenchmarkGKSliceEncoding1000(b *testing.B) {
 	BGKSliceEncoding(b, 1000)
 }
+
+func BenchmarkSkiplistInsertRemove(b *testing.B) {
+	s := NewSkiplist()
+
+	vals := randSlice(randlen)
+	nodes := make([]*SkiplistNode, randlen)
+	for i, v := range vals {
+		nodes[i] = s.Insert(Entry{V: v, G: 1})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	// removed nodes are recycled by the next inserts
+	for n := 0; n < b.N; n++ {
+		i := n % randlen
+		s.Remove(nodes[i])
+		nodes[i] = s.Insert(Entry{V: vals[i], G: 1})
+	}
+}
+
+// BGKSliceInsertLatency reports the worst insert time, incremental
+// compressions (step > 0) should keep it much lower than full ones
+func BGKSliceInsertLatency(b *testing.B, step int) {
+	s := NewSliceSummary()
+	s.SetIncrementalCompress(step)
+
+	vals := randSlice(randlen)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	var worst time.Duration
+	for n := 0; n < b.N; n++ {
+		start := time.Now()
+		s.Insert(vals[n%randlen], uint64(n))
+		if d := time.Since(start); d > worst {
+			worst = d
+		}
+	}
+	b.Logf("N=%d entries=%d worst insert=%s", b.N, len(s.Entries), worst)
+}
+
+func BenchmarkGKSliceInsertLatencyFull(b *testing.B) {
+	BGKSliceInsertLatency(b, 0)
+}
+func BenchmarkGKSliceInsertLatencyIncremental(b *testing.B) {
+	BGKSliceInsertLatency(b, 8)
+}
+
+func sortedInt64Slice(n int) []int64 {
+	vs := make([]int64, n)
+	for i := range vs {
+		vs[i] = int64(i)
+	}
+	return vs
+}
+
+func BenchmarkGKSkiplistInsertOneByOne(b *testing.B) {
+	vs := sortedInt64Slice(10000)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		s := NewSummary()
+		for i, v := range vs {
+			s.Insert(float64(v), uint64(i))
+		}
+	}
+}
+
+func BenchmarkGKSkiplistInsertSorted(b *testing.B) {
+	vs := sortedInt64Slice(10000)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		s := NewSummary()
+		s.InsertSorted(vs, nil)
+	}
+}
+
+func BGKSkiplistMerge(b *testing.B, merge func(dst, src *Summary)) {
+	base, src := NewSummary(), NewSummary()
+	for i, v := range randSlice(10000) {
+		base.Insert(v, uint64(i))
+	}
+	for i, v := range randSlice(10000) {
+		src.Insert(v, uint64(i))
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		dst := base.Copy()
+		b.StartTimer()
+		merge(dst, src)
+	}
+}
+
+func BenchmarkGKSkiplistMerge(b *testing.B) {
+	BGKSkiplistMerge(b, (*Summary).Merge)
+}
+
+func BenchmarkGKSkiplistMergeInto(b *testing.B) {
+	BGKSkiplistMerge(b, (*Summary).MergeInto)
+}
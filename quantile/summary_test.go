@@ -1,8 +1,11 @@
 package quantile
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -180,6 +183,59 @@ func NewSummaryWithTestData() *Summary {
 	return s
 }
 
+func TestSummaryQuantileEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, q := range []float64{0, 0.5, 0.99, 1} {
+		assert.Equal(0.0, NewSummary().Quantile(q))
+		assert.Equal(0.0, NewSliceSummary().Quantile(q))
+	}
+}
+
+func TestSummaryMaxHeight(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(1, MaxHeightFor(0))
+	assert.Equal(1, MaxHeightFor(2))
+	assert.Equal(4, MaxHeightFor(10))
+	assert.Equal(10, MaxHeightFor(1024))
+	assert.Equal(maxHeight, MaxHeightFor(1<<40))
+
+	s := NewSummaryWithMaxHeight(2)
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	assert.Len(s.data.head.next, 2)
+	assert.True(s.data.height < 2)
+	assert.InDelta(500, s.Quantile(0.5), EPSILON*1000)
+	assert.Equal(2, s.Copy().data.maxHeight)
+}
+
+func TestSummaryApproxQuantile(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0.0, NewSummary().ApproxQuantile(0.5))
+
+	rng := rand.New(rand.NewSource(42))
+	for _, n := range []int{10, 1000, 100000} {
+		s := NewSummary()
+		vals := make([]float64, 0, n)
+		for i := 0; i < n; i++ {
+			v := rng.Float64()
+			vals = append(vals, v)
+			s.Insert(v, uint64(i))
+		}
+		sort.Float64s(vals)
+
+		for _, q := range []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 1} {
+			exact := rankError(vals, q, s.Quantile(q))
+			approx := rankError(vals, q, s.ApproxQuantile(q))
+			// much coarser than EPSILON, but still usable
+			assert.True(approx <= exact+0.1, "n=%d q=%v approx rank error %v", n, q, approx)
+		}
+	}
+}
+
 func TestSummaryGob(t *testing.T) {
 	assert := assert.New(t)
 
@@ -190,6 +246,62 @@ func TestSummaryGob(t *testing.T) {
 	ss.GobDecode(bytes)
 
 	assert.Equal(s.N, ss.N)
+	assert.Equal(maxHeight, ss.data.maxHeight)
+}
+
+func TestSummaryDecodeMaxHeight(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummaryWithMaxHeight(4)
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+
+	b, err := s.GobEncode()
+	assert.Nil(err)
+	fromGob := NewSummary()
+	assert.Nil(fromGob.GobDecode(b))
+	assert.Equal(4, fromGob.data.maxHeight)
+	assert.Equal(s.Entries(), fromGob.Entries())
+
+	b, err = json.Marshal(s)
+	assert.Nil(err)
+	var fromJSON Summary
+	assert.Nil(json.Unmarshal(b, &fromJSON))
+	assert.Equal(4, fromJSON.data.maxHeight)
+	assert.Equal(s.Entries(), fromJSON.Entries())
+
+	// the payloads of the default height do not carry it
+	b, err = json.Marshal(NewSummaryWithTestData())
+	assert.Nil(err)
+	assert.NotContains(string(b), "max_height")
+	fromJSON = Summary{}
+	assert.Nil(json.Unmarshal(b, &fromJSON))
+	assert.Equal(maxHeight, fromJSON.data.maxHeight)
+}
+
+func TestSummaryEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(NewSummary().Entries())
+
+	s := NewSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(rand.Float64(), uint64(i))
+	}
+	entries := s.Entries()
+	assert.NotEmpty(entries)
+	assert.True(sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].V < entries[j].V }))
+
+	var total int64
+	for _, e := range entries {
+		total += e.G
+	}
+	assert.Equal(s.N, total)
+
+	// the entries are a copy, not a view on the summary
+	entries[0].V = -1
+	assert.NotEqual(-1.0, s.Entries()[0].V)
 }
 
 func TestSummaryMerge(t *testing.T) {
@@ -206,10 +318,12 @@ func TestSummaryMerge(t *testing.T) {
 
 	s1.Merge(s2)
 
+	// the merge does not keep the EPSILON guarantee, nor the same entries as
+	// the SliceSummary one, hence 14 and 29 rather than 15 and 30
 	expected := map[float64]float64{
 		0.0: 0,
-		0.2: 15,
-		0.4: 30,
+		0.2: 14,
+		0.4: 29,
 		0.6: 45,
 		0.8: 70,
 		1.0: 100,
@@ -264,7 +378,7 @@ func TestSummaryRemergeReal10000(t *testing.T) {
 	fmt.Println(s)
 	slices := s.BySlices()
 	fmt.Println(slices)
-	total := 0
+	var total int64
 	for _, s := range slices {
 		total += s.Weight
 	}
@@ -285,7 +399,7 @@ func TestSliceSummaryRemergeReal10000(t *testing.T) {
 	fmt.Println(s)
 	slices := s.BySlices()
 	fmt.Println(slices)
-	total := 0
+	var total int64
 	for _, s := range slices {
 		total += s.Weight
 	}
@@ -305,7 +419,7 @@ func TestSliceSummaryRemerge10000(t *testing.T) {
 	fmt.Println(s1)
 	slices := s1.BySlices()
 	fmt.Println(slices)
-	total := 0
+	var total int64
 	for _, s := range slices {
 		total += s.Weight
 	}
@@ -324,7 +438,7 @@ func TestSummaryRemerge10000(t *testing.T) {
 	fmt.Println(s1)
 	slices := s1.BySlices()
 	fmt.Println(slices)
-	total := 0
+	var total int64
 	for _, s := range slices {
 		total += s.Weight
 	}
@@ -348,9 +462,413 @@ func TestSummaryBySlices(t *testing.T) {
 		assert.Equal(float64(i+1), sl.Start)
 		assert.Equal(float64(i+1), sl.End)
 		if i == 4 {
-			assert.Equal(3, sl.Weight)
+			assert.Equal(int64(3), sl.Weight)
 		} else {
-			assert.Equal(1, sl.Weight)
+			assert.Equal(int64(1), sl.Weight)
+		}
+	}
+}
+
+func assertValidSlices(t *testing.T, slices []SummarySlice) {
+	assert := assert.New(t)
+	for i, sl := range slices {
+		assert.True(sl.Weight > 0, "slice %d has a non-positive weight: %v", i, sl)
+		assert.True(sl.Start <= sl.End, "slice %d has unordered bounds: %v", i, sl)
+		if i > 0 {
+			assert.True(slices[i-1].End <= sl.Start, "slice %d overlaps the previous one: %v", i, sl)
+		}
+	}
+}
+
+func TestSummaryBySlicesCompressed(t *testing.T) {
+	s := NewSummary()
+	ss := NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		// negative values and duplicates to exercise compression edge cases
+		v := float64(i%250 - 100)
+		s.Insert(v, uint64(i))
+		ss.Insert(v, uint64(i))
+	}
+
+	// entries can end up with no weight, it should not leak in slices
+	ss.Entries[len(ss.Entries)/2].G = 0
+
+	assertValidSlices(t, s.BySlices())
+	assertValidSlices(t, ss.BySlices())
+	assert.Equal(t, -100.0, s.BySlices()[0].Start)
+}
+
+// rankError returns how far (relative to N) the rank of v in sorted is from
+// the rank of the quantile q
+func rankError(sorted []float64, q, v float64) float64 {
+	lo := sort.SearchFloat64s(sorted, v)
+	hi := sort.Search(len(sorted), func(i int) bool { return sorted[i] > v })
+	r := q * float64(len(sorted))
+	if r < float64(lo) {
+		return (float64(lo) - r) / float64(len(sorted))
+	}
+	if r > float64(hi) {
+		return (r - float64(hi)) / float64(len(sorted))
+	}
+	return 0
+}
+
+func TestSliceSummaryMergeNoCompress(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	each := NewSliceSummary()
+	once := NewSliceSummary()
+	var all []float64
+	for n := 0; n < 200; n++ {
+		s := NewSliceSummary()
+		for i := 0; i < 500; i++ {
+			v := r.ExpFloat64() * 1000
+			s.Insert(v, uint64(i))
+			all = append(all, v)
+		}
+		each.Merge(s)
+		once.MergeNoCompress(s)
+	}
+	once.Compact()
+	sort.Float64s(all)
+
+	assert.Equal(int64(len(all)), each.N)
+	assert.Equal(int64(len(all)), once.N)
+
+	var eachErr, onceErr float64
+	for _, q := range testQuantiles {
+		eachErr = math.Max(eachErr, rankError(all, q, each.Quantile(q)))
+		onceErr = math.Max(onceErr, rankError(all, q, once.Quantile(q)))
+	}
+
+	// compressing once stays within the guarantees, compressing after each
+	// merge accumulates errors
+	assert.True(onceErr <= EPSILON, "once: %f", onceErr)
+	assert.True(onceErr <= eachErr, "once: %f, each: %f", onceErr, eachErr)
+}
+
+func TestSummaryForEachSliceEarlyStop(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummary()
+	ss := NewSliceSummary()
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i), uint64(i))
+		ss.Insert(float64(i), uint64(i))
+	}
+
+	for _, forEach := range []func(func(SummarySlice) bool){s.ForEachSlice, ss.ForEachSlice} {
+		calls := 0
+		forEach(func(SummarySlice) bool {
+			calls++
+			return calls < 3
+		})
+		assert.Equal(3, calls)
+	}
+
+	// when never stopped, it goes through the same slices as BySlices
+	var slices []SummarySlice
+	ss.ForEachSlice(func(sl SummarySlice) bool {
+		slices = append(slices, sl)
+		return true
+	})
+	assert.Equal(ss.BySlices(), slices)
+	assert.True(len(slices) > 3)
+}
+
+func TestSummaryBySlicesN(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummary()
+	ss := NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+		ss.Insert(float64(i), uint64(i))
+	}
+
+	weight := func(slices []SummarySlice) int64 {
+		var w int64
+		for _, sl := range slices {
+			w += sl.Weight
+		}
+		return w
+	}
+
+	for _, bySlices := range []struct {
+		all func() []SummarySlice
+		n   func(int) []SummarySlice
+	}{{s.BySlices, s.BySlicesN}, {ss.BySlices, ss.BySlicesN}} {
+		all := bySlices.all()
+		for _, max := range []int{1, 7, 10, len(all) - 1, len(all), len(all) + 1, 0} {
+			slices := bySlices.n(max)
+			if max > 0 {
+				assert.True(len(slices) <= max, "%d slices for max %d", len(slices), max)
+			} else {
+				assert.Len(slices, len(all))
+			}
+			assert.Equal(weight(all), weight(slices), "max %d", max)
+
+			// adjacent slices still cover the whole range, in order
+			assert.Equal(all[0].Start, slices[0].Start)
+			assert.Equal(all[len(all)-1].End, slices[len(slices)-1].End)
+			for i := 1; i < len(slices); i++ {
+				assert.True(slices[i-1].End <= slices[i].Start)
+			}
 		}
 	}
 }
+
+func TestSliceSummaryInsertBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSliceSummary()
+
+	// not a number values are always rejected
+	s.Insert(math.NaN(), 1)
+	s.Insert(math.Inf(1), 2)
+	s.Insert(math.Inf(-1), 3)
+	assert.Equal(3, s.Rejected())
+	assert.Equal(int64(0), s.N)
+
+	// no bounds by default
+	s.Insert(-1, 4)
+	assert.Equal(int64(1), s.N)
+
+	s = NewSliceSummary()
+	s.SetBounds(0, 1e12)
+	for i := 0; i < 100; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	s.Insert(-1, 100)
+	s.Insert(-1e12, 101)
+	s.Insert(1e12+1, 102)
+	s.Insert(1e12, 103) // bounds are inclusive
+
+	assert.Equal(3, s.Rejected())
+	assert.Equal(int64(101), s.N)
+	assert.Equal(0.0, s.Quantile(0))
+	assert.Equal(1e12, s.Quantile(1))
+
+	// the bounds and the count survive a copy
+	s2 := s.Copy()
+	s2.Insert(-1, 104)
+	assert.Equal(4, s2.Rejected())
+	assert.Equal(int64(101), s2.N)
+}
+
+func TestSliceSummaryIncrementalCompress(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	full := NewSliceSummary()
+	incr := NewSliceSummary()
+	incr.SetIncrementalCompress(4)
+
+	var all []float64
+	for i := 0; i < 100000; i++ {
+		v := r.ExpFloat64() * 1000
+		full.Insert(v, uint64(i))
+		incr.Insert(v, uint64(i))
+		all = append(all, v)
+	}
+	sort.Float64s(all)
+
+	assert.Equal(full.N, incr.N)
+	assert.NoError(incr.CheckInvariant())
+	assert.True(sort.SliceIsSorted(incr.Entries, func(i, j int) bool { return incr.Entries[i].V < incr.Entries[j].V }))
+
+	// every entry gets compressed in turn, so the summary stays about as small
+	assert.True(len(incr.Entries) <= 2*len(full.Entries), "full: %d, incremental: %d", len(full.Entries), len(incr.Entries))
+
+	for _, q := range testQuantiles {
+		fullErr := rankError(all, q, full.Quantile(q))
+		incrErr := rankError(all, q, incr.Quantile(q))
+		assert.True(fullErr <= EPSILON, "q=%f full: %f", q, fullErr)
+		assert.True(incrErr <= EPSILON, "q=%f incremental: %f", q, incrErr)
+	}
+
+	// a full compression, e.g. when merging, still works
+	incr.Compact()
+	assert.NoError(incr.CheckInvariant())
+	assert.Equal(all[0], incr.Quantile(0))
+	assert.Equal(all[len(all)-1], incr.Quantile(1))
+
+	// and the mode survives a copy
+	assert.Equal(4, incr.Copy().compressStep)
+
+	// as does a running compression, which the copy resumes where s would
+	for i := 0; incr.compressPos < 2 && i < 1000; i++ {
+		incr.Insert(r.ExpFloat64()*1000, uint64(i))
+	}
+	assert.True(incr.compressPos >= 2, "no running compression to copy")
+	cp := incr.Copy()
+	assert.Equal(incr.compressPos, cp.compressPos)
+	assert.Equal(incr.compressEpsN, cp.compressEpsN)
+	for i := 0; i < 100; i++ {
+		v := r.ExpFloat64() * 1000
+		incr.Insert(v, uint64(i))
+		cp.Insert(v, uint64(i))
+	}
+	assert.Equal(incr.Entries, cp.Entries)
+}
+
+func TestSummaryInsertSorted(t *testing.T) {
+	assert := assert.New(t)
+
+	const n = 10000
+	vs := make([]int64, n)
+	sorted := make([]float64, n)
+	for i := range vs {
+		vs[i] = int64(i / 3) // with duplicates
+		sorted[i] = float64(vs[i])
+	}
+
+	one := NewSummary()
+	for i, v := range vs {
+		one.Insert(float64(v), uint64(i))
+	}
+	batch := NewSummary()
+	batch.InsertSorted(vs, nil)
+
+	assert.Equal(one.N, batch.N)
+	assert.Equal(one.Entries()[0], batch.Entries()[0])
+	for _, q := range testQuantiles {
+		assert.True(rankError(sorted, q, batch.Quantile(q)) <= EPSILON, "quantile %f", q)
+	}
+
+	// a second batch, merged with the first one, then out of order values
+	for _, more := range [][]int64{{-5, 10, 100, 100, 2000, 50000}, {7, 3, 3000}} {
+		batch.InsertSorted(more, nil)
+		for _, v := range more {
+			one.Insert(float64(v), 0)
+			sorted = append(sorted, float64(v))
+		}
+	}
+	sort.Float64s(sorted)
+
+	assert.Equal(one.N, batch.N)
+	entries := batch.Entries()
+	assert.Equal(-5.0, entries[0].V)
+	assert.Equal(50000.0, entries[len(entries)-1].V)
+	for _, q := range testQuantiles {
+		assert.True(rankError(sorted, q, batch.Quantile(q)) <= EPSILON, "quantile %f", q)
+	}
+
+	// the skiplist is still consistent, in order on all its levels
+	for i := 0; i <= batch.data.height; i++ {
+		for curr := batch.data.head.next[i]; curr != nil && curr.next[i] != nil; curr = curr.next[i] {
+			assert.True(curr.value.V <= curr.next[i].value.V)
+			assert.Equal(curr, curr.next[i].prev[i])
+		}
+	}
+}
+
+func TestSummaryMergeInto(t *testing.T) {
+	assert := assert.New(t)
+
+	// the same expectations as Merge
+	s1 := NewSummary()
+	for i := 0; i < 101; i++ {
+		s1.Insert(float64(i), uint64(i))
+	}
+	s2 := NewSummary()
+	for i := 0; i < 50; i++ {
+		s2.Insert(float64(i), uint64(i))
+	}
+	merged := s1.Copy()
+	merged.Merge(s2)
+	s1.MergeInto(s2)
+	assert.Equal(merged.N, s1.N)
+	for _, q := range []float64{0, 0.2, 0.4, 0.6, 0.8, 1} {
+		assert.Equal(merged.Quantile(q), s1.Quantile(q), "quantile %f", q)
+	}
+
+	// and many random summaries merged in a row give the same quantiles as
+	// with Merge
+	var all []float64
+	dst, expected := NewSummary(), NewSummary()
+	for n := 0; n < 10; n++ {
+		src := NewSummary()
+		for i := 0; i < 1000; i++ {
+			v := rand.NormFloat64()*100 + float64(n*10)
+			src.Insert(v, uint64(i))
+			all = append(all, v)
+		}
+		dst.MergeInto(src)
+		expected.Merge(src)
+	}
+	assert.Equal(int64(len(all)), dst.N)
+	assert.Equal(expected.Entries(), dst.Entries())
+	for _, q := range testQuantiles {
+		assert.Equal(expected.Quantile(q), dst.Quantile(q), "quantile %f", q)
+	}
+
+	// merging an empty summary changes nothing
+	n := dst.N
+	dst.MergeInto(NewSummary())
+	assert.Equal(n, dst.N)
+}
+
+func TestSummaryScale(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	// durations in nanoseconds, converted to milliseconds
+	s := NewSummary()
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(r.Int63n(1e9)), uint64(i))
+	}
+	ms := s.Scale(1e-6)
+
+	assert.Equal(s.N, ms.N)
+	entries, scaled := s.Entries(), ms.Entries()
+	assert.Len(scaled, len(entries))
+	for i := range entries {
+		assert.Equal(entries[i].G, scaled[i].G)
+		assert.Equal(entries[i].Delta, scaled[i].Delta)
+		assert.Equal(entries[i].V*1e-6, scaled[i].V)
+	}
+	for _, q := range []float64{0, 0.25, 0.5, 0.9, 0.99, 1} {
+		assert.InDelta(s.Quantile(q)*1e-6, ms.Quantile(q), 1e-9, "quantile %v", q)
+	}
+
+	// s is left as it was
+	assert.Equal(entries, s.Entries())
+
+	assert.Equal(int64(0), NewSummary().Scale(2).N)
+	assert.Panics(func() { s.Scale(-1) })
+}
+
+func TestSummaryValueAtRank(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummary()
+	assert.Equal(0.0, s.ValueAtRank(0))
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		assert.Equal(s.Quantile(q), s.ValueAtRank(s.Rank(q)), "quantile %v", q)
+	}
+	assert.Equal(int64(9900), s.Rank(0.99))
+	assert.InDelta(9900, s.ValueAtRank(9900), EPSILON*float64(s.N))
+}
+
+func TestCompressEntriesLargeN(t *testing.T) {
+	assert := assert.New(t)
+
+	// the ranks of equal values folded into the delta do not fit in a 32
+	// bits int
+	entries := []Entry{
+		{V: 1, G: 1 << 31},
+		{V: 1, G: 1 << 31},
+		{V: 2, G: 1},
+	}
+	compressed := compressEntries(entries, 1<<32+1)
+
+	assert.Len(compressed, 2)
+	assert.Equal(int64(1<<31), compressed[0].Delta)
+	assert.Equal(2.0, compressed[1].V)
+}
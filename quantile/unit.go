@@ -0,0 +1,46 @@
+package quantile
+
+import "fmt"
+
+// Unit is the unit of the values inserted in a summary, e.g. "ns" or "ms".
+// Values are stored without their unit, so summaries whose values were
+// measured in different units cannot be merged into meaningful quantiles.
+type Unit string
+
+const (
+	// NoUnit is the unit of summaries created without any, they can be
+	// merged with summaries of any unit
+	NoUnit Unit = ""
+	// Nanosecond is the unit of summaries of durations in nanoseconds
+	Nanosecond Unit = "ns"
+	// Millisecond is the unit of summaries of durations in milliseconds
+	Millisecond Unit = "ms"
+)
+
+// UnitMismatchError is returned when merging summaries of different units
+type UnitMismatchError struct {
+	Unit      Unit
+	OtherUnit Unit
+}
+
+func (e *UnitMismatchError) Error() string {
+	return fmt.Sprintf("cannot merge summaries of different units: %q and %q", e.Unit, e.OtherUnit)
+}
+
+// NewSliceSummaryWithUnit allocates a new GK summary of values in unit
+func NewSliceSummaryWithUnit(unit Unit) *SliceSummary {
+	return &SliceSummary{Unit: unit}
+}
+
+// checkUnit returns an error if s2 cannot be merged into s because of their
+// units, and otherwise gives s the unit of s2 if it had none
+func (s *SliceSummary) checkUnit(s2 *SliceSummary) error {
+	if s2.Unit == NoUnit || s.Unit == s2.Unit {
+		return nil
+	}
+	if s.Unit != NoUnit {
+		return &UnitMismatchError{Unit: s.Unit, OtherUnit: s2.Unit}
+	}
+	s.Unit = s2.Unit
+	return nil
+}
@@ -0,0 +1,59 @@
+package quantile
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSliceSummaryMergeUnits(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := NewSliceSummaryWithUnit(Nanosecond)
+	ms := NewSliceSummaryWithUnit(Millisecond)
+	for i := 0; i < 100; i++ {
+		ns.Insert(float64(i*1e6), uint64(i))
+		ms.Insert(float64(i), uint64(i))
+	}
+
+	// a cross-unit merge is rejected and leaves the summary as is
+	before := ns.Copy()
+	err := ns.Merge(ms)
+	assert.Equal(&UnitMismatchError{Unit: Nanosecond, OtherUnit: Millisecond}, err)
+	assert.Equal(before, ns)
+	assert.Error(ns.MergeNoCompress(ms))
+	assert.Error(ns.MergeWeighted(ms, 0.5))
+
+	// same units merge
+	assert.NoError(ns.Merge(before))
+	assert.Equal(int64(200), ns.N)
+
+	// summaries without unit merge with any, and take the unit merged in
+	s := NewSliceSummary()
+	assert.NoError(s.Merge(ms))
+	assert.Equal(Millisecond, s.Unit)
+	assert.Equal(int64(100), s.N)
+	assert.NoError(ms.Merge(NewSliceSummary()))
+	assert.Equal(Millisecond, ms.Unit)
+}
+
+func TestSliceSummaryUnitSerialization(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSliceSummaryWithUnit(Nanosecond)
+	s.Insert(1, 1)
+	b, err := json.Marshal(s)
+	assert.NoError(err)
+	assert.Contains(string(b), `"Unit":"ns"`)
+
+	var s2 SliceSummary
+	assert.NoError(json.Unmarshal(b, &s2))
+	assert.Equal(Nanosecond, s2.Unit)
+	assert.Equal(Nanosecond, s.Copy().Unit)
+
+	// no unit, no change to the payload
+	b, err = json.Marshal(NewSliceSummary())
+	assert.NoError(err)
+	assert.NotContains(string(b), "Unit")
+}
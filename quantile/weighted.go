@@ -11,7 +11,7 @@ type WeightedSliceSummary struct {
 	*SliceSummary
 }
 
-func probabilisticRound(g int, weight float64) int {
+func probabilisticRound(g int64, weight float64) int64 {
 	// deterministic seed
 	rand.Seed(7337)
 
@@ -19,7 +19,7 @@ func probabilisticRound(g int, weight float64) int {
 	decimal := raw - math.Floor(raw)
 	limit := rand.Float64()
 
-	iraw := int(raw)
+	iraw := int64(raw)
 	if limit > decimal {
 		iraw++
 	}
@@ -30,10 +30,10 @@ func probabilisticRound(g int, weight float64) int {
 // WeighSummary applies a weight factor to a slice summary and return it as a
 // new slice.
 func WeighSummary(s *SliceSummary, weight float64) *SliceSummary {
-	sw := NewSliceSummary()
+	sw := NewSliceSummaryWithUnit(s.Unit)
 	sw.Entries = make([]Entry, 0, len(s.Entries))
 
-	gsum := 0
+	var gsum int64
 	for _, e := range s.Entries {
 		newg := probabilisticRound(e.G, weight)
 		// if an entry is down to 0 delete it
@@ -49,20 +49,46 @@ func WeighSummary(s *SliceSummary, weight float64) *SliceSummary {
 	return sw
 }
 
+// MergeWeighted merges s2 into s with all its weights scaled by weight. Merge
+// already weighs summaries by their number of values, MergeWeighted is
+// useful to give less importance to older summaries in a rollup, by merging
+// them with a weight < 1. A weight <= 0 merges nothing. Like Merge, it
+// returns an error if the summaries have different units.
+func (s *SliceSummary) MergeWeighted(s2 *SliceSummary, weight float64) error {
+	if weight <= 0 {
+		return nil
+	}
+	if weight == 1 {
+		return s.Merge(s2)
+	}
+
+	sw := WeighSummary(s2, weight)
+	// the rank uncertainty scales along with the weights
+	for i := range sw.Entries {
+		sw.Entries[i].Delta = int64(float64(sw.Entries[i].Delta) * weight)
+	}
+	return s.Merge(sw)
+}
+
 // BySlicesWeighted BySlices() is the BySlices version but combines multiple
-// weighted slice summaries before returning the histogram
-func BySlicesWeighted(summaries ...WeightedSliceSummary) []SummarySlice {
+// weighted slice summaries before returning the histogram. Summaries of a
+// different unit than the first one are left out, and the error of the first
+// of them is returned along with the histogram of the others.
+func BySlicesWeighted(summaries ...WeightedSliceSummary) ([]SummarySlice, error) {
 	if len(summaries) == 0 {
-		return []SummarySlice{}
+		return []SummarySlice{}, nil
 	}
 
+	var err error
 	mergeSummary := WeighSummary(summaries[0].SliceSummary, summaries[0].Weight)
 	if len(summaries) > 1 {
 		for _, s := range summaries[1:] {
 			sw := WeighSummary(s.SliceSummary, s.Weight)
-			mergeSummary.Merge(sw)
+			if merr := mergeSummary.Merge(sw); merr != nil && err == nil {
+				err = merr
+			}
 		}
 	}
 
-	return mergeSummary.BySlices()
+	return mergeSummary.BySlices(), err
 }
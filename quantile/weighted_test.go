@@ -2,6 +2,7 @@ package quantile
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -22,11 +23,12 @@ func TestBySlicesWeightedHalf(t *testing.T) {
 	sw1 := WeightedSliceSummary{1.0, s}
 	sw2 := WeightedSliceSummary{0.5, s2}
 
-	ss := BySlicesWeighted(sw1, sw2)
+	ss, err := BySlicesWeighted(sw1, sw2)
+	require.NoError(t, err)
 
 	// deviation = (num of sum merged = 2) deviation * GK-dev (eps * N)
 	deviation := 2 * EPSILON * (100000 + 50000)
-	total := 0
+	var total int64
 	for _, sl := range ss {
 		total += sl.Weight
 		// corner case - tolerate
@@ -51,12 +53,13 @@ func TestBySlicesWeightedSingle(t *testing.T) {
 	}
 
 	sw := WeightedSliceSummary{0.1, s}
-	ss := BySlicesWeighted(sw)
+	ss, err := BySlicesWeighted(sw)
+	require.NoError(t, err)
 
 	// deviation = deviation * GK-dev (eps * N)
 	deviation := EPSILON * 1000000
 
-	total := 0
+	var total int64
 	for _, sl := range ss {
 		total += sl.Weight
 		// if the entry is alone this is ok
@@ -81,13 +84,111 @@ func TestBySlicesWeightedSmall(t *testing.T) {
 	}
 
 	sw := WeightedSliceSummary{0.5, s}
-	ss := BySlicesWeighted(sw)
+	ss, err := BySlicesWeighted(sw)
+	require.NoError(t, err)
 
 	// should have ~5 elements probabilistically chosen
 	fmt.Println(ss)
 }
 
 func TestBySlicesWeightedEmpty(t *testing.T) {
-	ss := BySlicesWeighted()
+	ss, err := BySlicesWeighted()
+	assert.NoError(t, err)
 	assert.Equal(t, 0, len(ss))
 }
+
+func TestBySlicesWeightedUnits(t *testing.T) {
+	ns, ms := NewSliceSummaryWithUnit(Nanosecond), NewSliceSummaryWithUnit(Millisecond)
+	for i := 0; i < 10; i++ {
+		ns.Insert(float64(i), 0)
+		ms.Insert(float64(i), 0)
+	}
+
+	// the summary of another unit is left out, and reported
+	ss, err := BySlicesWeighted(WeightedSliceSummary{1, ns}, WeightedSliceSummary{1, ms})
+	assert.Error(t, err)
+	alone, err := BySlicesWeighted(WeightedSliceSummary{1, ns})
+	assert.NoError(t, err)
+	assert.Equal(t, alone, ss)
+}
+
+func TestMergeKeepsRelativeWeights(t *testing.T) {
+	assert := assert.New(t)
+
+	small := NewSliceSummary()
+	for i := 0; i < 100; i++ {
+		small.Insert(float64(i), 0)
+	}
+	large := NewSliceSummary()
+	for i := 0; i < 900; i++ {
+		large.Insert(float64(1000+i), 0)
+	}
+
+	s := NewSliceSummary()
+	s.Merge(small)
+	s.Merge(large)
+
+	// the median comes from the summary having the most values
+	assert.Equal(int64(1000), s.N)
+	assert.InDelta(1400, s.Quantile(0.5), 20)
+}
+
+func TestMergeWeighted(t *testing.T) {
+	assert := assert.New(t)
+
+	newSummary := func(from int) *SliceSummary {
+		s := NewSliceSummary()
+		for i := 0; i < 1000; i++ {
+			s.Insert(float64(from+i), 0)
+		}
+		return s
+	}
+	old, recent := newSummary(0), newSummary(1000)
+
+	plain := NewSliceSummary()
+	plain.Merge(old)
+	plain.Merge(recent)
+	assert.InDelta(1000, plain.Quantile(0.5), 20)
+
+	// decaying the old summary shifts the quantiles toward the recent one
+	decayed := NewSliceSummary()
+	decayed.MergeWeighted(old, 0.1)
+	decayed.MergeWeighted(recent, 1)
+	assert.InEpsilon(1100, decayed.N, 0.05)
+	assert.InDelta(1450, decayed.Quantile(0.5), 30)
+	assert.True(decayed.Quantile(0.5) > plain.Quantile(0.5))
+	assert.Nil(decayed.CheckInvariant())
+
+	// nothing to merge without weight
+	decayed.MergeWeighted(old, 0)
+	assert.InEpsilon(1100, decayed.N, 0.05)
+}
+
+func TestMergeWeightedLargeN(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSliceSummary()
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i), 0)
+	}
+
+	// a long-lived summary, of more values than a 32 bits int can count,
+	// without inserting them all
+	big := NewSliceSummary()
+	require.NoError(t, big.MergeWeighted(s, 1e7))
+	assert.True(big.N > math.MaxUint32, "N=%d", big.N)
+	for i := 0; i < 1000; i++ {
+		big.Insert(float64(i), 0)
+	}
+
+	var total int64
+	for _, e := range big.Entries {
+		assert.True(e.G >= 0 && e.Delta >= 0, "%+v", e)
+		total += e.G
+	}
+	assert.Equal(big.N, total)
+	assert.NoError(big.CheckInvariant())
+	for _, q := range testQuantiles {
+		assert.InDelta(q*1000, big.Quantile(q), 2*EPSILON*1000+1, "quantile %v", q)
+	}
+}
@@ -0,0 +1,84 @@
+package quantile
+
+import "math"
+
+// WindowSliceSummary is a summary of the last inserted values only, for
+// sliding-window distributions. A GK summary cannot forget a value, so the
+// window is a ring of sub-summaries, each holding a fixed number of
+// consecutive values: once the ring is full, the oldest sub-summary is
+// dropped to make room for the new values. Queries merge the sub-summaries.
+//
+// The window moves by whole sub-summaries: it holds between n-n/buckets and n
+// of the last values, see NewWindowSliceSummary. Each sub-summary is an
+// EPSILON estimate of its values, and merging them without intermediate
+// compressions keeps the merged summary an EPSILON estimate of the window.
+type WindowSliceSummary struct {
+	buckets []*SliceSummary
+	size    int // values per bucket
+	cur     int // index of the bucket values are inserted in
+}
+
+// NewWindowSliceSummary returns a summary of about the last n values,
+// dropped by chunks of n/buckets. The more buckets, the smoother the window
+// moves, but the slower the queries.
+func NewWindowSliceSummary(n, buckets int) *WindowSliceSummary {
+	if buckets < 1 {
+		buckets = 1
+	}
+	size := n / buckets
+	if size < 1 {
+		size = 1
+	}
+
+	w := &WindowSliceSummary{
+		buckets: make([]*SliceSummary, buckets),
+		size:    size,
+	}
+	for i := range w.buckets {
+		w.buckets[i] = NewSliceSummary()
+	}
+	return w
+}
+
+// Insert inserts a new value v in the window paired with t (the ID of the span
+// it was reported from), dropping the oldest values if the window is full
+func (w *WindowSliceSummary) Insert(v float64, t uint64) {
+	if w.buckets[w.cur].N >= int64(w.size) {
+		w.cur = (w.cur + 1) % len(w.buckets)
+		w.buckets[w.cur] = NewSliceSummary()
+	}
+	w.buckets[w.cur].Insert(v, t)
+}
+
+// N returns the number of values in the window
+func (w *WindowSliceSummary) N() int64 {
+	var n int64
+	for _, b := range w.buckets {
+		n += b.N
+	}
+	return n
+}
+
+// Quantile returns an EPSILON estimate of the element at quantile 'q'
+// (0 <= q <= 1) of the values in the window, NaN if they cannot be merged,
+// see Snapshot
+func (w *WindowSliceSummary) Quantile(q float64) float64 {
+	s, err := w.Snapshot()
+	if err != nil {
+		return math.NaN()
+	}
+	return s.Quantile(q)
+}
+
+// Snapshot returns a summary of the values in the window, or an error if its
+// sub-summaries cannot be merged
+func (w *WindowSliceSummary) Snapshot() (*SliceSummary, error) {
+	s := NewSliceSummary()
+	for _, b := range w.buckets {
+		if err := s.MergeNoCompress(b); err != nil {
+			return nil, err
+		}
+	}
+	s.Compact()
+	return s, nil
+}
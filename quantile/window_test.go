@@ -0,0 +1,59 @@
+package quantile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowSliceSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	w := NewWindowSliceSummary(1000, 10)
+	assert.Equal(int64(0), w.N())
+	assert.Equal(0.0, w.Quantile(0.5))
+
+	for i := 0; i < 1000; i++ {
+		w.Insert(1000+float64(i%100), uint64(i))
+	}
+	assert.Equal(int64(1000), w.N())
+	assert.InDelta(1050, w.Quantile(0.5), 100*EPSILON*10)
+
+	// half of the window rolled, the old values are still half of the quantiles
+	for i := 0; i < 500; i++ {
+		w.Insert(float64(i%100), uint64(i))
+	}
+	assert.True(w.N() <= 1000, "%d values", w.N())
+	assert.Equal(1099.0, w.Quantile(1))
+	assert.Equal(0.0, w.Quantile(0))
+
+	// once the window rolled, the old values aged out
+	for i := 0; i < 1000; i++ {
+		w.Insert(float64(i%100), uint64(i))
+	}
+	assert.Equal(int64(1000), w.N())
+	assert.Equal(99.0, w.Quantile(1))
+	assert.InDelta(50, w.Quantile(0.5), 100*EPSILON*10)
+
+	s, err := w.Snapshot()
+	assert.NoError(err)
+	assert.Equal(int64(1000), s.N)
+	assert.NoError(s.CheckInvariant())
+}
+
+func TestWindowSliceSummaryRollsByBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	w := NewWindowSliceSummary(100, 4)
+	for i := 0; i < 100; i++ {
+		w.Insert(float64(i), uint64(i))
+	}
+	assert.Equal(int64(100), w.N())
+	assert.Equal(0.0, w.Quantile(0))
+
+	// the next value drops the oldest bucket, the 25 first values
+	w.Insert(100, 100)
+	assert.Equal(int64(76), w.N())
+	assert.Equal(25.0, w.Quantile(0))
+	assert.Equal(100.0, w.Quantile(1))
+}
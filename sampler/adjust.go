@@ -6,6 +6,9 @@ import (
 
 // AdjustScoring modifies sampler coefficients to fit better the `maxTPS` condition
 func (s *Sampler) AdjustScoring() {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+
 	currentTPS := s.Backend.GetSampledScore()
 	totalTPS := s.Backend.GetTotalScore()
 	offset := s.signatureScoreOffset
@@ -13,7 +16,7 @@ func (s *Sampler) AdjustScoring() {
 
 	newOffset, newSlope := adjustCoefficients(currentTPS, totalTPS, s.maxTPS, offset, cardinality)
 
-	s.SetSignatureCoefficients(newOffset, newSlope)
+	s.setSignatureCoefficients(newOffset, newSlope)
 }
 
 func adjustCoefficients(currentTPS, totalTPS, maxTPS, offset, cardinality float64) (newOffset, newSlope float64) {
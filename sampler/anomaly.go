@@ -0,0 +1,139 @@
+package sampler
+
+import (
+	"container/list"
+	"math"
+	"sync"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+const (
+	// Weight of the last trace in the moving averages of a signature, the
+	// baseline adapts to a lasting change after a few dozens of traces
+	anomalyAlpha float64 = 0.05
+	// Number of traces a signature needs before its traces are judged
+	anomalyMinBaseline int = 20
+	// Traces of signatures erroring less often than this are anomalies when
+	// they error
+	anomalyMaxErrorRate float64 = 0.05
+	// Maximum number of signatures tracked at once, the least recently seen
+	// one is forgotten for a new one once reached
+	anomalyMaxSignatures int = 10000
+)
+
+// anomalyBaseline is the moving average, and variance, of the root duration
+// and the error rate of the traces of a signature
+type anomalyBaseline struct {
+	signature Signature
+	count     int
+	mean      float64
+	variance  float64
+	errorRate float64
+}
+
+// anomalyScorer boosts the score of the traces whose root deviates from the
+// recent traces of its signature: way slower, or erroring when the signature
+// usually does not. It captures incidents as they start, before their traces
+// become frequent enough to be sampled down.
+type anomalyScorer struct {
+	threshold float64 // in standard deviations of the root duration
+	boost     float64
+
+	baselines map[Signature]*list.Element
+	lru       *list.List // of *anomalyBaseline, most recently seen first
+	mu        sync.Mutex
+}
+
+func newAnomalyScorer(threshold, boost float64) *anomalyScorer {
+	return &anomalyScorer{
+		threshold: threshold,
+		boost:     boost,
+		baselines: make(map[Signature]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// Score returns the factor to apply to the sample rate of the trace, boost if
+// it is an anomaly and 1 otherwise. It does not change the baseline, see
+// Observe.
+func (a *anomalyScorer) Score(root *model.Span, signature Signature) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	elem, ok := a.baselines[signature]
+	if !ok {
+		return 1
+	}
+	b := elem.Value.(*anomalyBaseline)
+	if b.count < anomalyMinBaseline {
+		return 1
+	}
+
+	duration := float64(root.Duration)
+	stddev := math.Sqrt(b.variance)
+	slow := duration-b.mean > a.threshold*stddev && duration > b.mean
+	rareError := root.Error != 0 && b.errorRate < anomalyMaxErrorRate
+	if slow || rareError {
+		return a.boost
+	}
+	return 1
+}
+
+// Observe adds the trace to the baseline of its signature, forgetting the
+// least recently seen signature if there are too many
+func (a *anomalyScorer) Observe(root *model.Span, signature Signature) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var b *anomalyBaseline
+	if elem, ok := a.baselines[signature]; ok {
+		a.lru.MoveToFront(elem)
+		b = elem.Value.(*anomalyBaseline)
+	} else {
+		b = &anomalyBaseline{signature: signature}
+		a.baselines[signature] = a.lru.PushFront(b)
+		if a.lru.Len() > anomalyMaxSignatures {
+			oldest := a.lru.Back()
+			a.lru.Remove(oldest)
+			delete(a.baselines, oldest.Value.(*anomalyBaseline).signature)
+		}
+	}
+
+	b.add(float64(root.Duration), root.Error != 0)
+}
+
+// add adds a trace to the moving averages, see
+// https://en.wikipedia.org/wiki/Moving_average#Exponentially_weighted_moving_variance_and_standard_deviation
+func (b *anomalyBaseline) add(duration float64, isError bool) {
+	var errorValue float64
+	if isError {
+		errorValue = 1
+	}
+
+	if b.count == 0 {
+		b.mean = duration
+		b.errorRate = errorValue
+	} else {
+		diff := duration - b.mean
+		incr := anomalyAlpha * diff
+		b.mean += incr
+		b.variance = (1 - anomalyAlpha) * (b.variance + diff*incr)
+		b.errorRate += anomalyAlpha * (errorValue - b.errorRate)
+	}
+	b.count++
+}
+
+// UpdateAnomalyBoost multiplies the sample rate of the traces whose root is
+// slower by more than threshold standard deviations than the recent traces of
+// its signature, or which error when their signature rarely does, by boost.
+// A boost <= 1 disables it.
+func (s *Sampler) UpdateAnomalyBoost(threshold, boost float64) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	if boost <= 1 {
+		s.anomaly = nil
+		return
+	}
+	s.anomaly = newAnomalyScorer(threshold, boost)
+}
@@ -0,0 +1,138 @@
+package sampler
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestAnomalyScorer(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAnomalyScorer(3, 10)
+	r := rand.New(rand.NewSource(42))
+	root := func(duration int64, isError bool) *model.Span {
+		s := &model.Span{Duration: duration}
+		if isError {
+			s.Error = 1
+		}
+		return s
+	}
+	var signature Signature = 42
+	// judges a trace, then adds it to the baseline as the sampler does
+	judge := func(root *model.Span, signature Signature) float64 {
+		score := a.Score(root, signature)
+		a.Observe(root, signature)
+		return score
+	}
+
+	// no baseline yet, nothing is judged
+	assert.Equal(1.0, judge(root(100e6, false), signature))
+
+	// a baseline of about 10ms
+	for i := 0; i < 200; i++ {
+		judge(root(int64(10e6+r.Intn(1e6)), false), signature)
+	}
+	normal := judge(root(10.5e6, false), signature)
+	assert.Equal(1.0, normal)
+
+	// an outlier scores higher, be it slower or erroring
+	assert.Equal(10.0, judge(root(50e6, false), signature))
+	assert.Equal(10.0, judge(root(10.5e6, true), signature))
+	// faster is not an anomaly
+	assert.Equal(1.0, judge(root(1e6, false), signature))
+
+	// other signatures have their own baseline
+	assert.Equal(1.0, judge(root(50e6, false), signature+1))
+
+	// a lasting change becomes the new baseline
+	for i := 0; i < 200; i++ {
+		judge(root(int64(50e6+r.Intn(5e6)), false), signature)
+	}
+	assert.Equal(1.0, judge(root(52e6, false), signature))
+}
+
+func TestSamplerAnomalyBoost(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	s.UpdateAnomalyBoost(3, 10)
+
+	trace, root := getTestTrace()
+	signature := computeSignature(trace, root, defaultEnv, s.signatureOptions)
+	// a frequent signature, sampled well below 1/10
+	for i := 0; i < 20000; i++ {
+		s.Backend.CountSignature(signature)
+	}
+	s.Backend.DecayScore()
+
+	for i := 0; i < 100; i++ {
+		s.anomaly.Observe(root, signature)
+	}
+	normal := s.GetSampleRate(trace, root, signature)
+
+	root.Duration *= 10
+	outlier := s.GetSampleRate(trace, root, signature)
+	assert.True(normal < 0.1, "normal: %f", normal)
+	assert.True(outlier > normal, "outlier: %f, normal: %f", outlier, normal)
+	assert.InDelta(10*normal, outlier, 1e-9)
+
+	// disabled
+	s.UpdateAnomalyBoost(3, 0)
+	assert.Equal(normal, s.GetSampleRate(trace, root, signature))
+}
+
+func TestAnomalyScorerScoreOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAnomalyScorer(3, 10)
+	root := &model.Span{Duration: 10e6}
+	var signature Signature = 42
+
+	// scoring alone builds no baseline
+	for i := 0; i < 2*anomalyMinBaseline; i++ {
+		a.Score(root, signature)
+	}
+	assert.Len(a.baselines, 0)
+	for i := 0; i < 2*anomalyMinBaseline; i++ {
+		a.Observe(root, signature)
+	}
+	assert.Equal(10.0, a.Score(&model.Span{Duration: 50e6}, signature))
+	assert.Equal(2*anomalyMinBaseline, a.baselines[signature].Value.(*anomalyBaseline).count)
+}
+
+func TestAnomalyScorerEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAnomalyScorer(3, 10)
+	root := &model.Span{Duration: 10e6}
+	for i := 0; i < anomalyMaxSignatures; i++ {
+		a.Observe(root, Signature(i))
+	}
+	// refreshed, the oldest is now the second one
+	a.Observe(root, Signature(0))
+
+	// a new signature gets a baseline, the least recently seen is forgotten
+	a.Observe(root, Signature(anomalyMaxSignatures))
+	assert.Len(a.baselines, anomalyMaxSignatures)
+	assert.Contains(a.baselines, Signature(0))
+	assert.Contains(a.baselines, Signature(anomalyMaxSignatures))
+	assert.NotContains(a.baselines, Signature(1))
+}
+
+func TestSamplerAnomalyObserve(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	s.UpdateAnomalyBoost(3, 10)
+
+	// every sampled trace is observed once, whatever decided its fate
+	trace, root := getTestTrace()
+	root.Metrics = map[string]float64{model.SpanSamplingPriorityMetricKey: PriorityUserKeep}
+	signature := computeSignature(trace, root, defaultEnv, s.signatureOptions)
+	s.Sample(trace, root, defaultEnv)
+	assert.Equal(1, s.anomaly.baselines[signature].Value.(*anomalyBaseline).count)
+}
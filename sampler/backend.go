@@ -5,19 +5,31 @@ import (
 	"time"
 )
 
+// defaultBackendShards is the number of shards the signature scores are spread over,
+// to reduce lock contention when many traces are sampled concurrently.
+const defaultBackendShards = 32
+
+// backendShard holds the scores of a subset of the signatures
+type backendShard struct {
+	scores map[Signature]float64
+	mu     sync.Mutex
+}
+
 // Backend storing any state required to run the sampling algorithms.
 //
 // Current implementation is only based on counters with polynomial decay.
 // Its bias with steady counts is 1 * decayFactor.
 // The stored scores represent approximation of the real count values (with a countScaleFactor factor).
 type Backend struct {
-	// Score per signature
-	scores map[Signature]float64
+	// Score per signature, sharded by signature
+	shards []backendShard
 	// Score of all traces (equals the sum of all signature scores)
 	totalScore float64
 	// Score of sampled traces
 	sampledScore float64
-	mu           sync.Mutex
+	// Signatures counted while not seen recently, since the last FlushNewSignatures
+	newSignatures int64
+	mu            sync.Mutex // protects totalScore, sampledScore and newSignatures
 
 	// Every decayPeriod, decay the score
 	// Lower value is more reactive, but forgets quicker
@@ -36,12 +48,21 @@ type Backend struct {
 
 // NewBackend returns an initialized Backend
 func NewBackend(decayPeriod time.Duration) *Backend {
+	return newBackendWithShards(decayPeriod, defaultBackendShards)
+}
+
+func newBackendWithShards(decayPeriod time.Duration, nbShards int) *Backend {
 	// With this factor, any past trace counts for less than 50% after 6*decayPeriod and >1% after 39*decayPeriod
 	// We can keep it hardcoded, but having `decayPeriod` configurable should be enough?
 	decayFactor := 1.125 // 9/8
 
+	shards := make([]backendShard, nbShards)
+	for i := range shards {
+		shards[i].scores = make(map[Signature]float64)
+	}
+
 	return &Backend{
-		scores:           make(map[Signature]float64),
+		shards:           shards,
 		sampledScore:     0,
 		decayPeriod:      decayPeriod,
 		decayFactor:      decayFactor,
@@ -70,11 +91,37 @@ func (b *Backend) Stop() {
 	close(b.exit)
 }
 
+// shard returns the shard holding the score of a signature
+func (b *Backend) shard(signature Signature) *backendShard {
+	return &b.shards[uint64(signature)%uint64(len(b.shards))]
+}
+
+// lockShards locks all the shards, always in the same order to avoid deadlocks
+func (b *Backend) lockShards() {
+	for i := range b.shards {
+		b.shards[i].mu.Lock()
+	}
+}
+
+func (b *Backend) unlockShards() {
+	for i := range b.shards {
+		b.shards[i].mu.Unlock()
+	}
+}
+
 // CountSignature counts an incoming signature
 func (b *Backend) CountSignature(signature Signature) {
+	shard := b.shard(signature)
+	shard.mu.Lock()
+	_, seen := shard.scores[signature]
+	shard.scores[signature]++
+	shard.mu.Unlock()
+
 	b.mu.Lock()
-	b.scores[signature]++
 	b.totalScore++
+	if !seen {
+		b.newSignatures++
+	}
 	b.mu.Unlock()
 }
 
@@ -88,9 +135,10 @@ func (b *Backend) CountSample() {
 // GetSignatureScore returns the score of a signature.
 // It is normalized to represent a number of signatures per second.
 func (b *Backend) GetSignatureScore(signature Signature) float64 {
-	b.mu.Lock()
-	score := b.scores[signature] / b.countScaleFactor
-	b.mu.Unlock()
+	shard := b.shard(signature)
+	shard.mu.Lock()
+	score := shard.scores[signature] / b.countScaleFactor
+	shard.mu.Unlock()
 
 	return score
 }
@@ -121,25 +169,47 @@ func (b *Backend) GetUpperSampledScore() float64 {
 
 // GetCardinality returns the number of different signatures seen recently.
 func (b *Backend) GetCardinality() int64 {
+	var cardinality int64
+	b.lockShards()
+	for i := range b.shards {
+		cardinality += int64(len(b.shards[i].scores))
+	}
+	b.unlockShards()
+
+	return cardinality
+}
+
+// FlushNewSignatures returns the number of signatures counted since the last
+// call which were not seen recently, that is new ones or ones whose score
+// decayed away. A jump means new signatures keep appearing, like with a
+// resource holding an ID, which grows the cardinality.
+func (b *Backend) FlushNewSignatures() int64 {
 	b.mu.Lock()
-	cardinality := int64(len(b.scores))
+	n := b.newSignatures
+	b.newSignatures = 0
 	b.mu.Unlock()
 
-	return cardinality
+	return n
 }
 
 // DecayScore applies the decay to the rolling counters
 func (b *Backend) DecayScore() {
-	b.mu.Lock()
-	for sig := range b.scores {
-		score := b.scores[sig]
-		if score > b.decayFactor*minSignatureScoreOffset {
-			b.scores[sig] /= b.decayFactor
-		} else {
-			// When the score is too small, we can optimize by simply dropping the entry
-			delete(b.scores, sig)
+	// Hold all the shards so that every signature decays in the same step
+	b.lockShards()
+	for i := range b.shards {
+		scores := b.shards[i].scores
+		for sig, score := range scores {
+			if score > b.decayFactor*minSignatureScoreOffset {
+				scores[sig] /= b.decayFactor
+			} else {
+				// When the score is too small, we can optimize by simply dropping the entry
+				delete(scores, sig)
+			}
 		}
 	}
+	b.unlockShards()
+
+	b.mu.Lock()
 	b.totalScore /= b.decayFactor
 	b.sampledScore /= b.decayFactor
 	b.mu.Unlock()
@@ -90,3 +90,75 @@ func TestCountScoreOblivion(t *testing.T) {
 
 	assert.True(backend.GetSignatureScore(sign) < 0.01*float64(tracesPerPeriod))
 }
+
+func TestBackendShards(t *testing.T) {
+	assert := assert.New(t)
+	backend := getTestBackend()
+
+	signatures := make([]Signature, 1000)
+	for i := range signatures {
+		signatures[i] = Signature(i)
+		backend.CountSignature(signatures[i])
+	}
+
+	assert.Equal(int64(len(signatures)), backend.GetCardinality())
+	for _, sign := range signatures {
+		assert.True(backend.GetSignatureScore(sign) > 0.0)
+	}
+
+	// decaying enough times expires the signatures of all the shards
+	for i := 0; i < 100; i++ {
+		backend.DecayScore()
+	}
+	assert.Equal(int64(0), backend.GetCardinality())
+}
+
+func benchmarkBackendParallel(b *testing.B, nbShards int) {
+	backend := newBackendWithShards(5*time.Second, nbShards)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		sign := randomSignature()
+		for pb.Next() {
+			backend.CountSignature(sign)
+			backend.GetSignatureScore(sign)
+			sign++
+		}
+	})
+}
+
+func BenchmarkBackendParallelSingleShard(b *testing.B) {
+	benchmarkBackendParallel(b, 1)
+}
+
+func BenchmarkBackendParallel(b *testing.B) {
+	benchmarkBackendParallel(b, defaultBackendShards)
+}
+
+func TestBackendNewSignatures(t *testing.T) {
+	assert := assert.New(t)
+	backend := getTestBackend()
+
+	// a burst of new signatures, counted twice each
+	for i := 0; i < 100; i++ {
+		backend.CountSignature(Signature(i))
+		backend.CountSignature(Signature(i))
+	}
+	assert.Equal(int64(100), backend.FlushNewSignatures())
+	assert.Equal(int64(0), backend.FlushNewSignatures(), "reset by the flush")
+
+	// repeated signatures are not new
+	for i := 0; i < 100; i++ {
+		backend.CountSignature(Signature(i % 10))
+	}
+	assert.Equal(int64(0), backend.FlushNewSignatures())
+
+	// decayed away, they are new again
+	for i := 0; i < 100; i++ {
+		backend.DecayScore()
+	}
+	backend.CountSignature(Signature(1))
+	backend.CountSignature(Signature(1000))
+	assert.Equal(int64(2), backend.FlushNewSignatures())
+}
@@ -0,0 +1,16 @@
+package sampler
+
+import "time"
+
+// Clock tells the current time, so that time-dependent logic can be driven
+// by tests instead of relying on sleeps
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the Clock telling the actual time, used by default
+var SystemClock Clock = systemClock{}
@@ -0,0 +1,100 @@
+package sampler
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+const (
+	// maxResourcesPerService is how many resources of a service are reported
+	// at flush, the most seen ones, the others are summed up as OtherResource
+	maxResourcesPerService = 20
+	// maxCountedResourcesPerService is how many resources of a service are
+	// counted between two flushes, the next ones count as OtherResource
+	maxCountedResourcesPerService = 1000
+)
+
+// OtherResource is the resource the traces of the least seen resources of a
+// service are counted under, to bound the cardinality of the counts
+const OtherResource = "other"
+
+// ServiceResource identifies traces by the service and resource of their root
+type ServiceResource struct {
+	Service  string
+	Resource string
+}
+
+// TraceCounts is the number of traces seen per root service and resource
+type TraceCounts map[ServiceResource]int64
+
+// traceCounter counts the traces per root service and resource between two flushes.
+// Like decayed signatures, keys which are not seen anymore are forgotten: the counts
+// are reset at every flush, which bounds the cardinality to a single flush period.
+type traceCounter struct {
+	counts    TraceCounts
+	resources map[string]int // distinct resources counted per service
+	mu        sync.Mutex
+}
+
+func newTraceCounter() *traceCounter {
+	return &traceCounter{counts: make(TraceCounts), resources: make(map[string]int)}
+}
+
+// Count counts a trace knowing its root
+func (c *traceCounter) Count(root *model.Span) {
+	key := ServiceResource{Service: root.Service, Resource: root.Resource}
+
+	c.mu.Lock()
+	if _, ok := c.counts[key]; !ok {
+		if c.resources[key.Service] >= maxCountedResourcesPerService {
+			key.Resource = OtherResource
+		} else {
+			c.resources[key.Service]++
+		}
+	}
+	c.counts[key]++
+	c.mu.Unlock()
+}
+
+// Flush returns the counts since the last flush and resets them, keeping the
+// maxResourcesPerService most seen resources of each service
+func (c *traceCounter) Flush() TraceCounts {
+	c.mu.Lock()
+	counts := c.counts
+	c.counts = make(TraceCounts, len(counts))
+	c.resources = make(map[string]int, len(c.resources))
+	c.mu.Unlock()
+
+	return topResources(counts, maxResourcesPerService)
+}
+
+// topResources returns counts with only the n most seen resources of each
+// service, the others summed up as OtherResource
+func topResources(counts TraceCounts, n int) TraceCounts {
+	byService := make(map[string][]ServiceResource)
+	for key := range counts {
+		if key.Resource != OtherResource {
+			byService[key.Service] = append(byService[key.Service], key)
+		}
+	}
+
+	for _, keys := range byService {
+		if len(keys) <= n {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if counts[keys[i]] != counts[keys[j]] {
+				return counts[keys[i]] > counts[keys[j]]
+			}
+			return keys[i].Resource < keys[j].Resource
+		})
+		for _, key := range keys[n:] {
+			counts[ServiceResource{Service: key.Service, Resource: OtherResource}] += counts[key]
+			delete(counts, key)
+		}
+	}
+
+	return counts
+}
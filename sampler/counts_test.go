@@ -0,0 +1,73 @@
+package sampler
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestFlushTraceCounts(t *testing.T) {
+	assert := assert.New(t)
+	s := getTestSampler()
+
+	fed := map[ServiceResource]int64{
+		{Service: "mcnulty", Resource: "GET /"}:     10,
+		{Service: "mcnulty", Resource: "POST /"}:    3,
+		{Service: "bunk", Resource: "SELECT 1"}:     7,
+		{Service: "bunk", Resource: "SELECT 1 + 1"}: 1,
+	}
+
+	for key, n := range fed {
+		for i := int64(0); i < n; i++ {
+			trace, root := getTestTrace()
+			for j := range trace {
+				trace[j].Service = key.Service
+			}
+			root.Resource = key.Resource
+			s.Sample(trace, root, defaultEnv)
+		}
+	}
+
+	assert.Equal(TraceCounts(fed), s.FlushTraceCounts())
+
+	// counts are reset at flush
+	assert.Len(s.FlushTraceCounts(), 0)
+}
+
+func TestTraceCounterTopResources(t *testing.T) {
+	assert := assert.New(t)
+	c := newTraceCounter()
+
+	// resource i is seen i+1 times
+	for i := 0; i < maxResourcesPerService+5; i++ {
+		for j := 0; j <= i; j++ {
+			c.Count(&model.Span{Service: "web", Resource: strconv.Itoa(i)})
+		}
+	}
+	c.Count(&model.Span{Service: "db", Resource: "SELECT 1"})
+
+	counts := c.Flush()
+	assert.Len(counts, maxResourcesPerService+2)
+	// the 5 least seen resources are summed up
+	assert.Equal(int64(1+2+3+4+5), counts[ServiceResource{Service: "web", Resource: OtherResource}])
+	assert.Equal(int64(6), counts[ServiceResource{Service: "web", Resource: "5"}])
+	assert.Equal(int64(1), counts[ServiceResource{Service: "db", Resource: "SELECT 1"}])
+}
+
+func TestTraceCounterMaxCountedResources(t *testing.T) {
+	assert := assert.New(t)
+	c := newTraceCounter()
+
+	for i := 0; i < maxCountedResourcesPerService+10; i++ {
+		c.Count(&model.Span{Service: "web", Resource: strconv.Itoa(i)})
+	}
+	// already counted resources are still counted on their own
+	c.Count(&model.Span{Service: "web", Resource: "0"})
+
+	assert.Len(c.counts, maxCountedResourcesPerService+1)
+	assert.Equal(int64(10), c.counts[ServiceResource{Service: "web", Resource: OtherResource}])
+	assert.Equal(int64(2), c.counts[ServiceResource{Service: "web", Resource: "0"}])
+}
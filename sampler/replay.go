@@ -0,0 +1,111 @@
+package sampler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// ReadTraces decodes traces serialized in JSON, such as traces captured from
+// an application: either an array of traces or one trace per line
+func ReadTraces(r io.Reader) ([]model.Trace, error) {
+	var traces []model.Trace
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return traces, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode traces: %v", err)
+		}
+
+		// a trace is an array of spans, which an array of traces is not
+		var batch []model.Trace
+		if err := json.Unmarshal(raw, &batch); err == nil {
+			traces = append(traces, batch...)
+			continue
+		}
+		var trace model.Trace
+		if err := json.Unmarshal(raw, &trace); err != nil {
+			return nil, fmt.Errorf("cannot decode trace %d: %v", len(traces), err)
+		}
+		traces = append(traces, trace)
+	}
+}
+
+// ReplayStats sums up the replay of traces through a sampler
+type ReplayStats struct {
+	Seen  int
+	Kept  int
+	State InternalState
+}
+
+// replayClock is the Clock of a replay, telling the time of the trace
+// being replayed
+type replayClock struct {
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time { return c.now }
+
+// Replay runs the traces through s in order, as if each was received when
+// its root ended, and writes the decision taken for each to w, along with
+// the sampler state once done. The time of the traces drives the sampler
+// instead of the wall clock: the scores decay and the coefficients are
+// adjusted as often as they would have been while receiving them, so that
+// a replay gives the same decisions every time. Traces without env get
+// defaultEnv. s must not be running, be it before or during the replay.
+func Replay(w io.Writer, s *Sampler, traces []model.Trace, defaultEnv string) ReplayStats {
+	var stats ReplayStats
+	var clock *replayClock
+	var lastDecay, lastAdjust time.Time
+
+	for _, trace := range traces {
+		root := trace.GetRoot()
+		if root == nil {
+			continue
+		}
+
+		end := time.Unix(0, root.Start+root.Duration)
+		if clock == nil {
+			// keep the remaining warmup, from the time of the first trace
+			s.warmupEnd = end.Add(s.warmupEnd.Sub(s.clock.Now()))
+			clock = &replayClock{now: end}
+			s.clock = clock
+			lastDecay, lastAdjust = end, end
+		}
+		if end.After(clock.now) {
+			clock.now = end
+		}
+		for ; clock.now.Sub(lastDecay) >= s.Backend.decayPeriod; lastDecay = lastDecay.Add(s.Backend.decayPeriod) {
+			s.Backend.DecayScore()
+		}
+		for ; clock.now.Sub(lastAdjust) >= adjustPeriod; lastAdjust = lastAdjust.Add(adjustPeriod) {
+			s.AdjustScoring()
+		}
+
+		env := trace.GetEnv()
+		if env == "" {
+			env = defaultEnv
+		}
+		decision := "drop"
+		if s.Sample(trace, root, env) {
+			decision = "keep"
+			stats.Kept++
+		}
+		stats.Seen++
+		fmt.Fprintf(w, "%s %d %s %s %s\n", decision, root.TraceID, root.Service, root.Name, root.Resource)
+	}
+
+	stats.State = s.GetState()
+	fmt.Fprintf(w, "seen: %d, kept: %d\n", stats.Seen, stats.Kept)
+	fmt.Fprintf(w, "inTPS: %f, outTPS: %f, maxTPS: %f, offset: %f, slope: %f, cardinality: %d\n",
+		stats.State.InTPS, stats.State.OutTPS, stats.State.MaxTPS, stats.State.Offset, stats.State.Slope, stats.State.Cardinality)
+
+	return stats
+}
@@ -0,0 +1,78 @@
+package sampler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// replayFixture holds 4 traces, one per line, spread over a minute
+const replayFixture = `
+[{"service":"web","name":"http.request","resource":"GET /","trace_id":11,"span_id":1,"start":1500000000000000000,"duration":1000000},{"service":"db","name":"query","resource":"SELECT","trace_id":11,"span_id":2,"parent_id":1,"start":1500000000000100000,"duration":500000}]
+[{"service":"web","name":"http.request","resource":"GET /","trace_id":12,"span_id":1,"start":1500000001000000000,"duration":1000000}]
+[{"service":"web","name":"http.request","resource":"GET /","trace_id":13,"span_id":1,"start":1500000030000000000,"duration":1000000,"error":1}]
+[{"service":"web","name":"http.request","resource":"POST /","trace_id":14,"span_id":1,"start":1500000060000000000,"duration":1000000,"meta":{"env":"staging"}}]
+`
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestReadTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	traces, err := ReadTraces(strings.NewReader(replayFixture))
+	assert.NoError(err)
+	if assert.Len(traces, 4) {
+		assert.Len(traces[0], 2)
+		assert.Equal("db", traces[0][1].Service)
+		assert.Equal(uint64(14), traces[3][0].TraceID)
+	}
+
+	// the same traces as an array
+	lines := strings.Split(strings.TrimSpace(replayFixture), "\n")
+	array, err := ReadTraces(strings.NewReader("[" + strings.Join(lines, ",") + "]"))
+	assert.NoError(err)
+	assert.Equal(traces, array)
+
+	_, err = ReadTraces(strings.NewReader(`[{"service":"web"}] {"service":"web"}`))
+	assert.Error(err)
+	traces, err = ReadTraces(strings.NewReader(""))
+	assert.NoError(err)
+	assert.Len(traces, 0)
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	replay := func() (string, ReplayStats) {
+		traces, err := ReadTraces(strings.NewReader(replayFixture))
+		assert.NoError(err)
+
+		s := NewSamplerWithClock(1, 0, fixedClock(time.Unix(1600000000, 0)))
+		s.UpdateWarmup(10*time.Second, 0)
+		var buf bytes.Buffer
+		stats := Replay(&buf, s, traces, "prod")
+		return buf.String(), stats
+	}
+
+	out, stats := replay()
+	// the warmup dropping the 2 first traces started with the replay
+	assert.Equal(`drop 11 web http.request GET /
+drop 12 web http.request GET /
+keep 13 web http.request GET /
+keep 14 web http.request POST /
+seen: 4, kept: 2
+inTPS: 0.043998, outTPS: 0.033184, maxTPS: 0.000000, offset: 0.125000, slope: 3.000000, cardinality: 4
+`, out)
+	assert.Equal(4, stats.Seen)
+	assert.Equal(2, stats.Kept)
+	assert.Equal(int64(4), stats.State.Cardinality)
+
+	// deterministic
+	again, _ := replay()
+	assert.Equal(out, again)
+}
@@ -0,0 +1,21 @@
+package sampler
+
+import "github.com/DataDog/datadog-trace-agent/model"
+
+// UpdateRules sets the rules giving the sample rate of the traces whose root
+// matches them, evaluated in order. Traces matching none are scored.
+func (s *Sampler) UpdateRules(rules []model.SamplingRule) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.rules = rules
+}
+
+// ruleSampleRate returns the rate of the first rule matching root, if any
+func (s *Sampler) ruleSampleRate(root *model.Span) (float64, bool) {
+	for _, r := range s.rules {
+		if r.Match(root) {
+			return r.Rate, true
+		}
+	}
+	return 0, false
+}
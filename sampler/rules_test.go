@@ -0,0 +1,48 @@
+package sampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestSamplingRules(t *testing.T) {
+	assert := assert.New(t)
+
+	rules, err := model.ParseSamplingRules([]string{
+		"http.status_code>=500 => 1",
+		"service=web => 0",
+	})
+	assert.NoError(err)
+
+	s := getTestSampler()
+	s.UpdateRules(rules)
+
+	getTrace := func(service, status string) (model.Trace, *model.Span) {
+		trace, root := getTestTrace()
+		root.Service = service
+		root.Meta = map[string]string{"http.status_code": status}
+		return trace, root
+	}
+
+	// errors are all kept, even for the service whose traces are all dropped
+	for i := 0; i < 100; i++ {
+		trace, root := getTrace("web", "500")
+		assert.True(s.Sample(trace, root, defaultEnv), "errors should be kept")
+		trace, root = getTrace("web", "200")
+		assert.False(s.Sample(trace, root, defaultEnv), "web should be dropped")
+	}
+
+	// without matching rule, the traces are scored and the first ones kept
+	trace, root := getTrace("mcnulty", "200")
+	assert.True(s.Sample(trace, root, defaultEnv))
+
+	// and rules are not scaled by the extra sample rate
+	s.extraRate = 0
+	trace, root = getTrace("mcnulty", "500")
+	assert.True(s.Sample(trace, root, defaultEnv))
+	trace, root = getTrace("mcnulty", "200")
+	assert.False(s.Sample(trace, root, defaultEnv))
+}
@@ -15,8 +15,11 @@ package sampler
 
 import (
 	"math"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
@@ -30,11 +33,23 @@ const (
 	defaultSignatureScoreSlope  float64       = 3
 )
 
+// Sampling priorities a client can set on the root span to override the sampler decision
+const (
+	// PriorityUserDrop tells the trace has to be dropped
+	PriorityUserDrop float64 = -1
+	// PriorityUserKeep tells the trace has to be kept
+	PriorityUserKeep float64 = 2
+)
+
 // Sampler is the main component of the sampling logic
 type Sampler struct {
 	// Storage of the state of the sampler
 	Backend *Backend
 
+	// Guards the sampling parameters below, down to fullSampleBelowTPS, which
+	// can be updated while sampling, like by UpdateExtraRate or AdjustScoring
+	paramsMu sync.RWMutex
+
 	// Extra sampling rate to combine to the existing sampling
 	extraRate float64
 	// Maximum limit to the total number of traces per second to sample
@@ -48,11 +63,57 @@ type Sampler struct {
 	// signatureScoreFactor = math.Pow(signatureScoreSlope, math.Log10(scoreSamplingOffset))
 	signatureScoreFactor float64
 
+	// Honor the sampling priority set by clients on the trace root
+	honorPriority bool
+	// What the signatures cover, like the version of the root span
+	signatureOptions signatureOptions
+	// Memoizes the signatures of the repeating trace shapes, nil if disabled
+	signatureCache *signatureCache
+
+	// Always keep the traces having a span of one of these types
+	keepTypes map[string]struct{}
+	// Keep these traces even when above maxTPS, instead of counting them against it
+	keepTypesBypassMaxTPS bool
+	// Keep the traces having a span tagged with one of these, see UpdateKeepTags
+	keepTags []tagMatcher
+	// Sample rates of the traces whose root matches them, see UpdateRules
+	rules []model.SamplingRule
+	// Boosts the sample rate of the anomalies, see UpdateAnomalyBoost
+	anomaly *anomalyScorer
+	// Keep all the traces of the signatures seen less than this many times
+	// per second, see UpdateFullSampleBelowTPS
+	fullSampleBelowTPS float64
+	// The signatures kept since the last FlushKeptSignatures, nil unless
+	// keeping one trace per signature, see UpdateKeepOnePerSignature
+	keptSignatures   map[Signature]struct{}
+	keptSignaturesMu sync.Mutex
+
+	// Counts the traces per root service and resource
+	counter *traceCounter
+
+	// Tells the current time, to expire the deduplicated trace IDs
+	clock Clock
+
+	// Until warmupEnd, the sample rate is capped to warmupRate: the scores
+	// are empty right after the start, so otherwise every trace is kept
+	warmupEnd  time.Time
+	warmupRate float64
+
 	exit chan struct{}
+	// Guards stopped and the routines count, so that Run and Stop can race
+	lifecycleMu sync.Mutex
+	stopped     bool
+	routines    sync.WaitGroup
 }
 
 // NewSampler returns an initialized Sampler
 func NewSampler(extraRate float64, maxTPS float64) *Sampler {
+	return NewSamplerWithClock(extraRate, maxTPS, SystemClock)
+}
+
+// NewSamplerWithClock is the same as NewSampler, except that it gets the
+// current time from clock
+func NewSamplerWithClock(extraRate float64, maxTPS float64, clock Clock) *Sampler {
 	decayPeriod := defaultDecayPeriod
 
 	s := &Sampler{
@@ -60,6 +121,10 @@ func NewSampler(extraRate float64, maxTPS float64) *Sampler {
 		extraRate: extraRate,
 		maxTPS:    maxTPS,
 
+		honorPriority: true,
+		counter:       newTraceCounter(),
+		clock:         clock,
+
 		exit: make(chan struct{}),
 	}
 
@@ -68,8 +133,38 @@ func NewSampler(extraRate float64, maxTPS float64) *Sampler {
 	return s
 }
 
+// NewSignatureSampler returns a Sampler set up from conf the way the agent
+// sets up its signature engine, e.g. from a config built from code with
+// config.DefaultAgentConfig. If the sampling rules of conf are invalid, the
+// sampler is returned without them, along with the error.
+func NewSignatureSampler(conf *config.AgentConfig) (*Sampler, error) {
+	s := NewSampler(conf.ExtraSampleRate, conf.MaxTPS)
+	s.UpdateHonorPriority(conf.HonorSamplingPriority)
+	s.UpdateKeepTypes(conf.KeepTypes, conf.KeepTypesBypassMaxTPS)
+	s.UpdateKeepTags(conf.KeepTags)
+	s.UpdateSignatureWithVersion(conf.SignatureWithVersion)
+	s.UpdateSignatureIgnoreError(conf.SignatureIgnoreError)
+	s.UpdateSignatureFields(conf.SignatureRootFields, conf.SignatureSpanFields)
+	s.UpdateWarmup(conf.SamplerWarmup, conf.SamplerWarmupRate)
+	s.UpdateAnomalyBoost(conf.AnomalyThreshold, conf.AnomalyBoost)
+	s.UpdateFullSampleBelowTPS(conf.FullSampleBelowTPS)
+	s.UpdateSignatureCache(conf.SignatureCacheSize)
+	s.UpdateKeepOnePerSignature(conf.KeepOnePerSignature)
+
+	rules, err := model.ParseSamplingRules(conf.SamplingRules)
+	s.UpdateRules(rules)
+
+	return s, err
+}
+
 // SetSignatureCoefficients updates the internal scoring coefficients used by the signature scoring
 func (s *Sampler) SetSignatureCoefficients(offset float64, slope float64) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.setSignatureCoefficients(offset, slope)
+}
+
+func (s *Sampler) setSignatureCoefficients(offset float64, slope float64) {
 	s.signatureScoreOffset = offset
 	s.signatureScoreSlope = slope
 	s.signatureScoreFactor = math.Pow(slope, math.Log10(offset))
@@ -77,26 +172,243 @@ func (s *Sampler) SetSignatureCoefficients(offset float64, slope float64) {
 
 // UpdateExtraRate updates the extra sample rate
 func (s *Sampler) UpdateExtraRate(extraRate float64) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
 	s.extraRate = extraRate
 }
 
 // UpdateMaxTPS updates the max TPS limit
 func (s *Sampler) UpdateMaxTPS(maxTPS float64) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
 	s.maxTPS = maxTPS
 }
 
+// UpdateHonorPriority enables or disables honoring client sampling priorities
+func (s *Sampler) UpdateHonorPriority(honorPriority bool) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.honorPriority = honorPriority
+}
+
+// UpdateWarmup caps the sample rate to rate for the given duration, starting
+// now. A zero duration disables the warmup.
+func (s *Sampler) UpdateWarmup(duration time.Duration, rate float64) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.warmupEnd = s.clock.Now().Add(duration)
+	s.warmupRate = rate
+}
+
+// UpdateSignatureWithVersion enables or disables computing signatures per
+// version of the root span, see ComputeSignatureWithVersion
+func (s *Sampler) UpdateSignatureWithVersion(withVersion bool) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.signatureOptions.withVersion = withVersion
+}
+
+// UpdateSignatureIgnoreError enables or disables leaving the error flag of
+// the spans out of the signatures, to sample errors and successes together
+func (s *Sampler) UpdateSignatureIgnoreError(ignoreError bool) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.signatureOptions.ignoreError = ignoreError
+}
+
+// UpdateSignatureFields sets the span fields the signatures cover, of the
+// root and of each span, see config.SignatureFieldService. An empty list
+// keeps the default fields.
+func (s *Sampler) UpdateSignatureFields(rootFields, spanFields []string) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	// the defaults are left nil, for the signature cache to skip them
+	s.signatureOptions.rootFields, s.signatureOptions.spanFields = nil, nil
+	if f := newSignatureFields(rootFields); !f.isDefault(defaultRootFields) {
+		s.signatureOptions.rootFields = f
+	}
+	if f := newSignatureFields(spanFields); !f.isDefault(defaultSpanFields) {
+		s.signatureOptions.spanFields = f
+	}
+}
+
+// UpdateFullSampleBelowTPS keeps all the traces of the signatures whose
+// recent throughput is below tps traces per second, scoring them only once
+// they get busier. Their rate is still scaled by the extra sample rate and
+// capped by the warmup and the max TPS. A tps of 0 disables it.
+func (s *Sampler) UpdateFullSampleBelowTPS(tps float64) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.fullSampleBelowTPS = tps
+}
+
+// UpdateSignatureCache memoizes the signatures of up to size trace shapes,
+// saving their computation for the traces repeating them. A size of 0
+// disables the cache.
+func (s *Sampler) UpdateSignatureCache(size int) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	if size <= 0 {
+		s.signatureCache = nil
+		return
+	}
+	s.signatureCache = newSignatureCache(size)
+}
+
+// UpdateKeepOnePerSignature enables or disables keeping at least one trace
+// of each signature between two calls to FlushKeptSignatures, so that the
+// rare signatures are not all dropped: the first trace of a signature not
+// kept yet is kept, regardless of its score, with the sample rate it came in
+// with. These traces count against the max TPS, and none is kept above it or
+// during the warmup. Traces the clients ask to drop, or dropped by a
+// sampling rule, are still dropped.
+func (s *Sampler) UpdateKeepOnePerSignature(enabled bool) {
+	s.keptSignaturesMu.Lock()
+	if enabled {
+		s.keptSignatures = make(map[Signature]struct{})
+	} else {
+		s.keptSignatures = nil
+	}
+	s.keptSignaturesMu.Unlock()
+}
+
+// FlushKeptSignatures returns the number of distinct signatures kept since
+// the last call, and forgets them, so that the next trace of each is kept
+// again, see UpdateKeepOnePerSignature. It returns 0 if disabled.
+func (s *Sampler) FlushKeptSignatures() int {
+	s.keptSignaturesMu.Lock()
+	defer s.keptSignaturesMu.Unlock()
+
+	if s.keptSignatures == nil {
+		return 0
+	}
+	n := len(s.keptSignatures)
+	s.keptSignatures = make(map[Signature]struct{}, n)
+	return n
+}
+
+// markKept records that a trace of signature is kept, and tells if it is
+// the first one since the last flush. It always returns false if keeping
+// one trace per signature is disabled.
+func (s *Sampler) markKept(signature Signature) bool {
+	s.keptSignaturesMu.Lock()
+	defer s.keptSignaturesMu.Unlock()
+
+	if s.keptSignatures == nil {
+		return false
+	}
+	if _, ok := s.keptSignatures[signature]; ok {
+		return false
+	}
+	s.keptSignatures[signature] = struct{}{}
+	return true
+}
+
+// UpdateKeepTypes sets the span types for which traces are always kept, and
+// whether these traces are subject to the max TPS limit
+func (s *Sampler) UpdateKeepTypes(types []string, bypassMaxTPS bool) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	keepTypes := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			keepTypes[t] = struct{}{}
+		}
+	}
+	s.keepTypes = keepTypes
+	s.keepTypesBypassMaxTPS = bypassMaxTPS
+}
+
+// hasKeepType tells if any span of the trace has one of the types to keep
+func (s *Sampler) hasKeepType(trace model.Trace) bool {
+	if len(s.keepTypes) == 0 {
+		return false
+	}
+	for i := range trace {
+		if _, ok := s.keepTypes[strings.ToLower(trace[i].Type)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tagMatcher matches the spans having the meta key, with the value unless
+// anyValue
+type tagMatcher struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// UpdateKeepTags sets the tags for which traces are kept, subject to the max
+// TPS limit: "key:value" (or "key=value") for the spans whose meta key has
+// this value, or only "key" for the spans having it, whatever its value
+func (s *Sampler) UpdateKeepTags(tags []string) {
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	keepTags := make([]tagMatcher, 0, len(tags))
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		m := tagMatcher{key: t, anyValue: true}
+		if i := strings.IndexAny(t, ":="); i >= 0 {
+			m = tagMatcher{key: strings.TrimSpace(t[:i]), value: strings.TrimSpace(t[i+1:])}
+		}
+		keepTags = append(keepTags, m)
+	}
+	s.keepTags = keepTags
+}
+
+// hasKeepTag tells if any span of the trace has one of the tags to keep
+func (s *Sampler) hasKeepTag(trace model.Trace) bool {
+	if len(s.keepTags) == 0 {
+		return false
+	}
+	for i := range trace {
+		if len(trace[i].Meta) == 0 {
+			continue
+		}
+		for _, m := range s.keepTags {
+			if v, ok := trace[i].Meta[m.key]; ok && (m.anyValue || v == m.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Run runs and block on the Sampler main loop
 func (s *Sampler) Run() {
+	s.lifecycleMu.Lock()
+	if s.stopped {
+		s.lifecycleMu.Unlock()
+		return
+	}
+	s.routines.Add(2)
+	s.lifecycleMu.Unlock()
+
 	watchdog.Go(func() {
+		defer s.routines.Done()
 		s.Backend.Run()
 	})
+	defer s.routines.Done()
 	s.RunAdjustScoring()
 }
 
-// Stop stops the main Run loop
+// Stop stops the main Run loop and waits for all the sampler routines to
+// exit. It can safely be called several times.
 func (s *Sampler) Stop() {
-	s.Backend.Stop()
-	close(s.exit)
+	s.lifecycleMu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		s.Backend.Stop()
+		close(s.exit)
+	}
+	s.lifecycleMu.Unlock()
+
+	s.routines.Wait()
 }
 
 // RunAdjustScoring is the sampler feedback loop to adjust the scoring coefficients
@@ -121,14 +433,77 @@ func (s *Sampler) Sample(trace model.Trace, root *model.Span, env string) bool {
 		return false
 	}
 
-	signature := ComputeSignatureWithRootAndEnv(trace, root, env)
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+
+	var signature Signature
+	if s.signatureCache != nil {
+		signature = s.signatureCache.Signature(trace, root, env, s.signatureOptions)
+	} else {
+		signature = computeSignature(trace, root, env, s.signatureOptions)
+	}
+
+	return s.sampleWithSignature(trace, root, signature)
+}
+
+// SampleWithSignature is the same as Sample, except that it uses a signature
+// already computed upstream instead of computing it again
+func (s *Sampler) SampleWithSignature(trace model.Trace, root *model.Span, signature Signature) bool {
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	return s.sampleWithSignature(trace, root, signature)
+}
+
+func (s *Sampler) sampleWithSignature(trace model.Trace, root *model.Span, signature Signature) bool {
+	// Extra safety, just in case one trace is empty
+	if len(trace) == 0 {
+		return false
+	}
 
 	// Update sampler state by counting this trace
 	s.Backend.CountSignature(signature)
+	s.counter.Count(root)
+	if s.anomaly != nil {
+		// once judged, against the previous traces only
+		defer s.anomaly.Observe(root, signature)
+	}
+
+	if s.honorPriority {
+		if priority, ok := GetTracePriority(root); ok {
+			switch priority {
+			case PriorityUserKeep:
+				s.markKept(signature)
+				s.Backend.CountSample()
+				return true
+			case PriorityUserDrop:
+				return false
+			}
+		}
+	}
 
-	sampleRate := s.GetSampleRate(trace, root, signature)
+	sampled := s.hasKeepType(trace)
 
-	sampled := ApplySampleRate(root, sampleRate)
+	if sampled && s.keepTypesBypassMaxTPS {
+		s.markKept(signature)
+		s.Backend.CountSample()
+		return true
+	}
+
+	if !sampled {
+		// unlike the types, the tags never bypass the max TPS limit
+		sampled = s.hasKeepTag(trace)
+	}
+
+	scored := false
+	incomingRate := GetTraceAppliedSampleRate(root)
+	if !sampled {
+		sampleRate, ok := s.ruleSampleRate(root)
+		if !ok {
+			sampleRate = s.getSampleRate(trace, root, signature)
+			scored = true
+		}
+		sampled = ApplySampleRate(root, sampleRate)
+	}
 
 	if sampled {
 		// Count the trace to allow us to check for the maxTPS limit.
@@ -137,24 +512,108 @@ func (s *Sampler) Sample(trace model.Trace, root *model.Span, env string) bool {
 
 		// Check for the maxTPS limit, and if we require an extra sampling.
 		// No need to check if we already decided not to keep the trace.
-		maxTPSrate := s.GetMaxTPSSampleRate()
+		maxTPSrate := s.maxTPSSampleRate()
 		if maxTPSrate < 1 {
 			sampled = ApplySampleRate(root, maxTPSrate)
 		}
 	}
 
-	return sampled
+	if sampled {
+		s.markKept(signature)
+		return true
+	}
+
+	if scored && s.canForceKeep() && s.markKept(signature) {
+		// The first trace of its signature since the last flush is kept,
+		// whatever its score. It is not sampled, it only stands for itself.
+		// Rules are left to decide.
+		SetTraceAppliedSampleRate(root, incomingRate)
+		s.Backend.CountSample()
+		return true
+	}
+
+	return false
+}
+
+// canForceKeep tells if the first trace of a signature can be kept whatever
+// its score, see UpdateKeepOnePerSignature: not during the warmup, when all
+// the signatures are new, nor above the max TPS, when the cardinality is
+// too high for a trace of each
+func (s *Sampler) canForceKeep() bool {
+	if s.clock.Now().Before(s.warmupEnd) {
+		return false
+	}
+	return s.maxTPSSampleRate() >= 1
+}
+
+// FlushNewSignatures returns the number of signatures not seen recently
+// since the last call, see Backend.FlushNewSignatures
+func (s *Sampler) FlushNewSignatures() int64 {
+	return s.Backend.FlushNewSignatures()
+}
+
+// FlushSignatureCacheStats returns the number of signatures found in the
+// signature cache and computed since the last call, zeros if it is disabled
+func (s *Sampler) FlushSignatureCacheStats() (hits, misses int64) {
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	if s.signatureCache == nil {
+		return 0, 0
+	}
+	return s.signatureCache.Flush()
+}
+
+// TraceSignature returns the signature of a trace as the sampler computes it,
+// with the signature options it was given
+func (s *Sampler) TraceSignature(trace model.Trace) Signature {
+	s.paramsMu.RLock()
+	opts := s.signatureOptions
+	s.paramsMu.RUnlock()
+
+	return computeSignature(trace, trace.GetRoot(), trace.GetEnv(), opts)
+}
+
+// FlushTraceCounts returns the number of traces seen per root service and
+// resource since the last call
+func (s *Sampler) FlushTraceCounts() TraceCounts {
+	return s.counter.Flush()
 }
 
 // GetSampleRate returns the sample rate to apply to a trace.
 func (s *Sampler) GetSampleRate(trace model.Trace, root *model.Span, signature Signature) float64 {
-	sampleRate := s.GetSignatureSampleRate(signature) * s.extraRate
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	return s.getSampleRate(trace, root, signature)
+}
+
+func (s *Sampler) getSampleRate(trace model.Trace, root *model.Span, signature Signature) float64 {
+	var sampleRate float64
+	if s.fullSampleBelowTPS > 0 && s.Backend.GetSignatureScore(signature) < s.fullSampleBelowTPS {
+		// each trace of a low traffic signature is precious
+		sampleRate = 1
+	} else {
+		sampleRate = s.signatureSampleRate(signature)
+		if s.anomaly != nil {
+			sampleRate = math.Min(1, sampleRate*s.anomaly.Score(root, signature))
+		}
+	}
+	sampleRate *= s.extraRate
+
+	if sampleRate > s.warmupRate && s.clock.Now().Before(s.warmupEnd) {
+		sampleRate = s.warmupRate
+	}
 
 	return sampleRate
 }
 
 // GetMaxTPSSampleRate returns an extra sample rate to apply if we are above maxTPS.
 func (s *Sampler) GetMaxTPSSampleRate() float64 {
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	return s.maxTPSSampleRate()
+}
+
+func (s *Sampler) maxTPSSampleRate() float64 {
 	// When above maxTPS, apply an additional sample rate to statistically respect the limit
 	maxTPSrate := 1.0
 	if s.maxTPS > 0 {
@@ -179,6 +638,12 @@ func ApplySampleRate(root *model.Span, sampleRate float64) bool {
 	return SampleByRate(traceID, newRate)
 }
 
+// GetTracePriority returns the sampling priority set by the client on the trace root, if any.
+func GetTracePriority(root *model.Span) (float64, bool) {
+	priority, ok := root.Metrics[model.SpanSamplingPriorityMetricKey]
+	return priority, ok
+}
+
 // GetTraceAppliedSampleRate gets the sample rate the sample rate applied earlier in the pipeline.
 func GetTraceAppliedSampleRate(root *model.Span) float64 {
 	if rate, ok := root.Metrics[model.SpanSampleRateMetricKey]; ok {
@@ -3,6 +3,8 @@ package sampler
 import (
 	"math"
 	"math/rand"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,6 +35,41 @@ func getTestTrace() (model.Trace, *model.Span) {
 	return trace, &trace[0]
 }
 
+func TestNewSignatureSampler(t *testing.T) {
+	assert := assert.New(t)
+
+	// built from code, no file involved
+	conf := config.DefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	conf.ExtraSampleRate = 0.5
+	conf.MaxTPS = 20
+	conf.HonorSamplingPriority = false
+	conf.KeepTypes = []string{"db"}
+	conf.SignatureIgnoreError = true
+	conf.SamplingRules = []string{"service=web => 1"}
+	assert.NoError(conf.Validate())
+
+	s, err := NewSignatureSampler(conf)
+	assert.NoError(err)
+	assert.Equal(0.5, s.extraRate)
+	assert.Equal(20.0, s.maxTPS)
+	assert.False(s.honorPriority)
+	assert.Contains(s.keepTypes, "db")
+	assert.True(s.signatureOptions.ignoreError)
+	assert.Len(s.rules, 1)
+
+	trace, root := getTestTrace()
+	root.Service = "web"
+	assert.True(s.Sample(trace, root, defaultEnv))
+
+	// the sampler is usable even with invalid rules, without them
+	conf.SamplingRules = []string{"service=web"}
+	s, err = NewSignatureSampler(conf)
+	assert.Error(err)
+	assert.NotNil(s)
+	assert.Len(s.rules, 0)
+}
+
 func TestSamplerLoop(t *testing.T) {
 	s := getTestSampler()
 
@@ -53,6 +90,38 @@ func TestSamplerLoop(t *testing.T) {
 	}
 }
 
+func TestSamplerStop(t *testing.T) {
+	assert := assert.New(t)
+
+	before := runtime.NumGoroutine()
+
+	s := getTestSampler()
+	exit := make(chan struct{})
+	go func() {
+		s.Run()
+		close(exit)
+	}()
+	// let Run start its routines
+	time.Sleep(10 * time.Millisecond)
+	assert.True(runtime.NumGoroutine() > before)
+
+	s.Stop()
+	<-exit
+	// idempotent
+	s.Stop()
+
+	// Stop waited for all the routines, only the one which called Run may
+	// still be on its way out
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(before, runtime.NumGoroutine())
+
+	// a stopped sampler does not start again
+	s.Run()
+}
+
 func TestExtraSampleRate(t *testing.T) {
 	assert := assert.New(t)
 
@@ -62,6 +131,8 @@ func TestExtraSampleRate(t *testing.T) {
 
 	// Feed the s with a signature so that it has a < 1 sample rate
 	for i := 0; i < int(1e6); i++ {
+		// a new trace ID each time, else it is deduplicated
+		trace, root := getTestTrace()
 		s.Sample(trace, root, defaultEnv)
 	}
 
@@ -140,6 +211,24 @@ func TestSamplerChainedSampling(t *testing.T) {
 	assert.Equal(0.4, GetTraceAppliedSampleRate(rootAgain))
 }
 
+func TestSampleWithSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	s1 := getTestSampler()
+	s1.UpdateExtraRate(0.5)
+	s2 := getTestSampler()
+	s2.UpdateExtraRate(0.5)
+
+	for i := 0; i < 1000; i++ {
+		trace1, root1 := getTestTrace()
+		trace2 := model.Trace{trace1[0], trace1[1]}
+		root2 := &trace2[0]
+		signature := ComputeSignatureWithRootAndEnv(trace2, root2, defaultEnv)
+
+		assert.Equal(s1.Sample(trace1, root1, defaultEnv), s2.SampleWithSignature(trace2, root2, signature))
+	}
+}
+
 func BenchmarkSampler(b *testing.B) {
 	// Benchmark the resource consumption of many traces sampling
 
@@ -153,12 +242,269 @@ func BenchmarkSampler(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		trace := model.Trace{
-			model.Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: 42, Duration: 1000000000, Service: "mcnulty", Type: "web", Resource: string(rand.Intn(signatureCount))},
-			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 100, Duration: 200000000, Service: "mcnulty", Type: "sql"},
-			model.Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: 150, Duration: 199999000, Service: "master-db", Type: "sql"},
-			model.Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: 500000000, Duration: 500000, Service: "redis", Type: "redis"},
-			model.Span{TraceID: 1, SpanID: 5, ParentID: 1, Start: 700000000, Duration: 700000, Service: "mcnulty", Type: ""},
+			model.Span{TraceID: uint64(i), SpanID: 1, ParentID: 0, Start: 42, Duration: 1000000000, Service: "mcnulty", Type: "web", Resource: string(rand.Intn(signatureCount))},
+			model.Span{TraceID: uint64(i), SpanID: 2, ParentID: 1, Start: 100, Duration: 200000000, Service: "mcnulty", Type: "sql"},
+			model.Span{TraceID: uint64(i), SpanID: 3, ParentID: 2, Start: 150, Duration: 199999000, Service: "master-db", Type: "sql"},
+			model.Span{TraceID: uint64(i), SpanID: 4, ParentID: 1, Start: 500000000, Duration: 500000, Service: "redis", Type: "redis"},
+			model.Span{TraceID: uint64(i), SpanID: 5, ParentID: 1, Start: 700000000, Duration: 700000, Service: "mcnulty", Type: ""},
 		}
 		s.Sample(trace, &trace[0], defaultEnv)
 	}
 }
+
+func TestSamplingPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	// the scoring alone will drop every trace
+	s.extraRate = 0
+
+	for priority, expected := range map[float64]bool{
+		PriorityUserDrop: false,
+		0:                false,
+		1:                false,
+		PriorityUserKeep: true,
+	} {
+		trace, root := getTestTrace()
+		root.Metrics = map[string]float64{model.SpanSamplingPriorityMetricKey: priority}
+		assert.Equal(expected, s.Sample(trace, root, defaultEnv), "priority %v", priority)
+	}
+
+	// without priority, rely on the scoring
+	trace, root := getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv))
+
+	// with hints disabled, user-keep is not honored anymore
+	s.UpdateHonorPriority(false)
+	trace, root = getTestTrace()
+	root.Metrics = map[string]float64{model.SpanSamplingPriorityMetricKey: PriorityUserKeep}
+	assert.False(s.Sample(trace, root, defaultEnv))
+
+	// and user-drop traces can be kept
+	s.extraRate = 1
+	trace, root = getTestTrace()
+	root.Metrics = map[string]float64{model.SpanSamplingPriorityMetricKey: PriorityUserDrop}
+	assert.True(s.Sample(trace, root, defaultEnv))
+}
+
+func TestSamplingKeepTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	// the scoring alone will drop every trace
+	s.extraRate = 0
+
+	trace, root := getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv))
+
+	// any span of the trace can have the type, not only the root
+	s.UpdateKeepTypes([]string{"cache", " SQL"}, true)
+	trace, root = getTestTrace()
+	assert.True(s.Sample(trace, root, defaultEnv))
+
+	s.UpdateKeepTypes([]string{"cache"}, true)
+	trace, root = getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv))
+
+	// so low a max TPS that the extra rate drops everything
+	s.maxTPS = 1e-12
+	s.UpdateKeepTypes([]string{"web"}, true)
+	for i := 0; i < 100; i++ {
+		trace, root = getTestTrace()
+		assert.True(s.Sample(trace, root, defaultEnv), "should bypass max TPS")
+	}
+
+	// when counted against the limit, the traces are subject to it
+	s.UpdateKeepTypes([]string{"web"}, false)
+	for i := 0; i < 100; i++ {
+		trace, root = getTestTrace()
+		assert.False(s.Sample(trace, root, defaultEnv), "should be limited by max TPS")
+	}
+
+	// but still kept below the limit
+	s.maxTPS = 0
+	trace, root = getTestTrace()
+	assert.True(s.Sample(trace, root, defaultEnv))
+}
+
+func TestSamplingKeepTags(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	// the scoring alone will drop every trace
+	s.extraRate = 0
+
+	tagged := func(meta map[string]string) (model.Trace, *model.Span) {
+		trace, root := getTestTrace()
+		trace[1].Meta = meta
+		return trace, root
+	}
+
+	trace, root := tagged(map[string]string{"feature_flag": "x"})
+	assert.False(s.Sample(trace, root, defaultEnv))
+
+	// any span of the trace can have the tag, not only the root
+	s.UpdateKeepTags([]string{"feature_flag:x", " canary "})
+	trace, root = tagged(map[string]string{"feature_flag": "x"})
+	assert.True(s.Sample(trace, root, defaultEnv))
+	trace, root = tagged(map[string]string{"feature_flag": "y"})
+	assert.False(s.Sample(trace, root, defaultEnv))
+	trace, root = tagged(map[string]string{"canary": "whatever"})
+	assert.True(s.Sample(trace, root, defaultEnv))
+	trace, root = getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv))
+
+	s.UpdateKeepTags([]string{"feature_flag=y"})
+	trace, root = tagged(map[string]string{"feature_flag": "y"})
+	assert.True(s.Sample(trace, root, defaultEnv))
+
+	// the traces kept for their tags are subject to the max TPS
+	s.maxTPS = 1e-12
+	for i := 0; i < 100; i++ {
+		trace, root = tagged(map[string]string{"feature_flag": "y"})
+		assert.False(s.Sample(trace, root, defaultEnv), "should be limited by max TPS")
+	}
+}
+
+// fakeClock is a Clock only moving forward when told so
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestSamplerWarmup(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	s := NewSamplerWithClock(1, 0, clock)
+	trace, root := getTestTrace()
+	signature := ComputeSignature(trace)
+
+	// a brand new signature is always kept
+	assert.Equal(1.0, s.GetSampleRate(trace, root, signature))
+
+	s.UpdateWarmup(30*time.Second, 0.1)
+	assert.Equal(0.1, s.GetSampleRate(trace, root, signature))
+	clock.now = clock.now.Add(29 * time.Second)
+	assert.Equal(0.1, s.GetSampleRate(trace, root, signature))
+
+	// lower rates are not affected
+	s.extraRate = 0.05
+	assert.Equal(0.05, s.GetSampleRate(trace, root, signature))
+	s.extraRate = 1
+
+	clock.now = clock.now.Add(time.Second)
+	assert.Equal(1.0, s.GetSampleRate(trace, root, signature))
+
+	// nothing kept while warming up with a zero rate
+	s.UpdateWarmup(time.Minute, 0)
+	for i := 0; i < 100; i++ {
+		trace, root := getTestTrace()
+		assert.False(s.Sample(trace, root, defaultEnv))
+	}
+	// the scores kept growing meanwhile, so the rate is no longer 1
+	clock.now = clock.now.Add(time.Minute)
+	rate := s.GetSampleRate(trace, root, signature)
+	assert.True(rate > 0)
+	assert.Equal(s.GetSignatureSampleRate(signature), rate)
+}
+
+func TestSamplerFullSampleBelowTPS(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	// score aggressively, so that scoring alone drops most of the traces
+	s.SetSignatureCoefficients(0.01, defaultSignatureScoreSlope)
+	s.UpdateFullSampleBelowTPS(1)
+
+	// without decay, the score of a signature grows by 1/countScaleFactor per trace
+	lowRate := int(s.Backend.countScaleFactor) - 1
+	for i := 0; i < lowRate; i++ {
+		trace, root := getTestTrace()
+		assert.True(s.Sample(trace, root, defaultEnv), "trace %d of a low traffic signature dropped", i)
+	}
+
+	// a burst gets it scored
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		trace, root := getTestTrace()
+		if s.Sample(trace, root, defaultEnv) {
+			kept++
+		}
+	}
+	assert.True(kept < 100, "%d traces of the burst kept", kept)
+
+	// which it would have been from the start without the threshold
+	s = getTestSampler()
+	s.SetSignatureCoefficients(0.01, defaultSignatureScoreSlope)
+	kept = 0
+	for i := 0; i < lowRate; i++ {
+		trace, root := getTestTrace()
+		if s.Sample(trace, root, defaultEnv) {
+			kept++
+		}
+	}
+	assert.True(kept < lowRate, "all the traces kept without threshold")
+}
+
+func TestSamplerConcurrentUpdates(t *testing.T) {
+	// run with -race: the parameters are updated while sampling
+	s := getTestSampler()
+	s.UpdateSignatureCache(100)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				trace, root := getTestTrace()
+				s.Sample(trace, root, defaultEnv)
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		s.UpdateExtraRate(float64(j%10) / 10)
+		s.UpdateMaxTPS(float64(j))
+		s.UpdateKeepTags([]string{"feature_flag"})
+		s.UpdateKeepTypes([]string{"db"}, j%2 == 0)
+		s.UpdateRules([]model.SamplingRule{{Rate: 0.5}})
+		s.UpdateSignatureWithVersion(j%2 == 0)
+		s.UpdateAnomalyBoost(3, 2)
+		s.AdjustScoring()
+		s.GetState()
+	}
+	wg.Wait()
+}
+
+func TestSamplerKeepOnePerSignatureRate(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	s := NewSamplerWithClock(0, 0, clock) // drop every trace on its score
+	s.UpdateKeepOnePerSignature(true)
+
+	// the forced keep is not sampled, it keeps the rate the trace came in with
+	trace, root := getTestTrace()
+	root.Metrics = map[string]float64{model.SpanSampleRateMetricKey: 0.5}
+	assert.True(s.Sample(trace, root, defaultEnv))
+	assert.Equal(0.5, GetTraceAppliedSampleRate(root))
+	trace, root = getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv), "once per signature")
+	s.FlushKeptSignatures()
+
+	// nor during the warmup
+	s.UpdateWarmup(time.Minute, 0)
+	trace, root = getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv))
+	clock.now = clock.now.Add(time.Minute)
+	trace, root = getTestTrace()
+	assert.True(s.Sample(trace, root, defaultEnv))
+	s.FlushKeptSignatures()
+
+	// nor above the max TPS, which the forced keeps count against
+	s.UpdateMaxTPS(1e-12)
+	trace, root = getTestTrace()
+	assert.False(s.Sample(trace, root, defaultEnv))
+}
@@ -24,7 +24,13 @@ func SampleByRate(traceID uint64, sampleRate float64) bool {
 // GetSignatureSampleRate gives the sample rate to apply to any signature
 // For now, only based on count score
 func (s *Sampler) GetSignatureSampleRate(signature Signature) float64 {
-	score := s.GetCountScore(signature)
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	return s.signatureSampleRate(signature)
+}
+
+func (s *Sampler) signatureSampleRate(signature Signature) float64 {
+	score := s.countScore(signature)
 
 	if score > 1 {
 		score = 1.0
@@ -37,6 +43,12 @@ func (s *Sampler) GetSignatureSampleRate(signature Signature) float64 {
 // The score value can be seeing as the sample rate if the count were the only factor
 // Since other factors can intervene (such as extra global sampling), its value can be larger than 1
 func (s *Sampler) GetCountScore(signature Signature) float64 {
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	return s.countScore(signature)
+}
+
+func (s *Sampler) countScore(signature Signature) float64 {
 	score := s.Backend.GetSignatureScore(signature)
 
 	return s.signatureScoreFactor / math.Pow(s.signatureScoreSlope, math.Log10(score))
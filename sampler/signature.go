@@ -1,24 +1,156 @@
 package sampler
 
 import (
+	"hash"
 	"hash/fnv"
 	"sort"
+	"strings"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 )
 
 // Signature is a simple representation of trace, used to identify simlar traces
 type Signature uint64
 
+// SignatureVersion identifies the algorithm used to compute signatures. It is
+// stored in the most significant byte of every Signature so that signatures
+// computed by different versions never collide. Bump it whenever a change
+// modifies the signature of any trace.
+const SignatureVersion byte = 1
+
+// versionKey is the meta of the root span holding the version of its service
+const versionKey = "version"
+
+// Version returns the version of the algorithm which computed the signature.
+func (s Signature) Version() byte {
+	return byte(s >> 56)
+}
+
 // ComputeSignatureWithRootAndEnv generates the signature of a trace knowing its root
 // Signature based on the hash of (env, service, name, resource, is_error) for the root, plus the set of
 // (env, service, name, is_error) of each span.
 func ComputeSignatureWithRootAndEnv(trace model.Trace, root *model.Span, env string) Signature {
-	rootHash := computeRootHash(*root, env)
+	return computeSignature(trace, root, env, signatureOptions{})
+}
+
+// ComputeSignatureWithVersion is the same as ComputeSignatureWithRootAndEnv,
+// except that the root hash also covers the version of the root span, so that
+// different versions of a service, like canaries, have different signatures.
+func ComputeSignatureWithVersion(trace model.Trace, root *model.Span, env string) Signature {
+	return computeSignature(trace, root, env, signatureOptions{withVersion: true})
+}
+
+// signatureOptions tells what the signatures cover besides the defaults
+type signatureOptions struct {
+	// the root hash also covers the version of the root span
+	withVersion bool
+	// the hashes do not cover the error flag of the spans, so that errors
+	// and successes of a same endpoint are sampled together
+	ignoreError bool
+	// the fields the hashes cover of the root and of each span, the
+	// defaults if nil
+	rootFields *signatureFields
+	spanFields *signatureFields
+}
+
+// signatureField is a flag of a span field covered by the signatures
+type signatureField uint8
+
+const (
+	signatureService signatureField = 1 << iota
+	signatureName
+	signatureResource
+	signatureError
+	signatureType
+)
+
+// signatureFields is the set of span fields a hash covers, besides the env
+type signatureFields struct {
+	fields   signatureField
+	metaKeys []string
+}
+
+var (
+	defaultRootFields = &signatureFields{fields: signatureService | signatureName | signatureResource | signatureError}
+	defaultSpanFields = &signatureFields{fields: signatureService | signatureName | signatureError}
+)
+
+// newSignatureFields parses names, as validated by config.AgentConfig.Validate,
+// the unknown ones being ignored. It returns nil, the defaults, if there is
+// none.
+func newSignatureFields(names []string) *signatureFields {
+	f := &signatureFields{}
+	for _, name := range names {
+		switch name = strings.TrimSpace(name); name {
+		case config.SignatureFieldService:
+			f.fields |= signatureService
+		case config.SignatureFieldName:
+			f.fields |= signatureName
+		case config.SignatureFieldResource:
+			f.fields |= signatureResource
+		case config.SignatureFieldError:
+			f.fields |= signatureError
+		case config.SignatureFieldType:
+			f.fields |= signatureType
+		default:
+			if key := strings.TrimPrefix(name, config.SignatureFieldMetaPrefix); key != name && key != "" {
+				f.metaKeys = append(f.metaKeys, key)
+			}
+		}
+	}
+	if f.fields == 0 && len(f.metaKeys) == 0 {
+		return nil
+	}
+	return f
+}
+
+// isDefault tells if f covers the same fields as def
+func (f *signatureFields) isDefault(def *signatureFields) bool {
+	return f == nil || (f.fields == def.fields && len(f.metaKeys) == 0)
+}
+
+func (f *signatureFields) has(field signatureField) bool {
+	return f.fields&field != 0
+}
+
+// metaValues returns the values of the meta keys of f in span, joined
+func (f *signatureFields) metaValues(span *model.Span) string {
+	switch len(f.metaKeys) {
+	case 0:
+		return ""
+	case 1:
+		return span.Meta[f.metaKeys[0]]
+	}
+	values := make([]string, len(f.metaKeys))
+	for i, key := range f.metaKeys {
+		values[i] = span.Meta[key]
+	}
+	return strings.Join(values, "\x00")
+}
+
+// rootFieldSet returns the fields the root hash covers
+func (o signatureOptions) rootFieldSet() *signatureFields {
+	if o.rootFields == nil {
+		return defaultRootFields
+	}
+	return o.rootFields
+}
+
+// spanFieldSet returns the fields the hash of each span covers
+func (o signatureOptions) spanFieldSet() *signatureFields {
+	if o.spanFields == nil {
+		return defaultSpanFields
+	}
+	return o.spanFields
+}
+
+func computeSignature(trace model.Trace, root *model.Span, env string, opts signatureOptions) Signature {
+	rootHash := computeRootHash(*root, env, opts)
 	spanHashes := make([]spanHash, 0, len(trace))
 
 	for i := range trace {
-		spanHashes = append(spanHashes, computeSpanHash(trace[i], env))
+		spanHashes = append(spanHashes, computeSpanHash(trace[i], env, opts))
 	}
 
 	// Now sort, dedupe then merge all the hashes to build the signature
@@ -33,7 +165,7 @@ func ComputeSignatureWithRootAndEnv(trace model.Trace, root *model.Span, env str
 		}
 	}
 
-	return Signature(traceHash)
+	return Signature(uint64(SignatureVersion)<<56 | uint64(traceHash))
 }
 
 // ComputeSignature is the same as ComputeSignatureWithRoot, except that it finds the root itself
@@ -44,27 +176,49 @@ func ComputeSignature(trace model.Trace) Signature {
 	return ComputeSignatureWithRootAndEnv(trace, root, env)
 }
 
-func computeSpanHash(span model.Span, env string) spanHash {
+func computeSpanHash(span model.Span, env string, opts signatureOptions) spanHash {
 	h := fnv.New32a()
 	h.Write([]byte(env))
-	h.Write([]byte(span.Service))
-	h.Write([]byte(span.Name))
-	h.Write([]byte{byte(span.Error)})
+	writeFields(h, &span, opts.spanFieldSet(), opts)
 
 	return spanHash(h.Sum32())
 }
 
-func computeRootHash(span model.Span, env string) spanHash {
+func computeRootHash(span model.Span, env string, opts signatureOptions) spanHash {
 	h := fnv.New32a()
 	h.Write([]byte(env))
-	h.Write([]byte(span.Service))
-	h.Write([]byte(span.Name))
-	h.Write([]byte(span.Resource))
-	h.Write([]byte{byte(span.Error)})
+	writeFields(h, &span, opts.rootFieldSet(), opts)
+	if opts.withVersion {
+		// an empty version leaves the hash untouched
+		h.Write([]byte(span.Meta[versionKey]))
+	}
 
 	return spanHash(h.Sum32())
 }
 
+// writeFields hashes the fields of span, always in the same order not to
+// change the signatures of the default fields
+func writeFields(h hash.Hash32, span *model.Span, fields *signatureFields, opts signatureOptions) {
+	if fields.has(signatureService) {
+		h.Write([]byte(span.Service))
+	}
+	if fields.has(signatureName) {
+		h.Write([]byte(span.Name))
+	}
+	if fields.has(signatureResource) {
+		h.Write([]byte(span.Resource))
+	}
+	if fields.has(signatureError) && !opts.ignoreError {
+		h.Write([]byte{byte(span.Error)})
+	}
+	if fields.has(signatureType) {
+		h.Write([]byte(span.Type))
+	}
+	for _, key := range fields.metaKeys {
+		h.Write([]byte(span.Meta[key]))
+	}
+}
+
 // spanHash is the type of the hashes used during the computation of a signature
 // Use FNV for hashing since it is super-cheap and we have no cryptographic needs
 type spanHash uint32
@@ -0,0 +1,163 @@
+package sampler
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// signatureCacheKey is the cheap pre-hash of a trace shape: its root, what
+// depends on the signature options and the number of spans. Traces of a same
+// key can still differ in their other spans, which the entries verify.
+type signatureCacheKey struct {
+	env      string
+	service  string
+	name     string
+	resource string
+	version  string
+	typ      string
+	meta     string
+	err      int32
+	size     int
+	opts     signatureOptions
+}
+
+// spanShape is what the span hashes of a signature depend on
+type spanShape struct {
+	service  string
+	name     string
+	resource string
+	typ      string
+	meta     string
+	err      int32
+}
+
+type signatureCacheEntry struct {
+	key       signatureCacheKey
+	spans     []spanShape
+	signature Signature
+}
+
+// signatureCache memoizes the signatures of the traces having the same shape,
+// for the apps with a small set of repeating ones. It holds up to maxSize
+// shapes, forgetting the least recently used first. Traces with the same
+// spans in a different order are different shapes: they miss the cache but
+// never get a wrong signature.
+type signatureCache struct {
+	maxSize int
+	entries map[signatureCacheKey]*list.Element
+	lru     *list.List // of *signatureCacheEntry, most recently used first
+	mu      sync.Mutex
+
+	hits   int64
+	misses int64
+}
+
+func newSignatureCache(maxSize int) *signatureCache {
+	return &signatureCache{
+		maxSize: maxSize,
+		entries: make(map[signatureCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Signature returns the signature of the trace, computing it only if its
+// shape is not in the cache
+func (c *signatureCache) Signature(trace model.Trace, root *model.Span, env string, opts signatureOptions) Signature {
+	key := signatureCacheKey{
+		env:      env,
+		service:  root.Service,
+		name:     root.Name,
+		resource: root.Resource,
+		size:     len(trace),
+		opts:     opts,
+	}
+	if !opts.ignoreError {
+		key.err = root.Error
+	}
+	if opts.withVersion {
+		key.version = root.Meta[versionKey]
+	}
+	if fields := opts.rootFieldSet(); fields != defaultRootFields {
+		if fields.has(signatureType) {
+			key.typ = root.Type
+		}
+		key.meta = fields.metaValues(root)
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*signatureCacheEntry)
+		if entry.matches(trace, opts) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			atomic.AddInt64(&c.hits, 1)
+			return entry.signature
+		}
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	entry := &signatureCacheEntry{
+		key:       key,
+		spans:     make([]spanShape, len(trace)),
+		signature: computeSignature(trace, root, env, opts),
+	}
+	for i := range trace {
+		entry.spans[i] = shapeOf(&trace[i], opts)
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		// same root, other spans: the latest shape wins
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.lru.PushFront(entry)
+		if c.lru.Len() > c.maxSize {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*signatureCacheEntry).key)
+		}
+	}
+	c.mu.Unlock()
+
+	return entry.signature
+}
+
+// Flush returns the number of hits and misses since the last call
+func (c *signatureCache) Flush() (hits, misses int64) {
+	return atomic.SwapInt64(&c.hits, 0), atomic.SwapInt64(&c.misses, 0)
+}
+
+// matches tells if the spans of the trace have the shape of the entry
+func (e *signatureCacheEntry) matches(trace model.Trace, opts signatureOptions) bool {
+	if len(trace) != len(e.spans) {
+		return false
+	}
+	for i := range trace {
+		if shapeOf(&trace[i], opts) != e.spans[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func shapeOf(span *model.Span, opts signatureOptions) spanShape {
+	shape := spanShape{service: span.Service, name: span.Name}
+	if !opts.ignoreError {
+		shape.err = span.Error
+	}
+	if fields := opts.spanFieldSet(); fields != defaultSpanFields {
+		if fields.has(signatureResource) {
+			shape.resource = span.Resource
+		}
+		if fields.has(signatureType) {
+			shape.typ = span.Type
+		}
+		shape.meta = fields.metaValues(span)
+	}
+	return shape
+}
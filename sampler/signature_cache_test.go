@@ -0,0 +1,104 @@
+package sampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestSignatureCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newSignatureCache(3)
+	opts := signatureOptions{}
+	shape := func(childService string, childError int32) (model.Trace, *model.Span) {
+		trace := model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /"},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: childService, Name: "query", Error: childError},
+		}
+		return trace, &trace[0]
+	}
+
+	// repeated identical shapes hit the cache
+	for i := 0; i < 10; i++ {
+		trace, root := shape("db", 0)
+		assert.Equal(computeSignature(trace, root, defaultEnv, opts), c.Signature(trace, root, defaultEnv, opts))
+	}
+	hits, misses := c.Flush()
+	assert.Equal(int64(9), hits)
+	assert.Equal(int64(1), misses)
+
+	// the key covers the root only, the other spans are verified
+	for _, childError := range []int32{0, 1} {
+		trace, root := shape("cache", childError)
+		assert.Equal(computeSignature(trace, root, defaultEnv, opts), c.Signature(trace, root, defaultEnv, opts))
+		trace, root = shape("db", childError)
+		assert.Equal(computeSignature(trace, root, defaultEnv, opts), c.Signature(trace, root, defaultEnv, opts))
+	}
+	hits, misses = c.Flush()
+	assert.Equal(int64(0), hits)
+	assert.Equal(int64(4), misses)
+
+	// as well as the env and options
+	trace, root := shape("db", 1)
+	assert.Equal(computeSignature(trace, root, "staging", opts), c.Signature(trace, root, "staging", opts))
+	ignoreError := signatureOptions{ignoreError: true}
+	assert.Equal(computeSignature(trace, root, defaultEnv, ignoreError), c.Signature(trace, root, defaultEnv, ignoreError))
+	assert.Equal(computeSignature(trace, root, defaultEnv, opts), c.Signature(trace, root, defaultEnv, opts))
+	hits, misses = c.Flush()
+	assert.Equal(int64(1), hits)
+	assert.Equal(int64(2), misses)
+
+	// bounded, the least recently used shape first forgotten
+	c.Signature(trace, root, "qa", opts)
+	assert.Equal(3, c.lru.Len())
+	assert.Len(c.entries, 3)
+	c.Signature(trace, root, defaultEnv, opts)
+	c.Signature(trace, root, "staging", opts)
+	hits, misses = c.Flush()
+	assert.Equal(int64(1), hits)
+	assert.Equal(int64(2), misses)
+}
+
+func TestSamplerSignatureCache(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	hits, misses := s.FlushSignatureCacheStats()
+	assert.Equal(int64(0), hits+misses)
+
+	s.UpdateSignatureCache(10)
+	for i := 0; i < 5; i++ {
+		trace, root := getTestTrace()
+		s.Sample(trace, root, defaultEnv)
+	}
+	hits, misses = s.FlushSignatureCacheStats()
+	assert.Equal(int64(4), hits)
+	assert.Equal(int64(1), misses)
+
+	trace, root := getTestTrace()
+	signature := computeSignature(trace, root, defaultEnv, s.signatureOptions)
+	assert.True(s.Backend.GetSignatureScore(signature) > 0)
+}
+
+func BenchmarkComputeSignature(b *testing.B) {
+	trace := fixtures.RandomTrace(10, 8)
+	root := trace.GetRoot()
+
+	b.Run("Uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			computeSignature(trace, root, defaultEnv, signatureOptions{})
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		c := newSignatureCache(100)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c.Signature(trace, root, defaultEnv, signatureOptions{})
+		}
+	})
+}
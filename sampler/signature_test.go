@@ -57,3 +57,169 @@ func TestSignatureDifferentRoot(t *testing.T) {
 
 	assert.NotEqual(ComputeSignature(t1), ComputeSignature(t2))
 }
+
+func TestSignatureGolden(t *testing.T) {
+	assert := assert.New(t)
+	t1 := model.Trace{
+		model.Span{TraceID: 101, SpanID: 1011, Service: "x1", Name: "y1", Resource: "z1", Duration: 26965},
+		model.Span{TraceID: 101, SpanID: 1012, ParentID: 1011, Service: "x1", Name: "y1", Resource: "z1", Duration: 197884},
+		model.Span{TraceID: 101, SpanID: 1013, ParentID: 1012, Service: "x2", Name: "y2", Resource: "z2", Error: 1, Duration: 34384993},
+	}
+	// same trace, spans in a different order
+	t2 := model.Trace{t1[2], t1[0], t1[1]}
+	t3 := model.Trace{
+		model.Span{TraceID: 103, SpanID: 1031, Service: "x1", Name: "y1", Resource: "z2", Duration: 19207,
+			Meta: map[string]string{"env": "prod"}},
+	}
+
+	// These values must never change for a given SignatureVersion: if this
+	// test breaks, bump SignatureVersion and update the golden values.
+	assert.Equal(byte(1), SignatureVersion)
+	assert.Equal(Signature(0x100000000dca9d4), ComputeSignature(t1))
+	assert.Equal(ComputeSignature(t1), ComputeSignature(t2))
+	assert.Equal(Signature(0x1000000f0708698), ComputeSignature(t3))
+
+	assert.Equal(SignatureVersion, ComputeSignature(t1).Version())
+}
+
+func TestSignatureWithVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	newTrace := func(version string) (model.Trace, *model.Span) {
+		t := model.Trace{
+			model.Span{TraceID: 101, SpanID: 1011, Service: "x1", Name: "y1", Resource: "z1",
+				Meta: map[string]string{"version": version}},
+			model.Span{TraceID: 101, SpanID: 1012, ParentID: 1011, Service: "x2", Name: "y2", Resource: "z2"},
+		}
+		return t, &t[0]
+	}
+	stable, stableRoot := newTrace("1.0")
+	canary, canaryRoot := newTrace("1.1-canary")
+	unversioned, unversionedRoot := newTrace("")
+
+	// by default, the version is ignored
+	assert.Equal(
+		ComputeSignatureWithRootAndEnv(stable, stableRoot, "prod"),
+		ComputeSignatureWithRootAndEnv(canary, canaryRoot, "prod"),
+	)
+
+	assert.NotEqual(
+		ComputeSignatureWithVersion(stable, stableRoot, "prod"),
+		ComputeSignatureWithVersion(canary, canaryRoot, "prod"),
+	)
+
+	// traces without a version keep the same signature
+	assert.Equal(
+		ComputeSignatureWithRootAndEnv(unversioned, unversionedRoot, "prod"),
+		ComputeSignatureWithVersion(unversioned, unversionedRoot, "prod"),
+	)
+}
+
+func TestSignatureIgnoreError(t *testing.T) {
+	assert := assert.New(t)
+
+	newTrace := func(rootError, childError int32) (model.Trace, *model.Span) {
+		t := model.Trace{
+			model.Span{TraceID: 101, SpanID: 1011, Service: "x1", Name: "y1", Resource: "z1", Error: rootError},
+			model.Span{TraceID: 101, SpanID: 1012, ParentID: 1011, Service: "x2", Name: "y2", Resource: "z2", Error: childError},
+		}
+		return t, &t[0]
+	}
+	success, successRoot := newTrace(0, 0)
+	failure, failureRoot := newTrace(1, 1)
+	childFailure, childFailureRoot := newTrace(0, 1)
+
+	// by default, errors are sampled apart from successes
+	assert.NotEqual(
+		ComputeSignatureWithRootAndEnv(success, successRoot, "prod"),
+		ComputeSignatureWithRootAndEnv(failure, failureRoot, "prod"),
+	)
+	assert.NotEqual(
+		ComputeSignatureWithRootAndEnv(success, successRoot, "prod"),
+		ComputeSignatureWithRootAndEnv(childFailure, childFailureRoot, "prod"),
+	)
+
+	// but collapse to one signature when ignoring the flag
+	opts := signatureOptions{ignoreError: true}
+	assert.Equal(
+		computeSignature(success, successRoot, "prod", opts),
+		computeSignature(failure, failureRoot, "prod", opts),
+	)
+	assert.Equal(
+		computeSignature(success, successRoot, "prod", opts),
+		computeSignature(childFailure, childFailureRoot, "prod", opts),
+	)
+
+	// which is what the sampler uses once enabled
+	s := getTestSampler()
+	s.UpdateSignatureIgnoreError(true)
+	assert.Equal(opts, s.signatureOptions)
+}
+
+func TestSignatureFields(t *testing.T) {
+	assert := assert.New(t)
+
+	newTrace := func(resource, childType, method string) (model.Trace, *model.Span) {
+		t := model.Trace{
+			model.Span{TraceID: 101, SpanID: 1011, Service: "x1", Name: "y1", Resource: resource,
+				Meta: map[string]string{"http.method": method}},
+			model.Span{TraceID: 101, SpanID: 1012, ParentID: 1011, Service: "x2", Name: "y2", Resource: "z2", Type: childType},
+		}
+		return t, &t[0]
+	}
+	withFields := func(root, span []string) signatureOptions {
+		s := getTestSampler()
+		s.UpdateSignatureFields(root, span)
+		return s.signatureOptions
+	}
+	signature := func(trace model.Trace, root *model.Span, opts signatureOptions) Signature {
+		return computeSignature(trace, root, "prod", opts)
+	}
+	base, baseRoot := newTrace("z1", "sql", "GET")
+	otherResource, otherResourceRoot := newTrace("z3", "sql", "GET")
+	otherType, otherTypeRoot := newTrace("z1", "redis", "GET")
+	otherMethod, otherMethodRoot := newTrace("z1", "sql", "POST")
+
+	// the default fields are today's signatures
+	defaults := withFields(
+		[]string{"service", "name", "resource", "error"},
+		[]string{"service", "name", "error"},
+	)
+	assert.Equal(signatureOptions{}, defaults)
+	assert.Equal(signatureOptions{}, withFields(nil, []string{""}))
+	assert.Equal(ComputeSignatureWithRootAndEnv(base, baseRoot, "prod"), signature(base, baseRoot, defaults))
+	assert.NotEqual(signature(base, baseRoot, defaults), signature(otherResource, otherResourceRoot, defaults))
+	assert.Equal(signature(base, baseRoot, defaults), signature(otherType, otherTypeRoot, defaults))
+	assert.Equal(signature(base, baseRoot, defaults), signature(otherMethod, otherMethodRoot, defaults))
+
+	// removing the resource of the root groups the endpoints of a service
+	noResource := withFields([]string{"service", "name", "error"}, nil)
+	assert.Equal(signature(base, baseRoot, noResource), signature(otherResource, otherResourceRoot, noResource))
+	assert.NotEqual(signature(base, baseRoot, defaults), signature(base, baseRoot, noResource))
+
+	// adding the type of the spans or a meta of the root splits them
+	withType := withFields(nil, []string{"service", "name", "error", "type"})
+	assert.NotEqual(signature(base, baseRoot, withType), signature(otherType, otherTypeRoot, withType))
+	assert.Equal(signature(base, baseRoot, withType), signature(otherMethod, otherMethodRoot, withType))
+
+	withMethod := withFields([]string{"service", "name", "resource", "error", "meta.http.method"}, nil)
+	assert.NotEqual(signature(base, baseRoot, withMethod), signature(otherMethod, otherMethodRoot, withMethod))
+	assert.Equal(signature(base, baseRoot, withMethod), signature(otherType, otherTypeRoot, withMethod))
+
+	// the error flag is still left out when ignoring it
+	ignoreError := withFields([]string{"service", "error"}, []string{"service", "error"})
+	ignoreError.ignoreError = true
+	failure, failureRoot := newTrace("z1", "sql", "GET")
+	failure[1].Error = 1
+	assert.Equal(signature(base, baseRoot, ignoreError), signature(failure, failureRoot, ignoreError))
+
+	// and the signature cache tells them apart the same way, once filled
+	c := newSignatureCache(100)
+	for i := 0; i < 2; i++ {
+		for _, opts := range []signatureOptions{defaults, noResource, withType, withMethod} {
+			for _, trace := range []model.Trace{base, otherResource, otherType, otherMethod} {
+				assert.Equal(signature(trace, &trace[0], opts), c.Signature(trace, &trace[0], "prod", opts))
+			}
+		}
+	}
+}
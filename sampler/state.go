@@ -12,6 +12,9 @@ type InternalState struct {
 
 // GetState collects and return internal statistics and coefficients for indication purposes
 func (s *Sampler) GetState() InternalState {
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+
 	return InternalState{
 		s.signatureScoreOffset,
 		s.signatureScoreSlope,
@@ -0,0 +1,192 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// prometheusContentType is the content type of the Prometheus text format
+const prometheusContentType = "text/plain; version=0.0.4"
+
+// promMaxSeries is how many series a metric can have, the values reported
+// with further labels are folded into the promOtherLabels series instead, not
+// to grow without bounds with high cardinality tags
+const promMaxSeries = 1000
+
+// promOtherLabels are the labels of the series folding the values over
+// promMaxSeries
+const promOtherLabels = `{series="other"}`
+
+// PrometheusClient is a StatsClient keeping the metrics in memory, to serve
+// them in the Prometheus text format to the scrapers of its ServeHTTP. Counts
+// are exposed as counters, gauges as gauges, and histograms as summaries
+// without quantiles, only their sum and count. Metric names get their dots
+// replaced by underscores, and "key:value" tags become labels. Sample rates
+// are ignored since every value is recorded. Each metric keeps at most
+// promMaxSeries series.
+type PrometheusClient struct {
+	mu       sync.Mutex
+	families map[string]*promFamily
+}
+
+// promFamily is all the series of a metric, by labels
+type promFamily struct {
+	typ    string
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	value float64 // the counter or gauge value, or the sum of a summary
+	count int64   // the count of a summary
+}
+
+// NewPrometheusClient returns a new PrometheusClient without any metric
+func NewPrometheusClient() *PrometheusClient {
+	return &PrometheusClient{families: make(map[string]*promFamily)}
+}
+
+// series returns the series of a metric, creating it if needed, or nil if
+// the metric was already reported with another type
+func (p *PrometheusClient) series(name, typ string, tags []string) *promSeries {
+	name = promName(name)
+	f, ok := p.families[name]
+	if !ok {
+		f = &promFamily{typ: typ, series: make(map[string]*promSeries)}
+		p.families[name] = f
+	}
+	if f.typ != typ {
+		return nil
+	}
+	labels := promLabels(tags)
+	s, ok := f.series[labels]
+	if !ok && len(f.series) >= promMaxSeries {
+		labels = promOtherLabels
+		s, ok = f.series[labels]
+	}
+	if !ok {
+		s = &promSeries{}
+		f.series[labels] = s
+	}
+	return s
+}
+
+// Gauge sets the value of a gauge
+func (p *PrometheusClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	p.mu.Lock()
+	if s := p.series(name, "gauge", tags); s != nil {
+		s.value = value
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Count adds value to a counter
+func (p *PrometheusClient) Count(name string, value int64, tags []string, rate float64) error {
+	p.mu.Lock()
+	if s := p.series(name, "counter", tags); s != nil {
+		s.value += float64(value)
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Histogram adds value to a summary
+func (p *PrometheusClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	p.mu.Lock()
+	if s := p.series(name, "summary", tags); s != nil {
+		s.value += value
+		s.count++
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// ServeHTTP writes all the metrics in the Prometheus text format
+func (p *PrometheusClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	p.mu.Lock()
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.typ)
+
+		labels := make([]string, 0, len(f.series))
+		for l := range f.series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			s := f.series[l]
+			if f.typ == "summary" {
+				fmt.Fprintf(&buf, "%s_sum%s %s\n", name, l, promValue(s.value))
+				fmt.Fprintf(&buf, "%s_count%s %d\n", name, l, s.count)
+				continue
+			}
+			fmt.Fprintf(&buf, "%s%s %s\n", name, l, promValue(s.value))
+		}
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(buf.Bytes())
+}
+
+// promName returns the Prometheus version of a statsd metric or tag name,
+// which can only have letters, digits, underscores and colons, and cannot
+// start with a digit
+func promName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		}
+		return '_'
+	}, name)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// labelEscaper escapes the label values as the Prometheus text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels returns the Prometheus labels of statsd tags, sorted by name,
+// like {resource="GET /",service="web"}. A tag without a value is the value
+// of a "tag" label. A label can only be there once: the values of the tags of
+// the same name are joined, sorted and comma separated, like tag="a,b".
+func promLabels(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	values := make(map[string][]string, len(tags))
+	for _, tag := range tags {
+		name, value := "tag", tag
+		if i := strings.Index(tag, ":"); i > 0 {
+			name, value = tag[:i], tag[i+1:]
+		}
+		name = strings.Replace(promName(name), ":", "_", -1)
+		values[name] = append(values[name], value)
+	}
+	labels := make([]string, 0, len(values))
+	for name, vs := range values {
+		sort.Strings(vs)
+		labels = append(labels, name+`="`+labelEscaper.Replace(strings.Join(vs, ","))+`"`)
+	}
+	sort.Strings(labels)
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func promValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,83 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusClient(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewPrometheusClient()
+	var c StatsClient = MultiClient{Client, p}
+
+	c.Count("datadog.trace_agent.receiver.traces", 3, []string{"lang:go", "lang_version:1.8"}, 1)
+	c.Count("datadog.trace_agent.receiver.traces", 2, []string{"lang_version:1.8", "lang:go"}, 1)
+	c.Count("datadog.trace_agent.receiver.traces", 1, []string{"lang:python"}, 1)
+	c.Count("datadog.trace_agent.sampler.kept", 4, nil, 1)
+	c.Count("datadog.trace_agent.writer.dropped_payload", 1, []string{"reason:queue_full"}, 1)
+	c.Gauge("datadog.trace_agent.writer.payload_queue_depth", 5, nil, 1)
+	c.Gauge("datadog.trace_agent.writer.payload_queue_depth", 2, nil, 1)
+	c.Gauge("datadog.trace_agent.sampler.cardinality", 12, nil, 1)
+	// sample rates are ignored, every value is recorded
+	c.Histogram("datadog.trace_agent.writer.flush_duration", 0.5, nil, 0.01)
+	c.Histogram("datadog.trace_agent.writer.flush_duration", 1.5, nil, 0.01)
+	// the first type wins
+	c.Gauge("datadog.trace_agent.sampler.kept", 100, nil, 1)
+	c.Count("escaped", 1, []string{`path:C:\"dir"`}, 1)
+	// repeated tag names and names starting with a digit are valid labels
+	c.Count("labels", 1, []string{"b", "a", "2xx:yes"}, 1)
+	c.Count("labels", 1, []string{"a", "2xx:yes", "b"}, 1)
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	assert.Equal(prometheusContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(`# TYPE datadog_trace_agent_receiver_traces counter
+datadog_trace_agent_receiver_traces{lang="go",lang_version="1.8"} 5
+datadog_trace_agent_receiver_traces{lang="python"} 1
+# TYPE datadog_trace_agent_sampler_cardinality gauge
+datadog_trace_agent_sampler_cardinality 12
+# TYPE datadog_trace_agent_sampler_kept counter
+datadog_trace_agent_sampler_kept 4
+# TYPE datadog_trace_agent_writer_dropped_payload counter
+datadog_trace_agent_writer_dropped_payload{reason="queue_full"} 1
+# TYPE datadog_trace_agent_writer_flush_duration summary
+datadog_trace_agent_writer_flush_duration_sum 2
+datadog_trace_agent_writer_flush_duration_count 2
+# TYPE datadog_trace_agent_writer_payload_queue_depth gauge
+datadog_trace_agent_writer_payload_queue_depth 2
+# TYPE escaped counter
+escaped{path="C:\\\"dir\""} 1
+# TYPE labels counter
+labels{_2xx="yes",tag="a,b"} 2
+`, string(body))
+}
+
+func TestPrometheusClientMaxSeries(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewPrometheusClient()
+	for i := 0; i < promMaxSeries+10; i++ {
+		p.Count("datadog.trace_agent.sampler.kept", 1, []string{"resource:" + strconv.Itoa(i)}, 1)
+	}
+	// an existing series is still updated
+	p.Count("datadog.trace_agent.sampler.kept", 1, []string{"resource:0"}, 1)
+
+	f := p.families["datadog_trace_agent_sampler_kept"]
+	assert.Len(f.series, promMaxSeries+1)
+	assert.Equal(float64(10), f.series[promOtherLabels].value)
+	assert.Equal(float64(2), f.series[`{resource="0"}`].value)
+}
@@ -2,16 +2,34 @@ package statsd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/DataDog/datadog-trace-agent/config"
 )
 
+// StatsClient is what the agent uses to report its internal metrics
+type StatsClient interface {
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Count(name string, value int64, tags []string, rate float64) error
+	Histogram(name string, value float64, tags []string, rate float64) error
+}
+
 // Client is a global Statsd client. When a client is configured via Configure,
-// that becomes the new global Statsd client in the package.
-var Client *statsd.Client
+// that becomes the new global Statsd client in the package. Until then, it is
+// a nil *statsd.Client, which drops everything.
+var Client StatsClient = (*statsd.Client)(nil)
+
+// DefaultPrefix is the prefix of the names of the metrics the agent reports,
+// replaced by config.AgentConfig.StatsdPrefix
+const DefaultPrefix = "datadog.trace_agent."
+
+// Prometheus is the client serving the metrics of Client in the Prometheus
+// text format, nil unless enabled by config.AgentConfig.PrometheusMetrics
+var Prometheus *PrometheusClient
 
 // Configure creates a statsd client from a dogweb.ini style config file and set it to the global Statsd.
+// The Prometheus client, if enabled, gets the same metrics, prefix included.
 func Configure(conf *config.AgentConfig) error {
 	client, err := statsd.New(fmt.Sprintf("%s:%d", conf.StatsdHost, conf.StatsdPort))
 	if err != nil {
@@ -19,5 +37,75 @@ func Configure(conf *config.AgentConfig) error {
 	}
 
 	Client = client
+	Prometheus = nil
+	if conf.PrometheusMetrics {
+		Prometheus = NewPrometheusClient()
+		Client = MultiClient{client, Prometheus}
+	}
+	if conf.StatsdPrefix != DefaultPrefix {
+		Client = PrefixClient{Prefix: conf.StatsdPrefix, Client: Client}
+	}
 	return nil
 }
+
+// PrefixClient is a StatsClient reporting the metrics to Client with Prefix
+// instead of DefaultPrefix, or with Prefix prepended if they have another one
+type PrefixClient struct {
+	Prefix string
+	Client StatsClient
+}
+
+func (p PrefixClient) name(name string) string {
+	return p.Prefix + strings.TrimPrefix(name, DefaultPrefix)
+}
+
+// Gauge reports a gauge with the prefixed name
+func (p PrefixClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	return p.Client.Gauge(p.name(name), value, tags, rate)
+}
+
+// Count reports a count with the prefixed name
+func (p PrefixClient) Count(name string, value int64, tags []string, rate float64) error {
+	return p.Client.Count(p.name(name), value, tags, rate)
+}
+
+// Histogram reports a histogram value with the prefixed name
+func (p PrefixClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	return p.Client.Histogram(p.name(name), value, tags, rate)
+}
+
+// MultiClient is a StatsClient reporting the metrics to all its clients
+type MultiClient []StatsClient
+
+// Gauge reports a gauge to all the clients, returning the first error
+func (m MultiClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	var err error
+	for _, c := range m {
+		if e := c.Gauge(name, value, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Count reports a count to all the clients, returning the first error
+func (m MultiClient) Count(name string, value int64, tags []string, rate float64) error {
+	var err error
+	for _, c := range m {
+		if e := c.Count(name, value, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Histogram reports a histogram value to all the clients, returning the first error
+func (m MultiClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	var err error
+	for _, c := range m {
+		if e := c.Histogram(name, value, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
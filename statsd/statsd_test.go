@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// recordingClient is a StatsClient keeping the names of the metrics reported
+type recordingClient struct {
+	names []string
+}
+
+func (c *recordingClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	c.names = append(c.names, name)
+	return nil
+}
+
+func (c *recordingClient) Count(name string, value int64, tags []string, rate float64) error {
+	c.names = append(c.names, name)
+	return nil
+}
+
+func (c *recordingClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	c.names = append(c.names, name)
+	return nil
+}
+
+func TestPrefixClient(t *testing.T) {
+	assert := assert.New(t)
+
+	rec := &recordingClient{}
+	c := PrefixClient{Prefix: "mycompany.apm.", Client: rec}
+	c.Count("datadog.trace_agent.receiver.traces", 1, nil, 1)
+	c.Gauge("datadog.trace_agent.sampler.kept_signatures", 1, nil, 1)
+	c.Histogram("datadog.trace_agent.writer.flush_duration", 1, nil, 1)
+	c.Count("other", 1, nil, 1)
+
+	assert.Equal([]string{
+		"mycompany.apm.receiver.traces",
+		"mycompany.apm.sampler.kept_signatures",
+		"mycompany.apm.writer.flush_duration",
+		"mycompany.apm.other",
+	}, rec.names)
+}
+
+func TestConfigurePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(c StatsClient) { Client = c }(Client)
+
+	conf := config.NewDefaultAgentConfig()
+	assert.Equal(DefaultPrefix, conf.StatsdPrefix)
+	assert.NoError(Configure(conf))
+	assert.IsType(&statsd.Client{}, Client)
+
+	conf.StatsdPrefix = "mycompany.apm."
+	assert.NoError(Configure(conf))
+	if assert.IsType(PrefixClient{}, Client) {
+		assert.Equal("mycompany.apm.", Client.(PrefixClient).Prefix)
+	}
+	assert.Nil(Prometheus)
+}
+
+func TestConfigurePrometheus(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(c StatsClient, p *PrometheusClient) { Client, Prometheus = c, p }(Client, Prometheus)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.PrometheusMetrics = true
+	conf.StatsdPrefix = "mycompany.apm."
+	assert.NoError(Configure(conf))
+
+	// the Prometheus metrics have the same prefix as the statsd ones
+	Client.Count("datadog.trace_agent.receiver.traces", 1, nil, 1)
+	if assert.NotNil(Prometheus) {
+		assert.Contains(Prometheus.families, "mycompany_apm_receiver_traces")
+		assert.NotContains(Prometheus.families, "datadog_trace_agent_receiver_traces")
+	}
+}